@@ -0,0 +1,75 @@
+package up
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SplitAddress splits an inventory host into its host and optional port. It
+// accepts hostnames and IPv4 addresses with or without a port, e.g.
+// "10.0.0.1:2222", bare IPv6 addresses, e.g. "fd00::1", and bracketed IPv6
+// addresses with or without a port, e.g. "[fd00::1]:2222". Hosts with a
+// scheme, such as "docker://app", are reported unchanged.
+func SplitAddress(addr string) (host, port string, err error) {
+	if strings.Contains(addr, "://") {
+		return addr, "", nil
+	}
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("%s: missing ]", addr)
+		}
+		host, rest := addr[1:end], addr[end+1:]
+		if host == "" {
+			return "", "", fmt.Errorf("%s: missing host", addr)
+		}
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("%s: unexpected %s", addr,
+				rest)
+		}
+		port = rest[1:]
+		if err = validatePort(port); err != nil {
+			return "", "", fmt.Errorf("%s: %w", addr, err)
+		}
+		return host, port, nil
+	}
+	switch strings.Count(addr, ":") {
+	case 0:
+		return addr, "", nil
+	case 1:
+		i := strings.Index(addr, ":")
+		host, port = addr[:i], addr[i+1:]
+		if host == "" {
+			return "", "", fmt.Errorf("%s: missing host", addr)
+		}
+		if err = validatePort(port); err != nil {
+			return "", "", fmt.Errorf("%s: %w", addr, err)
+		}
+		return host, port, nil
+	default:
+		// Bare IPv6 addresses can't carry a port, since it would be
+		// ambiguous
+		return addr, "", nil
+	}
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+// URLHost reports the host in a form usable in URLs and rsync or scp
+// destinations, wrapping IPv6 addresses in brackets.
+func URLHost(host string) string {
+	if strings.Contains(host, ":") && !strings.Contains(host, "://") {
+		return "[" + host + "]"
+	}
+	return host
+}
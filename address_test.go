@@ -0,0 +1,43 @@
+package up
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitAddress(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"10.0.0.1":           "10.0.0.1 ",
+		"10.0.0.1:2222":      "10.0.0.1 2222",
+		"web.internal:22":    "web.internal 22",
+		"fd00::1":            "fd00::1 ",
+		"[fd00::1]":          "fd00::1 ",
+		"[fd00::1]:2222":     "fd00::1 2222",
+		"[fe80::1%eth0]:22":  "fe80::1%eth0 22",
+		"docker://app:1.2.3": "docker://app:1.2.3 ",
+	}
+	for in, want := range tcs {
+		host, port, err := SplitAddress(in)
+		if err != nil {
+			t.Fatalf("%s: %s", in, err)
+		}
+		if got := fmt.Sprint(host, " ", port); got != want {
+			t.Fatalf("%s: expected %q, got %q", in, want, got)
+		}
+	}
+	for _, in := range []string{
+		"[fd00::1", "[fd00::1]x", "[]:22", ":22", "web:", "web:0",
+		"web:ssh", "[fd00::1]:99999",
+	} {
+		if _, _, err := SplitAddress(in); err == nil {
+			t.Fatalf("%s: expected error", in)
+		}
+	}
+	if got := URLHost("fd00::1"); got != "[fd00::1]" {
+		t.Fatalf("expected [fd00::1], got %s", got)
+	}
+	if got := URLHost("10.0.0.1"); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+}
@@ -0,0 +1,315 @@
+package up
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Pos describes a location in an Upfile.
+type Pos struct {
+	// Offset in bytes, starting at 0.
+	Offset int
+
+	// Line number, starting at 1.
+	Line int
+
+	// Col is the byte offset within the line, starting at 1.
+	Col int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// File is the syntax tree of an Upfile. Unlike Config, it preserves the order
+// and position of everything parsed, which is useful for editor tooling and
+// linters.
+type File struct {
+	// Commands in the order they were defined.
+	Commands []*CmdNode
+
+	// Aliases in the order they were defined.
+	Aliases []*AliasNode
+
+	// Checksums in the order they were defined.
+	Checksums []*ChecksumNode
+
+	// Vars in the order they were declared.
+	Vars []*VarNode
+}
+
+// AliasNode is an alternate name for a command, defined with:
+//
+//	alias NAME = COMMAND
+type AliasNode struct {
+	Name   Ident
+	Target Ident
+}
+
+// ChecksumNode names a directory whose checksum is substituted for
+// $checksum.NAME, defined with:
+//
+//	checksum NAME=DIR NAME=DIR
+type ChecksumNode struct {
+	Name Ident
+	Dir  Ident
+}
+
+// VarNode declares the type of a variable, defined with:
+//
+//	var NAME TYPE
+type VarNode struct {
+	Name Ident
+	Type Ident
+}
+
+// CmdNode is a command definition and its body.
+type CmdNode struct {
+	// Name of the command.
+	Name Ident
+
+	// Description from "##" comment lines immediately preceding the
+	// command, joined by spaces.
+	Description string
+
+	// ExecIfs listed after the command name.
+	ExecIfs []Ident
+
+	// Tags listed after the command name with an "@" prefix, which is
+	// not included in the name.
+	Tags []Ident
+
+	// Execs in the command's indented body.
+	Execs []*ExecNode
+
+	// Needs are prerequisites written after "needs" or "needs-each".
+	Needs []*NeedNode
+
+	// Drain and Undrain are commands written after "drain" and
+	// "undrain".
+	Drain   []Ident
+	Undrain []Ident
+
+	// Runs in the command's indented body, which make it a composite
+	// command. Composite commands have no Execs.
+	Runs []*RunNode
+
+	// Version written after "version", naming where the version deployed
+	// comes from, e.g. "git". Its Name is empty if there isn't one.
+	Version Ident
+
+	// Requires are variables written after "requires", which must be
+	// set for the command to run.
+	Requires []Ident
+}
+
+// NeedNode is a prerequisite of a command, run once locally if written after
+// "needs" or on each server if written after "needs-each":
+//
+//	deploy check needs build needs-each migrate
+type NeedNode struct {
+	Command Ident
+	Each    bool
+}
+
+// RunNode runs another command on the given tags as part of a composite
+// command, written as:
+//
+//	run COMMAND on TAG_1,TAG_2
+//
+// Several may be written on one line separated by ";".
+type RunNode struct {
+	Command Ident
+	Tags    []Ident
+}
+
+// ExecNode is a single line in a command's body.
+type ExecNode struct {
+	// Text of the line without leading indentation.
+	Text string
+
+	// Pos of the first character of Text.
+	Pos Pos
+
+	// Vars referenced in the line with a "$" prefix, which may or may not
+	// correspond to commands defined in the Upfile. Each position points
+	// to the "$".
+	Vars []Ident
+}
+
+// Ident is a name and the position at which it appears.
+type Ident struct {
+	Name string
+	Pos  Pos
+}
+
+// End reports the position immediately after the identifier.
+func (i Ident) End() Pos {
+	return Pos{
+		Offset: i.Pos.Offset + len(i.Name),
+		Line:   i.Pos.Line,
+		Col:    i.Pos.Col + len(i.Name),
+	}
+}
+
+// Command reports the node defining the named command, or nil if there isn't
+// one.
+func (f *File) Command(name CmdName) *CmdNode {
+	for _, cmd := range f.Commands {
+		if cmd.Name.Name == string(name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// SyntaxError is an error found at a specific position in an Upfile.
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Pos.Line, e.Msg)
+}
+
+// ParseFile parses an Upfile into its syntax tree. Unlike ParseUpfile, it
+// does not validate references between commands.
+func ParseFile(rdr io.Reader) (*File, error) {
+	byt, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("read all: %w", err)
+	}
+	p := newParser(string(byt))
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+// position converts a byte offset in text into a Pos.
+func position(text string, offset int) Pos {
+	return positionFrom(text, Pos{Line: 1, Col: 1}, offset)
+}
+
+// positionFrom converts a byte offset in text into a Pos, counting lines from
+// an earlier Pos rather than the start of the text, so converting every
+// offset in a large Upfile isn't quadratic. Offsets before from are counted
+// from the start.
+func positionFrom(text string, from Pos, offset int) Pos {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	if offset < from.Offset || from.Line == 0 {
+		from = Pos{Line: 1, Col: 1}
+	}
+	seg := text[from.Offset:offset]
+	pos := Pos{Offset: offset, Line: from.Line + strings.Count(seg, "\n")}
+	if i := strings.LastIndexByte(seg, '\n'); i >= 0 {
+		pos.Col = len(seg) - i
+	} else {
+		pos.Col = from.Col + len(seg)
+	}
+	return pos
+}
+
+// varIdents finds all "$name" and "${name:q}" references in an exec line
+// starting at the given position.
+func varIdents(text, line string, linePos Pos) []Ident {
+	var idents []Ident
+	for i := 0; i < len(line); i++ {
+		if line[i] != '$' {
+			continue
+		}
+		start := i + 1
+		if start < len(line) && line[start] == '{' {
+			start++
+		}
+		j := start
+		for j < len(line) && isAlphaNumeric(rune(line[j])) {
+			j++
+		}
+		if j == start {
+			continue
+		}
+		idents = append(idents, Ident{
+			Name: line[start:j],
+			Pos:  positionFrom(text, linePos, linePos.Offset+i),
+		})
+		i = j - 1
+	}
+	return idents
+}
+
+// parseRuns reports the run statements in an exec line, or nil if the line
+// doesn't start with a whole run statement, e.g. "run foo", which is shell.
+func parseRuns(text string, exec *ExecNode) ([]*RunNode, error) {
+	if !strings.HasPrefix(exec.Text, "run ") {
+		return nil, nil
+	}
+	var runs []*RunNode
+	offset := exec.Pos.Offset
+	for i, stmt := range strings.Split(exec.Text, ";") {
+		words := fieldsWithOffsets(stmt, offset)
+		offset += len(stmt) + 1
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) != 4 || words[0].Name != "run" ||
+			words[2].Name != "on" {
+			if i == 0 {
+				return nil, nil
+			}
+			return nil, &SyntaxError{
+				Pos: exec.Pos,
+				Msg: "run must be: run COMMAND on TAG_1,TAG_2",
+			}
+		}
+		run := &RunNode{Command: Ident{
+			Name: words[1].Name,
+			Pos: positionFrom(text, exec.Pos,
+				words[1].Pos.Offset),
+		}}
+		tagOffset := words[3].Pos.Offset
+		for _, tag := range strings.Split(words[3].Name, ",") {
+			if tag == "" {
+				return nil, &SyntaxError{
+					Pos: words[3].Pos,
+					Msg: "empty tag",
+				}
+			}
+			run.Tags = append(run.Tags, Ident{
+				Name: tag,
+				Pos:  positionFrom(text, exec.Pos, tagOffset),
+			})
+			tagOffset += len(tag) + 1
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// fieldsWithOffsets splits s around spaces, recording each field's offset
+// from the start of the Upfile. Only offsets are set in each position.
+func fieldsWithOffsets(s string, offset int) []Ident {
+	var idents []Ident
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != ' ' && s[i] != '\t' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			idents = append(idents, Ident{
+				Name: s[start:i],
+				Pos:  Pos{Offset: offset + start},
+			})
+			start = -1
+		}
+	}
+	return idents
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// agentMsg is sent in both directions between up and an agent. Requests
+// carry a command to run or a chunk of a file to write, and responses carry
+// output and, once the request is done, its result. Many requests share a
+// connection and run concurrently, so responses are matched by ID.
+type agentMsg struct {
+	ID uint64
+
+	// Cmd to run with sh, as User if set.
+	Cmd  string
+	User string
+
+	// Put is the path to which Data is written at Offset. Files span
+	// several messages, the last of which is Done. The file is created
+	// with Mode once it's complete, so it's never seen half-written.
+	Put    string
+	Mode   os.FileMode
+	Offset int64
+	Data   []byte
+
+	// Stdout and Stderr stream a command's output as it runs.
+	Stdout []byte
+	Stderr []byte
+
+	// Done marks the last message of a request or response. Responses
+	// report the command's Exit code or an Err preventing it from
+	// running. Err on a request abandons a file partway through.
+	Done bool
+	Exit int
+	Err  string
+}
+
+// result of a request reported by its last response.
+func (m agentMsg) result() error {
+	switch {
+	case m.Err != "":
+		return errors.New(m.Err)
+	case m.Exit != 0:
+		return fmt.Errorf("exit status %d", m.Exit)
+	default:
+		return nil
+	}
+}
+
+// agentChunkSize is the most of a file sent in each message, so output from
+// other commands isn't held up behind a large file.
+const agentChunkSize = 256 << 10
+
+// agentCmd serves requests from up on stdin until it closes, writing
+// responses to stdout. The agent transport starts it on each server over
+// ssh, so the connection is authenticated and encrypted by ssh, and up must
+// be installed in the server's PATH.
+func agentCmd(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return serveAgent(os.Stdin, os.Stdout)
+}
+
+// serveAgent runs each command requested in r concurrently and writes files
+// in the order their chunks arrive, writing responses to w.
+func serveAgent(r io.Reader, w io.Writer) error {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		enc = gob.NewEncoder(w)
+	)
+	send := func(msg agentMsg) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// If up has gone away, the next read fails and ends the
+		// agent
+		_ = enc.Encode(msg)
+	}
+	puts := map[uint64]*os.File{}
+	defer func() {
+		for _, fi := range puts {
+			fi.Close()
+			os.Remove(fi.Name())
+		}
+	}()
+	dec := gob.NewDecoder(r)
+	for {
+		var req agentMsg
+		if err := dec.Decode(&req); err != nil {
+			wg.Wait()
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("decode: %w", err)
+		}
+		if req.Put != "" {
+			reply, err := agentPut(puts, req)
+			switch {
+			case err != nil:
+				send(agentMsg{ID: req.ID, Done: true,
+					Err: err.Error()})
+			case reply:
+				send(agentMsg{ID: req.ID, Done: true})
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(req agentMsg) {
+			defer wg.Done()
+			send(agentExec(req, send))
+		}(req)
+	}
+}
+
+// agentPut writes a chunk of a file, reporting whether the file is complete
+// and should be acknowledged. Once a chunk fails, the rest of the file is
+// ignored, since the failure was already reported.
+func agentPut(puts map[uint64]*os.File, req agentMsg) (bool, error) {
+	fi, ok := puts[req.ID]
+	if !ok {
+		if req.Offset != 0 {
+			return false, nil
+		}
+		var err error
+		fi, err = ioutil.TempFile(filepath.Dir(req.Put), ".up-put")
+		if err != nil {
+			return false, fmt.Errorf("create: %w", err)
+		}
+		puts[req.ID] = fi
+	}
+	fail := func(err error) (bool, error) {
+		delete(puts, req.ID)
+		fi.Close()
+		os.Remove(fi.Name())
+		return false, err
+	}
+	if req.Err != "" {
+		return fail(nil)
+	}
+	if _, err := fi.Write(req.Data); err != nil {
+		return fail(fmt.Errorf("write: %w", err))
+	}
+	if !req.Done {
+		return false, nil
+	}
+	if err := fi.Chmod(req.Mode); err != nil {
+		return fail(fmt.Errorf("chmod: %w", err))
+	}
+	if err := fi.Close(); err != nil {
+		return fail(fmt.Errorf("close: %w", err))
+	}
+	delete(puts, req.ID)
+	if err := os.Rename(fi.Name(), req.Put); err != nil {
+		os.Remove(fi.Name())
+		return false, fmt.Errorf("rename: %w", err)
+	}
+	return true, nil
+}
+
+// agentExec runs a requested command, streaming its output, and reports its
+// result.
+func agentExec(req agentMsg, send func(agentMsg)) agentMsg {
+	res := agentMsg{ID: req.ID, Done: true}
+	c, err := localTransport{}.command("", req.User, req.Cmd)
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	c.Stdout = agentWriter(func(p []byte) {
+		send(agentMsg{ID: req.ID, Stdout: p})
+	})
+	c.Stderr = agentWriter(func(p []byte) {
+		send(agentMsg{ID: req.ID, Stderr: p})
+	})
+	err = c.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		res.Exit = exitErr.ExitCode()
+	case err != nil:
+		res.Err = err.Error()
+	}
+	return res
+}
+
+// agentWriter sends output as it's written. The message is encoded before
+// send returns, so p isn't retained.
+type agentWriter func(p []byte)
+
+func (w agentWriter) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
+
+// agentConn is up's end of a connection to an agent.
+type agentConn struct {
+	mu      sync.Mutex
+	enc     *gob.Encoder
+	nextID  uint64
+	pending map[uint64]*agentCall
+
+	// err is set once the connection is lost, failing every request.
+	err error
+}
+
+// agentCall is a request awaiting its result.
+type agentCall struct {
+	stdout, stderr io.Writer
+	done           chan error
+}
+
+// newAgentConn sends requests to w and reads responses from r until it
+// fails. wait, if set, is called once reading fails to explain why, e.g.
+// because ssh exited.
+func newAgentConn(r io.Reader, w io.Writer, wait func() error) *agentConn {
+	a := &agentConn{
+		enc:     gob.NewEncoder(w),
+		pending: map[uint64]*agentCall{},
+	}
+	go a.read(r, wait)
+	return a
+}
+
+func (a *agentConn) read(r io.Reader, wait func() error) {
+	dec := gob.NewDecoder(r)
+	for {
+		var msg agentMsg
+		if err := dec.Decode(&msg); err != nil {
+			err = fmt.Errorf("agent connection lost: %w", err)
+			if wait != nil {
+				if werr := wait(); werr != nil {
+					err = fmt.Errorf("agent connection "+
+						"lost: %w", werr)
+				}
+			}
+			a.fail(err)
+			return
+		}
+		a.mu.Lock()
+		call := a.pending[msg.ID]
+		if msg.Done {
+			delete(a.pending, msg.ID)
+		}
+		a.mu.Unlock()
+		if call == nil {
+			continue
+		}
+		if len(msg.Stdout) > 0 && call.stdout != nil {
+			call.stdout.Write(msg.Stdout)
+		}
+		if len(msg.Stderr) > 0 && call.stderr != nil {
+			call.stderr.Write(msg.Stderr)
+		}
+		if msg.Done {
+			call.done <- msg.result()
+		}
+	}
+}
+
+// fail every pending and future request with err. Requests may be retried
+// over a new connection, since the agent may never have received them.
+func (a *agentConn) fail(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = &transportError{err: err}
+	for id, call := range a.pending {
+		call.done <- a.err
+		delete(a.pending, id)
+	}
+}
+
+// failed reports why the connection was lost, if it was.
+func (a *agentConn) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// call sends the first message of a request, reporting its ID for any
+// which follow.
+func (a *agentConn) call(req agentMsg, call *agentCall) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, a.err
+	}
+	a.nextID++
+	req.ID = a.nextID
+	a.pending[req.ID] = call
+	if err := a.enc.Encode(req); err != nil {
+		delete(a.pending, req.ID)
+		return 0, fmt.Errorf("send: %w", err)
+	}
+	return req.ID, nil
+}
+
+// send a later message of a request.
+func (a *agentConn) send(req agentMsg) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	if err := a.enc.Encode(req); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	return nil
+}
+
+// forget a request which won't be answered.
+func (a *agentConn) forget(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, id)
+}
+
+// exec runs cmd on the agent's server, as user if set, writing its output as
+// it arrives.
+func (a *agentConn) exec(user, cmd string, stdout, stderr io.Writer) error {
+	call := &agentCall{
+		stdout: stdout,
+		stderr: stderr,
+		done:   make(chan error, 1),
+	}
+	if _, err := a.call(agentMsg{Cmd: cmd, User: user}, call); err != nil {
+		return err
+	}
+	return <-call.done
+}
+
+// put copies the local file to remote on the agent's server in chunks,
+// keeping its permissions. A remote path ending in "/" is a directory into
+// which the file is copied with the same name.
+func (a *agentConn) put(local, remote string) error {
+	fi, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer fi.Close()
+	info, err := fi.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if strings.HasSuffix(remote, "/") {
+		remote += filepath.Base(local)
+	}
+	call := &agentCall{done: make(chan error, 1)}
+	buf := make([]byte, agentChunkSize)
+	var (
+		id  uint64
+		off int64
+	)
+	for {
+		n, err := io.ReadFull(fi, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			if off > 0 {
+				a.forget(id)
+				_ = a.send(agentMsg{ID: id, Put: remote,
+					Offset: off, Done: true, Err: "abort"})
+			}
+			return fmt.Errorf("read: %w", err)
+		}
+		req := agentMsg{
+			ID:     id,
+			Put:    remote,
+			Mode:   info.Mode().Perm(),
+			Offset: off,
+			Data:   buf[:n],
+			Done:   done,
+		}
+		if off == 0 {
+			id, err = a.call(req, call)
+		} else {
+			err = a.send(req)
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		off += int64(n)
+
+		// Stop early if the agent already failed to write the file
+		select {
+		case err = <-call.done:
+			return err
+		default:
+		}
+	}
+	return <-call.done
+}
+
+// agentTransport runs commands on the server through `up agent`, which it
+// starts over ssh the first time it's needed. Every later command and file
+// for the server shares that connection, saving an ssh handshake for each
+// step. Steps written "put LOCAL REMOTE" copy a local file to the server
+// over the connection. If the connection is lost, the next step reconnects.
+type agentTransport struct {
+	settings up.Settings
+
+	mu   sync.Mutex
+	conn *agentConn
+}
+
+// command runs cmd over its own ssh connection without the agent, for
+// callers which need a process.
+func (t *agentTransport) command(
+	server, user, cmd string,
+) (*exec.Cmd, error) {
+	if user != "" {
+		cmd = "sudo -n -u " + user + " sh -c " + shellQuote(cmd)
+	}
+	args, err := t.sshArgs(server)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command("ssh", append(args, cmd)...), nil
+}
+
+// run cmd on the server through the agent.
+func (t *agentTransport) run(
+	server, user, cmd string,
+	stdout, stderr io.Writer,
+) error {
+	conn, err := t.session(server)
+	if err != nil {
+		return err
+	}
+	if local, remote, ok := up.Put(cmd); ok {
+		if user != "" {
+			return errors.New("put cannot run as another user")
+		}
+		return conn.put(local, remote)
+	}
+	return conn.exec(user, cmd, stdout, stderr)
+}
+
+// session reports the connection to the server's agent, starting it if
+// there's none or the last was lost.
+func (t *agentTransport) session(server string) (*agentConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && t.conn.failed() == nil {
+		return t.conn, nil
+	}
+	args, err := t.sshArgs(server)
+	if err != nil {
+		return nil, err
+	}
+	c := exec.Command("ssh", append(args, "up", "agent")...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	w, err := c.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin pipe: %w", err)
+	}
+	r, err := c.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err = c.Start(); err != nil {
+		return nil, fmt.Errorf("start ssh: %w", err)
+	}
+	t.conn = newAgentConn(r, w, func() error {
+		err := c.Wait()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return hostKeyError(server, t.settings, msg)
+		}
+		return err
+	})
+	return t.conn, nil
+}
+
+// sshArgs connects to the server, failing rather than prompting for a
+// password since many servers connect at once.
+func (t *agentTransport) sshArgs(server string) ([]string, error) {
+	host, port, err := up.SplitAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	if t.settings.Port != 0 {
+		port = strconv.Itoa(t.settings.Port)
+	}
+	args := []string{"-T", "-o", "BatchMode=yes"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if t.settings.User != "" {
+		args = append(args, "-l", t.settings.User)
+	}
+	if t.settings.Key != "" {
+		args = append(args, "-i", t.settings.Key, "-o",
+			"IdentitiesOnly=yes")
+	}
+	if t.settings.SSHAgent != nil && !*t.settings.SSHAgent {
+		args = append(args, "-o", "IdentityAgent=none")
+	}
+	if t.settings.KnownHosts != "" {
+		args = append(args, "-o",
+			"UserKnownHostsFile="+t.settings.KnownHosts)
+	}
+	switch {
+	case t.settings.HostKeys == "tofu":
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	case t.settings.HostKeys == "strict", t.settings.KnownHosts != "":
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	}
+	return append(args, host), nil
+}
+
+// hostKeyError explains ssh failing to verify a server's host key, which is
+// otherwise reported among ssh's other output.
+func hostKeyError(server string, s up.Settings, msg string) error {
+	known := s.KnownHosts
+	if known == "" {
+		known = "known_hosts"
+	}
+	switch {
+	case strings.Contains(msg, "HOST IDENTIFICATION HAS CHANGED"):
+		return fmt.Errorf("host key of %s changed since it was "+
+			"recorded in %s: if the server was rebuilt, remove "+
+			"its old key with ssh-keygen -R", server, known)
+	case strings.Contains(msg, "Host key verification failed"):
+		return fmt.Errorf("host key of %s isn't in %s: add it, or "+
+			"set host_keys to tofu to trust it on first connection",
+			server, known)
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// startAgent serves an agent over pipes, reporting a connection to it.
+func startAgent(t *testing.T) (*agentConn, func()) {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveAgent(reqR, resW)
+		resW.Close()
+	}()
+	conn := newAgentConn(resR, reqW, nil)
+	return conn, func() {
+		reqW.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAgentExec(t *testing.T) {
+	t.Parallel()
+	conn, stop := startAgent(t)
+	defer stop()
+
+	var stdout, stderr bytes.Buffer
+	err := conn.exec("", "echo out; echo err >&2", &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("unexpected output %q, %q", stdout.String(),
+			stderr.String())
+	}
+
+	err = conn.exec("", "exit 3", ioutil.Discard, ioutil.Discard)
+	if err == nil || err.Error() != "exit status 3" {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+
+	// Commands sharing the connection run concurrently
+	errs := make(chan error, 2)
+	outs := make([]bytes.Buffer, 2)
+	for i := range outs {
+		go func(i int) {
+			errs <- conn.exec("", "sleep 0.1; echo done", &outs[i],
+				ioutil.Discard)
+		}(i)
+	}
+	for range outs {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, out := range outs {
+		if out.String() != "done\n" {
+			t.Fatalf("unexpected output %q", out.String())
+		}
+	}
+}
+
+func TestAgentPut(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn, stop := startAgent(t)
+	defer stop()
+
+	// Span several chunks, ending partway through one
+	want := strings.Repeat("0123456789", agentChunkSize/4)
+	local := filepath.Join(dir, "app")
+	err = ioutil.WriteFile(local, []byte(want), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(dir, "srv") + "/"
+	if err = os.Mkdir(remote, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.put(local, remote); err != nil {
+		t.Fatal(err)
+	}
+	pth := filepath.Join(remote, "app")
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(byt) != want {
+		t.Fatalf("expected %d bytes, got %d", len(want), len(byt))
+	}
+	fi, err := os.Stat(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 {
+		t.Fatalf("expected mode 0755, got %v", fi.Mode())
+	}
+
+	// Writing into a missing directory fails without breaking the
+	// connection
+	err = conn.put(local, filepath.Join(dir, "missing", "app"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	err = conn.exec("", "true", ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected only app, got %d files", len(files))
+	}
+}
+
+func TestAgentLost(t *testing.T) {
+	t.Parallel()
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	go io.Copy(ioutil.Discard, reqR)
+	conn := newAgentConn(resR, reqW, nil)
+	resW.Close()
+	err := conn.exec("", "true", ioutil.Discard, ioutil.Discard)
+	if !isTransportError(err) {
+		t.Fatalf("expected transport error, got %v", err)
+	}
+	if conn.failed() == nil {
+		t.Fatal("expected the connection to fail")
+	}
+}
+
+func TestAgentHostKeys(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		settings up.Settings
+		want     string
+	}{
+		{want: "-T -o BatchMode=yes 10.0.0.1"},
+		{
+			settings: up.Settings{KnownHosts: "known_hosts"},
+			want: "-T -o BatchMode=yes -o " +
+				"UserKnownHostsFile=known_hosts -o " +
+				"StrictHostKeyChecking=yes 10.0.0.1",
+		},
+		{
+			settings: up.Settings{Key: "id_deploy",
+				SSHAgent: new(bool)},
+			want: "-T -o BatchMode=yes -i id_deploy -o " +
+				"IdentitiesOnly=yes -o IdentityAgent=none " +
+				"10.0.0.1",
+		},
+		{
+			settings: up.Settings{HostKeys: "tofu"},
+			want: "-T -o BatchMode=yes -o " +
+				"StrictHostKeyChecking=accept-new 10.0.0.1",
+		},
+	}
+	for i, tc := range tcs {
+		tr := &agentTransport{settings: tc.settings}
+		args, err := tr.sshArgs("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(args, " "); got != tc.want {
+			t.Fatalf("%d: expected %q, got %q", i, tc.want, got)
+		}
+	}
+	_, err := newTransport("10.0.0.1", up.Settings{Transport: "agent",
+		HostKeys: "never"})
+	if err == nil {
+		t.Fatal("expected error for unknown host_keys")
+	}
+
+	s := up.Settings{KnownHosts: "deploy/known_hosts"}
+	err = hostKeyError("10.0.0.1", s, "@@@ WARNING: REMOTE HOST "+
+		"IDENTIFICATION HAS CHANGED! @@@\n"+
+		"Host key verification failed.")
+	if !strings.Contains(err.Error(), "changed since it was recorded "+
+		"in deploy/known_hosts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = hostKeyError("10.0.0.1", s, "Host key verification failed.")
+	if !strings.Contains(err.Error(), "isn't in deploy/known_hosts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
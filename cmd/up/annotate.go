@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// annotation marks the start or end of a deploy on dashboards, so graphs
+// show exactly when rollouts happened.
+type annotation struct {
+	Time     time.Time
+	Command  up.CmdName
+	Checksum string
+	DeployID string
+	Tags     []string
+	Operator string
+
+	// Done is set when the deploy finished, in which case Err reports
+	// whether it failed.
+	Done bool
+	Err  error
+}
+
+// annotator posts annotations to a dashboard through its API.
+type annotator interface {
+	annotate(a annotation) error
+}
+
+// annotators post to every configured dashboard. The deploy matters more
+// than its annotations, so failing to post is only logged.
+type annotators []annotator
+
+// parseAnnotators parses comma-separated dashboards of "grafana:URL" or
+// "datadog[:SITE]", e.g. "grafana:https://grafana.internal,datadog". API
+// keys are read from $UP_GRAFANA_TOKEN and $UP_DATADOG_API_KEY rather than
+// flags, so they don't appear in the process list. The client making the
+// requests is configured by opts.
+func parseAnnotators(
+	spec string,
+	opts ...httpclient.Option,
+) (annotators, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	opts = append([]httpclient.Option{
+		httpclient.WithTimeout(10 * time.Second),
+	}, opts...)
+	client, err := httpclient.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	var as annotators
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+		switch parts[0] {
+		case "grafana":
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, errors.New(
+					"grafana must be grafana:URL")
+			}
+			token := os.Getenv("UP_GRAFANA_TOKEN")
+			if token == "" {
+				return nil, errors.New(
+					"missing $UP_GRAFANA_TOKEN")
+			}
+			as = append(as, &grafana{
+				client: client,
+				base:   strings.TrimSuffix(parts[1], "/"),
+				token:  token,
+			})
+		case "datadog":
+			site := "datadoghq.com"
+			if len(parts) == 2 && parts[1] != "" {
+				site = parts[1]
+			}
+			key := os.Getenv("UP_DATADOG_API_KEY")
+			if key == "" {
+				return nil, errors.New(
+					"missing $UP_DATADOG_API_KEY")
+			}
+			as = append(as, &datadog{client: client,
+				base: "https://api." + site, key: key})
+		default:
+			return nil, fmt.Errorf("unknown dashboard %s: must be "+
+				"grafana or datadog", parts[0])
+		}
+	}
+	return as, nil
+}
+
+// newAnnotation describes a deploy of the plan by the identity, defaulting
+// to the current OS user.
+func newAnnotation(p *plan, identity string) annotation {
+	operator, err := resolveIdentity(identity)
+	if err != nil {
+		operator = "unknown"
+	}
+	seen := map[string]struct{}{}
+	var tags []string
+	for _, g := range p.Groups {
+		if _, ok := seen[g.Tag]; ok {
+			continue
+		}
+		seen[g.Tag] = struct{}{}
+		tags = append(tags, g.Tag)
+	}
+	sort.Strings(tags)
+	return annotation{
+		Command:  p.Command,
+		Checksum: p.Checksum,
+		DeployID: p.DeployID,
+		Tags:     tags,
+		Operator: operator,
+	}
+}
+
+// start posts that the deploy started.
+func (as annotators) start(a annotation) {
+	a.Time = time.Now()
+	as.post(a)
+}
+
+// finish posts that the deploy ended, successfully or not.
+func (as annotators) finish(a annotation, deployErr error) {
+	a.Time = time.Now()
+	a.Done = true
+	a.Err = deployErr
+	as.post(a)
+}
+
+func (as annotators) post(a annotation) {
+	for _, an := range as {
+		if err := an.annotate(a); err != nil {
+			log.Printf("failed to annotate deploy: %s\n", err)
+		}
+	}
+}
+
+// text summarizes the annotation, e.g. "up deployed web (checksum abc) to
+// web, db by alice".
+func (a annotation) text() string {
+	verb := "deploying"
+	if a.Done {
+		verb = "deployed"
+		if a.Err != nil {
+			verb = "failed to deploy"
+		}
+	}
+	text := fmt.Sprintf("up %s %s (checksum %s) to %s by %s", verb,
+		a.Command, a.Checksum, strings.Join(a.Tags, ", "),
+		a.Operator)
+	if a.Err != nil {
+		text += ": " + a.Err.Error()
+	}
+	return text
+}
+
+// labels reports the annotation as KEY:VALUE tags, which both Grafana and
+// Datadog can filter on.
+func (a annotation) labels() []string {
+	labels := []string{
+		"up",
+		"command:" + string(a.Command),
+		"checksum:" + a.Checksum,
+		"operator:" + a.Operator,
+	}
+	if a.DeployID != "" {
+		labels = append(labels, "deploy:"+a.DeployID)
+	}
+	for _, tag := range a.Tags {
+		labels = append(labels, "tag:"+tag)
+	}
+	return labels
+}
+
+// grafana posts annotations with the Grafana HTTP API.
+type grafana struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func (g *grafana) annotate(a annotation) error {
+	target := g.base + "/api/annotations"
+	return jsonRequest(g.client, http.MethodPost, target,
+		http.Header{"Authorization": {"Bearer " + g.token}},
+		map[string]interface{}{
+			"time": a.Time.UnixNano() / int64(time.Millisecond),
+			"tags": a.labels(),
+			"text": a.text(),
+		}, nil)
+}
+
+// datadog posts annotations as events with the Datadog API.
+type datadog struct {
+	client *http.Client
+	base   string
+	key    string
+}
+
+func (d *datadog) annotate(a annotation) error {
+	alert := "info"
+	if a.Done {
+		alert = "success"
+		if a.Err != nil {
+			alert = "error"
+		}
+	}
+	target := d.base + "/api/v1/events"
+	return jsonRequest(d.client, http.MethodPost, target,
+		http.Header{"DD-API-KEY": {d.key}},
+		map[string]interface{}{
+			"title":            a.text(),
+			"text":             a.text(),
+			"date_happened":    a.Time.Unix(),
+			"tags":             a.labels(),
+			"alert_type":       alert,
+			"source_type_name": "up",
+		}, nil)
+}
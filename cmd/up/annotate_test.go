@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAnnotators(t *testing.T) {
+	t.Parallel()
+	var (
+		mu   sync.Mutex
+		reqs []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			delete(body, "time")
+			delete(body, "date_happened")
+			auth := r.Header.Get("Authorization") +
+				r.Header.Get("DD-API-KEY")
+			mu.Lock()
+			reqs = append(reqs, fmt.Sprintf("%s %s %v", r.URL.Path,
+				auth, body))
+			mu.Unlock()
+		}))
+	defer srv.Close()
+
+	p := &plan{
+		Command:  "deploy",
+		Checksum: "abc",
+		Groups: []*planGroup{
+			{Command: "deploy_web", Tag: "web"},
+			{Command: "deploy_db", Tag: "db"},
+			{Command: "migrate", Tag: "db"},
+		},
+	}
+	ann := newAnnotation(p, "alice")
+	as := annotators{
+		&grafana{client: srv.Client(), base: srv.URL, token: "t"},
+		&datadog{client: srv.Client(), base: srv.URL, key: "k"},
+	}
+	as.start(ann)
+	as.finish(ann, errors.New("boom"))
+
+	labels := "[up command:deploy checksum:abc operator:alice tag:db " +
+		"tag:web]"
+	start := "up deploying deploy (checksum abc) to db, web by alice"
+	fail := "up failed to deploy deploy (checksum abc) to db, web by " +
+		"alice: boom"
+	want := []string{
+		"/api/annotations Bearer t map[tags:" + labels + " text:" +
+			start + "]",
+		"/api/v1/events k map[alert_type:info source_type_name:up " +
+			"tags:" + labels + " text:" + start + " title:" +
+			start + "]",
+		"/api/annotations Bearer t map[tags:" + labels + " text:" +
+			fail + "]",
+		"/api/v1/events k map[alert_type:error source_type_name:up " +
+			"tags:" + labels + " text:" + fail + " title:" +
+			fail + "]",
+	}
+	if fmt.Sprint(reqs) != fmt.Sprint(want) {
+		t.Fatalf("expected\n%q\ngot\n%q", want, reqs)
+	}
+}
+
+func TestAnnotationDeployID(t *testing.T) {
+	t.Parallel()
+	p := &plan{Command: "deploy", Checksum: "abc", DeployID: "ci-42"}
+	labels := newAnnotation(p, "alice").labels()
+	want := "[up command:deploy checksum:abc operator:alice deploy:ci-42]"
+	if got := fmt.Sprint(labels); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseAnnotators(t *testing.T) {
+	t.Parallel()
+	if _, err := parseAnnotators("prometheus"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := parseAnnotators("grafana"); err == nil {
+		t.Fatal("expected error for missing url")
+	}
+	as, err := parseAnnotators("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as != nil {
+		t.Fatalf("expected no annotators, got %v", as)
+	}
+}
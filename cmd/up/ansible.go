@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// importAnsibleCmd converts an Ansible playbook and INI inventory into a
+// best-effort Upfile and inventory.json, flagging whatever couldn't be
+// converted, to lower the cost of trying up.
+func importAnsibleCmd(args []string) error {
+	fs := flag.NewFlagSet("import-ansible", flag.ExitOnError)
+	upfile := fs.String("o", "Upfile", "path to write the upfile, or - for stdout")
+	inventory := fs.String("inventory", "inventory.json", "path to write the inventory converted from inventory.ini")
+	force := fs.Bool("force", false, "overwrite existing files (default false)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usage(errors.New(
+			"import-ansible requires a playbook and an " +
+				"optional inventory"))
+	}
+	if !*force {
+		outs := []string{*upfile}
+		if fs.NArg() == 2 {
+			outs = append(outs, *inventory)
+		}
+		for _, out := range outs {
+			if _, err := os.Stat(out); err == nil && out != "-" {
+				return fmt.Errorf("%s exists: use -force to "+
+					"overwrite", out)
+			}
+		}
+	}
+
+	byt, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read playbook: %w", err)
+	}
+	doc, err := parseYAML(byt)
+	if err != nil {
+		return fmt.Errorf("parse playbook: %w", err)
+	}
+	plays, ok := doc.([]interface{})
+	if !ok {
+		return errors.New("playbook must be a list of plays")
+	}
+	var buf bytes.Buffer
+	warnings, err := convertPlaybook(&buf, filepath.Base(fs.Arg(0)), plays)
+	if err != nil {
+		return fmt.Errorf("convert playbook: %w", err)
+	}
+
+	// Catch mistakes in the conversion before anyone relies on it
+	_, err = up.ParseUpfile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("parse converted upfile: %w", err)
+	}
+
+	var invByt []byte
+	if fs.NArg() == 2 {
+		fi, err := os.Open(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("open inventory: %w", err)
+		}
+		defer fi.Close()
+		hosts, invWarnings, err := parseAnsibleInventory(fi)
+		if err != nil {
+			return fmt.Errorf("parse inventory: %w", err)
+		}
+		warnings = append(warnings, invWarnings...)
+		invByt, err = json.MarshalIndent(hosts, "", "\t")
+		if err != nil {
+			return fmt.Errorf("marshal inventory: %w", err)
+		}
+		invByt = append(invByt, '\n')
+	}
+
+	if *upfile == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = ioutil.WriteFile(*upfile, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("write upfile: %w", err)
+	}
+	if invByt != nil {
+		if err = ioutil.WriteFile(*inventory, invByt, 0644); err != nil {
+			return fmt.Errorf("write inventory: %w", err)
+		}
+	}
+	for _, w := range warnings {
+		log.Printf("warning: %s\n", w)
+	}
+	if len(warnings) > 0 {
+		log.Printf("converted with %d warnings: search the upfile for "+
+			"TODO\n", len(warnings))
+	}
+	return nil
+}
+
+// ansibleTaskKeys are keywords on a task which aren't its module.
+var ansibleTaskKeys = map[string]bool{
+	"name": true, "become": true, "become_user": true, "args": true,
+	"tags": true, "ignore_errors": true, "changed_when": true,
+	"failed_when": true, "when": true, "loop": true, "register": true,
+	"notify": true, "until": true, "retries": true, "delay": true,
+	"environment": true, "vars": true, "no_log": true,
+	"check_mode": true, "delegate_to": true, "run_once": true,
+	"loop_control": true,
+}
+
+// ansibleIgnored are task keywords whose behavior is dropped, so the
+// converted step may behave differently.
+var ansibleIgnored = []string{"when", "loop", "register", "notify",
+	"until", "environment", "delegate_to", "run_once", "become_user",
+	"failed_when", "ignore_errors"}
+
+// jinjaVarRegexp matches a simple Jinja variable, e.g. {{ app_dir }}.
+var jinjaVarRegexp = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// nameRegexp matches characters which can't appear in an Upfile name.
+var nameRegexp = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// converter holds the state of converting a playbook.
+type converter struct {
+	vars     map[string]string
+	used     map[string]bool
+	warnings []string
+}
+
+func (c *converter) warnf(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// convertPlaybook writes an Upfile with a command for each play, targeting
+// the play's hosts as tags, with each task converted into steps run over
+// ssh. It reports what couldn't be converted.
+func convertPlaybook(
+	w io.Writer,
+	name string,
+	plays []interface{},
+) ([]string, error) {
+	c := &converter{vars: map[string]string{}, used: map[string]bool{}}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Imported by up import-ansible from %s. Review every "+
+		"command before\n# running, especially any marked TODO.\n\n",
+		name)
+
+	names := map[string]bool{}
+	for i, raw := range plays {
+		play, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("play %d must be a mapping", i+1)
+		}
+		if imp, ok := play["import_playbook"]; ok {
+			c.warnf("play %d: import_playbook %v is not supported",
+				i+1, imp)
+			continue
+		}
+		cmdName := upName(yamlString(play["name"]))
+		if cmdName == "" {
+			cmdName = fmt.Sprintf("play_%d", i+1)
+		}
+		for base, n := cmdName, 2; names[cmdName]; n++ {
+			cmdName = fmt.Sprintf("%s_%d", base, n)
+		}
+		names[cmdName] = true
+		if err := c.play(bw, cmdName, play); err != nil {
+			return nil, fmt.Errorf("play %s: %w", cmdName, err)
+		}
+	}
+	if len(names) > 1 {
+		c.warnf("plays are separate commands: run them in order")
+	}
+
+	// Variables follow the commands, so the first play is the default
+	varNames := make([]string, 0, len(c.vars))
+	for v := range c.vars {
+		varNames = append(varNames, v)
+	}
+	sort.Strings(varNames)
+	for _, v := range varNames {
+		if names[v] {
+			c.warnf("variable %s shadows a play of the same name", v)
+			continue
+		}
+		fmt.Fprintf(bw, "%s\n\t%s\n\n", v, c.vars[v])
+	}
+	var undefined []string
+	for v := range c.used {
+		if _, ok := c.vars[v]; !ok && v != "remote" {
+			undefined = append(undefined, v)
+		}
+	}
+	sort.Strings(undefined)
+	for _, v := range undefined {
+		c.warnf("$%s is undefined: set it in the environment or "+
+			"the upfile", v)
+	}
+	fmt.Fprint(bw, "# ssh destination, e.g. deploy@$server\nremote\n"+
+		"\t$server\n")
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return c.warnings, nil
+}
+
+func (c *converter) play(
+	w io.Writer,
+	name string,
+	play map[string]interface{},
+) error {
+	hosts := yamlString(play["hosts"])
+	if list, ok := play["hosts"].([]interface{}); ok {
+		for _, host := range list {
+			hosts += yamlString(host) + ","
+		}
+	}
+	var tags []string
+	for _, pattern := range strings.FieldsFunc(hosts,
+		func(r rune) bool { return r == ':' || r == ',' }) {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasPrefix(pattern, "&") ||
+			strings.HasPrefix(pattern, "!") {
+			c.warnf("%s: host pattern %s is not supported", name,
+				pattern)
+			continue
+		}
+		tags = append(tags, pattern)
+	}
+	if len(tags) == 0 {
+		return errors.New("hosts is required")
+	}
+	if user := yamlString(play["remote_user"]); user != "" {
+		c.warnf("%s: remote_user %s: set remote to %s@$server", name,
+			user, user)
+	}
+	vars, _ := play["vars"].(map[string]interface{})
+	for key, val := range vars {
+		s, ok := val.(string)
+		if !ok {
+			c.warnf("%s: variable %s is not a string", name, key)
+			continue
+		}
+		c.vars[key] = c.jinja(s)
+	}
+	for _, key := range []string{"roles", "handlers", "vars_files"} {
+		if _, ok := play[key]; ok {
+			c.warnf("%s: %s are not supported", name, key)
+		}
+	}
+	become := yamlBool(play["become"])
+
+	var steps []string
+	for _, key := range []string{"pre_tasks", "tasks", "post_tasks"} {
+		tasks, _ := play[key].([]interface{})
+		for i, raw := range tasks {
+			task, ok := raw.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s %d must be a mapping", key,
+					i+1)
+			}
+			steps = append(steps, c.task(name, task, become)...)
+		}
+	}
+	if len(steps) == 0 {
+		steps = append(steps, "true")
+	}
+
+	fmt.Fprint(w, name)
+	for _, tag := range tags {
+		fmt.Fprintf(w, " @%s", tag)
+	}
+	fmt.Fprintln(w)
+	for _, step := range steps {
+		fmt.Fprintf(w, "\t%s\n", step)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// task converts a task into steps. Tasks which can't be converted become a
+// TODO comment and a failing step, so they can't be silently skipped.
+func (c *converter) task(
+	play string,
+	task map[string]interface{},
+	become bool,
+) []string {
+	if b, ok := task["become"]; ok {
+		become = yamlBool(b)
+	}
+	var module string
+	for key := range task {
+		if strings.HasPrefix(key, "with_") {
+			c.warnf("%s: %s is ignored", play, key)
+			continue
+		}
+		if !ansibleTaskKeys[key] {
+			module = key
+		}
+	}
+	desc := yamlString(task["name"])
+	if desc == "" {
+		desc = module
+	}
+	for _, key := range ansibleIgnored {
+		if _, ok := task[key]; ok {
+			c.warnf("%s: %s: %s is ignored", play, desc, key)
+		}
+	}
+
+	args, _ := task["args"].(map[string]interface{})
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	short := module
+	for _, prefix := range []string{"ansible.builtin.",
+		"ansible.legacy."} {
+		short = strings.TrimPrefix(short, prefix)
+	}
+	params := task[module]
+	switch m := params.(type) {
+	case map[string]interface{}:
+		for key, val := range m {
+			args[key] = val
+		}
+	case string:
+		switch short {
+		case "shell", "command", "raw":
+			args["_raw_params"] = m
+		default:
+			// Other modules take key=value shorthand, e.g.
+			// service: name=app state=restarted
+			for _, field := range strings.Fields(m) {
+				parts := strings.SplitN(field, "=", 2)
+				if len(parts) == 2 {
+					args[parts[0]] = parts[1]
+				}
+			}
+		}
+	}
+	arg := func(key string) string {
+		return c.jinja(yamlString(args[key]))
+	}
+
+	// Scripts are written to the server with printf, escaping any "$" and
+	// "#" so up neither substitutes the operator's environment into them
+	// nor ends the step at a comment
+	printf := func(text string) string {
+		escaped, ok := escapeScript(text)
+		if !ok {
+			return printfLines("%s", c.jinja(text))
+		}
+		c.warnf("%s: %s: $ and # are escaped to run as written", play,
+			desc)
+		return printfLines("%b", c.jinja(escaped))
+	}
+
+	var steps []string
+	switch short {
+	case "shell", "command", "raw":
+		// Jinja is converted once the script is escaped, so the
+		// variables it becomes are still substituted
+		raw := func(key string) string {
+			return yamlString(args[key])
+		}
+		cmd := raw("_raw_params")
+		if cmd == "" {
+			cmd = raw("cmd")
+		}
+		if dir := raw("chdir"); dir != "" {
+			cmd = "cd " + dir + " && " + cmd
+		}
+		if pth := raw("creates"); pth != "" {
+			cmd = "test -e " + pth + " || { " + cmd + "; }"
+		}
+		if pth := raw("removes"); pth != "" {
+			cmd = "test ! -e " + pth + " || { " + cmd + "; }"
+		}
+		cmd = strings.TrimRight(cmd, "\n")
+		if !strings.ContainsAny(cmd, "$#\n") {
+			steps = append(steps, remote(c.jinja(cmd), become))
+			break
+		}
+		sh := "sh"
+		if become {
+			sh = "sudo -n sh"
+		}
+		steps = append(steps, printf(cmd)+" | ssh $remote "+
+			shellQuote(sh))
+	case "copy":
+		dest := arg("dest")
+		switch {
+		case args["content"] != nil:
+			write := "cat > " + dest
+			if become {
+				write = "sudo -n tee " + dest + " >/dev/null"
+			}
+			steps = append(steps,
+				printf(yamlString(args["content"]))+
+					" | ssh $remote "+shellQuote(write))
+		case arg("src") != "":
+			rsync := "rsync -az "
+			if become {
+				rsync += "--rsync-path='sudo -n rsync' "
+			}
+			steps = append(steps, rsync+arg("src")+" $remote:"+dest)
+		default:
+			return c.unsupported(play, desc, module+" without src "+
+				"or content")
+		}
+		steps = append(steps, c.attrs(dest, args, become)...)
+	case "file":
+		pth := arg("path")
+		if pth == "" {
+			pth = arg("dest")
+		}
+		switch arg("state") {
+		case "directory":
+			steps = append(steps, remote("mkdir -p "+pth, become))
+		case "absent":
+			steps = append(steps, remote("rm -rf "+pth, become))
+		case "touch":
+			steps = append(steps, remote("touch "+pth, become))
+		case "", "file":
+		default:
+			return c.unsupported(play, desc, "file state "+
+				arg("state"))
+		}
+		steps = append(steps, c.attrs(pth, args, become)...)
+	case "service", "systemd", "systemd_service":
+		unit := arg("name")
+		if yamlBool(args["daemon_reload"]) {
+			steps = append(steps, remote(
+				"sudo -n systemctl daemon-reload", false))
+		}
+		if yamlBool(args["enabled"]) {
+			steps = append(steps, remote(
+				"sudo -n systemctl enable "+unit, false))
+		}
+		switch state := arg("state"); state {
+		case "started", "stopped", "restarted", "reloaded":
+			helper := strings.TrimSuffix(state, "ed")
+			if state == "stopped" {
+				helper = "stop"
+			}
+			steps = append(steps, fmt.Sprintf(
+				"ssh $remote '$systemd_%s(%s)'", helper, unit))
+		case "":
+		default:
+			return c.unsupported(play, desc, "service state "+state)
+		}
+	default:
+		return c.unsupported(play, desc, "module "+module)
+	}
+	return steps
+}
+
+// attrs sets the mode, owner and group of a path from a task's arguments.
+func (c *converter) attrs(
+	pth string,
+	args map[string]interface{},
+	become bool,
+) []string {
+	var steps []string
+	if mode := c.jinja(yamlString(args["mode"])); mode != "" {
+		steps = append(steps, remote("chmod "+mode+" "+pth, become))
+	}
+	owner := c.jinja(yamlString(args["owner"]))
+	if group := c.jinja(yamlString(args["group"])); group != "" {
+		owner += ":" + group
+	}
+	if owner != "" {
+		steps = append(steps, remote("chown "+owner+" "+pth, become))
+	}
+	return steps
+}
+
+func (c *converter) unsupported(play, desc, what string) []string {
+	c.warnf("%s: %s: %s is not supported", play, desc, what)
+	msg := strings.Replace(fmt.Sprintf("TODO: convert %s (%s)", desc,
+		what), "'", "", -1)
+	return []string{
+		"# TODO: " + what + " is not supported",
+		fmt.Sprintf("echo '%s' >&2 && false", msg),
+	}
+}
+
+// jinja converts simple Jinja variables into Upfile variables, e.g.
+// {{ app_dir }} into $app_dir, warning about any other templating.
+func (c *converter) jinja(s string) string {
+	s = jinjaVarRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		name := jinjaVarRegexp.FindStringSubmatch(m)[1]
+		c.used[name] = true
+		return "$" + name
+	})
+	if strings.Contains(s, "{{") || strings.Contains(s, "{%") {
+		c.warnf("jinja expression left as-is: %s", s)
+	}
+	return s
+}
+
+// remote runs a single-line command on the server over ssh.
+func remote(cmd string, become bool) string {
+	if become {
+		cmd = "sudo -n sh -c " + shellQuote(cmd)
+	}
+	return "ssh $remote " + shellQuote(cmd)
+}
+
+// printfLines prints text line by line with printf and the verb, %s or %b,
+// which keeps a multi-line value on a single Upfile step.
+func printfLines(verb, text string) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	quoted := make([]string, 0, len(lines))
+	for _, line := range lines {
+		quoted = append(quoted, shellQuote(line))
+	}
+	return "printf '" + verb + `\n' ` + strings.Join(quoted, " ")
+}
+
+// escapeScript escapes "\", "$" and "#" for printf's %b, which prints them
+// as written. It reports whether there was a "$" or "#", which would
+// otherwise be substituted by up or start a comment.
+func escapeScript(s string) (string, bool) {
+	if !strings.ContainsAny(s, "$#") {
+		return s, false
+	}
+	r := strings.NewReplacer(`\`, `\\`, "$", `\0044`, "#", `\0043`)
+	return r.Replace(s), true
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// upName converts an Ansible name, such as a play's, into an Upfile command
+// name.
+func upName(s string) string {
+	return strings.Trim(nameRegexp.ReplaceAllString(strings.ToLower(s),
+		"_"), "_")
+}
+
+func yamlString(v interface{}) string {
+	s, _ := v.(string)
+	return strings.TrimSpace(s)
+}
+
+// yamlBool reports whether a YAML scalar is true in any of the ways Ansible
+// accepts.
+func yamlBool(v interface{}) bool {
+	switch strings.ToLower(yamlString(v)) {
+	case "yes", "true", "on", "1", "y":
+		return true
+	}
+	return false
+}
+
+// ansibleInventoryHost is a host in the converted inventory.json.
+type ansibleInventoryHost struct {
+	Tags []string `json:"tags"`
+	up.Settings
+}
+
+// rangeRegexp matches a numeric host range, e.g. web[01:10].
+var rangeRegexp = regexp.MustCompile(`\[(\d+):(\d+)\]`)
+
+// parseAnsibleInventory converts an INI inventory into inventory.json hosts,
+// tagging each host with its groups and any groups containing them.
+func parseAnsibleInventory(
+	rdr io.Reader,
+) (map[string]interface{}, []string, error) {
+	var (
+		warnings []string
+		section  = "ungrouped"
+		kind     string
+		groups   = map[string][]string{}
+		children = map[string][]string{}
+		settings = map[string]up.Settings{}
+	)
+	scn := bufio.NewScanner(rdr)
+	for n := 1; scn.Scan(); n++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = line[1:len(line)-1], ""
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind == "vars" {
+				warnings = append(warnings, fmt.Sprintf(
+					"inventory: [%s:vars] is ignored",
+					section))
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		switch kind {
+		case "vars":
+			continue
+		case "children":
+			children[section] = append(children[section], fields[0])
+			continue
+		case "":
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown section "+
+				"kind %s", n, kind)
+		}
+
+		var s up.Settings
+		addr := fields[0]
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("line %d: expected "+
+					"KEY=VALUE: %s", n, field)
+			}
+			switch parts[0] {
+			case "ansible_host", "ansible_ssh_host":
+				addr = parts[1]
+			case "ansible_user", "ansible_ssh_user":
+				s.User = parts[1]
+			case "ansible_port", "ansible_ssh_port":
+				port, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return nil, nil, fmt.Errorf("line %d: "+
+						"port: %w", n, err)
+				}
+				s.Port = port
+			default:
+				warnings = append(warnings, fmt.Sprintf(
+					"inventory: %s: %s is ignored",
+					fields[0], parts[0]))
+			}
+		}
+		for _, host := range expandHostRange(addr) {
+			groups[section] = append(groups[section], host)
+			if s != (up.Settings{}) {
+				settings[host] = s
+			}
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return nil, nil, fmt.Errorf("scan: %w", err)
+	}
+
+	// Tag hosts with every group containing them, however deeply
+	tags := map[string]map[string]bool{}
+	var tagHosts func(group, tag string, seen map[string]bool)
+	tagHosts = func(group, tag string, seen map[string]bool) {
+		if seen[group] {
+			return
+		}
+		seen[group] = true
+		for _, host := range groups[group] {
+			if tags[host] == nil {
+				tags[host] = map[string]bool{}
+			}
+			tags[host][tag] = true
+		}
+		for _, child := range children[group] {
+			tagHosts(child, tag, seen)
+		}
+	}
+	for group := range groups {
+		tagHosts(group, group, map[string]bool{})
+	}
+	for group := range children {
+		tagHosts(group, group, map[string]bool{})
+	}
+
+	hosts := make(map[string]interface{}, len(tags))
+	for host, set := range tags {
+		hostTags := make([]string, 0, len(set))
+		for tag := range set {
+			hostTags = append(hostTags, tag)
+		}
+		sort.Strings(hostTags)
+		s, ok := settings[host]
+		if !ok {
+			hosts[host] = hostTags
+			continue
+		}
+		hosts[host] = ansibleInventoryHost{Tags: hostTags, Settings: s}
+	}
+	return hosts, warnings, nil
+}
+
+// expandHostRange expands a numeric range in a host, e.g. web[01:03] into
+// web01, web02 and web03.
+func expandHostRange(host string) []string {
+	m := rangeRegexp.FindStringSubmatchIndex(host)
+	if m == nil {
+		return []string{host}
+	}
+	start, end := host[m[2]:m[3]], host[m[4]:m[5]]
+	from, _ := strconv.Atoi(start)
+	to, _ := strconv.Atoi(end)
+	var hosts []string
+	for i := from; i <= to; i++ {
+		num := fmt.Sprintf("%0*d", len(start), i)
+		for _, rest := range expandHostRange(host[m[1]:]) {
+			hosts = append(hosts, host[:m[0]]+num+rest)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestConvertPlaybook(t *testing.T) {
+	t.Parallel()
+	playbook := `---
+- name: Deploy app
+  hosts: web:db
+  become: yes
+  vars:
+    app_dir: /opt/app
+  tasks:
+  - name: Create dir
+    file: {path: "{{ app_dir }}", state: directory, mode: "0755"}
+  - name: Install nginx
+    apt: name=nginx
+  - copy:
+      src: build/app
+      dest: "{{ app_dir }}/app"
+  - shell: |
+      cd {{ app_dir }}
+      ./app migrate
+    args:
+      creates: /var/lib/app/migrated
+  - service: name=app state=restarted
+  - command: echo {{ release }}
+    when: release is defined
+- hosts: all
+  tasks:
+  - shell: uptime
+`
+	plays, err := parseYAML([]byte(playbook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	warnings, err := convertPlaybook(&buf, "site.yml",
+		plays.([]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := up.ParseUpfile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf.String())
+	}
+	if conf.DefaultCommand != "deploy_app" {
+		t.Fatalf("expected deploy_app, got %s", conf.DefaultCommand)
+	}
+	deploy := conf.Commands["deploy_app"]
+	if got := fmt.Sprint(deploy.Tags); got != "[web db]" {
+		t.Fatalf("unexpected tags %s", got)
+	}
+	steps := strings.Join(deploy.Execs, "\n")
+	for _, want := range []string{
+		"mkdir -p $app_dir",
+		"echo 'TODO: convert Install nginx (module apt)' >&2 && false",
+		"rsync -az --rsync-path='sudo -n rsync' build/app " +
+			"$remote:$app_dir/app",
+		"test -e /var/lib/app/migrated ||",
+		"$systemd_restart(app)",
+	} {
+		if !strings.Contains(steps, want) {
+			t.Fatalf("missing %q in\n%s", want, steps)
+		}
+	}
+	if got := conf.Commands["app_dir"].Execs[0]; got != "/opt/app" {
+		t.Fatalf("expected /opt/app, got %s", got)
+	}
+	if _, ok := conf.Commands["play_2"]; !ok {
+		t.Fatalf("missing play_2\n%s", buf.String())
+	}
+
+	got := strings.Join(warnings, "\n")
+	for _, want := range []string{
+		"module apt is not supported",
+		"when is ignored",
+		"$release is undefined",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing warning %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestConvertPlaybookEscapes(t *testing.T) {
+	t.Parallel()
+	playbook := `---
+- hosts: web
+  vars:
+    app_dir: /opt/app
+  tasks:
+  - name: Backup
+    shell: 'cp -r $HOME/{{ app_dir }} /backup  # nightly'
+  - command: echo 'a#b' "$USER\\n"
+`
+	plays, err := parseYAML([]byte(playbook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	warnings, err := convertPlaybook(&buf, "site.yml",
+		plays.([]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := up.ParseUpfile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf.String())
+	}
+	steps := conf.Commands["play_1"].Execs
+	if len(steps) != 2 {
+		t.Fatalf("expected 2 steps, got %q", steps)
+	}
+
+	// Printing each script, as the step does before piping it to ssh,
+	// gives it back as written, but for Jinja converted to variables
+	wants := []string{
+		"cp -r $HOME//opt/app /backup  # nightly\n",
+		`echo 'a#b' "$USER\\n"` + "\n",
+	}
+	scp := newScope(nil, conf.Commands)
+	for i, step := range steps {
+		if strings.Contains(step, "$HOME") ||
+			strings.Contains(step, "$USER") {
+			t.Fatalf("unescaped step %q", step)
+		}
+		end := strings.Index(step, " | ssh $remote")
+		if end < 0 {
+			t.Fatalf("unexpected step %q", step)
+		}
+		script, err := scp.substitute(step[:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("sh", "-c", script).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != wants[i] {
+			t.Fatalf("expected %q, got %q", wants[i], out)
+		}
+	}
+	got := strings.Join(warnings, "\n")
+	for _, want := range []string{
+		"Backup: $ and # are escaped",
+		"command: $ and # are escaped",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing warning %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestParseAnsibleInventory(t *testing.T) {
+	t.Parallel()
+	ini := `# comment
+bastion
+
+[web]
+web[01:02] ansible_user=deploy
+10.0.0.5 ansible_port=2222
+
+[db]
+db1 ansible_host=10.0.1.1
+
+[prod:children]
+web
+db
+
+[prod:vars]
+env=prod
+`
+	hosts, warnings, err := parseAnsibleInventory(strings.NewReader(ini))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %v", warnings)
+	}
+	byt, err := json.Marshal(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := up.ParseInventoryFile(bytes.NewReader(byt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "map[10.0.0.5:[prod web] 10.0.1.1:[db prod] " +
+		"bastion:[ungrouped] web01:[prod web] web02:[prod web]]"
+	if got := fmt.Sprint(inv.Hosts); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if got := inv.HostSettings["web02"].User; got != "deploy" {
+		t.Fatalf("expected user deploy, got %q", got)
+	}
+	if got := inv.HostSettings["10.0.0.5"].Port; got != 2222 {
+		t.Fatalf("expected port 2222, got %d", got)
+	}
+}
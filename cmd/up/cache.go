@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// buildCache records the prerequisites which ran successfully on this
+// machine for a checksum, so later deploys of the same checksum skip them.
+// An empty dir disables the cache.
+type buildCache struct {
+	dir string
+}
+
+// defaultCacheDir reports the directory in which prerequisites are cached by
+// default, or an empty string if the user has no cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "up")
+}
+
+// key identifies a prerequisite by the checksum and its fully substituted
+// steps, so changing either the files or the Upfile runs it again.
+func (c buildCache) key(chk string, g *planGroup) (string, error) {
+	byt, err := json.Marshal(g)
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", chk)
+	h.Write(byt)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// has reports whether the prerequisite already ran for the checksum.
+func (c buildCache) has(chk string, g *planGroup) (bool, error) {
+	if c.dir == "" {
+		return false, nil
+	}
+	key, err := c.key(chk, g)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(c.dir, key))
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf("stat: %w", err)
+	}
+}
+
+// lock the prerequisite for the checksum, so concurrent up processes on this
+// machine sharing the cache, such as CI deploying several services from one
+// workspace, don't run it at the same time. Whichever runs it second sees it
+// cached and skips it. waiting is called if another process holds the lock.
+func (c buildCache) lock(
+	chk string,
+	g *planGroup,
+	waiting func(),
+) (func() error, error) {
+	if c.dir == "" {
+		return func() error { return nil }, nil
+	}
+	key, err := c.key(chk, g)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("make dir: %w", err)
+	}
+	return lockFile(filepath.Join(c.dir, key+".lock"), waiting)
+}
+
+// add records that the prerequisite ran for the checksum.
+func (c buildCache) add(chk string, g *planGroup) error {
+	if c.dir == "" {
+		return nil
+	}
+	key, err := c.key(chk, g)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("make dir: %w", err)
+	}
+	byt := []byte(fmt.Sprintf("%s %s\n", g.Command,
+		time.Now().UTC().Format(time.RFC3339)))
+	return writeFileAtomic(filepath.Join(c.dir, key), byt, 0600)
+}
+
+// checkCache records the conditionals which passed on each server for a
+// checksum, so runs repeated within ttl, such as -t web followed by -t all,
+// don't check unchanged servers again. An empty dir or zero ttl disables the
+// cache.
+type checkCache struct {
+	dir string
+	ttl time.Duration
+	chk string
+}
+
+// path identifies a conditional by the server, checksum and its fully
+// substituted command.
+func (c checkCache) path(server, cmd string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s", server, c.chk, cmd)
+	key := base64.URLEncoding.EncodeToString(h.Sum(nil))
+	return filepath.Join(c.dir, "checks", key)
+}
+
+// uncached reports the servers on which the step hasn't passed within the
+// ttl, which must run it.
+func (c checkCache) uncached(
+	step planStep,
+	servers []string,
+) ([]string, error) {
+	if c.dir == "" || c.ttl <= 0 {
+		return servers, nil
+	}
+	var out []string
+	for _, server := range servers {
+		fi, err := os.Stat(c.path(server, step[server]))
+		switch {
+		case err == nil && time.Since(fi.ModTime()) < c.ttl:
+			continue
+		case err != nil && !os.IsNotExist(err):
+			return nil, fmt.Errorf("stat: %w", err)
+		}
+		out = append(out, server)
+	}
+	return out, nil
+}
+
+// add records that the step passed on the servers.
+func (c checkCache) add(step planStep, servers []string) error {
+	if c.dir == "" || c.ttl <= 0 {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(c.dir, "checks"), 0700)
+	if err != nil {
+		return fmt.Errorf("make dir: %w", err)
+	}
+	for _, server := range servers {
+		// A new file is written each time, so its modification time
+		// is always updated
+		err = writeFileAtomic(c.path(server, step[server]), nil, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file under a temporary name and renames it into
+// place, so other up processes reading it concurrently see either the old or
+// new file, never a partial one.
+func writeFileAtomic(pth string, byt []byte, perm os.FileMode) error {
+	fi, err := ioutil.TempFile(filepath.Dir(pth),
+		"."+filepath.Base(pth)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(fi.Name())
+	if _, err = fi.Write(byt); err != nil {
+		fi.Close()
+		return fmt.Errorf("write file: %w", err)
+	}
+	if err = fi.Chmod(perm); err != nil {
+		fi.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+	if err = fi.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err = os.Rename(fi.Name(), pth); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
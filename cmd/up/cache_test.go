@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCache(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := buildCache{dir: filepath.Join(dir, "cache")}
+	g := &planGroup{Command: "build", Batches: []*planBatch{{
+		Servers: []string{localServer},
+		Execs:   []planStep{{localServer: "make"}},
+	}}}
+	ok, err := c.has("abc", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected empty cache")
+	}
+	if err = c.add("abc", g); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = c.has("abc", g); err != nil || !ok {
+		t.Fatalf("expected cached, got %t %v", ok, err)
+	}
+	if ok, _ = c.has("def", g); ok {
+		t.Fatal("expected a new checksum to miss")
+	}
+	g.Batches[0].Execs[0][localServer] = "make all"
+	if ok, _ = c.has("abc", g); ok {
+		t.Fatal("expected new steps to miss")
+	}
+
+	// Disabled caches never hit
+	if err = (buildCache{}).add("abc", g); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ = (buildCache{}).has("abc", g); ok {
+		t.Fatal("expected disabled cache to miss")
+	}
+}
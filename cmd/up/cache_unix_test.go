@@ -0,0 +1,53 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCacheLock(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := buildCache{dir: filepath.Join(dir, "cache")}
+	g := &planGroup{Command: "build"}
+	unlock, err := c.lock("abc", g, func() {
+		t.Fatal("expected no wait for a free lock")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second lock, as taken by another up process, waits for the first
+	// to be released
+	waiting := make(chan struct{})
+	locked := make(chan error)
+	go func() {
+		unlock2, err := c.lock("abc", g, func() { close(waiting) })
+		if err == nil {
+			err = unlock2()
+		}
+		locked <- err
+	}()
+	<-waiting
+	if err = c.add("abc", g); err != nil {
+		t.Fatal(err)
+	}
+	if err = unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.has("abc", g); err != nil || !ok {
+		t.Fatalf("expected cached, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultChecksumAlgorithm is used unless -checksum-algorithm says otherwise.
+const defaultChecksumAlgorithm = "sha256"
+
+// checksumAlgorithms available to checksum a directory. Checksums are
+// prefixed with the algorithm's name, e.g. "blake3:...", so a version
+// endpoint can tell a checksum from a different scheme apart from one which
+// is simply out of date. Should the way files are combined ever change, the
+// change must come with a new name.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": newBLAKE3,
+}
+
+// checksumOpts choose how a directory is checksummed.
+type checksumOpts struct {
+	// Algorithm names one of checksumAlgorithms.
+	Algorithm string
+
+	// Modes includes each file's permissions, so a chmod alone changes
+	// the checksum.
+	Modes bool
+
+	// Symlinks includes the target of each symlink, which are otherwise
+	// skipped. Targets aren't followed.
+	Symlinks bool
+
+	// Exclude files and directories matching any of these globs, either
+	// by name or by path relative to the directory, e.g. build output
+	// which may change while the checksum is calculated.
+	Exclude []string
+}
+
+// prefix of checksums calculated with the options, e.g. "sha256+modes".
+// Checksums calculated with different options can't be compared, so each
+// option is named in the prefix.
+func (o checksumOpts) prefix() string {
+	prefix := o.Algorithm
+	if o.Modes {
+		prefix += "+modes"
+	}
+	if o.Symlinks {
+		prefix += "+symlinks"
+	}
+	return prefix
+}
+
+// checksumAttempts is how many times the checksum is calculated before
+// giving up when files keep changing.
+const checksumAttempts = 3
+
+// changedError reports a file which changed or disappeared while it was
+// hashed.
+type changedError struct {
+	path string
+}
+
+func (e *changedError) Error() string {
+	return fmt.Sprintf("%s changed while calculating checksum", e.path)
+}
+
+// calcChecksum of every file in the directory, skipping hidden files, prefixed
+// with the options used. If a file changes while it's hashed, as when a build
+// runs at the same time, the checksum is calculated again.
+func calcChecksum(dir string, opts checksumOpts) (string, error) {
+	var err error
+	for i := 1; i <= checksumAttempts; i++ {
+		var chk string
+		chk, err = hashDir(dir, opts)
+		var changed *changedError
+		if !errors.As(err, &changed) {
+			return chk, err
+		}
+		if i < checksumAttempts {
+			log.Printf("%s, retrying\n", err)
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		}
+	}
+	return "", fmt.Errorf("%w (try -checksum-exclude)", err)
+}
+
+// checksumFile is a file to hash as it was when the directory was walked.
+type checksumFile struct {
+	path string
+	info os.FileInfo
+}
+
+// hashDir lists every file to hash before hashing them in order, reporting
+// a changedError if any file is removed or modified in the meantime.
+func hashDir(dir string, opts checksumOpts) (string, error) {
+	newHash, ok := checksumAlgorithms[opts.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown algorithm %q", opts.Algorithm)
+	}
+	var files []checksumFile
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && pth != dir {
+			return &changedError{path: pth}
+		}
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && name != "." ||
+			excluded(dir, pth, opts.Exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		isLink := info.Mode()&os.ModeSymlink != 0
+		if info.IsDir() || !info.Mode().IsRegular() &&
+			!(isLink && opts.Symlinks) {
+			return nil
+		}
+		files = append(files, checksumFile{path: pth, info: info})
+		return nil
+	})
+	if err != nil {
+		var changed *changedError
+		if errors.As(err, &changed) {
+			return "", err
+		}
+		return "", fmt.Errorf("walk filepath: %w", err)
+	}
+
+	// Copy in large pieces, which blake3 hashes concurrently. Hide
+	// the file's WriteTo, which would use a small buffer instead.
+	h := newHash()
+	buf := make([]byte, 1<<20)
+	for _, f := range files {
+		if err = hashFile(h, f, opts, buf); err != nil {
+			return "", err
+		}
+	}
+	sum := h.Sum(nil)
+	if len(sum) == 0 {
+		return "", errors.New("empty checksum")
+	}
+	return opts.prefix() + ":" + base64.URLEncoding.EncodeToString(sum),
+		nil
+}
+
+// hashFile writes the file to h, followed by its mode or symlink target if
+// the options include them.
+func hashFile(
+	h hash.Hash,
+	f checksumFile,
+	opts checksumOpts,
+	buf []byte,
+) error {
+	mode := f.info.Mode()
+	if mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(f.path)
+		if os.IsNotExist(err) {
+			return &changedError{path: f.path}
+		}
+		if err != nil {
+			return fmt.Errorf("checksum: read link: %w", err)
+		}
+		fmt.Fprintf(h, "%s\x00", target)
+		return nil
+	}
+	if opts.Modes {
+		fmt.Fprintf(h, "%04o\x00", mode.Perm())
+	}
+	fi, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return &changedError{path: f.path}
+	}
+	if err != nil {
+		return fmt.Errorf("checksum: open file: %w", err)
+	}
+	defer fi.Close()
+	if _, err = io.CopyBuffer(h, struct{ io.Reader }{fi}, buf); err != nil {
+		return fmt.Errorf("checksum: copy: %w", err)
+	}
+
+	// Compare the file to when it was listed, since anything written
+	// to it during the copy may or may not have been hashed
+	after, err := fi.Stat()
+	if err != nil {
+		return fmt.Errorf("checksum: stat: %w", err)
+	}
+	if after.Size() != f.info.Size() ||
+		!after.ModTime().Equal(f.info.ModTime()) ||
+		opts.Modes && after.Mode() != mode {
+		return &changedError{path: f.path}
+	}
+	return nil
+}
+
+// excluded reports whether the path, or its name, matches any of the globs.
+func excluded(dir, pth string, globs []string) bool {
+	if len(globs) == 0 || pth == dir {
+		return false
+	}
+	rel, err := filepath.Rel(dir, pth)
+	if err != nil {
+		rel = pth
+	}
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, filepath.Base(pth)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namedChecksums calculates the checksum of each directory named in the
+// Upfile, keyed by the variable substituted with it, e.g. "checksum.app".
+// Relative directories are relative to base, the Upfile's directory.
+func namedChecksums(
+	dirs map[string]string,
+	base string,
+	opts checksumOpts,
+) (map[string]string, error) {
+	sums := make(map[string]string, len(dirs))
+	for name, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(base, dir)
+		}
+		chk, err := calcChecksum(dir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sums["checksum."+name] = chk
+	}
+	return sums, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCalcChecksum(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("hi"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums := map[string]string{}
+	for alg := range checksumAlgorithms {
+		chk, err := calcChecksum(dir, checksumOpts{Algorithm: alg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(chk, alg+":") {
+			t.Fatalf("expected %s prefix, got %s", alg, chk)
+		}
+		sums[alg] = chk
+	}
+	if sums["sha256"] == sums["blake3"] {
+		t.Fatal("expected algorithms to differ")
+	}
+
+	// Hidden files don't change the checksum
+	err = ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blake3 := checksumOpts{Algorithm: "blake3"}
+	chk, err := calcChecksum(dir, blake3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chk != sums["blake3"] {
+		t.Fatalf("expected %s, got %s", sums["blake3"], chk)
+	}
+	_, err = calcChecksum(dir, checksumOpts{Algorithm: "md5"})
+	if err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func TestNamedChecksums(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"app", "lib"} {
+		pth := filepath.Join(dir, sub)
+		if err = os.Mkdir(pth, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(pth, "main.go"),
+			[]byte(sub), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sums, err := namedChecksums(map[string]string{
+		"app": "app",
+		"lib": filepath.Join(dir, "lib"),
+	}, dir, checksumOpts{Algorithm: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"app", "lib"} {
+		want, err := calcChecksum(filepath.Join(dir, sub),
+			checksumOpts{Algorithm: "sha256"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sums["checksum."+sub]; got != want {
+			t.Fatalf("%s: expected %s, got %s", sub, want, got)
+		}
+	}
+	if sums["checksum.app"] == sums["checksum.lib"] {
+		t.Fatal("expected checksums to differ")
+	}
+	_, err = namedChecksums(map[string]string{"x": "missing"}, dir,
+		checksumOpts{Algorithm: "sha256"})
+	if err == nil {
+		t.Fatal("expected error for missing directory")
+	}
+}
+
+func TestCalcChecksumOpts(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "run.sh")
+	if err = ioutil.WriteFile(pth, []byte("echo hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("run.sh", filepath.Join(dir, "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		opts   checksumOpts
+		prefix string
+	}{
+		{checksumOpts{Algorithm: "sha256"}, "sha256:"},
+		{checksumOpts{Algorithm: "sha256", Modes: true},
+			"sha256+modes:"},
+		{checksumOpts{Algorithm: "sha256", Symlinks: true},
+			"sha256+symlinks:"},
+	}
+	for _, tc := range tcs {
+		before, err := calcChecksum(dir, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(before, tc.prefix) {
+			t.Fatalf("expected %s prefix, got %s", tc.prefix,
+				before)
+		}
+
+		// Change the file's mode and the link's target, which only
+		// change the checksum when included
+		if err = os.Chmod(pth, 0755); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, "current")
+		if err = os.Remove(link); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Symlink("./run.sh", link); err != nil {
+			t.Fatal(err)
+		}
+		after, err := calcChecksum(dir, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := tc.opts.Modes || tc.opts.Symlinks
+		if (before != after) != changed {
+			t.Fatalf("%+v: expected changed %t, got %s then %s",
+				tc.opts, changed, before, after)
+		}
+
+		// Restore both for the next case
+		if err = os.Chmod(pth, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Remove(link); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Symlink("run.sh", link); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHashFileChanged(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(pth, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := checksumFile{path: pth, info: info}
+	opts := checksumOpts{Algorithm: "sha256"}
+	buf := make([]byte, 32)
+	if err = hashFile(sha256.New(), f, opts, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A build rewrites the file after it was listed
+	if err = ioutil.WriteFile(pth, []byte("v2 longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var changed *changedError
+	err = hashFile(sha256.New(), f, opts, buf)
+	if !errors.As(err, &changed) {
+		t.Fatalf("expected changed error, got %v", err)
+	}
+
+	// Or removes it
+	if err = os.Remove(pth); err != nil {
+		t.Fatal(err)
+	}
+	err = hashFile(sha256.New(), f, opts, buf)
+	if !errors.As(err, &changed) {
+		t.Fatalf("expected changed error, got %v", err)
+	}
+}
+
+func TestCalcChecksumExclude(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		pth := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(pth, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go", "package main")
+	opts := checksumOpts{
+		Algorithm: "sha256",
+		Exclude:   []string{"dist", "*.log", "cmd/tmp"},
+	}
+	before, err := calcChecksum(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("dist/app", "binary")
+	write("logs/build.log", "building")
+	write("cmd/tmp/x", "x")
+	after, err := calcChecksum(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Fatalf("expected excluded files skipped, got %s then %s",
+			before, after)
+	}
+	write("cmd/app/main.go", "package main")
+	after, err = calcChecksum(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("expected checksum to change")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mailer emails a summary of each deploy, for teams whose change management
+// requires emailed deploy records. A nil mailer sends nothing.
+type mailer struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+
+	// send is smtp.SendMail, replaced in tests.
+	send func(addr string, a smtp.Auth, from string, to []string,
+		msg []byte) error
+}
+
+// newMailer emails comma-separated recipients. The server is read from
+// $UP_SMTP_ADDR as host:port and the sender from $UP_SMTP_FROM. If
+// $UP_SMTP_USER is set, up authenticates with it and $UP_SMTP_PASSWORD.
+func newMailer(to string) (*mailer, error) {
+	if to == "" {
+		return nil, nil
+	}
+	m := &mailer{
+		addr: os.Getenv("UP_SMTP_ADDR"),
+		from: os.Getenv("UP_SMTP_FROM"),
+		send: smtp.SendMail,
+	}
+	if m.addr == "" {
+		return nil, errors.New("missing $UP_SMTP_ADDR")
+	}
+	if m.from == "" {
+		return nil, errors.New("missing $UP_SMTP_FROM")
+	}
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return nil, fmt.Errorf("$UP_SMTP_ADDR must be host:port: %w",
+			err)
+	}
+	if user := os.Getenv("UP_SMTP_USER"); user != "" {
+		m.auth = smtp.PlainAuth("", user,
+			os.Getenv("UP_SMTP_PASSWORD"), host)
+	}
+	for _, addr := range strings.Split(to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			m.to = append(m.to, addr)
+		}
+	}
+	return m, nil
+}
+
+// report summarizes a finished deploy.
+type report struct {
+	annotation
+
+	// Description of the command from its "##" comments, if any.
+	Description string
+
+	Start time.Time
+	Took  time.Duration
+
+	// Events recorded from every server, sorted by time.
+	Events []event
+
+	// Skipped servers which were unreachable.
+	Skipped []string
+
+	// Unmatched tags given with -t which no host has.
+	Unmatched []string
+
+	// Groups of batches which ran, in the order they were planned.
+	Groups []*planGroup
+}
+
+// failures reports each server whose command failed and its first error.
+func (rep report) failures() map[string]string {
+	failed := map[string]string{}
+	for _, e := range rep.Events {
+		if e.Type != "exit" || e.Data == "" {
+			continue
+		}
+		if _, ok := failed[e.Server]; !ok {
+			failed[e.Server] = e.Data
+		}
+	}
+	return failed
+}
+
+// servers reports every server which ran a command, sorted.
+func (rep report) servers() []string {
+	seen := map[string]struct{}{}
+	var servers []string
+	for _, e := range rep.Events {
+		if _, ok := seen[e.Server]; ok {
+			continue
+		}
+		seen[e.Server] = struct{}{}
+		servers = append(servers, e.Server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// subject of the email, which flags failed deploys so they stand out in an
+// inbox.
+func (rep report) subject() string {
+	result := "succeeded"
+	if rep.Err != nil {
+		result = "FAILED"
+	}
+	return fmt.Sprintf("[up] %s %s: %s to %s", rep.Command, result,
+		rep.Checksum, strings.Join(rep.Tags, ", "))
+}
+
+// writeSummary writes the report as plain text, listing failed servers
+// before the rest.
+func writeSummary(w io.Writer, rep report) {
+	result := "success"
+	if rep.Err != nil {
+		result = "FAILED: " + rep.Err.Error()
+	}
+	fmt.Fprintf(w, "Command:  %s\n", rep.Command)
+	fmt.Fprintf(w, "Checksum: %s\n", rep.Checksum)
+	if rep.DeployID != "" {
+		fmt.Fprintf(w, "Deploy:   %s\n", rep.DeployID)
+	}
+	fmt.Fprintf(w, "Tags:     %s\n", strings.Join(rep.Tags, ", "))
+	fmt.Fprintf(w, "Operator: %s\n", rep.Operator)
+	fmt.Fprintf(w, "Started:  %s\n", rep.Start.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "Took:     %s\n", rep.Took.Round(time.Second))
+	fmt.Fprintf(w, "Result:   %s\n", result)
+
+	failed := rep.failures()
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "\n*** FAILED on %d servers ***\n", len(failed))
+		for _, server := range rep.servers() {
+			if msg, ok := failed[server]; ok {
+				fmt.Fprintf(w, "\t%s: %s\n", server, msg)
+			}
+		}
+	}
+	var ok []string
+	for _, server := range rep.servers() {
+		if _, bad := failed[server]; !bad {
+			ok = append(ok, server)
+		}
+	}
+	if len(ok) > 0 {
+		fmt.Fprintf(w, "\nSucceeded on %d servers:\n", len(ok))
+		for _, server := range ok {
+			fmt.Fprintf(w, "\t%s\n", server)
+		}
+	}
+	if len(rep.Skipped) > 0 {
+		fmt.Fprintf(w, "\nSkipped %d unreachable servers:\n",
+			len(rep.Skipped))
+		for _, server := range rep.Skipped {
+			fmt.Fprintf(w, "\t%s\n", server)
+		}
+	}
+	if len(rep.Unmatched) > 0 {
+		fmt.Fprintf(w, "\nTags matching no hosts: %s\n",
+			strings.Join(rep.Unmatched, ", "))
+	}
+	if len(rep.Events) > 0 {
+		fmt.Fprintln(w, "\nEach server's log is attached.")
+	}
+}
+
+// message builds a MIME email of the summary with each server's log
+// attached.
+func (m *mailer) message(rep report) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", rep.subject())
+	fmt.Fprintf(&buf, "Date: %s\r\n", rep.Start.Add(rep.Took).Format(
+		time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create part: %w", err)
+	}
+	writeSummary(part, rep)
+
+	for _, server := range rep.servers() {
+		var events []event
+		for _, e := range rep.Events {
+			if e.Server == server {
+				events = append(events, e)
+			}
+		}
+		var out bytes.Buffer
+		replay(&out, &out, events, 0)
+		name := unsafeFilename.ReplaceAllString(server, "_") + ".log"
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			"Content-Disposition": {fmt.Sprintf(
+				"attachment; filename=%q", name)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create part: %w", err)
+		}
+		enc := base64.StdEncoding.EncodeToString(out.Bytes())
+		for len(enc) > 76 {
+			io.WriteString(part, enc[:76]+"\r\n")
+			enc = enc[76:]
+		}
+		io.WriteString(part, enc+"\r\n")
+	}
+	if err = mw.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// mail the report. The deploy already happened, so failing to send is
+// reported to the caller to log rather than changing the deploy's result.
+func (m *mailer) mail(rep report) error {
+	if m == nil {
+		return nil
+	}
+	msg, err := m.message(rep)
+	if err != nil {
+		return err
+	}
+	if err = m.send(m.addr, m.auth, m.from, m.to, msg); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailReport(t *testing.T) {
+	t.Parallel()
+	var (
+		gotTo  []string
+		gotMsg []byte
+	)
+	m := &mailer{
+		addr: "smtp.internal:587",
+		from: "up@example.com",
+		to:   []string{"ops@example.com", "cab@example.com"},
+		send: func(addr string, a smtp.Auth, from string, to []string,
+			msg []byte) error {
+			gotTo, gotMsg = to, msg
+			return nil
+		},
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rep := report{
+		annotation: annotation{
+			Command:  "deploy",
+			Checksum: "abc",
+			Tags:     []string{"db", "web"},
+			Operator: "alice",
+			Done:     true,
+			Err:      errors.New("exit status 1"),
+		},
+		Start: start,
+		Took:  90 * time.Second,
+		Events: []event{
+			{Server: "10.0.0.2", Type: "cmd", Data: "false"},
+			{Server: "10.0.0.1", Type: "cmd", Data: "echo hi"},
+			{Server: "10.0.0.1", Type: "stdout", Data: "hi\n"},
+			{Server: "10.0.0.1", Type: "exit"},
+			{Server: "10.0.0.2", Type: "exit",
+				Data: "exit status 1", Took: time.Second},
+		},
+		Unmatched: []string{"wbe"},
+	}
+	if err := m.mail(rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotTo) != 2 {
+		t.Fatalf("expected 2 recipients, got %v", gotTo)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(gotMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := "[up] deploy FAILED: abc to db, web"
+	if got := msg.Header.Get("Subject"); got != subject {
+		t.Fatalf("expected subject %q, got %q", subject, got)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		byt, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part.FileName()+"|"+string(byt))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d: %q", len(parts), parts)
+	}
+	summary := "|Command:  deploy\n" +
+		"Checksum: abc\n" +
+		"Tags:     db, web\n" +
+		"Operator: alice\n" +
+		"Started:  2026-01-02T03:04:05Z\n" +
+		"Took:     1m30s\n" +
+		"Result:   FAILED: exit status 1\n" +
+		"\n*** FAILED on 1 servers ***\n" +
+		"\t10.0.0.2: exit status 1\n" +
+		"\nSucceeded on 1 servers:\n" +
+		"\t10.0.0.1\n" +
+		"\nTags matching no hosts: wbe\n" +
+		"\nEach server's log is attached.\n"
+	if parts[0] != summary {
+		t.Fatalf("expected summary\n%s\ngot\n%s", summary, parts[0])
+	}
+
+	// Attachments are base64-encoded since logs may contain anything
+	if !strings.HasPrefix(parts[1], "10.0.0.1.log|") {
+		t.Fatalf("unexpected attachment %q", parts[1])
+	}
+	if !strings.HasPrefix(parts[2], "10.0.0.2.log|") {
+		t.Fatalf("unexpected attachment %q", parts[2])
+	}
+	byt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(
+		strings.SplitN(parts[2], "|", 2)[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[10.0.0.2] false\n" +
+		"[10.0.0.2] failed after 1s: exit status 1\n"
+	if string(byt) != want {
+		t.Fatalf("expected log %q, got %q", want, byt)
+	}
+
+	var nilMailer *mailer
+	if err = nilMailer.mail(rep); err != nil {
+		t.Fatal(err)
+	}
+}
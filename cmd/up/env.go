@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keptEnv are the environment variables local commands keep with -clean-env,
+// without which sh can't find commands and ssh can't reach its agent.
+var keptEnv = []string{"HOME", "PATH", "SSH_AUTH_SOCK", "USER"}
+
+// cleanEnv reports the environment of local commands run with -clean-env:
+// keptEnv and the variables named in pass, from environ. Variables written
+// NAME=VALUE in pass are set to VALUE instead. Everything else, such as
+// GOFLAGS, DOCKER_HOST or AWS_PROFILE, is left out, so the operator's own
+// environment can't change what a deploy does.
+func cleanEnv(environ, pass []string) ([]string, error) {
+	vals := map[string]string{}
+	for _, pair := range environ {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			vals[parts[0]] = parts[1]
+		}
+	}
+	env := []string{}
+	seen := map[string]struct{}{}
+	add := func(name, val string) {
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		env = append(env, name+"="+val)
+	}
+	for _, p := range pass {
+		parts := strings.SplitN(p, "=", 2)
+		if parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+			return nil, fmt.Errorf("invalid variable %q", p)
+		}
+		if len(parts) == 2 {
+			add(parts[0], parts[1])
+		} else if val, ok := vals[parts[0]]; ok {
+			add(parts[0], val)
+		}
+	}
+	for _, name := range keptEnv {
+		if val, ok := vals[name]; ok {
+			add(name, val)
+		}
+	}
+	return env, nil
+}
+
+// parseEnv reports the environment of local commands given -clean-env and
+// -pass-env. It's nil, inheriting up's environment, unless clean.
+func parseEnv(clean bool, pass string) ([]string, error) {
+	if !clean {
+		if pass != "" {
+			return nil, errors.New("-pass-env requires -clean-env")
+		}
+		return nil, nil
+	}
+	var names []string
+	if pass != "" {
+		names = strings.Split(pass, ",")
+	}
+	return cleanEnv(os.Environ(), names)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCleanEnv(t *testing.T) {
+	t.Parallel()
+	environ := []string{"PATH=/bin", "HOME=/home/op", "GOFLAGS=-race",
+		"AWS_PROFILE=personal", "KUBECONFIG=/kube", "EMPTY="}
+	tcs := map[string]struct {
+		pass []string
+		want string
+	}{
+		"kept": {want: "[HOME=/home/op PATH=/bin]"},
+		"pass": {
+			pass: []string{"KUBECONFIG", "UNSET", "EMPTY"},
+			want: "[KUBECONFIG=/kube EMPTY= " +
+				"HOME=/home/op PATH=/bin]",
+		},
+		"value": {
+			pass: []string{"GOFLAGS=-mod=vendor", "PATH=/usr/bin"},
+			want: "[GOFLAGS=-mod=vendor PATH=/usr/bin " +
+				"HOME=/home/op]",
+		},
+	}
+	for name, tc := range tcs {
+		got, err := cleanEnv(environ, tc.pass)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Fatalf("%s: expected %s, got %v", name, tc.want, got)
+		}
+	}
+	if _, err := cleanEnv(environ, []string{"=x"}); err == nil {
+		t.Fatal("expected error for an empty name")
+	}
+	if _, err := parseEnv(false, "GOFLAGS"); err == nil {
+		t.Fatal("expected error for -pass-env without -clean-env")
+	}
+}
+
+func TestExecuteEnv(t *testing.T) {
+	t.Parallel()
+	var stdout bytes.Buffer
+	err := execute(localTransport{}, "", "", `echo "$A-$B"`,
+		[]string{"A=a"}, nil, &stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "a-\n" {
+		t.Fatalf("expected a-, got %q", got)
+	}
+}
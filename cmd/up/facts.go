@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// factsProbe prints common facts about a host as KEY=VALUE lines. It's
+// expanded by the $facts() helper.
+const factsProbe = "echo hostname=$(hostname); echo os=$(uname -s); " +
+	"echo kernel=$(uname -r); echo arch=$(uname -m); " +
+	"echo cpus=$(getconf _NPROCESSORS_ONLN 2>/dev/null); " +
+	"if [ -r /etc/os-release ]; then (. /etc/os-release; " +
+	"echo distro=$ID; echo distro_version=$VERSION_ID); fi"
+
+// factsHelper expands $facts() into the built-in probe.
+func factsHelper(arg string) (string, error) {
+	if strings.TrimSpace(arg) != "" {
+		return "", errors.New("takes no arguments")
+	}
+	return factsProbe, nil
+}
+
+// factsCmd runs a gathering command on every selected host and writes the
+// facts each one printed, keyed by host, as a snapshot of the fleet.
+func factsCmd(args []string) error {
+	fs := flag.NewFlagSet("facts", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile")
+	inventory := fs.String("i", "inventory.json", "path to inventory")
+	command := fs.String("c", "", "command printing a host's facts as JSON or KEY=VALUE lines")
+	tags := fs.String("t", "all", "tags from inventory to gather")
+	output := fs.String("o", "facts.json", "path to write facts, or - for stdout")
+	pol := addPolicyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *command == "" {
+		return usage(errors.New("facts requires -c"))
+	}
+
+	fi, err := os.Open(*upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	name := conf.Resolve(up.CmdName(*command))
+	cmd, ok := conf.Commands[name]
+	if !ok {
+		return fmt.Errorf("undefined command: %s", name)
+	}
+
+	transports, err := selectHosts(*inventory, name, *tags, pol)
+	if err != nil {
+		return err
+	}
+
+	// Gather from every host concurrently
+	scp := newScope(environVars(), conf.Commands)
+	text := strings.Join(cmd.Execs, "\n")
+	facts := make(map[string]map[string]string, len(transports))
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+	)
+	for host := range transports {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			out, err := hostOutput(transports[host], scp, host,
+				text)
+			var hostFacts map[string]string
+			if err == nil {
+				hostFacts, err = parseFacts(out)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("[%s] %s\n", host, err)
+				failed = append(failed, host)
+				return
+			}
+			facts[host] = hostFacts
+		}(host)
+	}
+	wg.Wait()
+
+	byt, err := json.MarshalIndent(facts, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	byt = append(byt, '\n')
+	if *output == "-" {
+		_, err = os.Stdout.Write(byt)
+	} else {
+		err = writeFileAtomic(*output, byt, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("write facts: %w", err)
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("gather facts: failed on %s",
+			strings.Join(failed, ", "))
+	}
+	if *output != "-" {
+		log.Printf("wrote facts for %d hosts to %s\n", len(facts),
+			*output)
+	}
+	return nil
+}
+
+// parseFacts accepts a JSON object or KEY=VALUE lines. Values in JSON which
+// aren't strings are kept as JSON, e.g. 4 or ["a","b"].
+func parseFacts(byt []byte) (map[string]string, error) {
+	facts := map[string]string{}
+	byt = bytes.TrimSpace(byt)
+	if len(byt) > 0 && byt[0] == '{' {
+		raw := map[string]json.RawMessage{}
+		if err := json.Unmarshal(byt, &raw); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		for key, val := range raw {
+			var s string
+			if err := json.Unmarshal(val, &s); err != nil {
+				s = string(val)
+			}
+			facts[key] = s
+		}
+		return facts, nil
+	}
+	scn := bufio.NewScanner(bytes.NewReader(byt))
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("fact must be KEY=VALUE: %s",
+				line)
+		}
+		key, val := strings.TrimSpace(parts[0]), parts[1]
+		facts[key] = strings.TrimSpace(val)
+	}
+	if err := scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return facts, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseFacts(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]struct {
+		have    string
+		want    string
+		wantErr bool
+	}{
+		"lines": {
+			have: "os=Linux\n\n# comment\ncpus = 4\nflags=a=b\n",
+			want: "map[cpus:4 flags:a=b os:Linux]",
+		},
+		"json": {
+			have: `{"os":"Linux","cpus":4,"ips":["10.0.0.1"]}`,
+			want: `map[cpus:4 ips:["10.0.0.1"] os:Linux]`,
+		},
+		"empty":     {have: "", want: "map[]"},
+		"malformed": {have: "os Linux", wantErr: true},
+		"bad json":  {have: `{"os":`, wantErr: true},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseFacts([]byte(tc.have))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != tc.want {
+				t.Fatalf("expected %s, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFactsProbe(t *testing.T) {
+	t.Parallel()
+	scp := newScope(nil, nil)
+	out, err := hostOutput(localTransport{}, scp, "1.1.1.1", "$facts()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	facts, err := parseFacts(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"hostname", "os", "kernel", "arch"} {
+		if facts[key] == "" {
+			t.Fatalf("missing %s in %v", key, facts)
+		}
+	}
+}
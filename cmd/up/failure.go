@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// failureInjector makes the first step of chosen servers fail without running
+// it, so rollouts can be rehearsed to check that prompts, drains and other
+// failure handling behave before a real failure happens. A nil
+// failureInjector never fails.
+type failureInjector struct {
+	// hosts are globs of hosts to fail, each optionally limited to a tag.
+	hosts []failureTarget
+
+	// probability of failing any other server, between 0 and 1.
+	probability float64
+
+	mu      sync.Mutex
+	decided map[string]bool
+}
+
+type failureTarget struct {
+	tag  string
+	host string
+}
+
+// parseFailures parses comma-separated entries which are either a host glob,
+// "TAG:HOST_GLOB" or a percentage, e.g. "web:10.0.0.3,10%". An empty spec
+// reports a nil failureInjector.
+func parseFailures(spec string) (*failureInjector, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	f := &failureInjector{decided: map[string]bool{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.HasSuffix(entry, "%") {
+			pct, err := strconv.ParseFloat(
+				strings.TrimSuffix(entry, "%"), 64)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("%s must be between 0%% "+
+					"and 100%%", entry)
+			}
+			f.probability = pct / 100
+			continue
+		}
+		var target failureTarget
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) == 2 && !strings.Contains(parts[1], ":") {
+			target.tag, target.host = parts[0], parts[1]
+		} else {
+			// IPv6 addresses contain colons and have no tag
+			target.host = entry
+		}
+		if target.host == "" {
+			return nil, fmt.Errorf("%s is missing a host", entry)
+		}
+		if _, err := path.Match(target.host, ""); err != nil {
+			return nil, fmt.Errorf("match %s: %w", target.host, err)
+		}
+		f.hosts = append(f.hosts, target)
+	}
+	return f, nil
+}
+
+// split servers of a tag into those which run normally and those which fail.
+// Each server is decided once per tag, so retries see the same result.
+func (f *failureInjector) split(
+	tag string,
+	servers []string,
+) (run, fail []string) {
+	if f == nil {
+		return servers, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, server := range servers {
+		key := tag + "\x00" + server
+		failed, ok := f.decided[key]
+		if !ok {
+			failed = f.matches(tag, server) ||
+				rand.Float64() < f.probability
+			f.decided[key] = failed
+		}
+		if failed {
+			fail = append(fail, server)
+		} else {
+			run = append(run, server)
+		}
+	}
+	return run, fail
+}
+
+// matches reports whether a server is listed to fail for the tag.
+func (f *failureInjector) matches(tag, server string) bool {
+	for _, target := range f.hosts {
+		if target.tag != "" && target.tag != tag {
+			continue
+		}
+		if ok, _ := path.Match(target.host, server); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFailureInjector(t *testing.T) {
+	t.Parallel()
+	f, err := parseFailures("web:10.0.0.3, 10.0.1.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []string{"10.0.0.2", "10.0.0.3", "10.0.1.5"}
+	run, fail := f.split("web", servers)
+	if fmt.Sprint(run, fail) != "[10.0.0.2] [10.0.0.3 10.0.1.5]" {
+		t.Fatalf("unexpected split %v %v", run, fail)
+	}
+	run, fail = f.split("api", servers)
+	if fmt.Sprint(run, fail) != "[10.0.0.2 10.0.0.3] [10.0.1.5]" {
+		t.Fatalf("unexpected split %v %v", run, fail)
+	}
+
+	f, err = parseFailures("100%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run, _ = f.split("web", servers); len(run) != 0 {
+		t.Fatalf("expected every server to fail, ran %v", run)
+	}
+	f, err = parseFailures("0%,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fail = f.split("web", []string{"::1", "::2"}); len(fail) != 1 {
+		t.Fatalf("expected ::1 to fail, got %v", fail)
+	}
+
+	var nilInjector *failureInjector
+	if run, fail = nilInjector.split("web", servers); len(fail) != 0 {
+		t.Fatalf("expected no failures, got %v", fail)
+	}
+	for _, bad := range []string{"101%", "x%", "web:", "[", ","} {
+		if _, err = parseFailures(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// filters transform a variable's value in references such as
+// "${server:host}". shortN, e.g. short8, is handled by applyFilters.
+var filters = map[string]func(val string) string{
+	"q":     shellQuote,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"host":  addrHost,
+	"port":  addrPort,
+}
+
+// applyFilters passes val through each filter named, in order.
+func applyFilters(val string, names []string) (string, error) {
+	for _, name := range names {
+		if fn, ok := filters[name]; ok {
+			val = fn(val)
+			continue
+		}
+		if !strings.HasPrefix(name, "short") {
+			return "", fmt.Errorf("unknown filter %s", name)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "short"))
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("unknown filter %s", name)
+		}
+		if len(val) > n {
+			val = val[:n]
+		}
+	}
+	return val, nil
+}
+
+// addrHost reports the host of an address which may have a port, without
+// brackets if it's IPv6.
+func addrHost(addr string) string {
+	host, _, err := up.SplitAddress(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// addrPort reports the port of an address, or "" if it has none.
+func addrPort(addr string) string {
+	_, port, err := up.SplitAddress(addr)
+	if err != nil {
+		return ""
+	}
+	return port
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// finding is a problem found while validating an Upfile.
+type finding struct {
+	// Line on which the problem was found, starting at 1, or 0 if it
+	// isn't known.
+	Line int
+
+	// Level is "error" or "warning".
+	Level string
+
+	Msg string
+}
+
+// upfileFindings reports a parse error, or else any warnings, as findings.
+func upfileFindings(conf *up.Config, parseErr error) []finding {
+	if parseErr != nil {
+		f := finding{Level: "error", Msg: parseErr.Error()}
+		var synErr *up.SyntaxError
+		if errors.As(parseErr, &synErr) {
+			f.Line, f.Msg = synErr.Pos.Line, synErr.Msg
+		}
+		return []finding{f}
+	}
+	var findings []finding
+	for _, w := range conf.Warnings {
+		findings = append(findings, finding{
+			Line:  w.Line,
+			Level: "warning",
+			Msg:   w.Msg,
+		})
+	}
+	return findings
+}
+
+// writeFindings writes findings in the Upfile at pth for machines to read.
+// The format is "sarif", read by code scanning tools, or "github", workflow
+// commands which GitHub Actions shows as annotations on pull requests.
+func writeFindings(
+	w io.Writer,
+	format, pth string,
+	findings []finding,
+) error {
+	switch format {
+	case "sarif":
+		return writeSARIF(w, pth, findings)
+	case "github":
+		for _, f := range findings {
+			loc := "file=" + githubProperty.Replace(pth)
+			if f.Line > 0 {
+				loc += fmt.Sprintf(",line=%d", f.Line)
+			}
+			_, err := fmt.Fprintf(w, "::%s %s::%s\n", f.Level, loc,
+				githubData.Replace(f.Msg))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// githubData and githubProperty escape characters with meaning in a
+// workflow command's message and properties respectively.
+var (
+	githubData = strings.NewReplacer("%", "%25", "\r", "%0D",
+		"\n", "%0A")
+	githubProperty = strings.NewReplacer("%", "%25", "\r", "%0D",
+		"\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+// writeSARIF writes findings as a SARIF 2.1.0 log.
+func writeSARIF(w io.Writer, pth string, findings []finding) error {
+	type region struct {
+		StartLine int `json:"startLine"`
+	}
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region *region `json:"region,omitempty"`
+		} `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID  string `json:"ruleId"`
+		Level   string `json:"level"`
+		Message struct {
+			Text string `json:"text"`
+		} `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	results := []result{}
+	for _, f := range findings {
+		var loc location
+		loc.PhysicalLocation.ArtifactLocation.URI = pth
+		if f.Line > 0 {
+			loc.PhysicalLocation.Region = &region{StartLine: f.Line}
+		}
+		res := result{
+			RuleID:    "up/" + f.Level,
+			Level:     f.Level,
+			Locations: []location{loc},
+		}
+		res.Message.Text = f.Msg
+		results = append(results, res)
+	}
+	log := map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []interface{}{map[string]interface{}{
+			"tool": map[string]interface{}{
+				"driver": map[string]interface{}{
+					"name": "up",
+				},
+			},
+			"results": results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
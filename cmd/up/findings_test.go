@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestWriteFindings(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(
+		"deploy\n\techo hi\nunused\n\techo x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warns := upfileFindings(conf, nil)
+	_, err = up.ParseUpfile(strings.NewReader(
+		"deploy\n\trun a on web; run foo on\n"))
+	if err == nil {
+		t.Fatal("expected syntax error")
+	}
+	errs := upfileFindings(nil, err)
+
+	var buf bytes.Buffer
+	if err = writeFindings(&buf, "github", "Upfile", append(warns,
+		errs...)); err != nil {
+		t.Fatal(err)
+	}
+	want := "::warning file=Upfile,line=3::unused is never used\n" +
+		"::error file=Upfile,line=2::run must be: run COMMAND on " +
+		"TAG_1,TAG_2\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	buf.Reset()
+	if err = writeFindings(&buf, "sarif", "Upfile", warns); err != nil {
+		t.Fatal(err)
+	}
+	var sarif struct {
+		Version string
+		Runs    []struct {
+			Results []struct {
+				Level     string
+				Message   struct{ Text string }
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine int }
+					}
+				}
+			}
+		}
+	}
+	if err = json.Unmarshal(buf.Bytes(), &sarif); err != nil {
+		t.Fatal(err)
+	}
+	if sarif.Version != "2.1.0" || len(sarif.Runs) != 1 ||
+		len(sarif.Runs[0].Results) != 1 {
+		t.Fatalf("unexpected sarif %s", buf.String())
+	}
+	res := sarif.Runs[0].Results[0]
+	loc := res.Locations[0].PhysicalLocation
+	if res.Level != "warning" ||
+		res.Message.Text != "unused is never used" ||
+		loc.ArtifactLocation.URI != "Upfile" ||
+		loc.Region.StartLine != 3 {
+		t.Fatalf("unexpected result %s", buf.String())
+	}
+}
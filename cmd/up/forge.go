@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// deployment tracks a deploy on a source forge, so the forge shows which
+// checksum is live in each environment. A nil deployment tracks nothing.
+type deployment struct {
+	forge forge
+
+	// Environment deployed to, such as the command or "production".
+	Environment string
+
+	// Ref is the commit deployed.
+	Ref string
+
+	// URL links to the deploy's logs or report, if any.
+	URL string
+
+	id string
+}
+
+// forge creates deployments and updates their status through an API.
+type forge interface {
+	create(d *deployment, description string) (id string, err error)
+
+	// update the status of a deployment to "in_progress", "success" or
+	// "failure".
+	update(d *deployment, status string) error
+}
+
+// newDeployment parses a spec of "github:OWNER/REPO" or
+// "gitlab:GROUP/PROJECT". The token is read from $UP_GITHUB_TOKEN or
+// $UP_GITLAB_TOKEN rather than a flag, so it doesn't appear in the process
+// list. Self-hosted forges are set with $UP_GITHUB_API_URL or $UP_GITLAB_URL.
+// If ref is empty, the commit checked out in dir is used. The client making
+// the requests is configured by opts. An empty spec reports a nil deployment.
+func newDeployment(
+	spec, env, ref, link, dir string,
+	opts ...httpclient.Option,
+) (*deployment, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || !strings.Contains(parts[1], "/") {
+		return nil, fmt.Errorf("%s must be github:OWNER/REPO or "+
+			"gitlab:GROUP/PROJECT", spec)
+	}
+	opts = append([]httpclient.Option{
+		httpclient.WithTimeout(30 * time.Second),
+	}, opts...)
+	client, err := httpclient.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	var f forge
+	switch parts[0] {
+	case "github":
+		token := os.Getenv("UP_GITHUB_TOKEN")
+		if token == "" {
+			return nil, errors.New("missing $UP_GITHUB_TOKEN")
+		}
+		base := os.Getenv("UP_GITHUB_API_URL")
+		if base == "" {
+			base = "https://api.github.com"
+		}
+		f = &github{client: client, base: base, repo: parts[1],
+			token: token}
+	case "gitlab":
+		token := os.Getenv("UP_GITLAB_TOKEN")
+		if token == "" {
+			return nil, errors.New("missing $UP_GITLAB_TOKEN")
+		}
+		base := os.Getenv("UP_GITLAB_URL")
+		if base == "" {
+			base = "https://gitlab.com"
+		}
+		f = &gitlab{client: client, base: base, project: parts[1],
+			token: token}
+	default:
+		return nil, fmt.Errorf("unknown forge %s: must be github or "+
+			"gitlab", parts[0])
+	}
+	if ref == "" {
+		var err error
+		if ref, err = gitHead(dir); err != nil {
+			return nil, err
+		}
+	}
+	return &deployment{
+		forge:       f,
+		Environment: env,
+		Ref:         ref,
+		URL:         link,
+	}, nil
+}
+
+// start creates the deployment and marks it in progress.
+func (d *deployment) start(chk, deployID string) error {
+	if d == nil {
+		return nil
+	}
+	desc := "up checksum " + chk
+	if deployID != "" {
+		desc += " deploy " + deployID
+	}
+	id, err := d.forge.create(d, desc)
+	if err != nil {
+		return fmt.Errorf("create deployment: %w", err)
+	}
+	d.id = id
+	if err = d.forge.update(d, "in_progress"); err != nil {
+		return fmt.Errorf("update deployment: %w", err)
+	}
+	log.Printf("created deployment %s to %s\n", id, d.Environment)
+	return nil
+}
+
+// finish marks the deployment a success or failure depending on the deploy's
+// error. The deploy already happened, so failing to update is only logged.
+func (d *deployment) finish(deployErr error) {
+	if d == nil || d.id == "" {
+		return
+	}
+	status := "success"
+	if deployErr != nil {
+		status = "failure"
+	}
+	if err := d.forge.update(d, status); err != nil {
+		log.Printf("failed to update deployment %s: %s\n", d.id, err)
+	}
+}
+
+// github tracks deployments with the GitHub deployments API.
+type github struct {
+	client *http.Client
+	base   string
+	repo   string
+	token  string
+}
+
+func (g *github) create(d *deployment, description string) (string, error) {
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	err := jsonRequest(g.client, http.MethodPost,
+		fmt.Sprintf("%s/repos/%s/deployments", g.base, g.repo),
+		g.headers(), map[string]interface{}{
+			"ref":               d.Ref,
+			"environment":       d.Environment,
+			"description":       description,
+			"auto_merge":        false,
+			"required_contexts": []string{},
+		}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(resp.ID), nil
+}
+
+func (g *github) update(d *deployment, status string) error {
+	body := map[string]interface{}{"state": status}
+	if d.URL != "" {
+		body["log_url"] = d.URL
+	}
+	return jsonRequest(g.client, http.MethodPost,
+		fmt.Sprintf("%s/repos/%s/deployments/%s/statuses", g.base,
+			g.repo, d.id), g.headers(), body, nil)
+}
+
+func (g *github) headers() http.Header {
+	return http.Header{
+		"Accept":        {"application/vnd.github+json"},
+		"Authorization": {"Bearer " + g.token},
+	}
+}
+
+// gitlab tracks deployments with the GitLab deployments API.
+type gitlab struct {
+	client  *http.Client
+	base    string
+	project string
+	token   string
+}
+
+// gitlabStatuses maps deployment statuses to GitLab's names for them.
+var gitlabStatuses = map[string]string{
+	"in_progress": "running",
+	"success":     "success",
+	"failure":     "failed",
+}
+
+func (g *gitlab) create(d *deployment, description string) (string, error) {
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	err := jsonRequest(g.client, http.MethodPost, g.url(""),
+		g.headers(), map[string]interface{}{
+			"environment": d.Environment,
+			"sha":         d.Ref,
+			"ref":         d.Ref,
+			"tag":         false,
+			"status":      "created",
+		}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(resp.ID), nil
+}
+
+func (g *gitlab) update(d *deployment, status string) error {
+	return jsonRequest(g.client, http.MethodPut, g.url("/"+d.id),
+		g.headers(), map[string]interface{}{
+			"status": gitlabStatuses[status],
+		}, nil)
+}
+
+func (g *gitlab) url(suffix string) string {
+	return fmt.Sprintf("%s/api/v4/projects/%s/deployments%s", g.base,
+		url.PathEscape(g.project), suffix)
+}
+
+func (g *gitlab) headers() http.Header {
+	return http.Header{"Private-Token": {g.token}}
+}
+
+// jsonRequest sends body as JSON and decodes the response into out, if set.
+func jsonRequest(
+	client *http.Client,
+	method, target string,
+	header http.Header,
+	body, out interface{},
+) error {
+	byt, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(byt))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byt, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxStateSize))
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status,
+			strings.TrimSpace(string(byt)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(byt, out); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	return nil
+}
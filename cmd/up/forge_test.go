@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestDeployment(t *testing.T) {
+	t.Parallel()
+	var (
+		mu   sync.Mutex
+		reqs []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			auth := r.Header.Get("Authorization") +
+				r.Header.Get("Private-Token")
+			mu.Lock()
+			reqs = append(reqs, fmt.Sprintf("%s %s %s %v",
+				r.Method, r.URL.EscapedPath(), auth, body))
+			mu.Unlock()
+			w.Write([]byte(`{"id":7}`))
+		}))
+	defer srv.Close()
+
+	gh := "POST /repos/o/r/deployments"
+	gl := "/api/v4/projects/g%2Fp/deployments"
+	tcs := map[string]struct {
+		forge forge
+		want  []string
+	}{
+		"github": {
+			forge: &github{client: srv.Client(), base: srv.URL,
+				repo: "o/r", token: "t"},
+			want: []string{
+				gh + " Bearer t map[auto_merge:false " +
+					"description:up checksum abc " +
+					"environment:prod ref:f00 " +
+					"required_contexts:[]]",
+				gh + "/7/statuses Bearer t map[" +
+					"log_url:http://ci/1 " +
+					"state:in_progress]",
+				gh + "/7/statuses Bearer t map[" +
+					"log_url:http://ci/1 state:failure]",
+			},
+		},
+		"gitlab": {
+			forge: &gitlab{client: srv.Client(), base: srv.URL,
+				project: "g/p", token: "t"},
+			want: []string{
+				"POST " + gl + " t map[environment:prod " +
+					"ref:f00 sha:f00 status:created " +
+					"tag:false]",
+				"PUT " + gl + "/7 t map[status:running]",
+				"PUT " + gl + "/7 t map[status:failed]",
+			},
+		},
+	}
+	for name, tc := range tcs {
+		mu.Lock()
+		reqs = nil
+		mu.Unlock()
+		d := &deployment{
+			forge:       tc.forge,
+			Environment: "prod",
+			Ref:         "f00",
+			URL:         "http://ci/1",
+		}
+		if err := d.start("abc", ""); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		d.finish(errors.New("exit status 1"))
+		mu.Lock()
+		got := reqs
+		mu.Unlock()
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s: expected\n%q\ngot\n%q", name, tc.want,
+				got)
+		}
+	}
+
+	var nilDeployment *deployment
+	if err := nilDeployment.start("abc", ""); err != nil {
+		t.Fatal(err)
+	}
+	nilDeployment.finish(nil)
+	_, err := newDeployment("bitbucket:o/r", "", "x", "", ".")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// gitVersion reports the commit checked out in dir prefixed with "git:", like
+// a checksum is prefixed with its algorithm. Uncommitted changes to tracked
+// files add "-dirty", as they do to git describe --dirty, so a deploy of
+// them is never mistaken for the commit. Untracked files are ignored.
+func gitVersion(dir string) (string, error) {
+	sha, err := gitHead(dir)
+	if err != nil {
+		return "", err
+	}
+	c := exec.Command("git", "status", "--porcelain",
+		"--untracked-files=no")
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git status: %w", err)
+	}
+	if len(strings.TrimSpace(string(out))) > 0 {
+		sha += "-dirty"
+	}
+	return "git:" + sha, nil
+}
+
+// gitHead reports the commit checked out in dir.
+func gitHead(dir string) (string, error) {
+	c := exec.Command("git", "rev-parse", "HEAD")
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitVersion(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "up-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		t.Helper()
+		c := exec.Command("git", append([]string{"-c",
+			"user.name=up", "-c", "user.email=up@example.com"},
+			args...)...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	pth := filepath.Join(dir, "main.go")
+	err = ioutil.WriteFile(pth, []byte("package main\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", "main.go")
+	git("commit", "-q", "-m", "init")
+	sha, err := gitHead(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Untracked files don't make the version dirty
+	err = ioutil.WriteFile(filepath.Join(dir, "new.go"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gitVersion(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "git:" + sha; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	err = ioutil.WriteFile(pth, []byte("package up\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gitVersion(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "git:" + sha + "-dirty"; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+}
+
+func TestGitVersionNotRepo(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = gitVersion(dir); err == nil {
+		t.Fatal("expected error outside a repository")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// healthCheck requests a URL and asserts the response meets expectations.
+// Services often report "200 but degraded" in the body, so the status alone
+// isn't enough.
+type healthCheck struct {
+	URL     string
+	Header  http.Header
+	Status  int
+	Body    []string
+	Regexp  []*regexp.Regexp
+	MaxTime time.Duration
+}
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(val string) error {
+	if !strings.Contains(val, ":") {
+		return fmt.Errorf("header %q must be NAME: VALUE", val)
+	}
+	*h = append(*h, val)
+	return nil
+}
+
+// stringsFlag collects a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringsFlag) Set(val string) error {
+	*s = append(*s, val)
+	return nil
+}
+
+// healthCmd checks a URL's health, retrying until it passes or the attempts
+// run out, so it can be used as a step or conditional in an Upfile:
+//
+//	up check -body '"status":"ok"' http://$server/health
+func healthCmd(args []string) error {
+	var (
+		headers  headerFlags
+		bodies   stringsFlag
+		patterns stringsFlag
+	)
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Var(&headers, "H", "header sent with each request, e.g. 'Host: example.com' (repeatable)")
+	fs.Var(&bodies, "body", "substring the response body must contain (repeatable)")
+	fs.Var(&patterns, "body-regexp", "regular expression the response body must match (repeatable)")
+	status := fs.Int("status", http.StatusOK, "expected response status")
+	maxTime := fs.Duration("max-time", 0, "fail responses slower than this, e.g. 500ms (default no limit)")
+	attempts := fs.Int("attempts", 1, "attempts before failing")
+	interval := fs.Duration("interval", time.Second, "wait between attempts")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each request")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification (default false)")
+	proxy := fs.String("proxy", "", "proxy for requests, e.g. http://proxy:3128 (default $HTTPS_PROXY)")
+	caCert := fs.String("cacert", "", "PEM file of CA certificates trusted alongside the system's")
+	cert := fs.String("cert", "", "PEM client certificate for servers requiring mutual TLS")
+	key := fs.String("key", "", "PEM private key of -cert")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage(errors.New("check requires a url"))
+	}
+	if *attempts < 1 {
+		return errors.New("-attempts must be at least 1")
+	}
+	hc := &healthCheck{
+		URL:     fs.Arg(0),
+		Header:  http.Header{},
+		Status:  *status,
+		Body:    bodies,
+		MaxTime: *maxTime,
+	}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		hc.Header.Add(strings.TrimSpace(parts[0]),
+			strings.TrimSpace(parts[1]))
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("compile %q: %w", p, err)
+		}
+		hc.Regexp = append(hc.Regexp, re)
+	}
+	opts := []httpclient.Option{
+		httpclient.WithTimeout(*timeout),
+		httpclient.WithProxy(*proxy),
+		httpclient.WithCACert(*caCert),
+		httpclient.WithClientCert(*cert, *key),
+	}
+	if *insecure {
+		opts = append(opts, httpclient.WithInsecure())
+	}
+	client, err := httpclient.New(opts...)
+	if err != nil {
+		return err
+	}
+	for i := 1; i <= *attempts; i++ {
+		var took time.Duration
+		took, err = hc.check(client)
+		if err == nil {
+			log.Printf("check %s: attempt %d/%d passed in %s\n",
+				hc.URL, i, *attempts,
+				took.Round(time.Millisecond))
+			return nil
+		}
+		log.Printf("check %s: attempt %d/%d failed: %s\n", hc.URL, i,
+			*attempts, err)
+		if i < *attempts {
+			time.Sleep(*interval)
+		}
+	}
+	return fmt.Errorf("unhealthy: %w", err)
+}
+
+// check makes a single request, reporting how long it took and an error if
+// any expectation wasn't met.
+func (hc *healthCheck) check(client *http.Client) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, hc.URL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("new request: %w", err)
+	}
+	for name, vals := range hc.Header {
+		for _, val := range vals {
+			req.Header.Add(name, val)
+		}
+	}
+	// The Host header must be set on the request itself
+	if host := hc.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStateSize))
+	took := time.Since(start)
+	if err != nil {
+		return took, fmt.Errorf("read body: %w", err)
+	}
+	if resp.StatusCode != hc.Status {
+		return took, fmt.Errorf("expected status %d, got %d",
+			hc.Status, resp.StatusCode)
+	}
+	if hc.MaxTime > 0 && took > hc.MaxTime {
+		return took, fmt.Errorf("took %s, over %s",
+			took.Round(time.Millisecond), hc.MaxTime)
+	}
+	body := string(byt)
+	for _, sub := range hc.Body {
+		if !strings.Contains(body, sub) {
+			return took, fmt.Errorf("body missing %q", sub)
+		}
+	}
+	for _, re := range hc.Regexp {
+		if !re.MatchString(body) {
+			return took, fmt.Errorf("body doesn't match %q", re)
+		}
+	}
+	return took, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path == "/slow" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			w.Write([]byte(`{"status":"degraded","db":"ok"}`))
+		}))
+	defer srv.Close()
+	header := http.Header{"X-Token": []string{"secret"}}
+	tcs := map[string]struct {
+		hc      healthCheck
+		wantErr bool
+	}{
+		"ok": {hc: healthCheck{Body: []string{`"db":"ok"`}}},
+		"regexp": {hc: healthCheck{Regexp: []*regexp.Regexp{
+			regexp.MustCompile(`"status":"(ok|degraded)"`),
+		}}},
+		"degraded": {
+			hc:      healthCheck{Body: []string{`"status":"ok"`}},
+			wantErr: true,
+		},
+		"no match": {
+			hc: healthCheck{Regexp: []*regexp.Regexp{
+				regexp.MustCompile(`^ok$`),
+			}},
+			wantErr: true,
+		},
+		"status": {
+			hc:      healthCheck{Status: http.StatusNoContent},
+			wantErr: true,
+		},
+		"slow": {
+			hc: healthCheck{
+				URL:     srv.URL + "/slow",
+				MaxTime: time.Millisecond,
+			},
+			wantErr: true,
+		},
+		"unauthorized": {
+			hc:      healthCheck{Header: http.Header{}},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			if tc.hc.URL == "" {
+				tc.hc.URL = srv.URL
+			}
+			if tc.hc.Header == nil {
+				tc.hc.Header = header
+			}
+			if tc.hc.Status == 0 {
+				tc.hc.Status = http.StatusOK
+			}
+			_, err := tc.hc.check(srv.Client())
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// helperRegexp matches helper calls such as "$systemd_restart(app)".
+var helperRegexp = regexp.MustCompile(`\$([a-z_]+)\(([^()]*)\)`)
+
+// helpers expand a call's argument into shell commands. Their output must not
+// contain single quotes, so helpers are safe inside single-quoted ssh
+// commands.
+var helpers = map[string]func(arg string) (string, error){
+	"facts":           factsHelper,
+	"pkg_upgrade":     pkgUpgradeHelper,
+	"reboot_required": rebootRequiredHelper,
+	"script":          scriptHelper,
+	"systemd_restart": systemdHelper("restart", true),
+	"systemd_reload":  systemdHelper("reload", true),
+	"systemd_start":   systemdHelper("start", true),
+	"systemd_stop":    systemdHelper("stop", false),
+}
+
+// expandHelpers replaces each helper call in a command with its shell
+// commands. Calls of other names are left alone, since they may be shell
+// syntax, unless they look like a misspelled systemd helper.
+func expandHelpers(cmd string) (string, error) {
+	var err error
+	cmd = helperRegexp.ReplaceAllStringFunc(cmd, func(call string) string {
+		m := helperRegexp.FindStringSubmatch(call)
+		fn, ok := helpers[m[1]]
+		switch {
+		case !ok && strings.HasPrefix(m[1], "systemd_"):
+			err = fmt.Errorf("unknown helper %s", m[1])
+			return call
+		case !ok:
+			return call
+		}
+		out, fnErr := fn(m[2])
+		if fnErr != nil {
+			err = fmt.Errorf("%s: %w", m[1], fnErr)
+			return call
+		}
+		return out
+	})
+	if err != nil {
+		return "", err
+	}
+	return cmd, nil
+}
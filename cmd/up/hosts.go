@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// hostPattern selects hosts by CIDR, e.g. 10.0.1.0/24, or by glob, e.g.
+// web-*.internal.
+type hostPattern struct {
+	cidr *net.IPNet
+	glob string
+}
+
+// parseHostPatterns from a comma-separated list.
+func parseHostPatterns(s string) ([]hostPattern, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var patterns []hostPattern
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if strings.Contains(p, "/") {
+			_, cidr, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("parse cidr: %w", err)
+			}
+			patterns = append(patterns, hostPattern{cidr: cidr})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, hostPattern{glob: p})
+	}
+	return patterns, nil
+}
+
+func (p hostPattern) match(host string) bool {
+	if p.cidr != nil {
+		if h, _, err := up.SplitAddress(host); err == nil {
+			host = h
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && p.cidr.Contains(ip)
+	}
+	ok, _ := path.Match(p.glob, host)
+	return ok
+}
+
+// matchHost reports whether the host matches any of the patterns. Every host
+// matches if there are no patterns.
+func matchHost(patterns []hostPattern, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p.match(host) {
+			return true
+		}
+	}
+	return false
+}
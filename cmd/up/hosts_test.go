@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	t.Parallel()
+	patterns, err := parseHostPatterns("10.0.1.0/24, web-*.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[string]bool{
+		"10.0.1.7":          true,
+		"10.0.2.7":          false,
+		"10.0.1.7:2222":     true,
+		"web-1.internal":    true,
+		"db-1.internal":     false,
+		"web-1.internal.io": false,
+	}
+	for host, want := range tcs {
+		if got := matchHost(patterns, host); got != want {
+			t.Fatalf("%s: expected %t, got %t", host, want, got)
+		}
+	}
+	if !matchHost(nil, "anything") {
+		t.Fatal("expected no patterns to match everything")
+	}
+	if _, err = parseHostPatterns("10.0.1.0/99"); err == nil {
+		t.Fatal("expected error for bad cidr")
+	}
+}
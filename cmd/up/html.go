@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"time"
+)
+
+// htmlReport is the data rendered into a standalone HTML report.
+type htmlReport struct {
+	report
+	Result  string
+	Failed  bool
+	Batches []htmlBatch
+	Servers []htmlServer
+}
+
+// htmlBatch is a row in the report's timeline.
+type htmlBatch struct {
+	Name    string
+	Servers []string
+	Offset  time.Duration
+	Took    time.Duration
+
+	// Left and Width position the batch's bar as percentages of the
+	// deploy's duration.
+	Left, Width float64
+}
+
+// htmlServer is a server's status, time spent running commands and log.
+type htmlServer struct {
+	Name   string
+	Status string
+	Error  string
+	Cmds   int
+	Took   time.Duration
+	Log    string
+
+	// Width of the server's bar as a percentage of the slowest server.
+	Width float64
+}
+
+// serverSpan is when a server's first command started and its last ended.
+type serverSpan struct {
+	start, end time.Time
+}
+
+// newHTMLReport summarizes the timeline and each server from the report's
+// events.
+func newHTMLReport(rep report) htmlReport {
+	h := htmlReport{report: rep, Result: "succeeded"}
+	if rep.Err != nil {
+		h.Result, h.Failed = "FAILED: "+rep.Err.Error(), true
+	}
+	spans := map[string]*serverSpan{}
+	took := map[string]time.Duration{}
+	cmds := map[string]int{}
+	for _, e := range rep.Events {
+		s, ok := spans[e.Server]
+		if !ok {
+			s = &serverSpan{start: e.Time, end: e.Time}
+			spans[e.Server] = s
+		}
+		if e.Time.After(s.end) {
+			s.end = e.Time
+		}
+		switch e.Type {
+		case "cmd":
+			cmds[e.Server]++
+		case "exit":
+			took[e.Server] += e.Took
+		}
+	}
+	total := rep.Took
+	if total <= 0 {
+		total = time.Nanosecond
+	}
+	percent := func(d time.Duration) float64 {
+		return 100 * float64(d) / float64(total)
+	}
+
+	for _, g := range rep.Groups {
+		for i, b := range g.Batches {
+			var start, end time.Time
+			for _, server := range b.Servers {
+				s, ok := spans[server]
+				if !ok {
+					continue
+				}
+				if start.IsZero() || s.start.Before(start) {
+					start = s.start
+				}
+				if s.end.After(end) {
+					end = s.end
+				}
+			}
+			hb := htmlBatch{
+				Name: fmt.Sprintf("%s %s %d/%d", g.Command,
+					g.Tag, i+1, len(g.Batches)),
+				Servers: b.Servers,
+			}
+			if !start.IsZero() {
+				hb.Offset = start.Sub(rep.Start)
+				hb.Took = end.Sub(start)
+				hb.Left = percent(hb.Offset)
+				hb.Width = percent(hb.Took)
+			}
+			h.Batches = append(h.Batches, hb)
+		}
+	}
+
+	failed := rep.failures()
+	var slowest time.Duration
+	for _, d := range took {
+		if d > slowest {
+			slowest = d
+		}
+	}
+	for _, server := range rep.servers() {
+		var events []event
+		for _, e := range rep.Events {
+			if e.Server == server {
+				events = append(events, e)
+			}
+		}
+		var out bytes.Buffer
+		replay(&out, &out, events, 0)
+		hs := htmlServer{
+			Name:   server,
+			Status: "ok",
+			Cmds:   cmds[server],
+			Took:   took[server].Round(time.Millisecond),
+			Log:    out.String(),
+		}
+		if msg, ok := failed[server]; ok {
+			hs.Status, hs.Error = "failed", msg
+		}
+		if slowest > 0 {
+			hs.Width = 100 * float64(took[server]) /
+				float64(slowest)
+		}
+		h.Servers = append(h.Servers, hs)
+	}
+	for _, server := range rep.Skipped {
+		h.Servers = append(h.Servers, htmlServer{
+			Name:   server,
+			Status: "skipped",
+			Error:  "unreachable",
+		})
+	}
+	return h
+}
+
+// writeHTMLReport writes a standalone HTML report of the deploy, with no
+// external stylesheets or scripts, so it can be attached to a change ticket.
+func writeHTMLReport(w io.Writer, rep report) error {
+	return htmlTemplate.Execute(w, newHTMLReport(rep))
+}
+
+// saveHTMLReport writes the report to pth.
+func saveHTMLReport(pth string, rep report) error {
+	fi, err := os.Create(pth)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if err = writeHTMLReport(fi, rep); err != nil {
+		fi.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	return fi.Close()
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(
+	template.FuncMap{
+		"round": func(d time.Duration) time.Duration {
+			return d.Round(time.Millisecond)
+		},
+		"utc": func(t time.Time) string {
+			return t.UTC().Format(time.RFC3339)
+		},
+	}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>up {{.Command}} {{if .Failed}}FAILED{{else}}succeeded{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 0.8em; vertical-align: top; }
+th { border-bottom: 1px solid #ccc; }
+.chart { width: 30em; background: #f2f2f2; }
+.bar { height: 1em; background: #4a7fbd; }
+.ok { color: #2a7a2a; }
+.failed { color: #b22; font-weight: bold; }
+.skipped { color: #a60; }
+pre { background: #f7f7f7; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>up {{.Command}}</h1>
+{{with .Description}}<p>{{.}}</p>{{end}}
+<table>
+<tr><th>Checksum</th><td><code>{{.Checksum}}</code></td></tr>
+{{with .DeployID}}<tr><th>Deploy</th><td><code>{{.}}</code></td></tr>
+{{end}}<tr><th>Tags</th><td>{{range $i, $t := .Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</td></tr>
+<tr><th>Operator</th><td>{{.Operator}}</td></tr>
+<tr><th>Started</th><td>{{utc .Start}}</td></tr>
+<tr><th>Took</th><td>{{round .Took}}</td></tr>
+<tr><th>Result</th><td class="{{if .Failed}}failed{{else}}ok{{end}}">{{.Result}}</td></tr>
+</table>
+
+<h2>Timeline</h2>
+<table>
+<tr><th>Batch</th><th>Servers</th><th>Started after</th><th>Took</th><th></th></tr>
+{{range .Batches}}<tr>
+<td>{{.Name}}</td>
+<td>{{range $i, $s := .Servers}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+<td>{{round .Offset}}</td>
+<td>{{round .Took}}</td>
+<td class="chart"><div class="bar" style="margin-left: {{printf "%.1f" .Left}}%; width: {{printf "%.1f" .Width}}%"></div></td>
+</tr>
+{{end}}</table>
+
+<h2>Servers</h2>
+<table>
+<tr><th>Server</th><th>Status</th><th>Commands</th><th>Took</th><th></th></tr>
+{{range .Servers}}<tr>
+<td>{{.Name}}</td>
+<td class="{{.Status}}">{{.Status}}{{with .Error}}: {{.}}{{end}}</td>
+<td>{{.Cmds}}</td>
+<td>{{.Took}}</td>
+<td class="chart"><div class="bar" style="width: {{printf "%.1f" .Width}}%"></div></td>
+</tr>
+{{end}}</table>
+
+<h2>Logs</h2>
+{{range .Servers}}{{if .Log}}<details{{if eq .Status "failed"}} open{{end}}>
+<summary class="{{.Status}}">{{.Name}}: {{.Status}}</summary>
+<pre>{{.Log}}</pre>
+</details>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteHTMLReport(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rep := report{
+		annotation: annotation{
+			Command:  "deploy",
+			Checksum: "abc",
+			Tags:     []string{"web"},
+			Operator: "alice",
+			Done:     true,
+			Err:      errors.New("exit status 1"),
+		},
+		Description: "Deploy the <web> app",
+		Start:       start,
+		Took:        10 * time.Second,
+		Events: []event{
+			{Time: start, Server: "10.0.0.1", Type: "cmd",
+				Data: "echo hi"},
+			{Time: start, Server: "10.0.0.1", Type: "stdout",
+				Data: "hi\n"},
+			{Time: start.Add(2 * time.Second), Server: "10.0.0.1",
+				Type: "exit", Took: 2 * time.Second},
+			{Time: start.Add(5 * time.Second), Server: "10.0.0.2",
+				Type: "cmd", Data: "false"},
+			{Time: start.Add(9 * time.Second), Server: "10.0.0.2",
+				Type: "exit", Data: "exit status 1",
+				Took: 4 * time.Second},
+		},
+		Skipped: []string{"10.0.0.3"},
+		Groups: []*planGroup{{
+			Command: "deploy",
+			Tag:     "web",
+			Batches: []*planBatch{
+				{Servers: []string{"10.0.0.1"}},
+				{Servers: []string{"10.0.0.2"}},
+			},
+		}},
+	}
+
+	h := newHTMLReport(rep)
+	if len(h.Batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(h.Batches))
+	}
+	b := h.Batches[1]
+	if b.Offset != 5*time.Second || b.Took != 4*time.Second {
+		t.Fatalf("expected batch 2 at 5s for 4s, got %s for %s",
+			b.Offset, b.Took)
+	}
+	if b.Left != 50 || b.Width != 40 {
+		t.Fatalf("expected bar at 50%% for 40%%, got %v for %v",
+			b.Left, b.Width)
+	}
+	var statuses []string
+	for _, s := range h.Servers {
+		statuses = append(statuses, s.Name+" "+s.Status)
+	}
+	want := "[10.0.0.1 ok 10.0.0.2 failed 10.0.0.3 skipped]"
+	if got := fmt.Sprint(statuses); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if h.Servers[0].Width != 50 || h.Servers[1].Width != 100 {
+		t.Fatalf("expected widths 50 and 100, got %v and %v",
+			h.Servers[0].Width, h.Servers[1].Width)
+	}
+
+	var buf bytes.Buffer
+	if err := writeHTMLReport(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"<title>up deploy FAILED</title>",
+		"Deploy the &lt;web&gt; app",
+		"<code>abc</code>",
+		"deploy web 2/2",
+		"<details open>",
+		"[10.0.0.2] failed after 4s: exit status 1",
+		"unreachable",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected report to contain %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<script") || strings.Contains(out, "href=") {
+		t.Fatal("expected a standalone report")
+	}
+}
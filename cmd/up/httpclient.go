@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// httpFlags are the flags configuring the clients up makes for HTTP
+// requests. Zero values keep each client's defaults.
+type httpFlags struct {
+	timeout time.Duration
+	retries int
+	proxy   string
+	caCert  string
+	cert    string
+	key     string
+}
+
+// options reports the httpclient.Options set by the flags.
+func (f httpFlags) options() []httpclient.Option {
+	return []httpclient.Option{
+		httpclient.WithTimeout(f.timeout),
+		httpclient.WithRetries(f.retries, httpclient.DefaultRetryWait),
+		httpclient.WithProxy(f.proxy),
+		httpclient.WithCACert(f.caCert),
+		httpclient.WithClientCert(f.cert, f.key),
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// project is what up init detected about the app in a directory.
+type project struct {
+	// Name of the app, from go.mod, package.json or else the directory.
+	Name string
+
+	Go     bool
+	Node   bool
+	Docker bool
+
+	// NodeBuild is set if package.json has a build script.
+	NodeBuild bool
+
+	// Units are systemd unit files, relative to the directory.
+	Units []string
+
+	// Port the app listens on, from the Dockerfile's EXPOSE or else a
+	// guess.
+	Port string
+
+	// Tags in the inventory. The deploy command targets the tag if
+	// there's only one.
+	Tags []string
+}
+
+// defaultPort is guessed when nothing declares the app's port.
+const defaultPort = "8080"
+
+// initCmd scaffolds a starter Upfile for the app in a directory, so new
+// projects don't start from stale examples.
+func initCmd(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("o", "Upfile", "path to write the upfile, or - for stdout")
+	inventory := fs.String("i", "inventory.json", "path to inventory whose tags are deployed, if it exists")
+	force := fs.Bool("force", false, "overwrite an existing upfile (default false)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		return usage(errors.New("init takes at most one directory"))
+	}
+	if *out != "-" && !*force {
+		if _, err := os.Stat(*out); err == nil {
+			return fmt.Errorf("%s exists: use -force to overwrite",
+				*out)
+		}
+	}
+
+	var inv up.Inventory
+	fi, err := os.Open(*inventory)
+	switch {
+	case err == nil:
+		defer fi.Close()
+		invFile, err := up.ParseInventoryFile(fi)
+		if err != nil {
+			return fmt.Errorf("parse inventory: %w", err)
+		}
+		inv = invFile.Hosts
+	case !os.IsNotExist(err):
+		return fmt.Errorf("open inventory: %w", err)
+	}
+
+	p, err := detectProject(dir, inv)
+	if err != nil {
+		return fmt.Errorf("detect project: %w", err)
+	}
+	var buf bytes.Buffer
+	writeUpfile(&buf, p)
+
+	// Catch mistakes in the template before anyone relies on it
+	_, err = up.ParseUpfile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("parse generated upfile: %w", err)
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err = ioutil.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write upfile: %w", err)
+	}
+	log.Printf("wrote %s: review it, then run up -c deploy\n", *out)
+	return nil
+}
+
+// moduleRegexp matches the module path in go.mod.
+var moduleRegexp = regexp.MustCompile(`(?m)^module\s+"?([^\s"]+)"?`)
+
+// exposeRegexp matches the first port in a Dockerfile's EXPOSE.
+var exposeRegexp = regexp.MustCompile(`(?mi)^\s*EXPOSE\s+(\d+)`)
+
+// detectProject inspects dir for a Dockerfile, systemd units, go.mod and
+// package.json.
+func detectProject(dir string, inv up.Inventory) (project, error) {
+	p := project{
+		Name: filepath.Base(filepath.Clean(dir)),
+		Port: defaultPort,
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		p.Name = filepath.Base(abs)
+	}
+
+	byt, err := readOptional(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return project{}, err
+	}
+	if byt != nil {
+		p.Go = true
+		if m := moduleRegexp.FindSubmatch(byt); m != nil {
+			p.Name = filepath.Base(string(m[1]))
+		}
+	}
+
+	byt, err = readOptional(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return project{}, err
+	}
+	if byt != nil {
+		p.Node = true
+		var pkg struct {
+			Name    string            `json:"name"`
+			Scripts map[string]string `json:"scripts"`
+		}
+		if err = json.Unmarshal(byt, &pkg); err != nil {
+			return project{}, fmt.Errorf("package.json: %w", err)
+		}
+		if pkg.Name != "" && !p.Go {
+			// Scoped packages are named @scope/name
+			p.Name = filepath.Base(pkg.Name)
+		}
+		_, p.NodeBuild = pkg.Scripts["build"]
+	}
+
+	byt, err = readOptional(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		return project{}, err
+	}
+	if byt != nil {
+		p.Docker = true
+		if m := exposeRegexp.FindSubmatch(byt); m != nil {
+			p.Port = string(m[1])
+		}
+	}
+
+	// Unit files are usually kept at the top level or one directory
+	// down, e.g. in deploy/ or systemd/
+	for _, pattern := range []string{"*.service", "*/*.service"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return project{}, fmt.Errorf("glob: %w", err)
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(dir, m)
+			if err != nil {
+				return project{}, fmt.Errorf("rel: %w", err)
+			}
+			p.Units = append(p.Units, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(p.Units)
+
+	seen := map[string]struct{}{}
+	for _, tags := range inv {
+		for _, tag := range tags {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				p.Tags = append(p.Tags, tag)
+			}
+		}
+	}
+	sort.Strings(p.Tags)
+	return p, nil
+}
+
+// readOptional reads a file, reporting nil if it doesn't exist.
+func readOptional(pth string) ([]byte, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filepath.Base(pth), err)
+	}
+	return byt, nil
+}
+
+// writeUpfile writes a starter Upfile for the project. Deploys are skipped on
+// servers which already run the checksum, record it once the health check
+// passes, and are built once locally beforehand.
+func writeUpfile(w io.Writer, p project) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	var detected []string
+	if p.Docker {
+		detected = append(detected, "Dockerfile")
+	}
+	detected = append(detected, p.Units...)
+	if p.Go {
+		detected = append(detected, "go.mod")
+	}
+	if p.Node {
+		detected = append(detected, "package.json")
+	}
+	if len(detected) == 0 {
+		detected = append(detected, "nothing")
+	}
+	fmt.Fprintln(bw, "# Generated by up init from "+
+		strings.Join(detected, ", ")+".")
+	fmt.Fprintln(bw, "# Review every command before running: "+
+		"up -c deploy")
+	fmt.Fprintln(bw)
+
+	var build, steps []string
+	steps = append(steps, "ssh $remote 'mkdir -p $dir'")
+	switch {
+	case p.Docker:
+		build = append(build, "docker build -t $app .")
+		steps = append(steps,
+			"docker save $app | ssh $remote docker load",
+			"ssh $remote 'docker rm -f $app; docker run -d "+
+				"--name $app --restart unless-stopped "+
+				"-p $port:$port $app'")
+	case p.Go:
+		build = append(build,
+			"CGO_ENABLED=0 GOOS=linux go build -o $app .")
+		steps = append(steps, "rsync -az $app $remote:$dir/")
+	case p.Node:
+		build = append(build, "npm ci")
+		if p.NodeBuild {
+			build = append(build, "npm run build")
+		}
+		steps = append(steps,
+			"rsync -az --delete --exclude node_modules ./ "+
+				"$remote:$dir/",
+			"ssh $remote 'cd $dir && npm ci --omit=dev'")
+	default:
+		steps = append(steps, "rsync -az --delete ./ $remote:$dir/")
+	}
+	if !p.Docker {
+		for _, unit := range p.Units {
+			steps = append(steps, fmt.Sprintf("rsync -az "+
+				"--rsync-path='sudo -n rsync' %s "+
+				"$remote:/etc/systemd/system/", unit))
+		}
+		if len(p.Units) > 0 {
+			steps = append(steps,
+				"ssh $remote 'sudo -n systemctl daemon-reload'")
+		}
+		for _, unit := range p.Units {
+			name := strings.TrimSuffix(filepath.Base(unit),
+				".service")
+			steps = append(steps, fmt.Sprintf(
+				"ssh $remote '$systemd_restart(%s)'", name))
+		}
+	}
+	steps = append(steps,
+		"up check -attempts 10 http://$server:$port/health",
+		"ssh $remote 'echo $checksum > $dir/.checksum'")
+
+	// A host with several tags would be deployed once per tag, so only
+	// choose the tag when there's no doubt
+	if len(p.Tags) > 1 {
+		fmt.Fprintf(bw, "# Inventory tags: %s. Add @TAG after deploy "+
+			"to choose where it runs\n", strings.Join(p.Tags, ", "))
+	}
+	fmt.Fprint(bw, "deploy")
+	if len(p.Tags) == 1 {
+		fmt.Fprintf(bw, " @%s", p.Tags[0])
+	}
+	fmt.Fprint(bw, " check_version")
+	if len(build) > 0 {
+		fmt.Fprint(bw, " needs build")
+	}
+	fmt.Fprintln(bw)
+	writeSteps(bw, steps)
+
+	if len(build) > 0 {
+		fmt.Fprintln(bw, "build")
+		writeSteps(bw, build)
+	}
+	fmt.Fprintln(bw, "# Skips servers already running this checksum")
+	fmt.Fprintln(bw, "check_version")
+	writeSteps(bw, []string{
+		"ssh $remote 'grep -qx -- $checksum $dir/.checksum'",
+	})
+	fmt.Fprintln(bw, "app")
+	writeSteps(bw, []string{p.Name})
+	fmt.Fprintln(bw, "dir")
+	writeSteps(bw, []string{"/opt/$app"})
+	fmt.Fprintln(bw, "port")
+	writeSteps(bw, []string{p.Port})
+	fmt.Fprintln(bw, "# ssh destination, e.g. deploy@$server")
+	fmt.Fprintln(bw, "remote")
+	fmt.Fprint(bw, "\t$server\n")
+}
+
+// writeSteps writes indented steps followed by a blank line.
+func writeSteps(w io.Writer, steps []string) {
+	for _, step := range steps {
+		fmt.Fprintf(w, "\t%s\n", step)
+	}
+	fmt.Fprintln(w)
+}
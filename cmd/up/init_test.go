@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod":             "module example.com/acme/api\n",
+		"Dockerfile":         "FROM scratch\nEXPOSE 3000/tcp\n",
+		"deploy/api.service": "[Unit]\n",
+	}
+	for name, content := range files {
+		pth := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(pth, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := detectProject(dir, up.Inventory{"10.0.0.1": {"api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{api true false true false [deploy/api.service] 3000 [api]}"
+	if got := fmt.Sprint(p); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	var buf bytes.Buffer
+	writeUpfile(&buf, p)
+	conf, err := up.ParseUpfile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf.String())
+	}
+	if len(conf.Warnings) > 0 {
+		t.Fatalf("unexpected warnings %v", conf.Warnings)
+	}
+	if conf.DefaultCommand != "deploy" {
+		t.Fatalf("expected deploy, got %s", conf.DefaultCommand)
+	}
+	deploy := conf.Commands["deploy"]
+	if got := fmt.Sprint(deploy.Tags, deploy.ExecIfs, deploy.Needs); got !=
+		"[api] [check_version] [{build false}]" {
+		t.Fatalf("unexpected deploy %s", got)
+	}
+
+	// Docker takes precedence over the Go toolchain and systemd
+	steps := strings.Join(deploy.Execs, "\n")
+	if !strings.Contains(steps, "docker save $app") ||
+		strings.Contains(steps, "systemctl") {
+		t.Fatalf("unexpected steps\n%s", steps)
+	}
+	if got := conf.Commands["port"].Execs[0]; got != "3000" {
+		t.Fatalf("expected port 3000, got %s", got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// inventoryCmd runs inventory subcommands. Only export exists today.
+func inventoryCmd(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return usage(errors.New("inventory requires export"))
+	}
+	fs := flag.NewFlagSet("inventory export", flag.ExitOnError)
+	inventory := fs.String("i", "inventory.json", "path to inventory")
+	format := fs.String("format", "ssh-config", "output format: ssh-config")
+	output := fs.String("o", "-", "path to write the export, or - for stdout")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usage(errors.New("inventory export takes no arguments"))
+	}
+	if *format != "ssh-config" {
+		return fmt.Errorf("unknown format %q: use ssh-config", *format)
+	}
+
+	fi, err := os.Open(*inventory)
+	if err != nil {
+		return fmt.Errorf("open inventory: %w", err)
+	}
+	defer fi.Close()
+	inv, err := up.ParseInventoryFile(fi)
+	if err != nil {
+		return fmt.Errorf("parse inventory: %w", err)
+	}
+
+	if *output == "-" {
+		return writeSSHConfig(os.Stdout, *inventory, inv)
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if err = writeSSHConfig(out, *inventory, inv); err != nil {
+		out.Close()
+		return fmt.Errorf("write ssh config: %w", err)
+	}
+	return out.Close()
+}
+
+// writeSSHConfig writes a Host block for every host reached over ssh, with
+// the user, port and key from its settings, so interactive ssh and up connect
+// the same way. Hosts with a transport other than the default, such as winrm or
+// docker, aren't reached over ssh and are skipped.
+func writeSSHConfig(w io.Writer, name string, inv *up.InventoryFile) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Generated by up inventory export from %s.\n"+
+		"# Regenerate rather than editing, so it stays in sync.\n", name)
+
+	hosts := make([]string, 0, len(inv.Hosts))
+	for host := range inv.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		s := inv.Settings(host)
+		if s.Transport != "" && s.Transport != "local" {
+			continue
+		}
+		tags := append([]string{}, inv.Hosts[host]...)
+		sort.Strings(tags)
+		fmt.Fprintf(bw, "\n# %s\n", strings.Join(tags, ", "))
+
+		// ssh takes the port separately, which the settings include
+		name, _, err := up.SplitAddress(host)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "Host %s\n", name)
+		if s.User != "" {
+			fmt.Fprintf(bw, "\tUser %s\n", s.User)
+		}
+		if s.Port != 0 {
+			fmt.Fprintf(bw, "\tPort %d\n", s.Port)
+		}
+		if s.Key != "" {
+			fmt.Fprintf(bw, "\tIdentityFile %s\n", s.Key)
+			fmt.Fprintln(bw, "\tIdentitiesOnly yes")
+		}
+		if s.SSHAgent != nil && !*s.SSHAgent {
+			fmt.Fprintln(bw, "\tIdentityAgent none")
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestWriteSSHConfig(t *testing.T) {
+	t.Parallel()
+	inv, err := up.ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1": ["web"],
+		"10.0.0.2:2222": {"tags": ["web", "db"], "key": "keys/db"},
+		"10.0.0.3": ["iis"],
+		"tags": {
+			"web": {"user": "deploy", "ssh_agent": false},
+			"iis": {"transport": "winrm"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = writeSSHConfig(&buf, "inventory.json", inv); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	want := "\n# web\nHost 10.0.0.1\n\tUser deploy\n" +
+		"\tIdentityAgent none\n" +
+		"\n# db, web\nHost 10.0.0.2\n\tUser deploy\n\tPort 2222\n" +
+		"\tIdentityFile keys/db\n\tIdentitiesOnly yes\n" +
+		"\tIdentityAgent none\n"
+	if !strings.HasSuffix(got, want) {
+		t.Fatalf("expected suffix %q, got %q", want, got)
+	}
+	if strings.Contains(got, "10.0.0.3") {
+		t.Fatalf("winrm host exported: %q", got)
+	}
+}
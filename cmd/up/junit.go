@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// junitSuites is the root of a JUnit XML report. Each server is a suite and
+// each command it ran is a test case, so CI systems show which hosts failed.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// newJUnitReport maps each command run on each server to a test case, with
+// its output and, if it failed, its error. Unreachable servers which were
+// skipped are reported as skipped test cases.
+func newJUnitReport(rep report) junitSuites {
+	suites := junitSuites{
+		Name: string(rep.Command),
+		Time: rep.Took.Seconds(),
+	}
+	for _, server := range rep.servers() {
+		suite := junitSuite{Name: server}
+		var (
+			tc  *junitCase
+			out strings.Builder
+		)
+		for _, e := range rep.Events {
+			if e.Server != server {
+				continue
+			}
+			switch e.Type {
+			case "cmd":
+				if suite.Timestamp == "" {
+					suite.Timestamp = e.Time.UTC().Format(
+						time.RFC3339)
+				}
+				tc = &junitCase{Name: e.Data, Classname: server}
+				out.Reset()
+			case "stdout", "stderr":
+				out.WriteString(e.Data)
+			case "exit":
+				if tc == nil {
+					continue
+				}
+				tc.Time = e.Took.Seconds()
+				tc.SystemOut = out.String()
+				if e.Data != "" {
+					tc.Failure = &junitMessage{
+						Message: e.Data,
+						Text:    out.String(),
+					}
+					suite.Failures++
+				}
+				suite.Tests++
+				suite.Time += tc.Time
+				suite.Cases = append(suite.Cases, *tc)
+				tc = nil
+			}
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+	for _, server := range rep.Skipped {
+		suites.Suites = append(suites.Suites, junitSuite{
+			Name:    server,
+			Tests:   1,
+			Skipped: 1,
+			Cases: []junitCase{{
+				Name:      string(rep.Command),
+				Classname: server,
+				Skipped: &junitMessage{
+					Message: "unreachable",
+				},
+			}},
+		})
+	}
+	for _, suite := range suites.Suites {
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+	}
+	return suites
+}
+
+// writeJUnitReport writes the deploy as JUnit XML, which Jenkins, GitLab and
+// most other CI systems display natively.
+func writeJUnitReport(w io.Writer, rep report) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(newJUnitReport(rep)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// saveJUnitReport writes the JUnit report to pth.
+func saveJUnitReport(pth string, rep report) error {
+	fi, err := os.Create(pth)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if err = writeJUnitReport(fi, rep); err != nil {
+		fi.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	return fi.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteJUnitReport(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rep := report{
+		annotation: annotation{
+			Command: "deploy",
+			Done:    true,
+			Err:     errors.New("exit status 1"),
+		},
+		Start: start,
+		Took:  10 * time.Second,
+		Events: []event{
+			{Time: start, Server: "10.0.0.1", Type: "cmd",
+				Data: "echo hi"},
+			{Time: start, Server: "10.0.0.1", Type: "stdout",
+				Data: "hi\n"},
+			{Time: start, Server: "10.0.0.1", Type: "exit",
+				Took: 2 * time.Second},
+			{Time: start, Server: "10.0.0.2", Type: "cmd",
+				Data: "test -f <missing>"},
+			{Time: start, Server: "10.0.0.2", Type: "stderr",
+				Data: "no such file\n"},
+			{Time: start, Server: "10.0.0.2", Type: "exit",
+				Data: "exit status 1", Took: time.Second},
+		},
+		Skipped: []string{"10.0.0.3"},
+	}
+	var buf bytes.Buffer
+	if err := writeJUnitReport(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="deploy" tests="3" failures="1" skipped="1" time="10">
+	<testsuite name="10.0.0.1" tests="1" failures="0" skipped="0" time="2" timestamp="2026-01-02T03:04:05Z">
+		<testcase name="echo hi" classname="10.0.0.1" time="2">
+			<system-out>hi&#xA;</system-out>
+		</testcase>
+	</testsuite>
+	<testsuite name="10.0.0.2" tests="1" failures="1" skipped="0" time="1" timestamp="2026-01-02T03:04:05Z">
+		<testcase name="test -f &lt;missing&gt;" classname="10.0.0.2" time="1">
+			<failure message="exit status 1">no such file&#xA;</failure>
+			<system-out>no such file&#xA;</system-out>
+		</testcase>
+	</testsuite>
+	<testsuite name="10.0.0.3" tests="1" failures="0" skipped="1" time="0">
+		<testcase name="deploy" classname="10.0.0.3" time="0">
+			<skipped message="unreachable"></skipped>
+		</testcase>
+	</testsuite>
+</testsuites>
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
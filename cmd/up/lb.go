@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// lbCmd drains servers from a load balancer and restores them, for use in
+// an Upfile command's drain and undrain steps:
+//
+//	up lb haproxy -socket /run/haproxy.sock web/$server drain
+//	up lb http -X POST http://lb/servers/$server/drain
+func lbCmd(args []string) error {
+	if len(args) == 0 {
+		return usage(errors.New("lb requires haproxy or http"))
+	}
+	switch args[0] {
+	case "haproxy":
+		return haproxyCmd(args[1:])
+	case "http":
+		return lbHTTPCmd(args[1:])
+	default:
+		return usage(fmt.Errorf("unknown lb %q", args[0]))
+	}
+}
+
+// haproxyCmd sets a server's state through the HAProxy runtime API. When
+// draining with -wait, it waits for the server's sessions to finish.
+func haproxyCmd(args []string) error {
+	fs := flag.NewFlagSet("haproxy", flag.ExitOnError)
+	socket := fs.String("socket", "/var/run/haproxy.sock", "path or host:port of the haproxy stats socket")
+	wait := fs.Duration("wait", 0, "when draining, wait up to this long for current sessions to finish")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usage(errors.New("haproxy requires BACKEND/SERVER " +
+			"and drain, ready or maint"))
+	}
+	server, state := fs.Arg(0), fs.Arg(1)
+	parts := strings.SplitN(server, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("server %q must be BACKEND/SERVER", server)
+	}
+	switch state {
+	case "drain", "ready", "maint":
+	default:
+		return fmt.Errorf(
+			"unknown state %q: must be drain, ready or maint", state)
+	}
+	out, err := haproxyExec(*socket, fmt.Sprintf("set server %s state %s",
+		server, state))
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("haproxy: %s", out)
+	}
+	log.Printf("%s is %s\n", server, state)
+	if state != "drain" || *wait == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(*wait)
+	for {
+		out, err = haproxyExec(*socket, "show stat")
+		if err != nil {
+			return err
+		}
+		n, err := haproxySessions(out, parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still has %d sessions after %s",
+				server, n, *wait)
+		}
+		log.Printf("waiting for %d sessions on %s\n", n, server)
+		time.Sleep(time.Second)
+	}
+}
+
+// haproxyExec runs a single command on the HAProxy runtime API and reports
+// its output. Addresses containing a "/" are unix sockets.
+func haproxyExec(addr, cmd string) (string, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		return "", fmt.Errorf("set deadline: %w", err)
+	}
+	if _, err = io.WriteString(conn, cmd+"\n"); err != nil {
+		return "", fmt.Errorf("write: %w", err)
+	}
+	byt, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("read: %w", err)
+	}
+	return string(byt), nil
+}
+
+// haproxySessions reports a server's current sessions from the CSV output of
+// "show stat".
+func haproxySessions(stat, backend, server string) (int, error) {
+	rdr := csv.NewReader(strings.NewReader(strings.TrimPrefix(stat,
+		"# ")))
+	rdr.FieldsPerRecord = -1
+	rows, err := rdr.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("parse stat: %w", err)
+	}
+	if len(rows) == 0 {
+		return 0, errors.New("empty stat")
+	}
+	col := -1
+	for i, name := range rows[0] {
+		if name == "scur" {
+			col = i
+		}
+	}
+	if col < 2 {
+		return 0, errors.New("stat missing scur")
+	}
+	for _, row := range rows[1:] {
+		if len(row) <= col || row[0] != backend || row[1] != server {
+			continue
+		}
+		n, err := strconv.Atoi(row[col])
+		if err != nil {
+			return 0, fmt.Errorf("parse scur: %w", err)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%s/%s not found", backend, server)
+}
+
+// lbHTTPCmd calls a generic HTTP endpoint which drains or restores a server,
+// failing unless it responds with a 2xx status.
+func lbHTTPCmd(args []string) error {
+	var headers headerFlags
+	fs := flag.NewFlagSet("http", flag.ExitOnError)
+	method := fs.String("X", http.MethodPost, "request method")
+	fs.Var(&headers, "H", "header sent with the request, e.g. 'Authorization: Bearer x' (repeatable)")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for the request")
+	proxy := fs.String("proxy", "", "proxy for requests, e.g. http://proxy:3128 (default $HTTPS_PROXY)")
+	retries := fs.Int("retries", 0, "times to retry requests which fail to connect or get a 429, 502, 503 or 504 (default 0)")
+	caCert := fs.String("cacert", "", "PEM file of CA certificates trusted alongside the system's")
+	cert := fs.String("cert", "", "PEM client certificate for servers requiring mutual TLS")
+	key := fs.String("key", "", "PEM private key of -cert")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage(errors.New("http requires a url"))
+	}
+	req, err := http.NewRequest(*method, fs.Arg(0), nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		req.Header.Add(strings.TrimSpace(parts[0]),
+			strings.TrimSpace(parts[1]))
+	}
+	client, err := httpclient.New(httpFlags{
+		timeout: *timeout,
+		retries: *retries,
+		proxy:   *proxy,
+		caCert:  *caCert,
+		cert:    *cert,
+		key:     *key,
+	}.options()...)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		byt, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status,
+			strings.TrimSpace(string(byt)))
+	}
+	log.Printf("%s %s: %s\n", *method, fs.Arg(0), resp.Status)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHaproxyExec(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "haproxy.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		got <- line
+		conn.Write([]byte("No such server.\n"))
+	}()
+	out, err := haproxyExec(sock, "set server web/a state drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := <-got; line != "set server web/a state drain\n" {
+		t.Fatalf("unexpected command %q", line)
+	}
+	if out != "No such server.\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestHaproxySessions(t *testing.T) {
+	t.Parallel()
+	stat := "# pxname,svname,qcur,qmax,scur,smax\n" +
+		"web,FRONTEND,,,3,9\n" +
+		"web,a,0,0,2,5\n" +
+		"web,b,0,0,0,5\n"
+	n, err := haproxySessions(stat, "web", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 sessions, got %d", n)
+	}
+	n, err = haproxySessions(stat, "web", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected 0 sessions, got %d", n)
+	}
+	if _, err = haproxySessions(stat, "api", "a"); err == nil {
+		t.Fatal("expected error")
+	}
+}
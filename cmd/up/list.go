@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// listCmd prints the commands and aliases defined in an Upfile.
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile")
+	quiet := fs.Bool("q", false, "print only names (default false)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fi, err := os.Open(*upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	printList(os.Stdout, conf, *quiet)
+	return nil
+}
+
+// printList writes commands in the order they're defined in the Upfile,
+// followed by aliases sorted by name. Variables, i.e. commands only ever
+// substituted into other commands, aren't listed. Unless quiet, commands are
+// followed by their descriptions.
+func printList(out io.Writer, conf *up.Config, quiet bool) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	roots := map[up.CmdName]struct{}{}
+	for _, name := range conf.Roots() {
+		roots[name] = struct{}{}
+	}
+	for _, node := range conf.File().Commands {
+		name := up.CmdName(node.Name.Name)
+		if _, ok := roots[name]; !ok {
+			continue
+		}
+		desc := conf.Commands[name].Description
+		switch {
+		case quiet:
+			fmt.Fprintln(w, name)
+		case name == conf.DefaultCommand:
+			fmt.Fprintf(w, "%s (default)\t%s\n", name, desc)
+		default:
+			fmt.Fprintf(w, "%s\t%s\n", name, desc)
+		}
+	}
+	aliases := make([]string, 0, len(conf.Aliases))
+	for alias := range conf.Aliases {
+		aliases = append(aliases, string(alias))
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if quiet {
+			fmt.Fprintln(w, alias)
+			continue
+		}
+		target := conf.Aliases[up.CmdName(alias)]
+		fmt.Fprintf(w, "%s -> %s\n", alias, target)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// lockFile returns immediately. Files can't be locked on this platform, so
+// concurrent up processes may repeat each other's prerequisites.
+func lockFile(pth string, waiting func()) (func() error, error) {
+	return func() error { return nil }, nil
+}
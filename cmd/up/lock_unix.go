@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at pth, creating it if needed,
+// and returns a func to release it. The lock is shared with other up
+// processes on this machine, and released by the OS if the process dies. If
+// another process holds the lock, waiting is called before blocking until
+// it's released.
+func lockFile(pth string, waiting func()) (func() error, error) {
+	fi, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock: %w", err)
+	}
+	fd := int(fi.Fd())
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		waiting()
+		err = syscall.Flock(fd, syscall.LOCK_EX)
+	}
+	if err != nil {
+		fi.Close()
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+	return fi.Close, nil
+}
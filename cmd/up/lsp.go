@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// lspCmd runs a minimal language server for Upfiles over stdio. It publishes
+// diagnostics from the parser, completes command and variable names, and
+// shows a variable's expansion on hover.
+func lspCmd(args []string) error {
+	srv := newLSPServer(os.Stdout)
+	return srv.serve(os.Stdin)
+}
+
+// lspServer holds the open documents of a single client.
+type lspServer struct {
+	out  io.Writer
+	docs map[string]*lspDoc
+}
+
+// lspDoc is an open Upfile. conf is the last version which parsed
+// successfully, so completion keeps working while the user types.
+type lspDoc struct {
+	text string
+	conf *up.Config
+}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+
+	lspCompletionFunction = 3
+	lspCompletionVariable = 6
+)
+
+func newLSPServer(out io.Writer) *lspServer {
+	return &lspServer{out: out, docs: map[string]*lspDoc{}}
+}
+
+// serve handles requests until the client sends "exit" or closes the input.
+func (s *lspServer) serve(in io.Reader) error {
+	rdr := bufio.NewReader(in)
+	for {
+		byt, err := readLSPMessage(rdr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		var req lspRequest
+		if err = json.Unmarshal(byt, &req); err != nil {
+			return fmt.Errorf("unmarshal: %w", err)
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			// Notifications never receive a response
+			continue
+		}
+		resp := lspResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+		if err != nil {
+			resp.Error = &lspError{
+				Code:    -32603, // Internal error
+				Message: err.Error(),
+			}
+		}
+		if err = s.write(resp); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+}
+
+func (s *lspServer) handle(req lspRequest) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": 1, // Full
+				"hoverProvider":    true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"$"},
+				},
+			},
+			"serverInfo": map[string]string{"name": "up"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		doc := params.TextDocument
+		return nil, s.update(doc.URI, doc.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		changes := params.ContentChanges
+		if len(changes) == 0 {
+			return nil, nil
+		}
+		text := changes[len(changes)-1].Text
+		return nil, s.update(params.TextDocument.URI, text)
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return nil, s.publish(params.TextDocument.URI,
+			[]lspDiagnostic{})
+	case "textDocument/completion":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		return s.complete(params.TextDocument.URI), nil
+	case "textDocument/hover":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		return s.hover(params.TextDocument.URI, params.Position), nil
+	default:
+		if req.ID == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unsupported method: %s", req.Method)
+	}
+}
+
+// update a document's text, reparse it, and publish diagnostics.
+func (s *lspServer) update(uri, text string) error {
+	doc, ok := s.docs[uri]
+	if !ok {
+		doc = &lspDoc{}
+		s.docs[uri] = doc
+	}
+	doc.text = text
+	diags := []lspDiagnostic{}
+	conf, err := up.ParseUpfile(strings.NewReader(text))
+	if err != nil {
+		diag := lspDiagnostic{
+			Severity: lspSeverityError,
+			Source:   "up",
+			Message:  err.Error(),
+		}
+		var synErr *up.SyntaxError
+		if errors.As(err, &synErr) {
+			diag.Message = synErr.Msg
+			diag.Range = lineRange(text, synErr.Pos.Line)
+		}
+		diags = append(diags, diag)
+	} else {
+		doc.conf = conf
+		for _, w := range conf.Warnings {
+			diags = append(diags, lspDiagnostic{
+				Range:    lineRange(text, w.Line),
+				Severity: lspSeverityWarning,
+				Source:   "up",
+				Message:  w.Msg,
+			})
+		}
+	}
+	return s.publish(uri, diags)
+}
+
+func (s *lspServer) publish(uri string, diags []lspDiagnostic) error {
+	return s.write(lspNotification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params: map[string]interface{}{
+			"uri":         uri,
+			"diagnostics": diags,
+		},
+	})
+}
+
+// complete reports every command name in the document with its description.
+// Commands which may be substituted are offered as variables.
+func (s *lspServer) complete(uri string) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	doc, ok := s.docs[uri]
+	if !ok || doc.conf == nil {
+		return items
+	}
+	names := make([]string, 0, len(doc.conf.Commands))
+	for name := range doc.conf.Commands {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := doc.conf.Commands[up.CmdName(name)]
+		kind := lspCompletionVariable
+		if !cmd.Variable() {
+			kind = lspCompletionFunction
+		}
+		item := map[string]interface{}{
+			"label":  name,
+			"kind":   kind,
+			"detail": strings.Join(cmd.Execs, "\n"),
+		}
+		if cmd.Description != "" {
+			item["documentation"] = cmd.Description
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// hover shows the description and expansion of the command or variable under
+// the cursor.
+func (s *lspServer) hover(uri string, pos lspPosition) interface{} {
+	doc, ok := s.docs[uri]
+	if !ok || doc.conf == nil {
+		return nil
+	}
+	word := wordAt(doc.text, pos)
+	cmd, ok := doc.conf.Commands[up.CmdName(word)]
+	if !ok {
+		return nil
+	}
+	text := strings.Join(cmd.Execs, "\n")
+	if cmd.Variable() {
+		scp := newScope(nil, doc.conf.Commands)
+		expanded, err := scp.substitute(text)
+		if err == nil {
+			text = expanded
+		}
+	}
+	value := "```sh\n" + text + "\n```"
+	if cmd.Description != "" {
+		value = cmd.Description + "\n\n" + value
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{
+			"kind":  "markdown",
+			"value": value,
+		},
+	}
+}
+
+func (s *lspServer) write(msg interface{}) error {
+	byt, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(byt),
+		byt)
+	return err
+}
+
+// readLSPMessage reads the headers and body of a single message.
+func readLSPMessage(rdr *bufio.Reader) ([]byte, error) {
+	hdr, err := textproto.NewReader(rdr).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF && len(hdr) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	length, err := strconv.Atoi(hdr.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid content length: %w", err)
+	}
+	byt := make([]byte, length)
+	if _, err = io.ReadFull(rdr, byt); err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return byt, nil
+}
+
+// lineRange covers the full 1-indexed line within text.
+func lineRange(text string, line int) lspRange {
+	lines := strings.Split(text, "\n")
+	var length int
+	if line > 0 && line <= len(lines) {
+		length = len(lines[line-1])
+	}
+	return lspRange{
+		Start: lspPosition{Line: line - 1},
+		End:   lspPosition{Line: line - 1, Character: length},
+	}
+}
+
+// wordAt reports the command or variable name surrounding a position.
+func wordAt(text string, pos lspPosition) string {
+	lines := strings.Split(text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return ""
+	}
+	line := []byte(lines[pos.Line])
+	if pos.Character < 0 || pos.Character > len(line) {
+		return ""
+	}
+	isWord := func(b byte) bool {
+		return b == '_' || b == '-' || b == '.' ||
+			(b >= '0' && b <= '9') ||
+			(b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+	}
+	start, end := pos.Character, pos.Character
+	for start > 0 && isWord(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWord(line[end]) {
+		end++
+	}
+	return string(line[start:end])
+}
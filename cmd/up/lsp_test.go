@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLSP(t *testing.T) {
+	t.Parallel()
+	var in bytes.Buffer
+	send := func(id int, method string, params interface{}) {
+		msg := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  method,
+			"params":  params,
+		}
+		if id > 0 {
+			msg["id"] = id
+		}
+		byt, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(byt), byt)
+	}
+	doc := map[string]string{"uri": "file:///Upfile"}
+	send(1, "initialize", map[string]interface{}{})
+	send(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{
+			"uri": doc["uri"],
+			"text": "deploy\n\tssh $remote\n\n" +
+				"## The ssh destination\n" +
+				"remote\n\t$user@$server\n\n" +
+				"user\n\troot\n\n" +
+				"unused\n\ttrue\n",
+		},
+	})
+	send(2, "textDocument/hover", map[string]interface{}{
+		"textDocument": doc,
+		"position":     map[string]int{"line": 1, "character": 8},
+	})
+	send(3, "textDocument/completion", map[string]interface{}{
+		"textDocument": doc,
+		"position":     map[string]int{"line": 1, "character": 6},
+	})
+	send(0, "exit", nil)
+
+	var out bytes.Buffer
+	if err := newLSPServer(&out).serve(&in); err != nil {
+		t.Fatal(err)
+	}
+	rdr := bufio.NewReader(&out)
+	var msgs []string
+	for {
+		byt, err := readLSPMessage(rdr)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(byt))
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d: %v", len(msgs), msgs)
+	}
+	if !strings.Contains(msgs[1], "unused is never used") {
+		t.Fatalf("expected unused diagnostic, got %s", msgs[1])
+	}
+	if !strings.Contains(msgs[2], "root@$server") ||
+		!strings.Contains(msgs[2], "The ssh destination") {
+		t.Fatalf("expected expanded hover, got %s", msgs[2])
+	}
+	for _, name := range []string{"deploy", "remote", "user", "unused"} {
+		if !strings.Contains(msgs[3], `"label":"`+name+`"`) {
+			t.Fatalf("expected %s completion, got %s", name,
+				msgs[3])
+		}
+	}
+}
@@ -2,25 +2,29 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/base64"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/progress"
 )
 
 type flags struct {
+	// runFlags configure how the plan runs and who learns about it,
+	// shared with up apply.
+	runFlags
+
 	// Upfile allows you to specify a different Upfile name. This is
 	// helpful when running across multiple operating systems or shells.
 	// For example, you may have Upfile.windows.toml and Upfile.linux.toml,
@@ -39,55 +43,169 @@ type flags struct {
 	Tags map[string]struct{}
 
 	// Serial determines how many servers of the same type will be operated
-	// on at any one time. This defaults to 1. Use 0 to specify all of
-	// them.
-	Serial int
+	// on at any one time, either a number or a percentage of each tag's
+	// hosts. This defaults to 1. Use 0 to specify all of them.
+	Serial serial
 
 	// Directory used to calculate the checksum. Defaults to the current
 	// directory.
 	Directory string
 
+	// ChecksumOpts choose how Directory is hashed.
+	ChecksumOpts checksumOpts
+
+	// VersionFrom names where $checksum comes from, "checksum", "git" or
+	// "file:PATH", overriding the command's version in the Upfile.
+	VersionFrom string
+
+	// VersionID is used as $checksum instead of calculating it.
+	VersionID string
+
+	// DeployID identifies the deploy. CI may pass the same ID when it
+	// retries a pipeline, so the retry can be recognized. It's generated
+	// if empty.
+	DeployID string
+
 	// Vars passed into `up` at runtime to be used in start commands.
 	Vars map[string]string
 
 	// Stdin instructs `up` to read from stdin, achieved with `up -`.
 	Stdin bool
 
-	// Verbose will log full commands, even when they're very log. By
-	// default `up` truncates commands to 80 characters when logging,
-	// except in the case of a failure where the full command is displayed.
-	Verbose bool
+	// Warn prints any warnings found while parsing the Upfile.
+	Warn bool
+
+	// Validate the Upfile and inventory, then exit without running any
+	// commands.
+	Validate bool
+
+	// Werror treats warnings as errors when validating.
+	Werror bool
+
+	// ValidateFormat is "text", or "sarif" or "github" to write findings
+	// for machines to read.
+	ValidateFormat string
+
+	// NoopExec is a path to which a plan is written instead of running
+	// any commands. The plan can be run later with `up apply`.
+	NoopExec string
+
+	// Sign the plan written by NoopExec with this SSH key. If it's a
+	// public key, ssh-agent must hold the private key.
+	Sign string
+
+	// Hosts limits the inventory to hosts matching any of these CIDRs or
+	// globs, in addition to their tags.
+	Hosts []hostPattern
+
+	// State is a command run on each server after its Execs succeed,
+	// with the server's up.State as JSON in $state.
+	State up.CmdName
+
+	// Plugins are paths to executables providing variables or hosts,
+	// loaded before the inventory is read.
+	Plugins []string
+
+	// SpreadBy is "zone" or "region". Each tag's batches take hosts from
+	// each zone or region in turn, so no batch takes down a whole zone
+	// if it can be avoided.
+	SpreadBy string
 
-	// Prompt instructs `up` to wait for input before moving onto the next
-	// batch.
-	Prompt bool
+	// StrictTags fails if any tag given with -t matches no hosts, rather
+	// than warning and deploying to the tags which do. It's implied by
+	// Strict.
+	StrictTags bool
+
+	// Profiles are files to which CPU, memory and execution trace
+	// profiles of the deploy are written, to find what's slow.
+	Profiles profiles
 }
 
 type batch map[string][][]string
 
-type result struct {
-	server string
-	err    error
-}
+// version of up, recorded in each host's state. Release builds set it with
+// -ldflags "-X main.version=v1.2.3".
+var version = "devel"
 
 func main() {
 	log.SetFlags(0)
+	setLogOutput(os.Stderr, time.Local)
 	rand.Seed(time.Now().UnixNano())
 
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	log.Println("success")
+}
+
+// subcommands which may be passed as the first argument to up, e.g. `up lsp`.
+// Each receives the remaining arguments.
+var subcommands = map[string]func(args []string) error{
+	"apply":          applyCmd,
+	"check":          healthCmd,
+	"facts":          factsCmd,
+	"import-ansible": importAnsibleCmd,
+	"init":           initCmd,
+	"inventory":      inventoryCmd,
+	"lb":             lbCmd,
+	"list":           listCmd,
+	"lsp":            lspCmd,
+	"maintenance":    maintenanceCmd,
+	"plan":           planCmd,
+	"promote":        promoteCmd,
+	"reboot":         rebootCmd,
+	"replay":         replayCmd,
+	"agent":          agentCmd,
+	"run":            adhocCmd,
+	"status":         statusCmd,
+	"vars":           varsCmd,
 }
 
 func run() error {
-	flgs, err := parseFlags()
+	if len(os.Args) > 1 {
+		if fn, ok := subcommands[os.Args[1]]; ok {
+			return fn(os.Args[2:])
+		}
+	}
+	flgs, err := parseFlags(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		return usage(fmt.Errorf("parse flags: %w", err))
 	}
+	stop, err := flgs.Profiles.start()
+	if err != nil {
+		return err
+	}
+	err = deploy(flgs)
+	if stopErr := stop(); stopErr != nil && err == nil {
+		err = fmt.Errorf("profile: %w", stopErr)
+	}
+	if err != nil {
+		return err
+	}
 
-	var upFi io.ReadCloser
+	// Only deploys report success, since subcommands such as `up list -q`
+	// print output meant for other programs
+	log.Println("success")
+	return nil
+}
+
+// deploy runs the command from the Upfile across the inventory as described by
+// the flags.
+func deploy(flgs flags) error {
+	var (
+		upFi       io.ReadCloser
+		statusLine io.Writer
+		err        error
+	)
+	setLogOutput(os.Stderr, flgs.Timestamps)
+	if flgs.StatusLine != "" {
+		fi, err := startStatusLine(flgs.StatusLine, flgs.Timestamps)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		statusLine = fi
+	}
 	if flgs.Stdin {
 		upFi = os.Stdin
 	} else {
@@ -97,8 +215,23 @@ func run() error {
 		}
 		defer upFi.Close()
 	}
-	conf, err := up.ParseUpfile(upFi)
+
+	// Hash the Upfile and inventory as they're read, so plans can detect
+	// if either changed before they're applied.
+	upByt, err := ioutil.ReadAll(upFi)
 	if err != nil {
+		return fmt.Errorf("read upfile: %w", err)
+	}
+	conf, err := up.ParseUpfile(bytes.NewReader(upByt))
+	if err != nil {
+		if flgs.Validate && flgs.ValidateFormat != "text" {
+			findings := upfileFindings(nil, err)
+			if err := writeFindings(os.Stdout, flgs.ValidateFormat,
+				flgs.Upfile, findings); err != nil {
+				log.Printf("failed to write findings: %s\n",
+					err)
+			}
+		}
 		return fmt.Errorf("parse upfile: %w", err)
 	}
 
@@ -108,127 +241,600 @@ func run() error {
 		return fmt.Errorf("open inventory: %w", err)
 	}
 	defer invFi.Close()
-	inventory, err := up.ParseInventory(invFi)
+	invByt, err := ioutil.ReadAll(invFi)
+	if err != nil {
+		return fmt.Errorf("read inventory: %w", err)
+	}
+	invFile, err := up.ParseInventoryFile(bytes.NewReader(invByt))
 	if err != nil {
 		return fmt.Errorf("parse inventory: %w", err)
 	}
 
-	if flgs.Command != "" && flgs.Upfile != "-" {
-		conf.DefaultCommand = flgs.Command
-		if _, exist := conf.Commands[conf.DefaultCommand]; !exist {
-			return fmt.Errorf("undefined command: %s", conf.DefaultCommand)
+	deployID := flgs.DeployID
+	if deployID == "" {
+		if deployID, err = newDeployID(); err != nil {
+			return fmt.Errorf("new deploy id: %w", err)
 		}
 	}
-	lims := []string{}
-	for lim := range flgs.Tags {
-		lims = append(lims, string(lim))
+
+	if err = useCommand(conf, flgs.Command); err != nil {
+		return err
 	}
-	tmp := strings.Join(lims, ", ")
-	if tmp == "" {
-		tmp = string(conf.DefaultCommand)
+
+	// Plugins may add hosts and variables, so load them before either is
+	// used
+	name := conf.DefaultCommand
+	if flgs.Strict {
+		flgs.Vars = declaredVars(conf, flgs.Vars, name, flgs.State)
+	}
+	err = loadPlugins(flgs.Plugins, invFile, flgs.Vars, name, deployID,
+		flgs.Tags)
+	if err != nil {
+		return fmt.Errorf("plugin: %w", err)
+	}
+	inventory := invFile.Hosts
+
+	// Resolve each host's settings before filtering the inventory, since
+	// settings may be declared on tags which aren't being run.
+	settings := make(map[string]up.Settings, len(inventory))
+	for host := range inventory {
+		settings[host] = invFile.Settings(host)
+	}
+	transports, err := makeTransports(settings)
+	if err != nil {
+		return fmt.Errorf("make transports: %w", err)
 	}
 
 	if _, exist := inventory["all"]; exist {
 		return errors.New("reserved keyword 'all' cannot be inventory name")
 	}
+	if _, exist := invFile.TagSettings["all"]; exist {
+		return errors.New("reserved keyword 'all' cannot be a tag")
+	}
+	if _, exist := invFile.Groups["all"]; exist {
+		return errors.New("reserved keyword 'all' cannot be a group")
+	}
+	if flgs.Validate {
+		return validate(conf, flgs)
+	}
+	if flgs.Warn {
+		printWarnings(conf.Warnings)
+	}
 
-	// Default the tags equal to the command name, which makes the
-	// following work: `upgen my_app | up -`
-	if len(flgs.Tags) == 0 {
-		flgs.Tags[string(conf.DefaultCommand)] = struct{}{}
+	// Fail before anything runs rather than sending broken shell to
+	// servers mid-deploy
+	roots := []up.CmdName{conf.DefaultCommand}
+	if flgs.State != "" {
+		roots = append(roots, flgs.State)
+	}
+	missing := missingVars(conf, flgs.Vars, roots...)
+	if len(missing) > 0 && !flgs.Strict && !flgs.Stdin &&
+		isTerminal(os.Stdin) {
+		err = promptVars(terminalReader(os.Stdin, os.Stdout),
+			os.Stdout, conf, flgs.Vars, missing)
+		if err != nil {
+			return fmt.Errorf("prompt: %w", err)
+		}
+		missing = nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required variables: %s",
+			strings.Join(missing, ", "))
+	}
+	if err := checkVars(conf, flgs.Vars); err != nil {
+		return err
 	}
 
-	// Remove any unnecessary inventory. All remaining defined inventory
-	// will be used.
-	if _, exist := flgs.Tags["all"]; !exist {
-		for ip, tags := range inventory {
-			var found bool
-			for _, t := range tags {
-				if _, exist := flgs.Tags[t]; exist {
-					found = true
-					break
-				}
-			}
-			if !found {
-				delete(inventory, ip)
-			}
+	// Tags matching no hosts are likely typos, which would otherwise
+	// silently deploy to fewer hosts than intended
+	var unmatched []string
+	if _, all := flgs.Tags["all"]; !all {
+		unmatched, err = undefinedTags(invFile, setKeys(flgs.Tags))
+		if err != nil {
+			return err
+		}
+	}
+	if len(unmatched) > 0 {
+		if flgs.StrictTags {
+			return fmt.Errorf("tags not defined in inventory: %s",
+				strings.Join(unmatched, ", "))
 		}
+		log.Printf("warning: tags match no hosts: %s\n",
+			strings.Join(unmatched, ", "))
+	}
+	jobs, err := makeJobs(invFile, conf, flgs)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return errors.New("no runs match the given tags")
+	}
+	for _, j := range jobs {
+		err = checkPolicy(flgs.Policy, flgs.Identity, j.command,
+			inventoryTags(j.inventory))
+		if err != nil {
+			return fmt.Errorf("check policy: %w", err)
+		}
+		log.Printf("running %s on %s\n", j.command,
+			strings.Join(j.tags, ", "))
 	}
 
-	// Remove any tags which are not in the provided flags, as we'll be
-	// ignoring those
-	for ip, tags := range inventory {
-		var newTags []string
-		for _, t := range tags {
-			if _, exist := flgs.Tags[t]; !exist {
-				continue
+	// Calculate a checksum on the provided directory (defaults to
+	// current directory), or read its commit if the command is versioned
+	// by git
+	from := flgs.VersionFrom
+	if cmd, ok := conf.Commands[conf.DefaultCommand]; ok && from == "" {
+		from = cmd.Version
+	}
+	src, err := newVersionSource(from, flgs.VersionID, flgs.Directory,
+		flgs.ChecksumOpts)
+	if err != nil {
+		return err
+	}
+	log.Printf("calculating version\n")
+	chk, err := src.version()
+	if err != nil {
+		return fmt.Errorf("calc version: %w", err)
+	}
+	log.Printf("deploy %s\n", deployID)
+	scp := newScope(flgs.Vars, conf.Commands).with("checksum", chk).
+		with("deploy_id", deployID).withInventory(invFile)
+	if flgs.Strict {
+		scp = scp.withStrict()
+	}
+
+	// Monorepos may name a checksum for each service, e.g.
+	// $checksum.app, so services which didn't change needn't deploy
+	base := "."
+	if !flgs.Stdin {
+		base = filepath.Dir(flgs.Upfile)
+	}
+	sums, err := namedChecksums(conf.Checksums, base, flgs.ChecksumOpts)
+	if err != nil {
+		return fmt.Errorf("calc checksum: %w", err)
+	}
+	for name, sum := range sums {
+		scp = scp.with(name, sum)
+	}
+
+	var zones map[string]string
+	if flgs.SpreadBy != "" {
+		zones = hostZones(settings, flgs.SpreadBy)
+	}
+
+	// Plan each job, merging them into a single plan so composite
+	// commands run all of their commands concurrently
+	p := &plan{
+		Command:   conf.DefaultCommand,
+		Checksum:  chk,
+		DeployID:  deployID,
+		Hosts:     map[string]up.Settings{},
+		Unmatched: unmatched,
+	}
+	if cmd, ok := conf.Commands[conf.DefaultCommand]; ok {
+		p.Description = cmd.Description
+	}
+	for _, j := range jobs {
+		// Split into batches limited in size by the provided Serial
+		// flag.
+		batches, err := makeBatches(conf, j.inventory, flgs.Serial,
+			zones)
+		if err != nil {
+			return fmt.Errorf("make batches: %w", err)
+		}
+		log.Printf("got batches: %v\n", batches)
+
+		jobPlan, err := makePlan(conf, j.command, scp, chk, batches,
+			settings)
+		if err != nil {
+			return fmt.Errorf("make plan: %w", err)
+		}
+		p.merge(jobPlan)
+	}
+	if flgs.State != "" {
+		err = p.addState(conf, conf.Resolve(flgs.State), scp, version)
+		if err != nil {
+			return fmt.Errorf("add state: %w", err)
+		}
+	}
+	if err = p.addMaintenance(conf, scp); err != nil {
+		return fmt.Errorf("add maintenance: %w", err)
+	}
+	p.Upfile = newPlanFile(flgs.Upfile, upByt)
+	p.Inventory = newPlanFile(flgs.Inventory, invByt)
+	if flgs.NoopExec != "" {
+		if err = writePlan(flgs.NoopExec, p); err != nil {
+			return fmt.Errorf("write plan: %w", err)
+		}
+		if flgs.Sign != "" {
+			if err = signPlan(flgs.NoopExec, flgs.Sign); err != nil {
+				return fmt.Errorf("sign plan: %w", err)
 			}
-			newTags = append(newTags, t)
 		}
-		inventory[ip] = newTags
+		printPlan(os.Stdout, p)
+		log.Printf("wrote plan to %s\n", flgs.NoopExec)
+		return nil
 	}
-
-	// Validate all tags are defined in inventory (i.e. no silent failure
-	// on typos).
-	if len(inventory) == 0 {
-		msg := fmt.Sprintf("tags not defined in inventory: ")
-		for l := range flgs.Tags {
-			msg += fmt.Sprintf("%s, ", l)
+	if !flgs.IgnoreMaintenance {
+		if err = checkMaintenance(p, transports); err != nil {
+			return err
 		}
-		return errors.New(strings.TrimSuffix(msg, ", "))
 	}
+	var prm *prompter
+	if flgs.Prompt {
+		prm, err = newPrompter(flgs.PromptAuto, flgs.PromptTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	rep, err := flgs.reporting(conf.DefaultCommand, flgs.Directory,
+		statusLine)
+	if err != nil {
+		return err
+	}
+	return flgs.runner(transports, p.Checksum).runReported(p, prm, rep)
+}
+
+// reporting describes who learns about a deploy and how, beyond its logs.
+type reporting struct {
+	// record is a directory for transcripts. If empty, transcripts are
+	// only kept long enough to summarize.
+	record string
+
+	deployment *deployment
+	annotate   annotators
+	identity   string
+	mail       *mailer
 
-	log.Printf("running %s on %s\n", conf.DefaultCommand, tmp)
+	// html and junit are files to which reports are written.
+	html  string
+	junit string
 
-	// Calculate a sha256 checksum on the provided directory (defaults to
-	// current directory).
-	log.Printf("calculating checksum\n")
-	chk, err := calcChecksum(flgs.Directory)
+	// maxOutput is how many bytes of each server's output, the last
+	// written, are kept in summaries. Zero keeps everything.
+	maxOutput int
+
+	// progress is a file to which progress events are written as lines
+	// of JSON.
+	progress string
+
+	// statusLine receives the output of commands, while stdout only
+	// receives a line for each progress event, unless nil.
+	statusLine io.Writer
+}
+
+// defaultReportMaxOutput keeps the last 64 KiB of each server's output in
+// reports, so emailing a report on thousands of servers doesn't exhaust
+// memory.
+const defaultReportMaxOutput = 64 << 10
+
+// summarized reports whether anything needs a summary of the deploy once it
+// finishes.
+func (rep reporting) summarized() bool {
+	return rep.mail != nil || rep.html != "" || rep.junit != ""
+}
+
+// runReported runs the plan like runPlan, recording its transcripts,
+// tracking its deployment, annotating dashboards and mailing a summary as
+// configured.
+func (r *runner) runReported(p *plan, prm *prompter, rep reporting) error {
+	dir := rep.record
+	if dir == "" && rep.summarized() {
+		tmp, err := ioutil.TempDir("", "up-record")
+		if err != nil {
+			return fmt.Errorf("make temp dir: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	var err error
+	r.rec, err = newRecorder(dir)
 	if err != nil {
-		return fmt.Errorf("calc checksum: %w", err)
+		return fmt.Errorf("record: %w", err)
+	}
+	var prog *progress.Encoder
+	if rep.progress != "" {
+		fi, err := os.OpenFile(rep.progress,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("open progress: %w", err)
+		}
+		defer fi.Close()
+		prog = progress.NewEncoder(fi)
+		r.progress = prog.Callbacks()
+	}
+	if rep.statusLine != nil {
+		lines := &statusLines{out: os.Stdout, plan: p}
+		r.progress = joinProgress(r.progress, lines.callbacks())
+		r.output = rep.statusLine
 	}
+	if err = rep.deployment.start(p.Checksum, p.DeployID); err != nil {
+		return err
+	}
+	ann := newAnnotation(p, rep.identity)
+	rep.annotate.start(ann)
+	start := time.Now()
+	err = r.runPlan(p, prm)
+	took := time.Since(start)
+	end := progress.End{
+		Time:     time.Now(),
+		Command:  string(p.Command),
+		Checksum: p.Checksum,
+		DeployID: p.DeployID,
+		Took:     took,
+	}
+	if err != nil {
+		end.Err = err.Error()
+	}
+	r.progress.DeployEnd(end)
+	if err != nil {
+		log.Printf("%s failed after %s\n", p.Command,
+			roundDuration(took))
+	} else {
+		log.Printf("%s finished in %s\n", p.Command,
+			roundDuration(took))
+	}
+	rep.annotate.finish(ann, err)
+	rep.deployment.finish(err)
+	if recErr := r.rec.close(); recErr != nil && err == nil {
+		err = fmt.Errorf("record: %w", recErr)
+	}
+	if prog != nil && prog.Err() != nil && err == nil {
+		err = fmt.Errorf("progress: %w", prog.Err())
+	}
+	if !rep.summarized() {
+		return err
+	}
+	ann.Done, ann.Err = true, err
+	events, readErr := readTranscripts(dir, rep.maxOutput)
+	if readErr != nil {
+		log.Printf("failed to read transcripts: %s\n", readErr)
+	}
+	sum := report{
+		annotation:  ann,
+		Description: p.Description,
+		Start:       start,
+		Took:        took,
+		Events:      events,
+		Skipped:     r.skipped,
+		Unmatched:   p.Unmatched,
+		Groups:      p.Groups,
+	}
+	if rep.html != "" {
+		if htmlErr := saveHTMLReport(rep.html, sum); htmlErr != nil {
+			log.Printf("failed to write html report: %s\n", htmlErr)
+		}
+	}
+	if rep.junit != "" {
+		junitErr := saveJUnitReport(rep.junit, sum)
+		if junitErr != nil {
+			log.Printf("failed to write junit report: %s\n",
+				junitErr)
+		}
+	}
+	if rep.mail != nil {
+		if mailErr := rep.mail.mail(sum); mailErr != nil {
+			log.Printf("failed to email summary: %s\n", mailErr)
+		}
+	}
+	return err
+}
 
-	// Split into batches limited in size by the provided Serial flag.
-	batches, err := makeBatches(conf, inventory, flgs.Serial)
+// validate reports any warnings in the Upfile, logging them or writing them
+// to stdout in flgs.ValidateFormat. With flgs.Werror, warnings are treated as
+// errors.
+func validate(conf *up.Config, flgs flags) error {
+	if flgs.ValidateFormat == "text" {
+		printWarnings(conf.Warnings)
+	} else {
+		err := writeFindings(os.Stdout, flgs.ValidateFormat,
+			flgs.Upfile, upfileFindings(conf, nil))
+		if err != nil {
+			return fmt.Errorf("write findings: %w", err)
+		}
+	}
+	if flgs.Werror && len(conf.Warnings) > 0 {
+		return fmt.Errorf("%d warnings", len(conf.Warnings))
+	}
+	return nil
+}
+
+func printWarnings(warns []up.Warning) {
+	for _, w := range warns {
+		log.Printf("warning: %s\n", w)
+	}
+}
+
+// runner executes plans. It's shared across the goroutines running a plan's
+// batches, so it's only modified before they start: runReported sets rec,
+// progress and output, and runPlan sets skipped.
+type runner struct {
+	transports map[string]transport
+	verbose    bool
+	cache      buildCache
+	checks     checkCache
+	rate       *rateLimiter
+	sched      *scheduler
+	workers    int
+	runOnce    bool
+	failures   *failureInjector
+
+	// allExecIfs runs every ExecIf step rather than stopping at the
+	// first which fails.
+	allExecIfs bool
+	rec        *recorder
+
+	// skipUnreachable hosts found by a preflight check, which are
+	// recorded in skipped.
+	skipUnreachable bool
+	skipped         []string
+
+	// failUnreachable fails before anything runs if the preflight check
+	// finds any unreachable hosts.
+	failUnreachable bool
+
+	// transportRetries of commands which fail to reach their server.
+	transportRetries int
+
+	// env replaces the environment of local commands unless nil.
+	env []string
+
+	// localUser runs steps on this machine which don't name a user with
+	// "as USER:", unless empty.
+	localUser string
+
+	// progress is told when each batch starts and finishes, and when the
+	// deploy ends.
+	progress progress.Callbacks
+
+	// output receives the output of commands rather than stdout and
+	// stderr, unless nil.
+	output io.Writer
+}
+
+// transportRetryDelay is how long to wait before the first retry of a
+// command which failed to reach its server. Each later retry waits longer.
+var transportRetryDelay = time.Second
+
+// makeTransports for every host given its settings.
+func makeTransports(
+	settings map[string]up.Settings,
+) (map[string]transport, error) {
+	transports := make(map[string]transport, len(settings))
+	for host, s := range settings {
+		t, err := newTransport(host, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		transports[host] = t
+	}
+	return transports, nil
+}
+
+// selectHosts reads the inventory and reports the transport of each host
+// selected by the comma-separated tags, for subcommands which run a single
+// command everywhere rather than deploying. The policy must allow running
+// the command on them.
+func selectHosts(
+	inventory string,
+	name up.CmdName,
+	tags string,
+	pol *policyFlags,
+) (map[string]transport, error) {
+	fi, err := os.Open(inventory)
 	if err != nil {
-		return fmt.Errorf("make batches: %w", err)
+		return nil, fmt.Errorf("open inventory: %w", err)
 	}
-	log.Printf("got batches: %v\n", batches)
+	defer fi.Close()
+	invFile, err := up.ParseInventoryFile(fi)
+	if err != nil {
+		return nil, fmt.Errorf("parse inventory: %w", err)
+	}
+	j, err := makeJob(invFile, name, strings.Split(tags, ","), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = pol.check(name, inventoryTags(j.inventory)); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]up.Settings, len(j.inventory))
+	for host := range j.inventory {
+		settings[host] = invFile.Settings(host)
+	}
+	transports, err := makeTransports(settings)
+	if err != nil {
+		return nil, fmt.Errorf("make transports: %w", err)
+	}
+	return transports, nil
+}
+
+// transport reports how to run commands for a server, defaulting to running
+// them locally.
+func (r *runner) transport(server string) transport {
+	if t, ok := r.transports[server]; ok {
+		return t
+	}
+	return localTransport{}
+}
+
+// runPlan runs each group's batches concurrently, stopping at the first error.
+func (r *runner) runPlan(p *plan, prm *prompter) error {
+	if r.failures != nil {
+		log.Println("simulating failures: chosen servers will fail " +
+			"without running")
+	}
+	if r.failUnreachable {
+		dead := unreachableHosts(p.Hosts, preflightTimeout)
+		if len(dead) > 0 {
+			return fmt.Errorf("unreachable hosts: %s",
+				strings.Join(dead, ", "))
+		}
+	}
+	if r.skipUnreachable {
+		r.skipped = unreachableHosts(p.Hosts, preflightTimeout)
+		if len(r.skipped) > 0 {
+			log.Printf("skipping unreachable hosts: %s\n",
+				strings.Join(r.skipped, ", "))
+			p.without(r.skipped)
+			if len(p.Groups) == 0 {
+				return errors.New("every host is unreachable")
+			}
+			defer log.Printf("skipped %d unreachable hosts: %s\n",
+				len(r.skipped), strings.Join(r.skipped, ", "))
+		}
+	}
+	if len(p.Unmatched) > 0 {
+		defer log.Printf("tags matched no hosts: %s\n",
+			strings.Join(p.Unmatched, ", "))
+	}
+
+	// Run prerequisites once locally before any group, ignoring host
+	// transports.
+	local := &runner{
+		verbose:   r.verbose,
+		failures:  r.failures,
+		rec:       r.rec,
+		env:       r.env,
+		localUser: r.localUser,
+	}
+	for _, g := range p.Needs {
+		if err := r.runNeed(local, p.Checksum, g); err != nil {
+			return err
+		}
+	}
+
+	// Operators may pause new batches with SIGUSR1 and resume them with
+	// SIGUSR2
+	pause := newPauser()
+	defer watchPauseSignals(pause)()
 
 	// For each batch, run the ExecIfs and run Execs if necessary.
-	done := make(chan struct{}, len(batches))
-	crash := make(chan error)
-	defer close(crash)
-	for _, srvBatch := range batches {
+	done := make(chan struct{}, len(p.Groups))
+	crash := make(chan error, len(p.Groups))
+	for _, g := range p.Groups {
 		// Schedule our next batch to run
-		go func(srvBatch [][]string) {
-			for i, srvGroup := range srvBatch {
-				ch := make(chan result, len(srvGroup))
-				srvGroup = randomizeOrder(srvGroup)
-				cmd := conf.Commands[conf.DefaultCommand]
-				runExecIfs(ch, flgs.Vars, conf.Commands, cmd,
-					chk, srvGroup, flgs.Verbose)
-				for j := 0; j < len(srvGroup); j++ {
-					res := <-ch
-					if res.err != nil {
-						crash <- res.err
-						return
-					}
+		go func(tag string, srvBatch []*planBatch) {
+			for i, b := range srvBatch {
+				pause.wait()
+				err := r.runTracked(tag, i, len(srvBatch), b)
+				if err != nil {
+					crash <- err
+					return
 				}
 
 				// We want to prompt to continue unless it's
 				// the last batch
-				if flgs.Prompt && i != len(srvBatch)-1 {
-					if err := confirmPrompt(srvGroup); err != nil {
+				if prm != nil && i != len(srvBatch)-1 {
+					if err := prm.confirm(b.Servers); err != nil {
 						crash <- err
 						return
 					}
 				}
 			}
 			done <- struct{}{}
-		}(srvBatch)
+		}(g.Tag, g.Batches)
 	}
-	for i := 0; i < len(batches); i++ {
+	for i := 0; i < len(p.Groups); i++ {
 		select {
 		case <-done:
 			// Keep going
@@ -239,180 +845,366 @@ func run() error {
 	return nil
 }
 
-// confirmPrompt prompts the user and asks if up should continue.
-func confirmPrompt(ips []string) error {
-	var shouldContinue string
-	fmt.Println("done with", ips)
-	fmt.Printf("do you want to continue? [Y/n] ")
+// runTracked runs a batch, the ith of n in its tag, reporting its start and
+// each server's result to r.progress.
+func (r *runner) runTracked(tag string, i, n int, b *planBatch) error {
+	start := time.Now()
+	r.progress.BatchStart(progress.Batch{
+		Time:    start,
+		Tag:     tag,
+		Number:  i + 1,
+		Total:   n,
+		Servers: b.Servers,
+	})
+	ran, err := r.runBatch(tag, b)
+	status := progress.Deployed
+	switch {
+	case err != nil:
+		status = progress.Failed
+	case !ran:
+		status = progress.Current
+	}
+	var stepErr *stepError
+	errors.As(err, &stepErr)
+	took := time.Since(start)
+	log.Printf("%s batch %d/%d %s in %s\n", tag, i+1, n, status,
+		roundDuration(took))
+	for _, server := range b.Servers {
+		res := progress.Result{
+			Time:   time.Now(),
+			Tag:    tag,
+			Server: server,
+			Status: status,
+			Took:   took,
+		}
+		if err != nil {
+			res.Err = err.Error()
+		}
+		if stepErr != nil && stepErr.errs[server] != nil {
+			res.Err = stepErr.errs[server].Error()
+		}
+		r.progress.ServerResult(res)
+	}
+	return err
+}
 
-	rdr := bufio.NewReader(os.Stdin)
-	shouldContinue, err := rdr.ReadString('\n')
+// runNeed runs a prerequisite locally unless it already ran for the checksum.
+// It holds the cache's lock throughout, so another up process running the
+// same prerequisite waits for it, then skips it.
+func (r *runner) runNeed(local *runner, chk string, g *planGroup) error {
+	unlock, err := r.cache.lock(chk, g, func() {
+		log.Printf("waiting for another up running %s\n", g.Command)
+	})
+	if err != nil {
+		return fmt.Errorf("lock cache: %w", err)
+	}
+	defer unlock()
+	cached, err := r.cache.has(chk, g)
 	if err != nil {
-		return fmt.Errorf("failed to read: %w", err)
+		return fmt.Errorf("check cache: %w", err)
 	}
-	shouldContinue = strings.TrimSuffix(shouldContinue, "\n")
-	switch strings.ToLower(shouldContinue) {
-	case "y", "yes", "":
+	if cached {
+		log.Printf("skipping %s: already ran for checksum\n", g.Command)
 		return nil
-	case "n", "no":
-		return errors.New("stopping up")
-	default:
-		fmt.Printf("unknown input: %s\n", shouldContinue)
-		return confirmPrompt(ips)
 	}
+	for _, b := range g.Batches {
+		if _, err = local.runBatch(g.Tag, b); err != nil {
+			return fmt.Errorf("%s: %w", g.Command, err)
+		}
+	}
+	if err = r.cache.add(chk, g); err != nil {
+		return fmt.Errorf("add to cache: %w", err)
+	}
+	return nil
 }
 
-func runExecIfs(
-	ch chan result,
-	vars map[string]string,
-	cmds map[up.CmdName]*up.Cmd,
-	cmd *up.Cmd,
-	chk string,
-	servers []string,
-	verbose bool,
-) {
-	send := func(ch chan<- result, err error, servers []string) {
-		for _, srv := range servers {
-			ch <- result{server: srv, err: err}
+// runBatch runs the batch's Needs, then its Execs on all servers if any of its
+// ExecIfs fail, reporting whether the Execs ran. ExecIfs stop at the first
+// which fails, unless r.allExecIfs is set. Execs are wrapped by Drain and
+// Undrain, and Undrain is skipped if any Exec fails, so unhealthy servers
+// never receive traffic.
+func (r *runner) runBatch(tag string, b *planBatch) (bool, error) {
+	for _, need := range b.Needs {
+		if _, err := r.runBatch(tag, need); err != nil {
+			return false, err
 		}
 	}
 	var needToRun bool
-	for _, execIf := range cmd.ExecIfs {
-		// TODO should this also enforce ExecIfs? Probably...
-		// TODO this should handle errors correctly through the channel
-		cmds := copyCommands(cmds)
-		steps := cmds[execIf].Execs
-		for _, step := range steps {
-			ok, err := runExec(vars, cmds, step, chk, servers,
-				true, verbose)
-			if err != nil {
-				send(ch, err, servers)
-				return
+	for _, step := range b.ExecIfs {
+		servers, err := r.checks.uncached(step, b.Servers)
+		if err != nil {
+			return false, fmt.Errorf("check cache: %w", err)
+		}
+		if len(servers) == 0 {
+			continue
+		}
+		ok, err := r.runStep(step, servers, true)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			if err = r.checks.add(step, servers); err != nil {
+				return false, fmt.Errorf("add to check "+
+					"cache: %w", err)
 			}
-			if !ok {
-				needToRun = true
+		}
+		if !ok {
+			needToRun = true
+			if !r.allExecIfs {
+				break
 			}
 		}
 	}
-	if !needToRun && len(cmd.ExecIfs) > 0 {
-		for _, srv := range servers {
-			ch <- result{server: srv}
+	if !needToRun && len(b.ExecIfs) > 0 {
+		return false, nil
+	}
+	for _, step := range b.Drain {
+		if _, err := r.runStep(step, b.Servers, false); err != nil {
+			return true, fmt.Errorf("drain: %w", err)
 		}
-		return
 	}
-	for _, cmdLine := range cmd.Execs {
-		cmdLine, err := substituteVariables(vars, cmds, cmdLine)
-		if err != nil {
-			send(ch, err, servers)
-			return
+	for i, step := range b.Execs {
+		servers, failed := b.Servers, []string(nil)
+		if i == 0 {
+			servers, failed = r.failures.split(tag, b.Servers)
 		}
-
-		// We may have substituted a variable with a multi-line command
-		cmdLines := strings.SplitN(cmdLine, "\n", -1)
-		for _, cmdLine := range cmdLines {
-			_, err = runExec(vars, cmds, cmdLine, chk, servers,
-				false, verbose)
-			if err != nil {
-				send(ch, err, servers)
-				return
-			}
+		if _, err := r.runStep(step, servers, false); err != nil {
+			return true, err
+		}
+		if len(failed) > 0 {
+			return true, fmt.Errorf("simulated failure on %s",
+				strings.Join(failed, ", "))
+		}
+	}
+	for _, step := range b.Undrain {
+		if _, err := r.runStep(step, b.Servers, false); err != nil {
+			return true, fmt.Errorf("undrain: %w", err)
 		}
 	}
-	send(ch, nil, servers)
+	for _, step := range b.State {
+		if _, err := r.runStep(step, b.Servers, false); err != nil {
+			return true, fmt.Errorf("write state: %w", err)
+		}
+	}
+	return true, nil
 }
 
-// runExec reports whether all execIfs passed and an error if any.
-func runExec(
-	vars map[string]string,
-	cmds map[up.CmdName]*up.Cmd,
-	cmd, chk string,
+// runStep reports whether all execIfs passed and an error if any. No more
+// than r.workers servers run the step at once, if it's set.
+func (r *runner) runStep(
+	step planStep,
 	servers []string,
-	execIf, verbose bool,
+	execIf bool,
 ) (bool, error) {
-	cmds = copyCommands(cmds)
-	cmds["checksum"] = &up.Cmd{Execs: []string{chk}}
+	if r.runOnce && r.sameLocally(step, servers) {
+		servers = servers[:1]
+	}
 	ch := make(chan runResult, len(servers))
+	var workers chan struct{}
+	if r.workers > 0 {
+		workers = make(chan struct{}, r.workers)
+	}
 	for _, server := range servers {
-		go runCmd(ch, vars, cmds, cmd, chk, server, execIf, verbose)
+		if workers != nil {
+			workers <- struct{}{}
+		}
+		r.rate.wait()
+		go func(server string) {
+			r.runCmd(ch, step[server], server, execIf)
+			if workers != nil {
+				<-workers
+			}
+		}(server)
 	}
-	var err error
+	var stepErr *stepError
 	pass := true
 	for i := 0; i < len(servers); i++ {
 		res := <-ch
 		pass = pass && res.pass
-		if res.error != nil {
-			err = res.error
+		if res.error == nil {
+			continue
+		}
+		if stepErr == nil {
+			stepErr = &stepError{errs: map[string]error{}}
+		}
+		stepErr.errs[res.server] = res.error
+		stepErr.last = res.error
+	}
+	if stepErr != nil {
+		return pass, stepErr
+	}
+	return pass, nil
+}
+
+// sameLocally reports whether a step is the same on several servers, all of
+// which run it on this machine, so running it once has the same effect.
+func (r *runner) sameLocally(step planStep, servers []string) bool {
+	if len(servers) < 2 {
+		return false
+	}
+	for _, server := range servers {
+		if _, ok := r.transport(server).(localTransport); !ok {
+			return false
+		}
+		if step[server] != step[servers[0]] {
+			return false
 		}
 	}
-	return pass, err
+	return true
 }
 
 type runResult struct {
-	pass  bool
-	error error
+	server string
+	pass   bool
+	error  error
+}
+
+// stepError is a step's error on each server it failed on. It reports the
+// last as its own.
+type stepError struct {
+	errs map[string]error
+	last error
 }
 
-func runCmd(
+func (e *stepError) Error() string { return e.last.Error() }
+func (e *stepError) Unwrap() error { return e.last }
+
+// runCmd runs a fully substituted cmd with the server's transport once the
+// scheduler allows it.
+func (r *runner) runCmd(
 	ch chan<- runResult,
-	vars map[string]string,
-	cmds map[up.CmdName]*up.Cmd,
-	cmd, chk, server string,
-	execIf, verbose bool,
+	cmd, server string,
+	execIf bool,
 ) {
-	// TODO ensure that no cycles are present with depth-first
-	// search
-
-	// Now substitute any variables designated by a '$'
-	cmds = copyCommands(cmds)
-	cmds["server"] = &up.Cmd{Execs: []string{server}}
-	cmd, err := substituteVariables(vars, cmds, cmd)
-	if err != nil {
-		err = fmt.Errorf("substitute: %w", err)
-		ch <- runResult{pass: false, error: err}
-		return
-	}
+	release := r.sched.acquire(server)
+	defer release()
 
 	logLine := fmt.Sprintf("[%s] %s", server, cmd)
-	if !verbose && len(logLine) > 90 {
+	if !r.verbose && len(logLine) > 90 {
 		logLine = logLine[:87] + "..."
 	}
 	log.Printf("%s\n", logLine)
 
-	c := exec.Command("sh", "-c", cmd)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
-	if err = c.Run(); err != nil {
-		if execIf {
+	user, line := up.RunAs(cmd)
+	stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if r.output != nil {
+		stdout, stderr = r.output, r.output
+	}
+	out := stdout
+	var err error
+	if r.rec != nil {
+		r.rec.record(server, "cmd", cmd, 0)
+		stdout = io.MultiWriter(stdout, r.rec.output(server,
+			"stdout"))
+		stderr = io.MultiWriter(stderr, r.rec.output(server,
+			"stderr"))
+		start := time.Now()
+		defer func() {
+			var msg string
+			if err != nil && !execIf {
+				msg = err.Error()
+			}
+			r.rec.record(server, "exit", msg, time.Since(start))
+		}()
+	}
+	err = r.execute(server, user, line, stdout, stderr)
+	if err != nil {
+		// Conditions which couldn't reach the server didn't fail,
+		// so the server has failed rather than needing the command
+		if execIf && !isTransportError(err) {
 			// TODO log if verbose
-			ch <- runResult{pass: false}
+			ch <- runResult{server: server, pass: false}
 			return
 		}
 
-		fmt.Println("error running command:", cmd)
-		ch <- runResult{pass: false, error: err}
+		if isTransportError(err) {
+			fmt.Fprintln(out, "error reaching server for command:",
+				cmd)
+		} else {
+			fmt.Fprintln(out, "error running command:", cmd)
+		}
+		ch <- runResult{server: server, pass: false, error: err}
 		return
 	}
-	ch <- runResult{pass: true}
+	ch <- runResult{server: server, pass: true}
+}
+
+// stepUser reports the user as whom a step runs with a transport: the one it
+// names, if any, otherwise -local-user for steps run on this machine.
+func (r *runner) stepUser(t transport, user string) string {
+	if _, ok := t.(localTransport); ok && user == "" {
+		return r.localUser
+	}
+	return user
+}
+
+// execute a command with the server's transport, retrying it if it fails to
+// reach the server.
+func (r *runner) execute(
+	server, user, cmd string,
+	stdout, stderr io.Writer,
+) error {
+	t := r.transport(server)
+	user = r.stepUser(t, user)
+	for attempt := 1; ; attempt++ {
+		err := execute(t, server, user, cmd, r.env, os.Stdin, stdout,
+			stderr)
+		if err == nil || !isTransportError(err) ||
+			attempt > r.transportRetries {
+			return err
+		}
+		log.Printf("[%s] failed to reach server: %v: retrying "+
+			"(%d/%d)\n", server, err, attempt, r.transportRetries)
+		time.Sleep(time.Duration(attempt) * transportRetryDelay)
+	}
 }
 
 // parseFlags and validate them.
-func parseFlags() (flags, error) {
+func parseFlags(fs *flag.FlagSet, args []string) (flags, error) {
+	parseRun := addRunFlags(fs)
 	var (
-		upfile    = flag.String("f", "Upfile", "path to upfile")
-		inventory = flag.String("i", "inventory.json", "path to inventory")
-		command   = flag.String("c", "", "command to run in upfile (use - to read from stdin)")
-		tags      = flag.String("t", "", "tags from inventory to run (defaults to the name of the command)")
-		serial    = flag.Int("n", 1, "how many of each type of server to operate on at a time")
-		directory = flag.String("d", ".", "directory for checksum")
-		prompt    = flag.Bool("p", false, "prompt before moving to the next batch (default false)")
-		verbose   = flag.Bool("v", false, "verbose logs full commands (default false)")
+		upfile       = fs.String("f", "Upfile", "path to upfile")
+		inventory    = fs.String("i", "inventory.json", "path to inventory")
+		command      = fs.String("c", "", "command to run in upfile (use - to read from stdin)")
+		tags         = fs.String("t", "", "tags from inventory to run (defaults to the name of the command)")
+		serialFlag   = fs.String("n", "1", "how many of each type of server to operate on at a time, or a percentage, e.g. 25%")
+		directory    = fs.String("d", ".", "directory for checksum")
+		checksumAlg  = fs.String("checksum-algorithm", defaultChecksumAlgorithm, "algorithm for the checksum: sha256 or blake3")
+		checksumMode = fs.Bool("checksum-modes", false, "include file permissions in the checksum (default false)")
+		checksumLink = fs.Bool("checksum-symlinks", false, "include symlink targets in the checksum (default false)")
+		checksumSkip = fs.String("checksum-exclude", "", "comma-separated globs of files or directories left out of the checksum")
+		versionFrom  = fs.String("version-from", "", "where $checksum comes from: checksum, git or file:PATH (defaults to the command's version)")
+		versionID    = fs.String("version-id", "", "use this as $checksum rather than calculating it, e.g. a build number")
+		deployID     = fs.String("deploy-id", "", "identify the deploy as $deploy_id, e.g. a CI pipeline's ID (default random)")
+		warn         = fs.Bool("W", false, "print warnings found in the upfile (default false)")
+		validate     = fs.Bool("validate", false, "validate the upfile and inventory without running (default false)")
+		werror       = fs.Bool("Werror", false, "treat warnings as errors when validating (default false)")
+		validateFmt  = fs.String("validate-format", "text", "format of findings with -validate: text, sarif or github")
+		noopExec     = fs.String("noop-exec", "", "write a plan to this path instead of running commands")
+		sign         = fs.String("sign", "", "ssh key used to sign the plan written by -noop-exec")
+		hosts        = fs.String("hosts", "", "comma-separated CIDRs or globs limiting the hosts to run")
+		state        = fs.String("state", "", "command writing $state to each server after it succeeds, read by up status")
+		plugins      = fs.String("plugin", "", "comma-separated plugins providing variables or hosts")
+		spreadBy     = fs.String("spread-by", "", "spread each tag's batches across hosts' zone or region settings")
+		cpuProfile   = fs.String("cpuprofile", "", "file to write a CPU profile of the deploy, for go tool pprof")
+		memProfile   = fs.String("memprofile", "", "file to write a memory profile once the deploy finishes, for go tool pprof")
+		traceFile    = fs.String("trace", "", "file to write an execution trace of the deploy, for go tool trace")
+		strictTags   = fs.Bool("strict-tags", false, "fail if any tag given with -t matches no hosts, rather than warning (default false)")
 	)
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return flags{}, err
+	}
 
-	if *command == "" && *upfile != "-" {
+	if *command == "" && *upfile != "-" && !*validate {
 		return flags{}, errors.New("command is required")
 	}
+	run, err := parseRun()
+	if err != nil {
+		return flags{}, err
+	}
+	if run.Strict && *command == "" && !*validate {
+		return flags{}, errors.New("-strict requires -c")
+	}
 
 	lim := map[string]struct{}{}
 	if *tags != "" {
@@ -433,6 +1225,252 @@ func parseFlags() (flags, error) {
 			}
 		}
 	}
+	hostPatterns, err := parseHostPatterns(*hosts)
+	if err != nil {
+		return flags{}, fmt.Errorf("hosts: %w", err)
+	}
+	size, err := parseSerial(*serialFlag)
+	if err != nil {
+		return flags{}, err
+	}
+	if _, ok := checksumAlgorithms[*checksumAlg]; !ok {
+		return flags{}, fmt.Errorf("unknown -checksum-algorithm %q: "+
+			"use sha256 or blake3", *checksumAlg)
+	}
+	chkOpts := checksumOpts{
+		Algorithm: *checksumAlg,
+		Modes:     *checksumMode,
+		Symlinks:  *checksumLink,
+	}
+	if *checksumSkip != "" {
+		chkOpts.Exclude = strings.Split(*checksumSkip, ",")
+	}
+	if *versionFrom != "" && !up.ValidVersion(*versionFrom) {
+		return flags{}, fmt.Errorf("unknown -version-from %q: use "+
+			"checksum, git or file:PATH", *versionFrom)
+	}
+	if *versionFrom != "" && *versionID != "" {
+		return flags{}, errors.New("cannot use -version-id with " +
+			"-version-from")
+	}
+	switch *validateFmt {
+	case "text", "sarif", "github":
+	default:
+		return flags{}, fmt.Errorf("unknown -validate-format %q: use "+
+			"text, sarif or github", *validateFmt)
+	}
+	switch *spreadBy {
+	case "", "zone", "region":
+	default:
+		return flags{}, fmt.Errorf("unknown -spread-by %q: use zone "+
+			"or region", *spreadBy)
+	}
+	var pluginPaths []string
+	if *plugins != "" {
+		pluginPaths = strings.Split(*plugins, ",")
+	}
+	flgs := flags{
+		runFlags:       run,
+		Tags:           lim,
+		Upfile:         *upfile,
+		Inventory:      *inventory,
+		Serial:         size,
+		Directory:      *directory,
+		ChecksumOpts:   chkOpts,
+		VersionFrom:    *versionFrom,
+		VersionID:      *versionID,
+		DeployID:       *deployID,
+		Command:        up.CmdName(*command),
+		Vars:           environVars(),
+		Stdin:          *upfile == "-",
+		Warn:           *warn,
+		Validate:       *validate,
+		Werror:         *werror,
+		ValidateFormat: *validateFmt,
+		NoopExec:       *noopExec,
+		Sign:           *sign,
+		Hosts:          hostPatterns,
+		State:          up.CmdName(*state),
+		Plugins:        pluginPaths,
+		SpreadBy:       *spreadBy,
+		StrictTags:     *strictTags || run.Strict,
+		Profiles: profiles{
+			cpu:   *cpuProfile,
+			mem:   *memProfile,
+			trace: *traceFile,
+		},
+	}
+	return flgs, nil
+}
+
+// job is a single command and the hosts on which it runs. Composite commands
+// have a job for each of their runs.
+type job struct {
+	command   up.CmdName
+	tags      []string
+	inventory up.Inventory
+}
+
+// makeJobs selects the hosts for the command being run. Tags given with -t
+// limit the tags of each run in a composite command, and runs with no tags
+// left are skipped.
+func makeJobs(
+	invFile *up.InventoryFile,
+	conf *up.Config,
+	flgs flags,
+) ([]job, error) {
+	cmd := conf.Commands[conf.DefaultCommand]
+	if len(cmd.Runs) == 0 {
+		// Default the tags to those declared by the command, otherwise
+		// equal to the command name, which makes the following work:
+		// `upgen my_app | up -`
+		tags := cmd.Tags
+		if len(tags) == 0 {
+			tags = []string{string(conf.DefaultCommand)}
+		}
+		if len(flgs.Tags) > 0 {
+			tags = setKeys(flgs.Tags)
+		}
+		j, err := makeJob(invFile, conf.DefaultCommand, tags, nil,
+			flgs.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		return []job{j}, nil
+	}
+	var lims map[string]struct{}
+	if _, all := flgs.Tags["all"]; len(flgs.Tags) > 0 && !all {
+		expanded, err := invFile.ResolveTags(setKeys(flgs.Tags))
+		if err != nil {
+			return nil, fmt.Errorf("resolve tags: %w", err)
+		}
+		lims = map[string]struct{}{}
+		for _, tag := range expanded {
+			lims[tag] = struct{}{}
+		}
+	}
+	var jobs []job
+	for _, run := range cmd.Runs {
+		j, err := makeJob(invFile, conf.Resolve(run.Command), run.Tags,
+			lims, flgs.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("run %s: %w", run.Command, err)
+		}
+		if len(j.inventory) == 0 {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// makeJob selects the hosts with any of the given tags, which may be globs or
+// groups, and which match the host patterns. Each host's tags are limited to
+// those selected. If lims is not nil, only tags within it are selected, and
+// an empty inventory is not an error.
+func makeJob(
+	invFile *up.InventoryFile,
+	command up.CmdName,
+	tags []string,
+	lims map[string]struct{},
+	hosts []hostPattern,
+) (job, error) {
+	j := job{command: command, inventory: up.Inventory{}}
+
+	// Match any wildcards and expand any groups from the inventory into
+	// their tags
+	selected := map[string]struct{}{}
+	for _, tag := range tags {
+		selected[tag] = struct{}{}
+	}
+	_, all := selected["all"]
+	if !all {
+		expanded, err := invFile.ResolveTags(tags)
+		if err != nil {
+			return j, fmt.Errorf("resolve tags: %w", err)
+		}
+		selected = map[string]struct{}{}
+		for _, tag := range expanded {
+			if _, ok := lims[tag]; lims != nil && !ok {
+				continue
+			}
+			selected[tag] = struct{}{}
+		}
+	}
+	j.tags = setKeys(selected)
+
+	// Copy the inventory, keeping only selected tags and hosts.
+	for ip, hostTags := range invFile.Hosts {
+		if !matchHost(hosts, ip) {
+			continue
+		}
+		var newTags []string
+		for _, t := range hostTags {
+			if _, exist := selected[t]; exist || all {
+				newTags = append(newTags, t)
+			}
+		}
+		if len(newTags) > 0 {
+			j.inventory[ip] = newTags
+		}
+	}
+
+	// Validate all tags are defined in inventory (i.e. no silent failure
+	// on typos).
+	if len(j.inventory) > 0 || lims != nil {
+		return j, nil
+	}
+	if len(hosts) > 0 {
+		return j, errors.New("no hosts match both tags and -hosts")
+	}
+	return j, fmt.Errorf("tags not defined in inventory: %s",
+		strings.Join(j.tags, ", "))
+}
+
+// useCommand makes the command named by -c, resolving aliases, the one to
+// run, including for Upfiles read from stdin. Without -c, the Upfile's first
+// command runs.
+func useCommand(conf *up.Config, name up.CmdName) error {
+	if name == "" {
+		return nil
+	}
+	conf.DefaultCommand = conf.Resolve(name)
+	if _, exist := conf.Commands[conf.DefaultCommand]; !exist {
+		return fmt.Errorf("undefined command: %s", conf.DefaultCommand)
+	}
+	return nil
+}
+
+// undefinedTags reports, sorted, the tags which no host in the inventory has,
+// either directly or through a group. Globs matching no tags are an error.
+func undefinedTags(invFile *up.InventoryFile, tags []string) ([]string,
+	error) {
+	var undefined []string
+	for _, tag := range tags {
+		hosts, err := invFile.HostsWithTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if len(hosts) == 0 {
+			undefined = append(undefined, tag)
+		}
+	}
+	sort.Strings(undefined)
+	return undefined, nil
+}
+
+// setKeys reports the keys of a set, sorted.
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// environVars reports the environment variables available to substitute.
+func environVars() map[string]string {
 	extraVars := map[string]string{}
 	for _, pair := range os.Environ() {
 		if len(pair) == 0 {
@@ -445,25 +1483,30 @@ func parseFlags() (flags, error) {
 		}
 		extraVars[vals[0]] = vals[1]
 	}
-	flgs := flags{
-		Tags:      lim,
-		Upfile:    *upfile,
-		Inventory: *inventory,
-		Serial:    *serial,
-		Directory: *directory,
-		Command:   up.CmdName(*command),
-		Vars:      extraVars,
-		Stdin:     *upfile == "-",
-		Verbose:   *verbose,
-		Prompt:    *prompt,
+	return extraVars
+}
+
+// inventoryTags reports every distinct tag in the inventory.
+func inventoryTags(inventory up.Inventory) []string {
+	seen := map[string]struct{}{}
+	var tags []string
+	for _, hostTags := range inventory {
+		for _, tag := range hostTags {
+			if _, ok := seen[tag]; ok {
+				continue
+			}
+			seen[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
 	}
-	return flgs, nil
+	return tags
 }
 
 func makeBatches(
 	conf *up.Config,
 	inventory up.Inventory,
-	max int,
+	size serial,
+	zones map[string]string,
 ) (batch, error) {
 	batches := batch{}
 
@@ -481,10 +1524,15 @@ func makeBatches(
 
 	// Now create batches for each tag
 	for tag, ips := range invMap {
+		max := size.size(len(ips))
 		if max == 0 {
 			batches[tag] = [][]string{ips}
 			continue
 		}
+		if zones != nil {
+			batches[tag] = spreadBatches(ips, zones, max)
+			continue
+		}
 		b := [][]string{}
 		for _, ip := range ips {
 			b = appendToBatch(b, ip, max)
@@ -511,49 +1559,6 @@ func appendToBatch(b [][]string, srv string, max int) [][]string {
 	return b
 }
 
-func calcChecksum(dir string) (string, error) {
-	files := []string{}
-	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		name := info.Name()
-		if strings.HasPrefix(name, ".") && name != "." {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		if info.IsDir() || !info.Mode().IsRegular() {
-			return nil
-		}
-		files = append(files, pth)
-		return nil
-	})
-	if err != nil {
-		return "", fmt.Errorf("walk filepath: %w", err)
-	}
-	h := sha256.New()
-	for _, pth := range files {
-		fi, err := os.Open(pth)
-		if err != nil {
-			return "", fmt.Errorf("checksum: open file: %w", err)
-		}
-		if _, err = io.Copy(h, fi); err != nil {
-			fi.Close()
-			return "", fmt.Errorf("checksum: copy: %w", err)
-		}
-		if err = fi.Close(); err != nil {
-			return "", fmt.Errorf("checksum: close: %w", err)
-		}
-	}
-	sum := h.Sum(nil)
-	if len(sum) == 0 {
-		return "", errors.New("empty checksum")
-	}
-	return base64.URLEncoding.EncodeToString(sum), nil
-}
-
 func randomizeOrder(ss []string) []string {
 	out := make([]string, len(ss))
 	perm := rand.Perm(len(ss))
@@ -563,66 +1568,445 @@ func randomizeOrder(ss []string) []string {
 	return out
 }
 
-// substituteVariables recursively up to 10 times. After 10 substitutions, this
-// function reports an error.
-func substituteVariables(
-	vars map[string]string,
-	cmds map[up.CmdName]*up.Cmd,
-	cmd string,
-) (string, error) {
-	replacements := []string{}
-	for cmdName, cmd := range cmds {
-		if len(cmd.ExecIfs) > 0 {
-			continue
-		}
-		replacements = append(replacements, "$"+string(cmdName))
-		rep := ""
-		for _, c := range cmd.Execs {
-			rep += c + "\n"
-		}
-		rep = strings.TrimSpace(rep)
-		replacements = append(replacements, rep)
-	}
-	for name, val := range vars {
-		replacements = append(replacements, "$"+name)
-		replacements = append(replacements, val)
-	}
-	r := strings.NewReplacer(replacements...)
-	for i := 0; i < 10; i++ {
-		tmp := r.Replace(cmd)
-		if cmd == tmp {
-			// We're done
-			return cmd, nil
-		}
-		cmd = tmp
-	}
-	return "", errors.New("possible cycle detected")
-}
-
-func copyCommands(m1 map[up.CmdName]*up.Cmd) map[up.CmdName]*up.Cmd {
-	m2 := map[up.CmdName]*up.Cmd{}
-	for k, v := range m1 {
-		m2[k] = v
-	}
-	return m2
-}
-
 // usage prints usage instructions. It passes through any error to be sent to
 // Stderr by main().
 func usage(err error) error {
 	fmt.Println(`USAGE
 	up -c <cmd> [options...]
 	up -f -     [options...]
+	up -validate [-Werror] [-validate-format <format>] [options...]
+	up plan [-o plan.json] [options...]
+	up promote -from <tags> -to <tags> -status-c <cmd> | -status-url <cmd>
+	           -c <cmd> [options...]
+	up apply [-allowed-signers <file>] [-policy <file>] [-as <id>]
+	         [-cache-dir <dir>] [-check-cache-ttl <duration>]
+	         [-force] [-ignore-maintenance] [-p] [-p-auto <answer>]
+	         [-p-timeout <duration>] [-rate <n/unit>] [-max-inflight <n>]
+	         [-workers <n>] [-run-once] [-no-short-circuit]
+	         [-simulate-failures <hosts>] [-record <dir>]
+	         [-progress <file>] [-status-line <file>]
+	         [-deployment <repo>] [-deployment-env <env>]
+	         [-deployment-ref <ref>] [-deployment-url <url>]
+	         [-annotate <dashboards>] [-email <addrs>]
+	         [-report-html <file>] [-report-junit <file>]
+	         [-report-max-output <bytes>] [-skip-unreachable]
+	         [-transport-retries <n>] [-clean-env] [-pass-env <vars>]
+	         [-local-user <user>] [-proxy <url>]
+	         [-http-timeout <duration>] [-http-retries <n>]
+	         [-http-cacert <file>] [-http-cert <file> -http-key <file>]
+	         [-timestamps <zone>] [-strict] [-v] <plan.json>
+	up replay [-speed <n>] <dir>
+	up reboot [-i <inventory>] [-c <cmd>] [-timeout <duration>]
+	          [-interval <duration>] [-health <url>] [-policy <file>]
+	          [-as <id>] <server>
+	up agent
+	up init [-o <Upfile>] [-i <inventory>] [-force] [<dir>]
+	up inventory export [-i <inventory>] [-format ssh-config] [-o <file>]
+	up import-ansible [-o <Upfile>] [-inventory <inventory.json>] [-force]
+	                  <playbook.yml> [<inventory.ini>]
+	up list [-f <Upfile>] [-q]
+	up check [-status <code>] [-body <text>] [-body-regexp <re>]
+	         [-H <header>] [-max-time <duration>] [-attempts <n>]
+	         [-interval <duration>] [-timeout <duration>] [-insecure]
+	         [-proxy <url>] [-cacert <file>] [-cert <file> -key <file>]
+	         <url>
+	up status -c <cmd> | -url <cmd> [-f <Upfile>] [-i <inventory>]
+	          [-t <tags>] [-d <dir>] [-checksum <name>]
+	          [-checksum-algorithm <alg>] [-checksum-modes]
+	          [-checksum-symlinks] [-checksum-exclude <globs>]
+	          [-version-from <source>] [-version-id <id>]
+	          [-timeout <duration>] [-retries <n>] [-proxy <url>]
+	          [-cacert <file>] [-cert <file> -key <file>]
+	          [-policy <file>] [-as <id>]
+	up facts -c <cmd> [-f <Upfile>] [-i <inventory>] [-t <tags>]
+	         [-o <facts.json>] [-policy <file>] [-as <id>]
+	up run [-f <Upfile>] [-i <inventory>] [-t <tags>] [-compare]
+	       [-policy <file>] [-as <id>] <cmd>
+	up lb haproxy [-socket <addr>] [-wait <duration>] <backend/server>
+	              drain|ready|maint
+	up lb http [-X <method>] [-H <header>] [-timeout <duration>]
+	           [-retries <n>] [-proxy <url>] [-cacert <file>]
+	           [-cert <file> -key <file>] <url>
+	up lsp
+	up maintenance on|off -t <tags> [-f <Upfile>] [-i <inventory>]
+	               [-reason <text>] [-policy <file>] [-as <id>]
 
 OPTIONS
 	[-c] command to run in upfile
 	[-f] path to Upfile, default "Upfile" or use "-" to read from stdin
 	[-h] short-form help with flags
 	[-i] path to inventory, default "inventory.json"
-	[-n] number of servers to execute in parallel, default 1
-	[-p] prompt before moving to next batch, default false
-	[-t] comma-separated tags from inventory to execute, default is your command
+	[-n] number of servers to execute in parallel, default 1, or a
+	     percentage of each tag's hosts, e.g. 25%, rounded up, which
+	     scales batches with tags of very different sizes. 0 is all
+	[-p] prompt before moving to next batch, default false. If stdin
+	     isn't a terminal, up exits rather than waiting forever
+	[-p-auto] answer prompts with "continue" or "abort" when stdin isn't
+	     a terminal, e.g. in CI, or when -p-timeout expires
+	[-p-timeout] answer prompts nobody answers within this duration,
+	     e.g. 10m, with -p-auto or else "continue". Default waits forever
+	[-t] comma-separated tags from inventory to execute, default is the
+	     command's tags or else the command's name. Tags may use glob
+	     patterns, e.g. 'web-*'
 	[-v] verbose output, default false
+	[-timestamps] time zone in which each log line starts with the time
+	     in RFC3339, local or utc, or none to leave it out. Default is
+	     local. Each batch and the deploy log how long they took
+	[-W] print warnings found in the Upfile, default false
+	[-validate] check the Upfile and inventory without running, default false
+	[-Werror] treat warnings as errors with -validate, default false
+	[-validate-format] write -validate findings to stdout as text, sarif
+	     for code scanning, or github for annotations on pull requests
+	     from GitHub Actions, default text
+	[-noop-exec] path to write a plan of every command instead of running
+	[-sign] ssh key to sign the plan, writing the signature to PLAN.sig
+	[-hosts] comma-separated CIDRs or globs, e.g. 10.0.1.0/24 or
+	         'web-*.internal', limiting the hosts selected by tags
+	[-policy] path to a policy restricting who may run which commands,
+	     default $UP_POLICY. /etc/up/policy.json is enforced as well
+	     whenever it exists
+	[-as] identity checked against the policy, default is the OS user.
+	     The policy must let the OS user act as it
+	[-state] command run on each server after its commands succeed, which
+	     should save $state, a JSON record of the checksum, command,
+	     time and up version, for up status to read
+	[-cache-dir] directory recording prerequisites which already ran
+	     for the checksum, default is the user cache directory. "" runs
+	     them every time. Concurrent runs may share it: one running a
+	     prerequisite makes the others wait, then skip it
+	[-check-cache-ttl] remember conditionals which passed on a server
+	     for the checksum in -cache-dir this long, e.g. 5m, so runs
+	     repeated soon after, such as -t web then -t all, don't check
+	     unchanged servers again. Default 0 checks every time
+	[-max-inflight] most commands running at once across every tag and
+	     batch, default unlimited. Regardless, each server runs one
+	     command at a time, even when several tags select it
+	[-workers] most servers in a batch running a step at once, default
+	     the whole batch. -n sets how many servers are out of service
+	     at once, while -workers limits how many commands a batch
+	     runs at once, e.g. to spare a weak bastion
+	[-no-short-circuit] run every conditional step of a batch, even
+	     after one fails and the command must run anyway. By default,
+	     conditionals stop at the first which fails, saving a round
+	     trip to each server on deploys which change something.
+	     Default false
+	[-run-once] run steps which are identical on every server in a
+	     batch, i.e. which don't use $server, once for the batch
+	     rather than once per server, e.g. to post one notification.
+	     Only steps run locally, not with winrm, docker or k8s, are
+	     run once. Default false
+	[-deployment] track the deploy as a deployment on a source forge,
+	     either github:OWNER/REPO or gitlab:GROUP/PROJECT, which is
+	     marked in progress, then success or failure. The token is
+	     read from $UP_GITHUB_TOKEN or $UP_GITLAB_TOKEN. Self-hosted
+	     forges are set with $UP_GITHUB_API_URL or $UP_GITLAB_URL
+	[-deployment-env] environment of the deployment, default is the
+	     command
+	[-deployment-ref] commit deployed, default is the commit checked
+	     out in -d
+	[-deployment-url] link to the deploy's logs or report shown on the
+	     deployment
+	[-annotate] comma-separated dashboards on which to annotate when the
+	     deploy starts and ends with its command, checksum, tags and
+	     operator, either grafana:URL or datadog, optionally with the
+	     site, e.g. datadog:datadoghq.eu. API keys are read from
+	     $UP_GRAFANA_TOKEN or $UP_DATADOG_API_KEY
+	[-email] comma-separated addresses emailed a summary of the deploy,
+	     highlighting failed servers, with each server's log attached.
+	     The SMTP server is read from $UP_SMTP_ADDR as host:port and
+	     the sender from $UP_SMTP_FROM. Set $UP_SMTP_USER and
+	     $UP_SMTP_PASSWORD to authenticate
+	[-report-html] file to which a standalone HTML report of the deploy
+	     is written, with a timeline of batches, each server's status,
+	     duration and collapsible log, and the checksum deployed
+	[-report-junit] file to which a JUnit XML report of the deploy is
+	     written for CI systems. Each server is a test suite and each
+	     command it ran a test case with its duration, output and, if
+	     it failed, its error
+	[-report-max-output] bytes of each server's output kept in the
+	     email, HTML and JUnit reports, the last written, default
+	     65536. Earlier output is noted as truncated, and is kept in
+	     full by -record. 0 keeps everything
+	[-plugin] comma-separated paths to plugins, executables which up
+	     runs to provide variables, such as secrets, or hosts, such as
+	     those discovered from a cloud provider. Variables already set
+	     in the environment take precedence. See the plugin package
+	     to write one
+	[-record] directory in which to write a transcript of each server's
+	     commands, output and timing, one file per server, which up
+	     replay plays back
+	[-progress] file to which an event is written as a line of JSON
+	     when each batch starts, each server finishes its batch, and
+	     the deploy ends, e.g. /dev/fd/3. Programs running up, such as
+	     chatops bots, follow them with the progress package
+	[-status-line] file to which logs and the output of commands are
+	     appended, while stdout only receives a line as each batch
+	     starts, each server finishes and the deploy ends, with the
+	     batch and percentage complete, to post to a chat thread:
+
+	     web 1/3: started 10.0.0.1, 10.0.0.2 (0/6, 0%)
+	     web 1/3: 10.0.0.1 deployed (1/6, 16%)
+	[-simulate-failures] comma-separated hosts, TAG:HOST globs or a
+	     percentage of servers, e.g. 'web:10.0.0.3,10%', which fail
+	     instead of running their first step. Use it in staging to
+	     rehearse how prompts and drains handle a failed rollout
+	[-rate] limit how quickly commands start on servers, e.g. 5/s, 30/m
+	     or 600/h, spacing them evenly regardless of -n. Default is
+	     unlimited
+	[-spread-by] zone or region. Each tag's batches take hosts from each
+	     zone or region, as set in the inventory, in turn, so hosts in
+	     the same zone land in different batches wherever -n allows.
+	     Batches are balanced in size rather than filling each to -n
+	[-skip-unreachable] before running, connect to each host's ssh
+	     port, 22 unless its port is set, or WinRM port, and leave out
+	     hosts which don't answer within 5s. They're listed as skipped
+	     at the end and in -email, rather than failing the deploy.
+	     Default false
+	[-strict] fail rather than guess, for CI, while running by hand
+	     stays forgiving. -c is required, even with -f -. Tags in -t
+	     which no host has, as with -strict-tags, and ${name}
+	     variables which aren't defined are errors, and missing
+	     variables aren't prompted for. Hosts
+	     are checked as with -skip-unreachable, but any unreachable
+	     fails the deploy before it starts. Only variables declared
+	     with "var" or "requires" are taken from the environment, and
+	     local commands run with -clean-env. Write shell variables as
+	     $NAME rather than ${NAME}. Plans are already substituted, so
+	     apply's -strict only checks hosts and sets -clean-env.
+	     Default false
+	[-strict-tags] fail if any tag in -t matches no hosts. By default
+	     up warns and deploys to the tags which do, listing those which
+	     didn't at the end and in -email. Default false
+	[-ignore-maintenance] deploy even to hosts which up maintenance
+	     put in a maintenance window. Default false
+	[-transport-retries] times to retry a command which failed to
+	     reach its server, rather than failing itself, before the
+	     server counts as failed, waiting a little longer before each.
+	     ssh exiting 255, as it does when it can't connect or loses
+	     its connection, and lost agent connections count. Commands
+	     exiting 255 themselves are retried too, so use it only with
+	     steps which are safe to run again. Default 0. Either way,
+	     conditionals which fail to reach their server fail it rather
+	     than running the command
+	[-clean-env] run local commands, including the ssh which reaches
+	     each server, with only HOME, PATH, SSH_AUTH_SOCK and USER
+	     from the environment, so variables such as GOFLAGS,
+	     DOCKER_HOST or AWS_PROFILE set by whoever runs up can't change
+	     what the deploy does. Variables are still substituted from the
+	     full environment. Default false
+	[-pass-env] comma-separated environment variables which -clean-env
+	     keeps, e.g. 'KUBECONFIG,GOFLAGS=-mod=vendor'. NAME=VALUE sets
+	     the variable rather than taking it from the environment
+	[-local-user] run steps on this machine as a dedicated deploy user
+	     with "sudo -n -u", as if written "as USER:", so the ssh they
+	     run connects with that user's name, keys and agent rather
+	     than the operator's. Steps naming their own user and steps on
+	     other transports are unaffected. The operator needs a sudoers
+	     rule allowing it without a password
+	[-proxy] send HTTP requests, such as -annotate and -deployment,
+	     through this http, https or socks5 proxy, e.g.
+	     http://proxy:3128. By default the proxy comes from
+	     HTTPS_PROXY, HTTP_PROXY and NO_PROXY. "up check", "up status
+	     -url" and "up lb http" take -proxy as well
+	[-http-timeout] limit each HTTP request, including its retries.
+	     Default 10s for -annotate and 30s for -deployment
+	[-http-retries] times to retry HTTP requests which fail to connect
+	     or get a 429, 502, 503 or 504 response, waiting 500ms, then
+	     1s, and so on. Requests which may have been handled, such as
+	     a POST answered with a 502, are only retried after a 429 or
+	     503, so nothing is created twice. Default 0
+	[-http-cacert] PEM file of CA certificates, e.g. an internal CA,
+	     trusted by HTTP requests alongside the system's
+	[-http-cert] [-http-key] PEM client certificate and key presented
+	     to servers requiring mutual TLS. "up check", "up status -url"
+	     and "up lb http" take -cacert, -cert and -key, and the last
+	     two -retries, which work the same way
+	[-cpuprofile] [-memprofile] [-trace] files to which a CPU profile,
+	     a memory profile and an execution trace of the deploy are
+	     written, to find where planning is slow, e.g. calculating
+	     checksums or substituting variables. Read them with go tool
+	     pprof and go tool trace
+	[-checksum-algorithm] sha256 or blake3, which is faster on large
+	     trees given several cores, to calculate $checksum of -d,
+	     default sha256. The checksum is prefixed with the algorithm,
+	     e.g. sha256:..., so version endpoints can tell checksums of
+	     another algorithm from outdated ones
+	[-checksum-modes] include each file's permissions in the checksum,
+	     so a chmod alone redeploys, default false
+	[-checksum-symlinks] include the target of each symlink in the
+	     checksum, default false, which skips symlinks. Targets aren't
+	     followed. Either option is added to the checksum's prefix,
+	     e.g. sha256+modes:...
+	[-checksum-exclude] comma-separated globs of files or directories,
+	     matching either their name or path within -d, e.g.
+	     'dist,*.log', left out of the checksum. Files which change
+	     while they're hashed, as when a build runs at the same time,
+	     are hashed again up to 3 times before up gives up, so exclude
+	     build output
+	[-version-from] checksum, git or file:PATH, where $checksum comes
+	     from, overriding the command's version in the Upfile. git uses
+	     the commit checked out in -d, e.g. git:<sha>, with -dirty
+	     added if tracked files have uncommitted changes. file:PATH
+	     uses the contents of a file relative to -d, e.g. file:VERSION
+	[-version-id] use this as $checksum rather than calculating it,
+	     e.g. a build number from CI
+	[-deploy-id] identify the deploy, default a random ID. It's logged,
+	     substituted for $deploy_id, saved in the plan and $state, and
+	     sent with -annotate, -deployment and reports. Pass the same
+	     ID, e.g. the CI pipeline's, when retrying a deploy, so
+	     conditionals can compare it to what's on each server and skip
+	     servers the first attempt already finished
+
+SUBCOMMANDS
+	plan	write a plan of every command to run without running them,
+		equivalent to -noop-exec. Use -o to choose the path,
+		default "plan.json"
+	apply	run a plan written by up plan or -noop-exec. apply refuses
+		to run if the Upfile or inventory changed since planning
+		unless -force is passed. Like a deploy, it refuses hosts in
+		maintenance unless -ignore-maintenance is passed, whatever
+		-force says. With -allowed-signers, apply also
+		refuses plans which aren't signed by a key in that OpenSSH
+		allowed signers file (see ssh-keygen(1))
+	agent	serve commands and files from up on stdin and stdout.
+		Hosts using the "agent" transport start it over ssh, so
+		up must be installed on them. You needn't run it yourself
+	check	request a URL and exit non-zero unless it responds with
+		-status, default 200, within -max-time, and its body
+		contains every -body and matches every -body-regexp.
+		-H adds request headers. Each attempt is logged, retrying
+		up to -attempts times. Use it as a step or conditional:
+
+		check_health
+			up check -attempts 5 -body ok http://$server/health
+
+	facts	run -c on every host selected by -t, default all, and
+		write the facts each prints, either a JSON object or
+		KEY=VALUE lines, to -o, default "facts.json", keyed by
+		host. $facts() prints the hostname, os, kernel, arch,
+		cpus, distro and distro_version:
+
+		gather_facts
+			ssh $server '$facts()'
+
+	import-ansible
+		convert an Ansible playbook into an Upfile with a command
+		for each play, run on the play's hosts as tags. shell,
+		command, raw, copy, file, service and systemd tasks become
+		steps run over ssh, and simple {{ vars }} become variables.
+		Scripts with "$" or "#" are escaped so they run as written,
+		with a warning. Anything else is printed as a warning and
+		becomes a TODO step which fails until it's converted by
+		hand. An INI
+		inventory is converted to -inventory, tagging each host
+		with its groups
+	init	write a starter Upfile to -o, default "Upfile", for the app
+		in a directory, default ".". It detects a Dockerfile,
+		systemd units, go.mod and package.json to build the app
+		once locally, copy it to each server, restart it and check
+		its health. Servers already running the checksum are
+		skipped. If the inventory has a single tag, deploy
+		targets it. Review the commands before deploying
+	inventory export
+		write the inventory in another format to -o, default
+		stdout. -format ssh-config writes a Host block for each
+		host with its user and port, e.g. for an Include in
+		~/.ssh/config, so interactive ssh and up connect the same
+		way. Hosts using another transport are skipped
+	lb	drain a server from a load balancer or restore it, for use
+		in drain and undrain hooks. "lb haproxy" sets the
+		server's state over the HAProxy runtime API at -socket, a
+		unix socket path or host:port. With -wait, draining waits
+		for the server's current sessions to finish. "lb http"
+		sends a request, default POST, and fails unless it
+		responds with a 2xx status
+	list	list the commands and aliases in the Upfile with their
+		descriptions. -q prints only their names, which is useful
+		for shell completion, e.g.
+		complete -W "$(up list -q)" up
+	lsp	run a language server for Upfiles over stdio
+	maintenance
+		start or end a maintenance window on the hosts selected by
+		-t by running the Upfile's maintenance_on or
+		maintenance_off command on each. maintenance_on gets
+		$maintenance, JSON of when the window started, -as, and
+		-reason, to save on the host, and maintenance_off removes
+		it. If the Upfile has a maintenance_status command
+		printing what was saved, or nothing outside a window,
+		deploys and up apply refuse to run on hosts in maintenance
+		unless -ignore-maintenance is passed, and up status lists
+		them:
+
+		maintenance_on
+			ssh $server "echo ${maintenance:q} > /var/lib/up.maint"
+			up lb haproxy web/$server maint
+
+		maintenance_off
+			up lb haproxy web/$server ready
+			ssh $server 'rm -f /var/lib/up.maint'
+
+		maintenance_status
+			ssh $server 'cat /var/lib/up.maint 2>/dev/null || true'
+	promote	deploy -c to the hosts selected by -to, e.g. production,
+		only if every host selected by -from, e.g. staging, is
+		running the local version, read with -status-c or
+		-status-url as with status. Otherwise it prints their
+		status and deploys nothing. The version checked is passed
+		to the deploy as -version-id, so exactly what was tested
+		is promoted. It takes every other option, except -t:
+
+		up promote -from staging -to production \
+			-status-url version_url -c deploy
+	run	run a command on every host selected by -t, default all,
+		printing each host's output. Variables are substituted
+		from the Upfile, if any, so the default transport reaches
+		hosts with ssh. -compare groups hosts by identical output,
+		largest group first, marks the rest as outliers and exits
+		non-zero if there's more than one group:
+
+		up run -compare -t web ssh '$server' openssl version
+
+	reboot	reboot a server over ssh with -c, default "sudo -n shutdown
+		-r now", wait for it to stop accepting connections, then
+		wait until ssh succeeds again and, with -health, the URL
+		responds 200, failing after -timeout, default 10m. The
+		server's user, port and keys come from the inventory, as
+		for the agent transport. Use it as a step, so the next
+		batch only starts once the server is back:
+
+		patch
+			ssh $server 'sudo -n syspatch'
+			up reboot -health http://$server/health $server
+	replay	play back the transcripts written by -record, interleaving
+		servers as they originally ran. -speed 2 plays twice as
+		fast and -speed 0 prints without waiting
+	status	report which hosts selected by -t, default all, are in
+		sync with the checksum of -d, or the checksum named by
+		-checksum, and which are outdated, without deploying.
+		With -c, the command is run on each host and should
+		print what -state saved, e.g.
+
+		write_state
+			ssh $server 'echo '"'"'$state'"'"' > /var/lib/up.json'
+
+		read_state
+			ssh $server 'cat /var/lib/up.json'
+
+		With -url, the command holds the URL of each host's
+		version endpoint, which is requested concurrently and
+		may respond with the checksum or the saved state:
+
+		version_url
+			http://$server:3000/version
+
+		-version-from, -version-id, or "version" on the
+		Upfile's first command choose the version to which
+		hosts are compared, as when deploying.
+	vars	print the variables the command given by -c, default the
+		first, would use, with their values and where each comes
+		from: env, plugin, upfile, builtin for those up sets while
+		deploying, or unset for required variables without one.
+		Secrets are masked. -a prints every variable
 
 UPFILE
 	Upfiles define the steps to be run for each server using a syntax
@@ -640,6 +2024,191 @@ UPFILE
 	   the name with "$". Variable substitution values may be a single
 	   value or an entire series of commands.
 
+	Commands are indented with a tab. Blank lines, including those with
+	only whitespace, may appear between them; the command name's body
+	ends at the next line which is neither indented nor blank.
+
+	Commands run on hosts tagged with the command's name unless "-t" is
+	passed. A command may instead declare its default tags after its
+	name with an "@" prefix:
+
+	deploy_dashboard @dashboard @openbsd check_version
+		CMD_1
+
+	Lines starting with "#" are comments, and a "#" after whitespace
+	ends a step with one. A "#" within a word, e.g. in 'a#b' or ${#v},
+	is part of the step. Comments starting with "##" immediately before
+	a command describe it, and the description is shown by up list and
+	the language server:
+
+	## Deploys the dashboard
+	deploy_dashboard @dashboard check_version
+		CMD_1
+
+	Commands with long names may be given short aliases, which are
+	accepted by "-c":
+
+	alias d = deploy_dashboard
+
+	$checksum is the checksum of -d. Repositories holding several
+	services may name a checksum for each service's directory, relative
+	to the Upfile, substituted for $checksum.NAME, so each service is
+	only deployed when its own files change:
+
+	checksum app=cmd/app lib=pkg
+	deploy_app check_app_version
+		ssh $server 'echo $checksum.app > /srv/app/.checksum'
+
+	Services which already report the commit they were built from may
+	be versioned by git instead, which is faster than hashing large
+	trees. $checksum is then the commit checked out in -d, e.g.
+	git:<sha>, or git:<sha>-dirty with uncommitted changes. Services
+	reporting a version written by their build may instead use the
+	contents of a file relative to -d, e.g. "version file:VERSION":
+
+	deploy check_version version git
+		CMD_1
+
+	Commands may declare prerequisites after "needs", which run once on
+	this machine before any server, or after "needs-each", which run on
+	each server before the command. Prerequisites run in dependency
+	order, each only once, and may not form a cycle. Once a prerequisite
+	run on this machine succeeds, it's skipped for later deploys of the
+	same checksum (see -cache-dir). Conditionals must come before either
+	keyword:
+
+	deploy check_version needs build needs-each migrate
+		CMD_1
+
+	Commands may name a "drain" command, which runs on each server
+	after its conditionals pass and before its steps, and an "undrain"
+	command, which runs only once every step succeeds. End the steps
+	with a health check so traffic is only restored to healthy servers.
+	If a step fails, the server stays drained:
+
+	deploy check_version drain lb_drain undrain lb_undrain
+		CMD_1
+		up check -attempts 10 http://$server/health
+
+	lb_drain
+		up lb haproxy -wait 30s web/$server drain
+
+	lb_undrain
+		up lb haproxy web/$server ready
+
+	Commands may declare the variables they require after "requires".
+	Before anything runs, up fails listing every required variable
+	which isn't set in the environment, by a plugin, or as a command,
+	including those required by commands referenced. When stdin is a
+	terminal, up asks for them instead:
+
+	deploy check_version requires UP_USER, IMAGE_TAG
+		ssh $UP_USER@$server 'run $IMAGE_TAG'
+
+	Variables may be declared with a type, "string", "int", "bool", or
+	"enum" listing the values allowed. Before anything runs, up fails
+	if any declared variable is set to a value of the wrong type, so a
+	mistyped ENV=prdo is caught rather than deployed. "secret" is a
+	string which isn't shown when asked for:
+
+	var PORT int
+	var ENV enum(staging, prod)
+	var DB_PASSWORD secret
+
+	A step written "as USER: COMMAND" runs as another user. Docker hosts
+	run it with "docker exec -u", Kubernetes pods with sudo, and the
+	default transport with sudo on this machine, so ssh connects with
+	that user's name and keys. Variables are substituted in the user.
+	Only a single word followed by ":" is a user, so a step such as
+	"as -o a.o a.s" runs as written:
+
+	deploy_app
+		as deploy: rsync -a app $server:
+		as $app_user: ssh $server 'sudo -n systemctl restart app'
+
+	Helpers expand into common steps. $systemd_restart(UNIT) restarts a
+	systemd unit with "sudo -n", then fails unless the unit is still
+	active a second later, printing its status and recent logs.
+	$systemd_start, $systemd_reload and $systemd_stop work the same way,
+	with stop checking the unit is inactive. Variables may be passed as
+	the unit, and helpers need no quoting inside ssh:
+
+	restart_app
+		ssh $remote '$systemd_restart($app)'
+
+	$script(NAME=VALUE... PATH ARGS...) embeds the local script at PATH
+	when planning, then on the host writes it to a temporary file, runs
+	it with the environment and arguments, and removes it. It needs
+	base64 and mktemp on the host, and its arguments may not contain
+	single quotes:
+
+	migrate
+		ssh $remote '$script(ENV=prod scripts/migrate.sh $version)'
+
+	$pkg_upgrade() upgrades every package with apt-get, dnf, yum, or
+	syspatch then pkg_add on OpenBSD, through "sudo -n" or "doas -n"
+	unless already root, and records when a reboot is needed.
+	$reboot_required() succeeds only when one is, so patching a fleet
+	one host at a time takes a few steps:
+
+	patch
+		ssh $server '$pkg_upgrade()'
+		if ssh $server '$reboot_required()'; then up reboot $server; fi
+
+	A step written "each TAG: COMMAND" is repeated for every host in
+	the inventory with the tag, which may be a glob or group, with the
+	host substituted for $each. As with "as", only a single word
+	followed by ":" is a tag, so "each x in y" runs as written. Steps
+	may build configuration from other hosts rather than hardcoding
+	their addresses:
+
+	deploy_web
+		ssh $server 'rm -f /etc/app/redis_peers'
+		each redis: ssh $server 'echo $each >> /etc/app/redis_peers'
+
+	$hosts(TAG) is the hosts with the tag separated by spaces, and
+	$hosts(TAG,SEP) separates them with SEP exactly as written, so
+	$hosts(redis,,) separates them with commas:
+
+	deploy_web
+		ssh $server 'app -redis-peers $hosts(redis,,)'
+
+	Variables are substituted as written, so values with spaces or
+	quotes may break the step or run commands of their own. ${NAME:q}
+	substitutes the value in single quotes, escaping any inside it, so
+	the shell running the step sees a single word:
+
+	notify
+		echo ${MESSAGE:q} | mail -s ${SUBJECT:q} ops@example.com
+
+	Other filters transform values without a subshell, and may be
+	chained, e.g. ${checksum:short8:q}. "upper" and "lower" change case,
+	"host" and "port" split an address such as $server, and "shortN"
+	keeps the first N characters:
+
+	tag_image
+		docker tag app app:${checksum:short8}
+
+	Scripts which use "$" themselves, such as awk, may be written as a
+	literal block fenced by lines of "` + "```" + `". The block runs
+	as a single step exactly as written, without substituting
+	variables or stripping comments:
+
+	count_users
+		` + "```" + `
+		awk -F: '$3 >= 1000 { n++ } END { print n }' /etc/passwd
+		` + "```" + `
+
+	A composite command runs other commands simultaneously, each on its
+	own tags, so one command can bring up an entire environment. Each
+	run is written "run COMMAND on TAG_1,TAG_2", and several may share a
+	line separated by ";". A line which doesn't start with a whole run,
+	e.g. "run foo", is an ordinary step. "-t" limits the tags of every
+	run:
+
+	release
+		run deploy_web on web; run deploy_api on api
+
 	These parts are generally arranged as follows:
 
 	CMD_NAME_1 CONDITIONAL_1 CONDITIONAL_2
@@ -665,14 +2234,112 @@ INVENTORY
 		"IP_2": ["TAG_1"]
 	}
 
+	Hosts may be hostnames, IPv4 or IPv6 addresses, with an optional port,
+	e.g. "10.0.0.1:2222" or "[fd00::1]:2222". A port is used as the host's
+	port setting. In commands, $server is the host as written,
+	$server.host is the host alone, e.g. for ssh, $server.port is the port,
+	if any, and $server.addr wraps an IPv6 host in brackets for URLs and
+	rsync destinations, e.g. http://$server.addr:8080/health.
+	$server.user is the host's user setting, if any, so steps which ssh
+	themselves can use per-host credentials, e.g.
+	ssh $server.user@$server.host.
+
+	Hosts may instead map to an object holding their tags and settings,
+	and the reserved key "tags" holds settings shared by every host with
+	a tag. Per-host settings take precedence:
+
+	{
+		"IP_1": ["TAG_1"],
+		"IP_2": {"tags": ["TAG_2"], "user": "Administrator"},
+		"tags": {"TAG_2": {"transport": "winrm", "https": true}}
+	}
+
+	The reserved key "groups" defines composite tags, so "-t frontend"
+	selects every host tagged with any of the group's tags. Groups may
+	contain other groups:
+
+	{
+		"groups": {"frontend": ["TAG_1", "TAG_2"]}
+	}
+
+	Available settings are:
+
+	transport	"local" (default) runs commands with sh on this
+			machine. "winrm" runs commands on Windows hosts with
+			the winrm CLI, reading the password from
+			$UP_WINRM_PASSWORD and passing it to winrm as
+			$WINRM_PASSWORD, never as an argument which other
+			users could see. "agent" runs commands on the
+			host with up agent, started over one ssh
+			connection which every step shares, saving a
+			handshake for each. Steps written
+			"put LOCAL REMOTE" copy a file over it, into
+			REMOTE if it ends with "/".
+	user		user to connect as, also substituted for
+			$server.user
+	key		private key with which the agent transport's ssh
+			authenticates, offered instead of every key the
+			operator has
+	ssh_agent	false stops the agent transport's ssh from using
+			keys in the operator's ssh agent
+	port		port to connect to
+	https		connect over TLS (WinRM)
+	insecure	skip TLS certificate verification (WinRM)
+	zone		zone in which the host runs, used by -spread-by
+	region		region in which the host runs, used by -spread-by
+	known_hosts	known_hosts file checked by the agent transport
+			rather than each operator's, so everyone deploying
+			verifies the same keys, e.g. one committed beside
+			the inventory
+	host_keys	how the agent transport verifies host keys.
+			"strict", the default with known_hosts, refuses
+			hosts whose key isn't known. "tofu" trusts a host's
+			key the first time it connects and records it.
+			Either refuses a changed key. Unset leaves it to
+			the operator's ssh config
+
+	Hosts addressed as "docker://CONTAINER" run commands inside a local
+	Docker container with "docker exec", and hosts addressed as
+	"k8s://NAMESPACE/POD" run commands inside a Kubernetes pod with
+	"kubectl exec".
+
 	Because this is a simple JSON file, your inventory can be dynamically
 	generated if you wish based on the state of your architecture at a
 	given moment, or you can commit the single into source code alongside
 	your Upfile.
 
+POLICY
+	A policy file restricts who may run which commands against which
+	tags. A run is allowed if any rule matches the identity, the command
+	and every targeted tag. Entries are globs:
+
+	{
+		"rules": [
+			{"users": ["*"], "commands": ["deploy_*"], "tags": ["*_staging"]},
+			{"users": ["alice"], "commands": ["*"], "tags": ["*"]}
+		],
+		"assume": [
+			{"users": ["ci"], "identities": ["*"]}
+		]
+	}
+
+	The identity is the OS user. -as names another only if an "assume"
+	rule lets the OS user act as it, e.g. a CI runner deploying on
+	behalf of whoever triggered it.
+
+	/etc/up/policy.json is enforced whenever it exists, as well as any
+	policy given with -policy or $UP_POLICY, so it can't be left out.
+	Every subcommand which runs on hosts enforces it: up run is checked
+	as the command "run", up reboot as "reboot", up maintenance as
+	maintenance_on or maintenance_off, and the others as their -c.
+
 EXIT STATUS
 	up exits with 0 on success or 1 on any failure.
 
+SIGNALS
+	SIGUSR1 pauses a rollout: batches already running finish, but no new
+	batch starts until SIGUSR2 resumes it.
+
 EXAMPLES
 	In the following example Upfile, "deploy_dashboard" is the command.
 	Before running the script indented underneath the command, up will
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// Commands in the Upfile which start and end maintenance windows, and which
+// report whether a host is in one.
+const (
+	maintenanceOn     up.CmdName = "maintenance_on"
+	maintenanceOff    up.CmdName = "maintenance_off"
+	maintenanceStatus up.CmdName = "maintenance_status"
+)
+
+// maintenanceWindow is passed to maintenance_on as $maintenance to save on
+// the host, and printed back by maintenance_status until maintenance_off
+// removes it.
+type maintenanceWindow struct {
+	Since  time.Time `json:"since"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (w *maintenanceWindow) String() string {
+	var parts []string
+	if !w.Since.IsZero() {
+		parts = append(parts, "since "+w.Since.Format(time.RFC3339))
+	}
+	if w.By != "" {
+		parts = append(parts, "by "+w.By)
+	}
+	s := strings.Join(parts, " ")
+	if w.Reason != "" && s != "" {
+		s += ": "
+	}
+	return s + w.Reason
+}
+
+// maintenanceCmd starts or ends a maintenance window on every selected host
+// by running the Upfile's maintenance_on or maintenance_off command, e.g.
+//
+//	up maintenance on -t web -reason 'db migration'
+func maintenanceCmd(args []string) error {
+	if len(args) == 0 {
+		return usage(errors.New("maintenance requires on or off"))
+	}
+	var name up.CmdName
+	switch args[0] {
+	case "on":
+		name = maintenanceOn
+	case "off":
+		name = maintenanceOff
+	default:
+		return usage(fmt.Errorf("unknown maintenance %q: use on or off",
+			args[0]))
+	}
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile")
+	inventory := fs.String("i", "inventory.json", "path to inventory")
+	tags := fs.String("t", "", "tags from inventory to start or end maintenance on")
+	reason := fs.String("reason", "", "why the hosts are in maintenance, shown by up status")
+	pol := addPolicyFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *tags == "" {
+		return usage(errors.New("maintenance requires -t"))
+	}
+
+	fi, err := os.Open(*upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	cmd, ok := conf.Commands[name]
+	if !ok {
+		return fmt.Errorf("undefined command: %s", name)
+	}
+	transports, err := selectHosts(*inventory, name, *tags, pol)
+	if err != nil {
+		return err
+	}
+	scp := newScope(environVars(), conf.Commands)
+	if name == maintenanceOn {
+		id, err := resolveIdentity(pol.Identity)
+		if err != nil {
+			return err
+		}
+		byt, err := json.Marshal(maintenanceWindow{
+			Since:  time.Now().UTC(),
+			By:     id,
+			Reason: *reason,
+		})
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		scp = scp.with("maintenance", string(byt))
+	}
+	results := runOnHosts(transports, scp, strings.Join(cmd.Execs, "\n"))
+	var failed int
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+			log.Printf("%s: maintenance %s failed: %s\n", res.Host,
+				args[0], res.Err)
+			continue
+		}
+		log.Printf("%s: maintenance %s\n", res.Host, args[0])
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d hosts", failed)
+	}
+	return nil
+}
+
+// readMaintenance runs the Upfile's maintenance_status command on every host,
+// reporting the windows of those in maintenance. It reports nothing if the
+// Upfile has no maintenance_status command.
+func readMaintenance(
+	conf *up.Config,
+	transports map[string]transport,
+	scp *scope,
+) (map[string]*maintenanceWindow, error) {
+	cmd, ok := conf.Commands[maintenanceStatus]
+	if !ok {
+		return nil, nil
+	}
+	text := strings.Join(cmd.Execs, "\n")
+	return parseWindows(runOnHosts(transports, scp, text))
+}
+
+// parseWindows parses what maintenance_status printed on each host,
+// reporting the windows of those in maintenance.
+func parseWindows(
+	results []hostResult,
+) (map[string]*maintenanceWindow, error) {
+	windows := map[string]*maintenanceWindow{}
+	for _, res := range results {
+		if res.Err != nil {
+			return nil, fmt.Errorf("%s: %w", res.Host, res.Err)
+		}
+		w, err := parseMaintenance(res.Out)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", res.Host, err)
+		}
+		if w != nil {
+			windows[res.Host] = w
+		}
+	}
+	return windows, nil
+}
+
+// parseMaintenance parses what maintenance_status printed: nothing if the
+// host isn't in maintenance, otherwise the saved $maintenance, or any other
+// text, which is taken as the reason.
+func parseMaintenance(out string) (*maintenanceWindow, error) {
+	out = strings.TrimSpace(out)
+	switch {
+	case out == "":
+		return nil, nil
+	case out[0] != '{':
+		return &maintenanceWindow{Reason: out}, nil
+	}
+	var w maintenanceWindow
+	if err := json.Unmarshal([]byte(out), &w); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &w, nil
+}
+
+// checkMaintenance fails if any host in the plan is in a maintenance window,
+// as reported by the maintenance_status commands recorded in it, so neither a
+// deploy nor applying a plan disturbs work in progress.
+func checkMaintenance(p *plan, transports map[string]transport) error {
+	if len(p.Maintenance) == 0 {
+		return nil
+	}
+	selected := make(map[string]transport, len(p.Maintenance))
+	for host := range p.Maintenance {
+		t, ok := transports[host]
+		if !ok {
+			t = localTransport{}
+		}
+		selected[host] = t
+	}
+	results := runEachHost(selected, func(
+		t transport,
+		host string,
+	) ([]byte, error) {
+		return runOutput(t, host, p.Maintenance[host])
+	})
+	windows, err := parseWindows(results)
+	if err != nil {
+		return fmt.Errorf("read maintenance: %w", err)
+	}
+	if len(windows) == 0 {
+		return nil
+	}
+	var msgs []string
+	for host, w := range windows {
+		msgs = append(msgs, fmt.Sprintf("%s (%s)", host, w))
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("hosts in maintenance, use -ignore-maintenance "+
+		"to deploy anyway: %s", strings.Join(msgs, ", "))
+}
+
+// printMaintenance writes the hosts in maintenance windows, if any.
+func printMaintenance(w io.Writer, windows map[string]*maintenanceWindow,
+	total int) {
+	if len(windows) == 0 {
+		return
+	}
+	hosts := make([]string, 0, len(windows))
+	for host := range windows {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	fmt.Fprintf(w, "%d/%d hosts in maintenance\n", len(windows), total)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "\t%s %s\n", host, windows[host])
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestParseMaintenance(t *testing.T) {
+	t.Parallel()
+	since := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tcs := []struct {
+		have string
+		want string
+	}{
+		{have: "", want: "<nil>"},
+		{have: " \n", want: "<nil>"},
+		{have: "upgrading disks\n", want: "upgrading disks"},
+		{
+			have: `{"since":"2021-03-04T05:06:07Z","by":"ops"}`,
+			want: "since " + since.Format(time.RFC3339) + " by ops",
+		},
+		{
+			have: `{"by":"ops","reason":"migration"}`,
+			want: "by ops: migration",
+		},
+	}
+	for _, tc := range tcs {
+		w, err := parseMaintenance(tc.have)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.have, err)
+		}
+		got := "<nil>"
+		if w != nil {
+			got = w.String()
+		}
+		if got != tc.want {
+			t.Fatalf("%q: expected %q, got %q", tc.have, tc.want,
+				got)
+		}
+	}
+	if _, err := parseMaintenance("{"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPrintMaintenance(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	printMaintenance(&buf, nil, 3)
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing, got %q", buf.String())
+	}
+	printMaintenance(&buf, map[string]*maintenanceWindow{
+		"10.0.0.2": {Reason: "b"},
+		"10.0.0.1": {By: "ops", Reason: "a"},
+	}, 3)
+	want := "2/3 hosts in maintenance\n" +
+		"\t10.0.0.1 by ops: a\n" +
+		"\t10.0.0.2 b\n"
+	if buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestApplyMaintenance(t *testing.T) {
+	t.Parallel()
+	conf, err := up.Parse([]byte(`deploy
+	echo deploy
+
+maintenance_status
+	test $server = 10.0.0.1 && echo upgrading || true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &plan{
+		Command: "deploy",
+		Hosts: map[string]up.Settings{
+			"10.0.0.1": {},
+			"10.0.0.2": {},
+		},
+	}
+	err = p.addMaintenance(conf, newScope(nil, conf.Commands))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "up-maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "plan.json")
+	if err = writePlan(pth, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying a plan refuses hosts in maintenance, even with -force,
+	// which only skips checking the Upfile and inventory
+	err = applyCmd([]string{"-force", "-cache-dir", "", pth})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "10.0.0.1 (upgrading)") ||
+		strings.Contains(msg, "10.0.0.2") {
+		t.Fatalf("expected only 10.0.0.1 in maintenance, got %s", msg)
+	}
+	err = applyCmd([]string{"-force", "-ignore-maintenance",
+		"-cache-dir", "", pth})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
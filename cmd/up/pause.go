@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// pauser holds new batches from starting while paused, so a rollout can be
+// halted without killing in-flight work. A nil pauser never pauses.
+type pauser struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newPauser() *pauser {
+	p := &pauser{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// pause holds batches which haven't started yet.
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+// resume lets held batches start.
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+	p.cond.Broadcast()
+}
+
+// wait blocks while paused.
+func (p *pauser) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.paused {
+		p.cond.Wait()
+	}
+}
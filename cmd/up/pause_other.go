@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// watchPauseSignals does nothing, since there's no SIGUSR1 or SIGUSR2.
+func watchPauseSignals(p *pauser) func() {
+	return func() {}
+}
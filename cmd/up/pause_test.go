@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauser(t *testing.T) {
+	t.Parallel()
+	var p *pauser
+	p.wait() // nil pausers never block
+
+	p = newPauser()
+	p.wait()
+	p.pause()
+	done := make(chan struct{})
+	go func() {
+		p.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected wait to block while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.resume()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected wait to return after resume")
+	}
+}
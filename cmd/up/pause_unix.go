@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchPauseSignals pauses on SIGUSR1 and resumes on SIGUSR2 until the
+// returned function is called.
+func watchPauseSignals(p *pauser) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				if sig == syscall.SIGUSR2 {
+					log.Printf("resumed\n")
+					p.resume()
+					continue
+				}
+				log.Printf("paused: running batches will " +
+					"finish, send SIGUSR2 to resume\n")
+				p.pause()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// rebootMarker is created when upgrades need a reboot to take effect. Debian
+// and Ubuntu create it themselves, and it's cleared by the reboot on every
+// supported system.
+const rebootMarker = "/var/run/reboot-required"
+
+// pkgUpgradeProbe upgrades every package with whichever of apt-get, dnf, yum
+// or OpenBSD's syspatch and pkg_add the host has, as root through sudo or
+// doas without prompting. It runs in a subshell so it composes with && like
+// a single command.
+const pkgUpgradeProbe = "(s=; [ $(id -u) -eq 0 ] || " +
+	"{ command -v sudo >/dev/null && s=\"sudo -n\" || s=\"doas -n\"; }; " +
+	"if command -v apt-get >/dev/null; then " +
+	"$s env DEBIAN_FRONTEND=noninteractive apt-get -qy update && " +
+	"$s env DEBIAN_FRONTEND=noninteractive apt-get -qy " +
+	"-o Dpkg::Options::=--force-confdef " +
+	"-o Dpkg::Options::=--force-confold dist-upgrade; " +
+	"elif command -v dnf >/dev/null || command -v yum >/dev/null; then " +
+	"p=yum; command -v dnf >/dev/null && p=dnf; " +
+	"$s $p -y upgrade && { ! command -v needs-restarting >/dev/null || " +
+	"$s needs-restarting -r >/dev/null || " +
+	"$s touch " + rebootMarker + "; }; " +
+	"elif command -v syspatch >/dev/null; then " +
+	"$s syspatch; r=$?; [ $r -eq 0 ] && $s touch " + rebootMarker + "; " +
+	"[ $r -eq 0 ] || [ $r -eq 2 ] && $s pkg_add -u; " +
+	"else echo no supported package manager >&2; false; fi)"
+
+// pkgUpgradeHelper expands $pkg_upgrade() into the upgrade. dnf and yum hosts
+// are marked as needing a reboot when needs-restarting says so, and OpenBSD
+// hosts whenever syspatch installed a patch, since patches may replace the
+// kernel. syspatch exits 2 when there was nothing to install.
+func pkgUpgradeHelper(arg string) (string, error) {
+	if strings.TrimSpace(arg) != "" {
+		return "", errors.New("takes no arguments")
+	}
+	return pkgUpgradeProbe, nil
+}
+
+// rebootRequiredHelper expands $reboot_required() into a check which
+// succeeds only if a reboot is needed for upgrades to take effect.
+func rebootRequiredHelper(arg string) (string, error) {
+	if strings.TrimSpace(arg) != "" {
+		return "", errors.New("takes no arguments")
+	}
+	return "test -f " + rebootMarker, nil
+}
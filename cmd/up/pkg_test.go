@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPkgUpgrade(t *testing.T) {
+	t.Parallel()
+
+	scp := newScope(nil, nil)
+	cmd, err := scp.substitute("$pkg_upgrade() && echo done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cmd, "'") {
+		t.Fatalf("expected no single quotes in %q", cmd)
+	}
+
+	// Every command the upgrade runs is stubbed to log its arguments,
+	// and syspatch exits with the status under test
+	tcs := []struct {
+		syspatch string
+		want     string
+		err      bool
+	}{
+		{syspatch: "0", want: "doas -n syspatch\n" +
+			"doas -n touch " + rebootMarker + "\n" +
+			"doas -n pkg_add -u\ndone\n"},
+		{syspatch: "2", want: "doas -n syspatch\n" +
+			"doas -n pkg_add -u\ndone\n"},
+		{syspatch: "1", want: "doas -n syspatch\n", err: true},
+	}
+	for _, tc := range tcs {
+		dir, err := ioutil.TempDir("", "up-pkg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		stubs := map[string]string{
+			"id":       "echo 1000",
+			"doas":     "shift; echo doas -n \"$@\"; \"$@\"",
+			"syspatch": "exit " + tc.syspatch,
+			"touch":    "",
+			"pkg_add":  "",
+		}
+		for name, body := range stubs {
+			script := "#!/bin/sh\n" + body + "\n"
+			err = ioutil.WriteFile(filepath.Join(dir, name),
+				[]byte(script), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		c := exec.Command("/bin/sh", "-c", cmd)
+		c.Env = []string{"PATH=" + dir}
+		out, err := c.Output()
+		if (err != nil) != tc.err {
+			t.Fatalf("syspatch %s: unexpected error %v",
+				tc.syspatch, err)
+		}
+		if string(out) != tc.want {
+			t.Fatalf("syspatch %s: expected %q, got %q",
+				tc.syspatch, tc.want, out)
+		}
+	}
+
+	if _, err = scp.substitute("$reboot_required(now)"); err == nil {
+		t.Fatal("expected error for an argument")
+	}
+}
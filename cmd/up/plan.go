@@ -0,0 +1,614 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// plan records every command up will run, fully substituted, batched and in
+// order. Plans are written with -noop-exec and run with `up apply`, so a
+// deploy can be validated in CI without touching any servers and replayed
+// exactly later.
+type plan struct {
+	// Command being run.
+	Command up.CmdName
+
+	// Description of the command from its "##" comments, if any.
+	Description string
+
+	// Checksum of the directory when the plan was made.
+	Checksum string
+
+	// DeployID identifies the deploy, from -deploy-id or generated when
+	// the plan is made, and is substituted for $deploy_id. Applying the
+	// plan again, or a CI retry passing the same -deploy-id, reuses it.
+	DeployID string
+
+	// Upfile and Inventory from which the plan was made.
+	Upfile    planFile
+	Inventory planFile
+
+	// Hosts in the plan and their inventory settings, used to choose
+	// each host's transport.
+	Hosts map[string]up.Settings
+
+	// Needs are prerequisites run once locally, in order, before any
+	// group.
+	Needs []*planGroup
+
+	// Groups run concurrently. Each group's batches run in order.
+	Groups []*planGroup
+
+	// Unmatched tags given with -t which no host has, listed once the
+	// plan runs.
+	Unmatched []string
+
+	// Maintenance is each host's maintenance_status command, if the
+	// Upfile has one, run before the plan to refuse hosts in maintenance.
+	Maintenance planStep
+}
+
+// newDeployID generates a random ID for a deploy.
+func newDeployID() (string, error) {
+	byt := make([]byte, 8)
+	if _, err := rand.Read(byt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(byt), nil
+}
+
+// localServer is substituted for $server in prerequisites run once locally.
+const localServer = "localhost"
+
+// planGroup is the batches of a single command on a single tag. Composite
+// commands have a group for each command and tag they run.
+type planGroup struct {
+	Command up.CmdName
+	Tag     string
+	Batches []*planBatch
+}
+
+// planFile records the path and hash of a file used to make a plan.
+type planFile struct {
+	Path string
+	Hash string
+}
+
+// verify reports an error if the file's contents changed since planning.
+func (f planFile) verify() error {
+	if f.Path == "-" {
+		return errors.New("cannot verify upfile read from stdin")
+	}
+	byt, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("read file: %w", err)
+	}
+	if newPlanFile(f.Path, byt).Hash != f.Hash {
+		return fmt.Errorf("%s changed since planning", f.Path)
+	}
+	return nil
+}
+
+func newPlanFile(pth string, byt []byte) planFile {
+	sum := sha256.Sum256(byt)
+	return planFile{
+		Path: pth,
+		Hash: base64.URLEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// planBatch is a group of servers which run the same steps in parallel.
+type planBatch struct {
+	// Servers in the batch.
+	Servers []string
+
+	// Needs are prerequisites run on every server before anything else.
+	Needs []*planBatch
+
+	// ExecIfs are conditional steps. If there are any, Execs run only
+	// when at least one of them fails.
+	ExecIfs []planStep
+
+	// Drain steps remove servers from their load balancer before Execs
+	// run, and Undrain steps restore them after Execs succeed.
+	Drain   []planStep
+	Undrain []planStep
+
+	// Execs run on every server in order.
+	Execs []planStep
+
+	// State steps record what's deployed on each server after Execs run
+	// successfully.
+	State []planStep
+}
+
+// planStep maps each server to its fully substituted command for a single
+// step. Every server in a batch completes a step before any starts the next.
+type planStep map[string]string
+
+// makePlan resolves the command's prerequisites and ExecIfs and substitutes
+// all variables for each server in every batch. Groups are sorted by tag.
+func makePlan(
+	conf *up.Config,
+	name up.CmdName,
+	scp *scope,
+	chk string,
+	batches batch,
+	settings map[string]up.Settings,
+) (*plan, error) {
+	p := &plan{
+		Command:  name,
+		Checksum: chk,
+		Hosts:    map[string]up.Settings{},
+	}
+	if cmd, ok := conf.Commands[name]; ok {
+		p.Description = cmd.Description
+	}
+	needs := conf.Prerequisites(name)
+	for _, need := range needs {
+		if need.Each {
+			continue
+		}
+		b := &planBatch{Servers: []string{localServer}}
+		if err := b.add(conf, need.Command, scp); err != nil {
+			return nil, fmt.Errorf("%s: %w", need.Command, err)
+		}
+		p.Needs = append(p.Needs, &planGroup{
+			Command: need.Command,
+			Batches: []*planBatch{b},
+		})
+	}
+	for tag, srvBatch := range batches {
+		g := &planGroup{Command: name, Tag: tag}
+		for _, srvGroup := range srvBatch {
+			b := &planBatch{Servers: randomizeOrder(srvGroup)}
+			for _, server := range b.Servers {
+				p.Hosts[server] = settings[server]
+			}
+			for _, need := range needs {
+				if !need.Each {
+					continue
+				}
+				nb := &planBatch{Servers: b.Servers}
+				err := nb.add(conf, need.Command, scp)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w",
+						need.Command, err)
+				}
+				b.Needs = append(b.Needs, nb)
+			}
+			if err := b.add(conf, name, scp); err != nil {
+				return nil, err
+			}
+			g.Batches = append(g.Batches, b)
+		}
+		p.Groups = append(p.Groups, g)
+	}
+	sort.Slice(p.Groups, func(i, j int) bool {
+		return p.Groups[i].Tag < p.Groups[j].Tag
+	})
+	return p, nil
+}
+
+// add the steps of a command's ExecIfs, drains and Execs to the batch.
+func (b *planBatch) add(conf *up.Config, name up.CmdName, scp *scope) error {
+	cmd := conf.Commands[name]
+	for _, execIf := range cmd.ExecIfs {
+		steps := conf.Commands[execIf].Execs
+		for _, line := range steps {
+			step, err := b.step(scp, line)
+			if err != nil {
+				return fmt.Errorf("%s: %w", execIf, err)
+			}
+			b.ExecIfs = append(b.ExecIfs, step)
+		}
+	}
+	var err error
+	for _, drain := range cmd.Drain {
+		drain = conf.Resolve(drain)
+		b.Drain, err = b.steps(b.Drain, scp, conf.Commands[drain].Execs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", drain, err)
+		}
+	}
+	for _, undrain := range cmd.Undrain {
+		undrain = conf.Resolve(undrain)
+		b.Undrain, err = b.steps(b.Undrain, scp,
+			conf.Commands[undrain].Execs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", undrain, err)
+		}
+	}
+	b.Execs, err = b.steps(b.Execs, scp, cmd.Execs)
+	return err
+}
+
+// steps substitutes each line and appends it to steps. A line written
+// "each TAG: COMMAND" is repeated for every host with the tag, substituting
+// the host for $each. Literal blocks are a single step, never substituted.
+func (b *planBatch) steps(
+	steps []planStep,
+	scp *scope,
+	execs []string,
+) ([]planStep, error) {
+	for _, cmdLine := range execs {
+		if _, ok := up.Literal(cmdLine); ok {
+			step, err := b.step(scp, cmdLine)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+			continue
+		}
+		tag, cmdLine, ok := up.Each(cmdLine)
+		if !ok {
+			var err error
+			steps, err = b.stepsAs(steps, scp, cmdLine)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		hosts, err := scp.hostsWithTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("each %s: %w", tag, err)
+		}
+		for _, host := range hosts {
+			steps, err = b.stepsAs(steps, scp.with("each", host),
+				cmdLine)
+			if err != nil {
+				return nil, fmt.Errorf("each %s: %w", tag, err)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// stepsAs substitutes a line, which may be written "as USER: COMMAND", and
+// appends its steps to steps.
+func (b *planBatch) stepsAs(
+	steps []planStep,
+	scp *scope,
+	cmdLine string,
+) ([]planStep, error) {
+	user, cmdLine := up.RunAs(cmdLine)
+	cmdLine, err := scp.substitute(cmdLine)
+	if err != nil {
+		return nil, fmt.Errorf("substitute: %w", err)
+	}
+
+	// We may have substituted a variable with a multi-line command,
+	// every line of which runs as the user
+	lines := strings.Split(cmdLine, "\n")
+	for _, line := range lines {
+		if user != "" {
+			line = fmt.Sprintf("as %s: %s", user, line)
+		}
+		step, err := b.step(scp, line)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// addState records each server's state with the named command after its
+// Execs run successfully. The state is substituted as $state.
+func (p *plan) addState(
+	conf *up.Config,
+	name up.CmdName,
+	scp *scope,
+	version string,
+) error {
+	cmd, ok := conf.Commands[name]
+	if !ok {
+		return fmt.Errorf("undefined command: %s", name)
+	}
+	now := time.Now().UTC()
+	for _, g := range p.Groups {
+		byt, err := json.Marshal(up.State{
+			Checksum: p.Checksum,
+			Command:  g.Command,
+			Time:     now,
+			Version:  version,
+			DeployID: p.DeployID,
+		})
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		stateScp := scp.with("state", string(byt))
+		for _, b := range g.Batches {
+			for _, line := range cmd.Execs {
+				step, err := b.step(stateScp, line)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				b.State = append(b.State, step)
+			}
+		}
+	}
+	return nil
+}
+
+// addMaintenance records each host's maintenance_status command, if the
+// Upfile has one, so the plan can refuse hosts in maintenance however it's
+// run.
+func (p *plan) addMaintenance(conf *up.Config, scp *scope) error {
+	cmd, ok := conf.Commands[maintenanceStatus]
+	if !ok {
+		return nil
+	}
+	text := strings.Join(cmd.Execs, "\n")
+	p.Maintenance = make(planStep, len(p.Hosts))
+	for host := range p.Hosts {
+		line, err := scp.withServer(host).substitute(text)
+		if err != nil {
+			return fmt.Errorf("%s: substitute: %w",
+				maintenanceStatus, err)
+		}
+		p.Maintenance[host] = line
+	}
+	return nil
+}
+
+// merge adds the prerequisites, groups and hosts of another plan, so the
+// commands of a composite command run together. Prerequisites shared by
+// several commands run once.
+func (p *plan) merge(other *plan) {
+	for _, need := range other.Needs {
+		var dupe bool
+		for _, existing := range p.Needs {
+			if existing.Command == need.Command {
+				dupe = true
+				break
+			}
+		}
+		if !dupe {
+			p.Needs = append(p.Needs, need)
+		}
+	}
+	p.Groups = append(p.Groups, other.Groups...)
+	for host, s := range other.Hosts {
+		p.Hosts[host] = s
+	}
+}
+
+// step substitutes a line for each server in the batch. Lines which don't
+// depend on the server are substituted once and shared. Literal blocks run
+// as written.
+func (b *planBatch) step(scp *scope, line string) (planStep, error) {
+	step := make(planStep, len(b.Servers))
+	if script, ok := up.Literal(line); ok {
+		for _, server := range b.Servers {
+			step[server] = script
+		}
+		return step, nil
+	}
+	cmd, same, err := scp.serverIndependent(line)
+	if err != nil {
+		return nil, fmt.Errorf("substitute: %w", err)
+	}
+	if same {
+		for _, server := range b.Servers {
+			step[server] = cmd
+		}
+		return step, nil
+	}
+	for _, server := range b.Servers {
+		cmd, err := scp.withServer(server).substitute(line)
+		if err != nil {
+			return nil, fmt.Errorf("substitute: %w", err)
+		}
+		step[server] = cmd
+	}
+	return step, nil
+}
+
+// commandTags reports the tags on which each command in the plan runs.
+func (p *plan) commandTags() map[up.CmdName][]string {
+	tags := map[up.CmdName][]string{}
+	for _, g := range p.Groups {
+		tags[g.Command] = append(tags[g.Command], g.Tag)
+	}
+	return tags
+}
+
+func writePlan(pth string, p *plan) error {
+	byt, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err = ioutil.WriteFile(pth, append(byt, '\n'), 0644); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	return nil
+}
+
+func readPlan(pth string) (*plan, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	return parsePlan(byt)
+}
+
+func parsePlan(byt []byte) (*plan, error) {
+	var p plan
+	if err := json.Unmarshal(byt, &p); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &p, nil
+}
+
+// printPlan describes each batch and the commands it will run.
+func printPlan(w io.Writer, p *plan) {
+	fmt.Fprintf(w, "plan: %s (checksum %s)\n", p.Command, p.Checksum)
+	if p.DeployID != "" {
+		fmt.Fprintf(w, "deploy id: %s\n", p.DeployID)
+	}
+	for _, g := range p.Needs {
+		fmt.Fprintf(w, "\nneeds %s (once, locally)\n", g.Command)
+		for _, b := range g.Batches {
+			printSteps(w, b, localServer, "")
+		}
+	}
+	for _, g := range p.Groups {
+		name := g.Tag
+		if g.Command != p.Command {
+			name = fmt.Sprintf("%s (%s)", g.Tag, g.Command)
+		}
+		for i, b := range g.Batches {
+			fmt.Fprintf(w, "\n%s batch %d/%d\n", name, i+1,
+				len(g.Batches))
+			for _, server := range b.Servers {
+				fmt.Fprintf(w, "\t[%s]\n", server)
+				for _, need := range b.Needs {
+					printSteps(w, need, server, "needs: ")
+				}
+				printSteps(w, b, server, "")
+			}
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// printSteps describes the steps a batch runs on a server, each line
+// starting with prefix.
+func printSteps(w io.Writer, b *planBatch, server, prefix string) {
+	for _, step := range b.ExecIfs {
+		fmt.Fprintf(w, "\t\t%sif fails: %s\n", prefix, step[server])
+	}
+	for _, step := range b.Drain {
+		fmt.Fprintf(w, "\t\t%sdrain: %s\n", prefix, step[server])
+	}
+	for _, step := range b.Execs {
+		fmt.Fprintf(w, "\t\t%s%s\n", prefix, step[server])
+	}
+	for _, step := range b.Undrain {
+		fmt.Fprintf(w, "\t\t%sundrain: %s\n", prefix, step[server])
+	}
+	for _, step := range b.State {
+		fmt.Fprintf(w, "\t\t%sstate: %s\n", prefix, step[server])
+	}
+}
+
+// planCmd writes a plan to run later with `up apply`. It accepts the same
+// flags as up itself.
+func planCmd(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	out := fs.String("o", "plan.json", "path to write the plan")
+	flgs, err := parseFlags(fs, args)
+	if err != nil {
+		return usage(fmt.Errorf("parse flags: %w", err))
+	}
+	flgs.NoopExec = *out
+	return deploy(flgs)
+}
+
+// applyCmd runs a plan previously written with `up plan` or -noop-exec,
+// refusing if the Upfile or inventory changed since it was planned.
+func applyCmd(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	parseRun := addRunFlags(fs)
+	force := fs.Bool("force", false, "apply even if the upfile or inventory changed, though not to hosts in maintenance (default false)")
+	signers := fs.String("allowed-signers", "", "require the plan be signed by a key in this ssh allowed signers file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage(errors.New("apply requires a plan"))
+	}
+	run, err := parseRun()
+	if err != nil {
+		return err
+	}
+	setLogOutput(os.Stderr, run.Timestamps)
+	var statusLog io.Writer
+	if run.StatusLine != "" {
+		fi, err := startStatusLine(run.StatusLine, run.Timestamps)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		statusLog = fi
+	}
+
+	// Verify and parse the same bytes, so the plan can't change between
+	// the two
+	byt, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read plan: %w", err)
+	}
+	if *signers != "" {
+		principal, err := verifyPlan(fs.Arg(0), byt, *signers)
+		if err != nil {
+			return fmt.Errorf("verify plan: %w", err)
+		}
+		log.Printf("plan signed by %s\n", principal)
+	}
+	p, err := parsePlan(byt)
+	if err != nil {
+		return fmt.Errorf("parse plan: %w", err)
+	}
+	if !*force {
+		if err = p.Upfile.verify(); err != nil {
+			return fmt.Errorf("verify upfile: %w", err)
+		}
+		if err = p.Inventory.verify(); err != nil {
+			return fmt.Errorf("verify inventory: %w", err)
+		}
+	}
+	for cmd, tags := range p.commandTags() {
+		err = checkPolicy(run.Policy, run.Identity, cmd, tags)
+		if err != nil {
+			return fmt.Errorf("check policy: %w", err)
+		}
+	}
+	var prm *prompter
+	if run.Prompt {
+		prm, err = newPrompter(run.PromptAuto, run.PromptTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	transports, err := makeTransports(p.Hosts)
+	if err != nil {
+		return fmt.Errorf("make transports: %w", err)
+	}
+	if !run.IgnoreMaintenance {
+		if err = checkMaintenance(p, transports); err != nil {
+			return err
+		}
+	}
+	if p.DeployID != "" {
+		log.Printf("applying %s as deploy %s\n", p.Command, p.DeployID)
+	} else {
+		log.Printf("applying %s\n", p.Command)
+	}
+	rep, err := run.reporting(p.Command, ".", statusLog)
+	if err != nil {
+		return err
+	}
+	err = run.runner(transports, p.Checksum).runReported(p, prm, rep)
+	if err != nil {
+		return err
+	}
+	log.Println("success")
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestMakePlan(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy check
+	echo $server $checksum
+	$multi
+
+check
+	curl $server/version
+
+multi
+	echo a
+	echo b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(nil, conf.Commands).with("checksum", "abc")
+	batches := batch{"web": [][]string{{"1.1.1.1"}, {"2.2.2.2"}}}
+	settings := map[string]up.Settings{"1.1.1.1": {User: "x"}}
+	p, err := makePlan(conf, conf.DefaultCommand, scp, "abc", batches,
+		settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Groups) != 1 || p.Groups[0].Tag != "web" {
+		t.Fatalf("expected web group, got %+v", p.Groups)
+	}
+	if len(p.Groups[0].Batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d",
+			len(p.Groups[0].Batches))
+	}
+	if p.Hosts["1.1.1.1"].User != "x" {
+		t.Fatalf("expected settings, got %+v", p.Hosts)
+	}
+	for _, b := range p.Groups[0].Batches {
+		srv := b.Servers[0]
+		want := &planBatch{
+			Servers: []string{srv},
+			ExecIfs: []planStep{{srv: "curl " + srv + "/version"}},
+			Execs: []planStep{
+				{srv: "echo " + srv + " abc"},
+				{srv: "echo a"},
+				{srv: "echo b"},
+			},
+		}
+		if !reflect.DeepEqual(b, want) {
+			t.Fatalf("expected %+v, got %+v", want, b)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "up-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "plan.json")
+	if err = writePlan(pth, p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPlan(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("expected %+v, got %+v", p, got)
+	}
+}
+
+func TestPlanFileVerify(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "Upfile")
+	if err = ioutil.WriteFile(pth, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := newPlanFile(pth, []byte("a"))
+	if err = f.verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pth, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.verify(); err == nil {
+		t.Fatal("expected error after change")
+	}
+	if err = newPlanFile("-", nil).verify(); err == nil {
+		t.Fatal("expected error for stdin")
+	}
+}
+
+func TestMakePlanNeeds(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy needs build needs-each migrate
+	echo deploy $server
+
+build
+	echo build $checksum
+
+migrate
+	echo migrate $server
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(nil, conf.Commands).with("checksum", "abc")
+	batches := batch{"deploy": [][]string{{"1.1.1.1"}}}
+	p, err := makePlan(conf, "deploy", scp, "abc", batches, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*planGroup{{
+		Command: "build",
+		Batches: []*planBatch{{
+			Servers: []string{localServer},
+			Execs:   []planStep{{localServer: "echo build abc"}},
+		}},
+	}}
+	if !reflect.DeepEqual(p.Needs, want) {
+		t.Fatalf("expected %+v, got %+v", want, p.Needs)
+	}
+	b := p.Groups[0].Batches[0]
+	wantNeeds := []*planBatch{{
+		Servers: []string{"1.1.1.1"},
+		Execs:   []planStep{{"1.1.1.1": "echo migrate 1.1.1.1"}},
+	}}
+	if !reflect.DeepEqual(b.Needs, wantNeeds) {
+		t.Fatalf("expected %+v, got %+v", wantNeeds, b.Needs)
+	}
+}
+
+func TestMakePlanRunAs(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy
+	as $owner: $restart
+
+restart
+	cd /srv/$server
+	./restart
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(map[string]string{"owner": "app"}, conf.Commands)
+	batches := batch{"deploy": [][]string{{"1.1.1.1"}}}
+	p, err := makePlan(conf, "deploy", scp, "abc", batches, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []planStep{
+		{"1.1.1.1": "as app: cd /srv/1.1.1.1"},
+		{"1.1.1.1": "as app: ./restart"},
+	}
+	got := p.Groups[0].Batches[0].Execs
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestMakePlanEach(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy
+	echo > peers
+	each redis: as app: echo $each:6379 >> peers.$server
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := up.ParseInventoryFile(strings.NewReader(`{
+		"1.1.1.1": ["deploy"],
+		"2.2.2.2": ["redis"],
+		"3.3.3.3": ["redis"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(nil, conf.Commands).withInventory(inv)
+	batches := batch{"deploy": [][]string{{"1.1.1.1"}}}
+	p, err := makePlan(conf, "deploy", scp, "abc", batches, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []planStep{
+		{"1.1.1.1": "echo > peers"},
+		{"1.1.1.1": "as app: echo 2.2.2.2:6379 >> peers.1.1.1.1"},
+		{"1.1.1.1": "as app: echo 3.3.3.3:6379 >> peers.1.1.1.1"},
+	}
+	got := p.Groups[0].Batches[0].Execs
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	_, err = makePlan(conf, "deploy", newScope(nil, conf.Commands), "abc",
+		batches, nil)
+	if err == nil {
+		t.Fatal("expected error without an inventory")
+	}
+}
+
+func TestAddStateDeployID(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy
+	echo $deploy_id
+
+write_state
+	echo '$state'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(nil, conf.Commands).with("deploy_id", "ci-42")
+	batches := batch{"deploy": [][]string{{"1.1.1.1"}}}
+	p, err := makePlan(conf, "deploy", scp, "abc", batches, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.DeployID = "ci-42"
+	if err = p.addState(conf, "write_state", scp, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	b := p.Groups[0].Batches[0]
+	if got := b.Execs[0]["1.1.1.1"]; got != "echo ci-42" {
+		t.Fatalf("unexpected exec %q", got)
+	}
+	line := strings.TrimPrefix(b.State[0]["1.1.1.1"], "echo ")
+	var state up.State
+	err = json.Unmarshal([]byte(strings.Trim(line, "'")), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.DeployID != "ci-42" || state.Checksum != "abc" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestMakePlanLiteral(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader("deploy\n" +
+		"\techo $server\n\t```\n\tawk '{ print $server }'\n\t```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(nil, conf.Commands)
+	batches := batch{"deploy": [][]string{{"1.1.1.1"}}}
+	p, err := makePlan(conf, "deploy", scp, "abc", batches, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []planStep{
+		{"1.1.1.1": "echo 1.1.1.1"},
+		{"1.1.1.1": "awk '{ print $server }'"},
+	}
+	got := p.Groups[0].Batches[0].Execs
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
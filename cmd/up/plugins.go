@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/plugin"
+)
+
+// loadPlugins runs each plugin once, merging the hosts of inventory
+// providers into the inventory and the variables of vars providers into
+// vars. Variables which are already set, e.g. in the environment, take
+// precedence, so operators can override a plugin.
+func loadPlugins(
+	paths []string,
+	invFile *up.InventoryFile,
+	vars map[string]string,
+	cmd up.CmdName,
+	deployID string,
+	tags map[string]struct{},
+) error {
+	req := plugin.VarsRequest{Command: string(cmd), DeployID: deployID}
+	for tag := range tags {
+		req.Tags = append(req.Tags, tag)
+	}
+	sort.Strings(req.Tags)
+	for _, pth := range paths {
+		if err := loadPlugin(pth, invFile, vars, req); err != nil {
+			return fmt.Errorf("%s: %w", pth, err)
+		}
+	}
+	return nil
+}
+
+func loadPlugin(
+	pth string,
+	invFile *up.InventoryFile,
+	vars map[string]string,
+	req plugin.VarsRequest,
+) error {
+	c, err := plugin.Start(pth)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	log.Printf("loaded plugin %s %s\n", c.Info.Name, c.Info.Version)
+
+	if c.Provides("inventory") {
+		inv, err := c.Inventory()
+		if err != nil {
+			return fmt.Errorf("inventory: %w", err)
+		}
+		for host, tags := range inv {
+			invFile.Hosts[host] = mergeTags(invFile.Hosts[host],
+				tags)
+		}
+	}
+	if c.Provides("vars") {
+		pluginVars, err := c.Vars(req)
+		if err != nil {
+			return fmt.Errorf("vars: %w", err)
+		}
+		for name, val := range pluginVars {
+			if _, exist := vars[name]; !exist {
+				vars[name] = val
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTags reports the sorted union of two lists of tags.
+func mergeTags(a, b []string) []string {
+	seen := map[string]struct{}{}
+	var tags []string
+	for _, tag := range append(append([]string{}, a...), b...) {
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMergeTags(t *testing.T) {
+	t.Parallel()
+	got := mergeTags([]string{"web", "db"}, []string{"cloud", "web"})
+	if want := "[cloud db web]"; fmt.Sprint(got) != want {
+		t.Fatalf("expected %s, got %v", want, got)
+	}
+}
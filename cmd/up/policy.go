@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// policy restricts who may run which commands against which tags. A request
+// is allowed if any single rule matches the identity, the command, and every
+// targeted tag. Without a policy file, everything is allowed.
+//
+// The identity is the OS user, unless the user may act as another, e.g. a CI
+// runner deploying on behalf of whoever triggered it:
+//
+//	{
+//		"rules": [
+//			{"users": ["*"], "commands": ["deploy_*"], "tags": ["*_staging"]},
+//			{"users": ["alice"], "commands": ["*"], "tags": ["*"]}
+//		],
+//		"assume": [
+//			{"users": ["ci"], "identities": ["*"]}
+//		]
+//	}
+type policy struct {
+	Rules  []policyRule `json:"rules"`
+	Assume []assumeRule `json:"assume"`
+}
+
+// assumeRule allows the listed OS users to act as the identities with -as.
+// Each entry is a glob as understood by path.Match.
+type assumeRule struct {
+	Users      []string `json:"users"`
+	Identities []string `json:"identities"`
+}
+
+// systemPolicy is enforced whenever it exists, as well as any other policy
+// given, so leaving out -policy can't get around it.
+const systemPolicy = "/etc/up/policy.json"
+
+// policyRule allows the listed users to run commands against tags. Each entry
+// is a glob as understood by path.Match.
+type policyRule struct {
+	Users    []string `json:"users"`
+	Commands []string `json:"commands"`
+	Tags     []string `json:"tags"`
+}
+
+func readPolicy(pth string) (*policy, error) {
+	fi, err := os.Open(pth)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer fi.Close()
+	var p policy
+	dec := json.NewDecoder(fi)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	var patterns []string
+	for _, r := range p.Rules {
+		patterns = append(patterns, r.patterns()...)
+	}
+	for _, r := range p.Assume {
+		patterns = append(patterns, r.Users...)
+		patterns = append(patterns, r.Identities...)
+	}
+	for _, pattern := range patterns {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern,
+				err)
+		}
+	}
+	return &p, nil
+}
+
+// check reports an error if the OS user may not act as identity, or if
+// identity may not run cmd against all of the tags. An empty identity is the
+// OS user.
+func (p *policy) check(
+	user, identity string,
+	cmd up.CmdName,
+	tags []string,
+) error {
+	if identity == "" || identity == user {
+		return p.allow(user, cmd, tags)
+	}
+	for _, r := range p.Assume {
+		if matchAny(r.Users, user) && matchAny(r.Identities, identity) {
+			return p.allow(identity, cmd, tags)
+		}
+	}
+	return fmt.Errorf("%s may not act as %s", user, identity)
+}
+
+// allow reports an error if no rule permits identity to run cmd against all
+// of the tags.
+func (p *policy) allow(identity string, cmd up.CmdName, tags []string) error {
+	for _, r := range p.Rules {
+		if r.allows(identity, cmd, tags) {
+			return nil
+		}
+	}
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return fmt.Errorf("%s may not run %s on %s", identity, cmd,
+		strings.Join(sorted, ", "))
+}
+
+func (r policyRule) allows(
+	identity string,
+	cmd up.CmdName,
+	tags []string,
+) bool {
+	if !matchAny(r.Users, identity) || !matchAny(r.Commands, string(cmd)) {
+		return false
+	}
+	for _, tag := range tags {
+		if !matchAny(r.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r policyRule) patterns() []string {
+	var patterns []string
+	patterns = append(patterns, r.Users...)
+	patterns = append(patterns, r.Commands...)
+	return append(patterns, r.Tags...)
+}
+
+// matchAny reports whether s matches any of the glob patterns. Patterns are
+// validated when the policy is read.
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFlags choose the policy enforced by subcommands which run on hosts,
+// and who it's checked for.
+type policyFlags struct {
+	Path     string
+	Identity string
+}
+
+// addPolicyFlags defines the policyFlags on fs.
+func addPolicyFlags(fs *flag.FlagSet) *policyFlags {
+	var f policyFlags
+	fs.StringVar(&f.Path, "policy", "", "path to policy restricting who may run commands, enforced with "+systemPolicy+" (default $UP_POLICY)")
+	fs.StringVar(&f.Identity, "as", "", "identity checked against the policy, if it lets the current user act as it (defaults to the current user)")
+	return &f
+}
+
+// check enforces the policy for running cmd against the tags.
+func (f *policyFlags) check(cmd up.CmdName, tags []string) error {
+	if err := checkPolicy(f.Path, f.Identity, cmd, tags); err != nil {
+		return fmt.Errorf("check policy: %w", err)
+	}
+	return nil
+}
+
+// checkPolicy enforces the system policy, if it exists, and the policy file
+// at pth, which defaults to $UP_POLICY, for identity. An empty identity is
+// the current OS user.
+func checkPolicy(
+	pth, identity string,
+	cmd up.CmdName,
+	tags []string,
+) error {
+	paths, err := policyPaths(systemPolicy, pth)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	user, err := resolveIdentity("")
+	if err != nil {
+		return err
+	}
+	for _, pth := range paths {
+		p, err := readPolicy(pth)
+		if err != nil {
+			return fmt.Errorf("read policy %s: %w", pth, err)
+		}
+		if err = p.check(user, identity, cmd, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyPaths lists the policies to enforce: system, if it exists, and pth,
+// which defaults to $UP_POLICY. A system policy which can't be checked for
+// is an error rather than skipped.
+func policyPaths(system, pth string) ([]string, error) {
+	var paths []string
+	_, err := os.Stat(system)
+	switch {
+	case err == nil:
+		paths = append(paths, system)
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("stat policy: %w", err)
+	}
+	if pth == "" {
+		pth = os.Getenv("UP_POLICY")
+	}
+	if pth != "" && pth != system {
+		paths = append(paths, pth)
+	}
+	return paths, nil
+}
+
+// resolveIdentity defaults an empty identity to the current OS user.
+func resolveIdentity(identity string) (string, error) {
+	if identity != "" {
+		return identity, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("current user: %w", err)
+	}
+	return u.Username, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(pth, []byte(`{"rules": [
+		{"users": ["*"], "commands": ["deploy_*"], "tags": ["*_staging"]},
+		{"users": ["alice"], "commands": ["*"], "tags": ["*"]}
+	], "assume": [
+		{"users": ["ci"], "identities": ["alice", "bob"]}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPolicy(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		user     string
+		identity string
+		cmd      string
+		tags     []string
+		wantErr  bool
+	}{
+		{"bob", "", "deploy_web", []string{"web_staging"}, false},
+		{"bob", "bob", "deploy_web", []string{"web_staging"}, false},
+		{"bob", "", "deploy_web", []string{"web_staging", "web"}, true},
+		{"bob", "", "reboot", []string{"web_staging"}, true},
+		{"alice", "", "reboot", []string{"web", "db"}, false},
+
+		// Only users the policy allows may act as someone else
+		{"bob", "alice", "reboot", []string{"web"}, true},
+		{"ci", "alice", "reboot", []string{"web"}, false},
+		{"ci", "bob", "reboot", []string{"web"}, true},
+		{"ci", "carol", "deploy_web", []string{"web_staging"}, true},
+	}
+	for _, tc := range tcs {
+		err := p.check(tc.user, tc.identity, up.CmdName(tc.cmd),
+			tc.tags)
+		if tc.wantErr && err == nil {
+			t.Fatalf("%+v: expected error", tc)
+		}
+		if !tc.wantErr && err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+	}
+}
+
+func TestPolicyPaths(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	system := filepath.Join(dir, "system.json")
+	other := filepath.Join(dir, "other.json")
+
+	// The system policy is enforced whenever it exists, whatever else is
+	// given
+	paths, err := policyPaths(system, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint([]string{other}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	if err = ioutil.WriteFile(system, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err = policyPaths(system, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint([]string{system, other}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	paths, err = policyPaths(system, system)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint([]string{system}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+}
+
+func TestSelectHostsPolicy(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inv := filepath.Join(dir, "inventory.json")
+	err = ioutil.WriteFile(inv, []byte(`{"10.0.0.1": ["web"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pth := filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(pth, []byte(`{"rules": [
+		{"users": ["*"], "commands": ["status"], "tags": ["*"]}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subcommands which run on hosts check the policy when selecting them
+	pol := &policyFlags{Path: pth}
+	if _, err = selectHosts(inv, "status", "web", pol); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = selectHosts(inv, "run", "web", pol); err == nil {
+		t.Fatal("expected run to be denied")
+	}
+	pol.Identity = "someone-else"
+	if _, err = selectHosts(inv, "status", "web", pol); err == nil {
+		t.Fatal("expected -as to be denied")
+	}
+}
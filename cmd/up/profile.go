@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiles are files to which profiles of a deploy are written, for go tool
+// pprof and go tool trace. Empty paths aren't profiled.
+type profiles struct {
+	cpu   string
+	mem   string
+	trace string
+}
+
+// start profiling, reporting a function which stops and writes every profile.
+// The memory profile is written when stopping, so it includes everything
+// allocated while deploying.
+func (p profiles) start() (func() error, error) {
+	var stops []func() error
+	stop := func() error {
+		var first error
+		for i := len(stops) - 1; i >= 0; i-- {
+			if err := stops[i](); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	if p.cpu != "" {
+		fi, err := os.Create(p.cpu)
+		if err != nil {
+			return nil, fmt.Errorf("create cpu profile: %w", err)
+		}
+		if err = pprof.StartCPUProfile(fi); err != nil {
+			fi.Close()
+			return nil, fmt.Errorf("start cpu profile: %w", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return fi.Close()
+		})
+	}
+	if p.trace != "" {
+		fi, err := os.Create(p.trace)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("create trace: %w", err)
+		}
+		if err = trace.Start(fi); err != nil {
+			fi.Close()
+			stop()
+			return nil, fmt.Errorf("start trace: %w", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return fi.Close()
+		})
+	}
+	if p.mem != "" {
+		stops = append(stops, func() error {
+			fi, err := os.Create(p.mem)
+			if err != nil {
+				return fmt.Errorf("create mem profile: %w", err)
+			}
+			defer fi.Close()
+			runtime.GC()
+			if err = pprof.WriteHeapProfile(fi); err != nil {
+				return fmt.Errorf("write mem profile: %w", err)
+			}
+			return nil
+		})
+	}
+	return stop, nil
+}
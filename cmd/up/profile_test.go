@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	// Not parallel, since only one CPU profile and trace may run at once
+	dir, err := ioutil.TempDir("", "up-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := profiles{
+		cpu:   filepath.Join(dir, "cpu.pprof"),
+		mem:   filepath.Join(dir, "mem.pprof"),
+		trace: filepath.Join(dir, "trace.out"),
+	}
+	stop, err := p.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{p.cpu, p.mem, p.trace} {
+		fi, err := os.Stat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == 0 {
+			t.Fatalf("%s is empty", pth)
+		}
+	}
+
+	stop, err = profiles{}.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = profiles{cpu: filepath.Join(dir, "missing", "cpu")}.start()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// promoteCmd deploys exactly the version running on the -from hosts to the
+// -to hosts, e.g. staging to production. It refuses unless every -from host
+// reports the local version, read as with up status, so what reaches
+// production is what was tested. Every other flag is the same as deploying.
+func promoteCmd(args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	from := fs.String("from", "", "tags whose hosts must be running the local version, e.g. staging")
+	to := fs.String("to", "", "tags to deploy the version to, e.g. production")
+	stateCmd := fs.String("status-c", "", "command printing a host's state, as with up status -c")
+	stateURL := fs.String("status-url", "", "command holding the URL of each host's version endpoint, as with up status -url")
+	flgs, err := parseFlags(fs, args)
+	if err != nil {
+		return usage(fmt.Errorf("parse flags: %w", err))
+	}
+	if *from == "" || *to == "" {
+		return usage(errors.New("promote requires -from and -to"))
+	}
+	if (*stateCmd == "") == (*stateURL == "") {
+		return usage(errors.New(
+			"promote requires one of -status-c or -status-url"))
+	}
+	if len(flgs.Tags) > 0 {
+		return usage(errors.New(
+			"promote deploys to -to rather than -t"))
+	}
+	if flgs.Stdin {
+		return usage(errors.New("promote can't read the upfile from " +
+			"stdin"))
+	}
+
+	fi, err := os.Open(flgs.Upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	name := conf.Resolve(up.CmdName(*stateCmd + *stateURL))
+	cmd, ok := conf.Commands[name]
+	if !ok {
+		return fmt.Errorf("undefined command: %s", name)
+	}
+	transports, err := selectHosts(flgs.Inventory, name, *from,
+		&policyFlags{Path: flgs.Policy, Identity: flgs.Identity})
+	if err != nil {
+		return err
+	}
+
+	// The version is calculated as the deploy would, then passed to it
+	// as -version-id, so a tree changed in the meantime can't deploy
+	// anything else
+	versionFrom := flgs.VersionFrom
+	deployed, ok := conf.Commands[conf.Resolve(flgs.Command)]
+	if ok && versionFrom == "" {
+		versionFrom = deployed.Version
+	}
+	src, err := newVersionSource(versionFrom, flgs.VersionID,
+		flgs.Directory, flgs.ChecksumOpts)
+	if err != nil {
+		return err
+	}
+	chk, err := src.version()
+	if err != nil {
+		return fmt.Errorf("calc version: %w", err)
+	}
+	scp := newScope(flgs.Vars, conf.Commands).with("checksum", chk)
+	sums, err := namedChecksums(conf.Checksums,
+		filepath.Dir(flgs.Upfile), flgs.ChecksumOpts)
+	if err != nil {
+		return fmt.Errorf("calc checksum: %w", err)
+	}
+	for name, sum := range sums {
+		scp = scp.with(name, sum)
+	}
+	text := strings.Join(cmd.Execs, "\n")
+	read := func(host string) (*up.State, error) {
+		return readState(transports[host], scp, host, text)
+	}
+	if *stateURL != "" {
+		opts := append([]httpclient.Option{
+			httpclient.WithTimeout(5 * time.Second),
+		}, flgs.HTTP.options()...)
+		client, err := httpclient.New(opts...)
+		if err != nil {
+			return err
+		}
+		read = func(host string) (*up.State, error) {
+			return fetchState(client, scp, host, text)
+		}
+	}
+	statuses := readStatuses(transports, read)
+	var differ int
+	for _, s := range statuses {
+		if s.Err != nil || s.State.Checksum != chk {
+			differ++
+		}
+	}
+	if differ > 0 {
+		printStatus(os.Stdout, statuses, chk)
+		return fmt.Errorf("%d/%d hosts in %s aren't running %s",
+			differ, len(statuses), *from, chk)
+	}
+	log.Printf("promoting %s from %s to %s\n", chk, *from, *to)
+
+	flgs.VersionID, flgs.VersionFrom = chk, ""
+	flgs.Tags = map[string]struct{}{}
+	for _, tag := range strings.Split(*to, ",") {
+		flgs.Tags[tag] = struct{}{}
+	}
+	stop, err := flgs.Profiles.start()
+	if err != nil {
+		return err
+	}
+	err = deploy(flgs)
+	if stopErr := stop(); stopErr != nil && err == nil {
+		err = fmt.Errorf("profile: %w", stopErr)
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// prompter asks whether to continue between batches. It's shared by every
+// group running concurrently, so only one prompt is shown at a time.
+type prompter struct {
+	mu  sync.Mutex
+	rdr *bufio.Reader
+	out io.Writer
+
+	// auto answers every prompt without asking when set to "continue"
+	// or "abort".
+	auto string
+
+	// timeout, if set, answers a prompt nobody has answered in time with
+	// timeoutAnswer, either "continue" or "abort".
+	timeout       time.Duration
+	timeoutAnswer string
+
+	// lines read from rdr in the background, so a prompt can time out
+	// without losing input typed afterward.
+	once  sync.Once
+	lines chan promptLine
+}
+
+type promptLine struct {
+	text string
+	err  error
+}
+
+// newPrompter prompts on stdin. If stdin isn't a terminal, as in CI, auto
+// decides how to answer rather than blocking forever, and it's an error for
+// auto to be empty. If timeout is set, prompts left unanswered that long are
+// answered with auto, or "continue" if it's empty.
+func newPrompter(auto string, timeout time.Duration) (*prompter, error) {
+	switch auto {
+	case "", "continue", "abort":
+	default:
+		return nil, fmt.Errorf(
+			"unknown -p-auto %q: must be continue or abort", auto)
+	}
+	prm := &prompter{
+		rdr:           bufio.NewReader(os.Stdin),
+		out:           os.Stdout,
+		timeout:       timeout,
+		timeoutAnswer: auto,
+	}
+	if prm.timeoutAnswer == "" {
+		prm.timeoutAnswer = "continue"
+	}
+	if !isTerminal(os.Stdin) {
+		if auto == "" {
+			return nil, errors.New("-p requires stdin to be a " +
+				"terminal, use -p-auto to continue or abort " +
+				"without one")
+		}
+		prm.auto = auto
+	}
+	return prm, nil
+}
+
+// confirm prompts the user and asks if up should continue.
+func (p *prompter) confirm(ips []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintln(p.out, "done with", ips)
+	switch p.auto {
+	case "continue":
+		fmt.Fprintln(p.out, "continuing: stdin is not a terminal")
+		return nil
+	case "abort":
+		return errors.New("stopping up: stdin is not a terminal")
+	}
+	p.once.Do(func() {
+		p.lines = make(chan promptLine)
+		go p.readLines()
+	})
+	var expired <-chan time.Time
+	if p.timeout > 0 {
+		t := time.NewTimer(p.timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		fmt.Fprintf(p.out, "do you want to continue? [Y/n] ")
+		var line promptLine
+		select {
+		case line = <-p.lines:
+		case <-expired:
+			fmt.Fprintln(p.out)
+			if p.timeoutAnswer == "abort" {
+				return fmt.Errorf("stopping up: "+
+					"no answer in %s", p.timeout)
+			}
+			fmt.Fprintf(p.out, "continuing: no answer in %s\n",
+				p.timeout)
+			return nil
+		}
+		if line.err != nil {
+			return fmt.Errorf("failed to read: %w", line.err)
+		}
+		shouldContinue := strings.TrimSuffix(line.text, "\n")
+		switch strings.ToLower(shouldContinue) {
+		case "y", "yes", "":
+			return nil
+		case "n", "no":
+			return errors.New("stopping up")
+		default:
+			fmt.Fprintf(p.out, "unknown input: %s\n",
+				shouldContinue)
+		}
+	}
+}
+
+// readLines sends each line of input to p.lines until the first error.
+func (p *prompter) readLines() {
+	for {
+		text, err := p.rdr.ReadString('\n')
+		p.lines <- promptLine{text: text, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// promptVars asks for the value of each variable named which isn't set in
+// vars, setting it. read reads a line of input, which isn't shown when
+// secret is set. Values which don't match the type declared for them are
+// asked for again.
+func promptVars(read func(secret bool) (string, error), out io.Writer,
+	conf *up.Config, vars map[string]string, names []string) error {
+	for _, name := range names {
+		v := conf.Vars[name]
+		for {
+			fmt.Fprintf(out, "%s: ", name)
+			val, err := read(v.Type == "secret")
+			if err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			}
+			if err = v.Check(val); err != nil {
+				fmt.Fprintf(out, "invalid %s: %s\n", name, err)
+				continue
+			}
+			vars[name] = val
+			break
+		}
+	}
+	return nil
+}
+
+// terminalReader reads lines from a terminal for promptVars, turning off echo
+// for secrets.
+func terminalReader(f *os.File, out io.Writer) func(bool) (string, error) {
+	rdr := bufio.NewReader(f)
+	return func(secret bool) (string, error) {
+		var line string
+		readLine := func() error {
+			var err error
+			line, err = rdr.ReadString('\n')
+			return err
+		}
+		if !secret {
+			err := readLine()
+			return strings.TrimSuffix(line, "\n"), err
+		}
+
+		// The newline typed isn't echoed either
+		err := withoutEcho(f, readLine)
+		fmt.Fprintln(out)
+		return strings.TrimSuffix(line, "\n"), err
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestPrompterConfirm(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		auto    string
+		input   string
+		wantErr bool
+	}{
+		{input: "\n"},
+		{input: "maybe\nyes\n"},
+		{input: "n\n", wantErr: true},
+		{input: "", wantErr: true},
+		{auto: "continue"},
+		{auto: "abort", wantErr: true},
+	}
+	for _, tc := range tcs {
+		prm := &prompter{
+			rdr:  bufio.NewReader(strings.NewReader(tc.input)),
+			out:  ioutil.Discard,
+			auto: tc.auto,
+		}
+		err := prm.confirm([]string{"1.1.1.1"})
+		if tc.wantErr != (err != nil) {
+			t.Fatalf("%+v: unexpected error %v", tc, err)
+		}
+	}
+	if _, err := newPrompter("sometimes", 0); err == nil {
+		t.Fatal("expected error for unknown -p-auto")
+	}
+}
+
+func TestPrompterTimeout(t *testing.T) {
+	t.Parallel()
+	for answer, wantErr := range map[string]bool{
+		"continue": false,
+		"abort":    true,
+	} {
+		// Nobody ever writes to the pipe
+		rdr, _ := io.Pipe()
+		prm := &prompter{
+			rdr:           bufio.NewReader(rdr),
+			out:           ioutil.Discard,
+			timeout:       time.Millisecond,
+			timeoutAnswer: answer,
+		}
+		err := prm.confirm([]string{"1.1.1.1"})
+		if wantErr != (err != nil) {
+			t.Fatalf("%s: unexpected error %v", answer, err)
+		}
+	}
+}
+
+func TestPromptVars(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`var PORT int
+var TOKEN secret
+
+deploy requires PORT, TOKEN, USER
+	echo $PORT $TOKEN $USER
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []string{"eighty", "80", "abc", "me"}
+	var secrets []bool
+	read := func(secret bool) (string, error) {
+		if len(input) == 0 {
+			return "", io.EOF
+		}
+		line := input[0]
+		input = input[1:]
+		secrets = append(secrets, secret)
+		return line, nil
+	}
+	vars := map[string]string{}
+	missing := missingVars(conf, vars, "deploy")
+	out := &bytes.Buffer{}
+	err = promptVars(read, out, conf, vars, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "map[PORT:80 TOKEN:abc USER:me]"
+	if fmt.Sprint(vars) != want {
+		t.Fatalf("expected %s, got %v", want, vars)
+	}
+	if fmt.Sprint(secrets) != "[false false true false]" {
+		t.Fatalf("unexpected secrets %v", secrets)
+	}
+	if !strings.Contains(out.String(), "invalid PORT") {
+		t.Fatalf("expected invalid PORT in %q", out.String())
+	}
+
+	err = promptVars(read, out, conf, map[string]string{}, []string{"PORT"})
+	if err == nil {
+		t.Fatal("expected error at eof")
+	}
+}
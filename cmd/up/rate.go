@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out the start of commands on servers evenly, so large
+// batches don't all hit shared infrastructure at once. A nil rateLimiter
+// never waits.
+type rateLimiter struct {
+	mu    sync.Mutex
+	every time.Duration
+	next  time.Time
+}
+
+// parseRate parses a rate such as "5/s", "30/m" or "600/h". An empty rate
+// reports a nil rateLimiter.
+func parseRate(s string) (*rateLimiter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rate %q must be N/s, N/m or N/h", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("rate %q must start with a positive "+
+			"number", s)
+	}
+	var per time.Duration
+	switch parts[1] {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("rate %q must be N/s, N/m or N/h", s)
+	}
+	return &rateLimiter{every: per / time.Duration(n)}, nil
+}
+
+// wait blocks until the next command may start.
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(l.every)
+	l.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]time.Duration{
+		"5/s":   200 * time.Millisecond,
+		"30/m":  2 * time.Second,
+		"600/h": 6 * time.Second,
+	}
+	for have, want := range tcs {
+		l, err := parseRate(have)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.every != want {
+			t.Fatalf("%s: expected %s, got %s", have, want, l.every)
+		}
+	}
+	if l, err := parseRate(""); l != nil || err != nil {
+		t.Fatalf("expected no limit, got %v, %v", l, err)
+	}
+	for _, bad := range []string{"5", "0/s", "-1/s", "5/d", "x/s"} {
+		if _, err := parseRate(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	t.Parallel()
+	l := &rateLimiter{every: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		l.wait()
+	}
+	if took := time.Since(start); took < 60*time.Millisecond {
+		t.Fatalf("expected 4 starts to take at least 60ms, took %s",
+			took)
+	}
+	var nilLimiter *rateLimiter
+	nilLimiter.wait()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// preflightTimeout is how long a host has to accept a connection before it's
+// skipped as unreachable.
+const preflightTimeout = 5 * time.Second
+
+// preflightAddr reports the address dialed to check whether a host is up: its
+// ssh port, 22 unless its settings say otherwise, or its WinRM port. Hosts
+// reached another way, such as containers, report false and are never
+// skipped.
+func preflightAddr(server string, s up.Settings) (string, bool) {
+	if strings.Contains(server, "://") {
+		return "", false
+	}
+	host, _, err := up.SplitAddress(server)
+	if err != nil {
+		return "", false
+	}
+	port := s.Port
+	switch s.Transport {
+	case "", "local", "agent":
+		if port == 0 {
+			port = 22
+		}
+	case "winrm":
+		if port == 0 {
+			port = 5985
+			if s.HTTPS {
+				port = 5986
+			}
+		}
+	default:
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
+
+// unreachableHosts dials every host concurrently and reports, sorted, those
+// which don't accept a connection within the timeout.
+func unreachableHosts(
+	hosts map[string]up.Settings,
+	timeout time.Duration,
+) []string {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		dead []string
+	)
+	for server, s := range hosts {
+		addr, ok := preflightAddr(server, s)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(server, addr string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err == nil {
+				conn.Close()
+				return
+			}
+			mu.Lock()
+			dead = append(dead, server)
+			mu.Unlock()
+		}(server, addr)
+	}
+	wg.Wait()
+	sort.Strings(dead)
+	return dead
+}
+
+// without removes servers from every batch in the plan, dropping batches and
+// groups left empty.
+func (p *plan) without(servers []string) {
+	skip := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		skip[server] = struct{}{}
+		delete(p.Hosts, server)
+	}
+	var groups []*planGroup
+	for _, g := range p.Groups {
+		var batches []*planBatch
+		for _, b := range g.Batches {
+			b.without(skip)
+			if len(b.Servers) > 0 {
+				batches = append(batches, b)
+			}
+		}
+		if len(batches) > 0 {
+			g.Batches = batches
+			groups = append(groups, g)
+		}
+	}
+	p.Groups = groups
+}
+
+// without removes skipped servers from the batch and its needs. Steps are
+// keyed by server, so they needn't change.
+func (b *planBatch) without(skip map[string]struct{}) {
+	var servers []string
+	for _, server := range b.Servers {
+		if _, ok := skip[server]; !ok {
+			servers = append(servers, server)
+		}
+	}
+	b.Servers = servers
+	for _, need := range b.Needs {
+		need.without(skip)
+	}
+}
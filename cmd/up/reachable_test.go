@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestUnreachableHosts(t *testing.T) {
+	t.Parallel()
+	open, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	// The inventory sets the port from the address
+	upAddr, downAddr := open.Addr().String(), closed.Addr().String()
+	hosts := map[string]up.Settings{
+		upAddr:         {Port: open.Addr().(*net.TCPAddr).Port},
+		downAddr:       {Port: closed.Addr().(*net.TCPAddr).Port},
+		"docker://app": {},
+		"10.0.0.1":     {Transport: "k8s"},
+	}
+	got := unreachableHosts(hosts, time.Second)
+	if fmt.Sprint(got) != fmt.Sprintf("[%s]", downAddr) {
+		t.Fatalf("expected [%s], got %v", downAddr, got)
+	}
+}
+
+func TestPlanWithout(t *testing.T) {
+	t.Parallel()
+	p := &plan{
+		Hosts: map[string]up.Settings{"a": {}, "b": {}, "c": {}},
+		Groups: []*planGroup{
+			{Tag: "web", Batches: []*planBatch{
+				{Servers: []string{"a"}},
+				{
+					Servers: []string{"b", "c"},
+					Needs: []*planBatch{
+						{Servers: []string{"b", "c"}},
+					},
+				},
+			}},
+			{Tag: "db", Batches: []*planBatch{
+				{Servers: []string{"a"}},
+			}},
+		},
+	}
+	p.without([]string{"a", "c"})
+	if len(p.Groups) != 1 || len(p.Groups[0].Batches) != 1 {
+		t.Fatalf("expected a single batch, got %+v", p.Groups)
+	}
+	b := p.Groups[0].Batches[0]
+	if got := fmt.Sprint(b.Servers, b.Needs[0].Servers); got != "[b] [b]" {
+		t.Fatalf("expected [b] [b], got %s", got)
+	}
+	if len(p.Hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", p.Hosts)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// rebooter reboots a server, then waits for it to go down and come back.
+type rebooter struct {
+	server string
+
+	// issue the reboot. The connection dropping as the server goes down
+	// isn't an error.
+	issue func() error
+
+	// reachable reports whether the server accepts connections.
+	reachable func() bool
+
+	// ready reports an error until the server is back, e.g. until ssh
+	// succeeds and its health check passes.
+	ready func() error
+
+	// interval between checks, and timeout for the whole reboot.
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// reboot the server, returning once it's ready again or failing after the
+// timeout.
+func (r rebooter) reboot() error {
+	deadline := time.Now().Add(r.timeout)
+	if err := r.issue(); err != nil {
+		return fmt.Errorf("issue reboot: %w", err)
+	}
+
+	// Without seeing the server go down, it may not have rebooted at all
+	// and would look ready straight away
+	for r.reachable() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still up after %s", r.timeout)
+		}
+		time.Sleep(r.interval)
+	}
+	log.Printf("reboot: %s is down, waiting for it to return\n",
+		r.server)
+	var err error
+	for {
+		if r.reachable() {
+			if err = r.ready(); err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				return fmt.Errorf("still down after %s",
+					r.timeout)
+			}
+			return fmt.Errorf("not ready after %s: %w", r.timeout,
+				err)
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+// rebootCmd reboots a server over ssh, waits for it to go down, then waits
+// until ssh and, with -health, its health check succeed again, so the next
+// step or batch only starts once it's back:
+//
+//	patch
+//		ssh $server 'sudo -n syspatch'
+//		up reboot $server
+func rebootCmd(args []string) error {
+	fs := flag.NewFlagSet("reboot", flag.ExitOnError)
+	inventory := fs.String("i", "inventory.json", "path to inventory with the server's ssh settings, if it exists")
+	command := fs.String("c", "sudo -n shutdown -r now", "command which reboots the server")
+	timeout := fs.Duration("timeout", 10*time.Minute, "time for the server to go down and return")
+	interval := fs.Duration("interval", 2*time.Second, "wait between checks")
+	health := fs.String("health", "", "URL which must respond 200 before the server is back")
+	pol := addPolicyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage(errors.New("reboot requires a server"))
+	}
+	server := fs.Arg(0)
+
+	// The inventory is only used for the server's settings and tags, so
+	// it's optional
+	var (
+		s    up.Settings
+		tags []string
+	)
+	fi, err := os.Open(*inventory)
+	switch {
+	case err == nil:
+		defer fi.Close()
+		invFile, err := up.ParseInventoryFile(fi)
+		if err != nil {
+			return fmt.Errorf("parse inventory: %w", err)
+		}
+		s = invFile.Settings(server)
+		tags = invFile.Hosts[server]
+	case !os.IsNotExist(err):
+		return fmt.Errorf("open inventory: %w", err)
+	}
+	if err = pol.check("reboot", tags); err != nil {
+		return err
+	}
+	addr, ok := preflightAddr(server, s)
+	if !ok || s.Transport == "winrm" {
+		return fmt.Errorf("%s isn't reached with ssh", server)
+	}
+
+	// Connect as the agent transport would, with the server's user, port
+	// and keys
+	sshArgs, err := (&agentTransport{settings: s}).sshArgs(server)
+	if err != nil {
+		return err
+	}
+	sshArgs = append([]string{"-o", "ConnectTimeout=5"}, sshArgs...)
+	ssh := func(cmd string) error {
+		var stderr bytes.Buffer
+		c := exec.Command("ssh", append(sshArgs, cmd)...)
+		c.Stderr = &stderr
+		if err := c.Run(); err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				return err
+			}
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil
+	}
+	var (
+		hc     *healthCheck
+		client *http.Client
+	)
+	if *health != "" {
+		hc = &healthCheck{URL: *health, Status: http.StatusOK}
+		client, err = httpclient.New(
+			httpclient.WithTimeout(5 * time.Second))
+		if err != nil {
+			return err
+		}
+	}
+	r := rebooter{
+		server: server,
+		issue: func() error {
+			// ssh exits 255 when the connection drops
+			err := ssh(*command)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) &&
+				exitErr.ExitCode() == 255 {
+				return nil
+			}
+			return err
+		},
+		reachable: func() bool {
+			conn, err := net.DialTimeout("tcp", addr, *interval)
+			if err != nil {
+				return false
+			}
+			conn.Close()
+			return true
+		},
+		ready: func() error {
+			if err := ssh("true"); err != nil {
+				return err
+			}
+			if hc == nil {
+				return nil
+			}
+			_, err := hc.check(client)
+			return err
+		},
+		interval: *interval,
+		timeout:  *timeout,
+	}
+	log.Printf("reboot: rebooting %s\n", server)
+	start := time.Now()
+	if err = r.reboot(); err != nil {
+		return fmt.Errorf("reboot %s: %w", server, err)
+	}
+	log.Printf("reboot: %s back after %s\n", server,
+		time.Since(start).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRebooter(t *testing.T) {
+	t.Parallel()
+
+	// The server answers twice before going down, is unreachable for
+	// two checks, then fails to be ready once
+	var issued bool
+	reachable := []bool{true, true, false, false, false, true, true}
+	ready := []error{errors.New("booting"), nil}
+	r := rebooter{
+		issue: func() error {
+			issued = true
+			return nil
+		},
+		reachable: func() bool {
+			up := reachable[0]
+			reachable = reachable[1:]
+			return up
+		},
+		ready: func() error {
+			err := ready[0]
+			ready = ready[1:]
+			return err
+		},
+		timeout: time.Minute,
+	}
+	if err := r.reboot(); err != nil {
+		t.Fatal(err)
+	}
+	if !issued {
+		t.Fatal("expected reboot to be issued")
+	}
+	if len(reachable) != 0 || len(ready) != 0 {
+		t.Fatalf("expected every check, %d and %d left",
+			len(reachable), len(ready))
+	}
+
+	// A server which never goes down didn't reboot
+	r.reachable = func() bool { return true }
+	r.timeout = 0
+	if err := r.reboot(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	r.issue = func() error { return errors.New("sudo: password required") }
+	if err := r.reboot(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// event is a single entry in a recorded transcript.
+type event struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+
+	// Type is "cmd" when a command starts, "stdout" or "stderr" for its
+	// output, and "exit" when it finishes.
+	Type string `json:"type"`
+
+	// Data is the command, its output or, on exit, its error if any.
+	Data string `json:"data,omitempty"`
+
+	// Took is set on exit.
+	Took time.Duration `json:"took,omitempty"`
+}
+
+// recorder writes a transcript of every command run on each server to its
+// own file in dir, one JSON event per line. A nil recorder records nothing.
+type recorder struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File
+	err   error
+}
+
+// unsafeFilename matches characters replaced in a server's transcript name,
+// since servers may be addresses such as docker://web or IPv6.
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func newRecorder(dir string) (*recorder, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("make dir: %w", err)
+	}
+	return &recorder{dir: dir, files: map[string]*os.File{}}, nil
+}
+
+// record an event for the server. The first error is kept and reported by
+// close, so a full disk doesn't interrupt a deploy midway.
+func (r *recorder) record(server, typ, data string, took time.Duration) {
+	if r == nil {
+		return
+	}
+	byt, err := json.Marshal(event{
+		Time:   time.Now().UTC(),
+		Server: server,
+		Type:   typ,
+		Data:   data,
+		Took:   took,
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil || r.err != nil {
+		if r.err == nil {
+			r.err = err
+		}
+		return
+	}
+	fi, ok := r.files[server]
+	if !ok {
+		name := unsafeFilename.ReplaceAllString(server, "_") + ".jsonl"
+		fi, err = os.OpenFile(filepath.Join(r.dir, name),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			r.err = fmt.Errorf("open transcript: %w", err)
+			return
+		}
+		r.files[server] = fi
+	}
+	if _, err = fi.Write(append(byt, '\n')); err != nil {
+		r.err = fmt.Errorf("write transcript: %w", err)
+	}
+}
+
+// output reports a writer recording everything written to it as events of
+// the type.
+func (r *recorder) output(server, typ string) io.Writer {
+	return recordWriter{r: r, server: server, typ: typ}
+}
+
+type recordWriter struct {
+	r      *recorder
+	server string
+	typ    string
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w.r.record(w.server, w.typ, string(p), 0)
+	return len(p), nil
+}
+
+// close every transcript, reporting the first error while recording.
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, fi := range r.files {
+		if err := fi.Close(); err != nil && r.err == nil {
+			r.err = fmt.Errorf("close transcript: %w", err)
+		}
+	}
+	return r.err
+}
+
+// replayCmd re-renders the transcripts recorded in a directory with -record,
+// interleaving servers as they originally ran.
+func replayCmd(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "playback speed, e.g. 2 for twice as fast, or 0 to print without waiting")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage(errors.New("replay requires a directory"))
+	}
+	if *speed < 0 {
+		return errors.New("-speed must not be negative")
+	}
+	events, err := readTranscripts(fs.Arg(0), 0)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("no transcripts in %s", fs.Arg(0))
+	}
+	replay(os.Stdout, os.Stderr, events, *speed)
+	return nil
+}
+
+// readTranscripts reads every transcript in dir, sorted by time. If limit is
+// positive, only the last limit bytes of each server's output are kept, so
+// reports on thousands of servers don't exhaust memory. The transcripts on
+// disk are complete.
+func readTranscripts(dir string, limit int) ([]event, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("glob: %w", err)
+	}
+	var events []event
+	for _, pth := range paths {
+		evts, err := readTranscript(pth, limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pth, err)
+		}
+		events = append(events, evts...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
+
+// readTranscript reads a single server's transcript, keeping only the last
+// limit bytes of its output if limit is positive. Output dropped is noted in
+// a stderr event in its place.
+func readTranscript(pth string, limit int) ([]event, error) {
+	fi, err := os.Open(pth)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer fi.Close()
+
+	// Output is dropped oldest first, and the events left empty are
+	// compacted once they're most of those kept
+	var (
+		events    []event
+		size      int
+		dropped   int
+		oldest    int
+		empty     int
+		firstDrop event
+	)
+	isOutput := func(e event) bool {
+		return e.Type == "stdout" || e.Type == "stderr"
+	}
+	scn := bufio.NewScanner(fi)
+	scn.Buffer(nil, maxStateSize)
+	for scn.Scan() {
+		var e event
+		if err = json.Unmarshal(scn.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		events = append(events, e)
+		if limit <= 0 || !isOutput(e) {
+			continue
+		}
+		size += len(e.Data)
+		for ; size > limit && oldest < len(events); oldest++ {
+			old := &events[oldest]
+			if !isOutput(*old) {
+				continue
+			}
+			if dropped == 0 {
+				firstDrop = *old
+			}
+			size -= len(old.Data)
+			dropped += len(old.Data)
+			old.Type, old.Data = "", ""
+			empty++
+		}
+		if empty > len(events)/2 {
+			events, oldest, empty = compactEvents(events), 0, 0
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	events = compactEvents(events)
+	if dropped > 0 {
+		firstDrop.Type = "stderr"
+		firstDrop.Data = fmt.Sprintf("[%d bytes of output truncated, "+
+			"see the full transcript with -record]\n", dropped)
+		events = append([]event{firstDrop}, events...)
+	}
+	return events, nil
+}
+
+// compactEvents removes events whose output was dropped.
+func compactEvents(events []event) []event {
+	kept := events[:0]
+	for _, e := range events {
+		if e.Type != "" {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// replay prints events as up printed them while running, waiting between
+// them as they originally did divided by speed. A speed of 0 doesn't wait.
+func replay(stdout, stderr io.Writer, events []event, speed float64) {
+	logger := log.New(stderr, "", 0)
+	for i, e := range events {
+		if speed > 0 && i > 0 {
+			gap := e.Time.Sub(events[i-1].Time)
+			time.Sleep(time.Duration(float64(gap) / speed))
+		}
+		switch e.Type {
+		case "cmd":
+			logger.Printf("[%s] %s\n", e.Server, e.Data)
+		case "stdout":
+			io.WriteString(stdout, e.Data)
+		case "stderr":
+			io.WriteString(stderr, e.Data)
+		case "exit":
+			if e.Data == "" {
+				continue
+			}
+			took := e.Took.Round(time.Millisecond)
+			logger.Printf("[%s] failed after %s: %s\n", e.Server,
+				took, e.Data)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec, err := newRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.record("10.0.0.1", "cmd", "echo hi", 0)
+	fmt.Fprint(rec.output("10.0.0.1", "stdout"), "hi\n")
+	rec.record("docker://web", "cmd", "false", 0)
+	rec.record("docker://web", "exit", "exit status 1", time.Second)
+	rec.record("10.0.0.1", "exit", "", time.Millisecond)
+	if err = rec.close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "docker___web.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := readTranscripts(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+	var stdout, stderr bytes.Buffer
+	replay(&stdout, &stderr, events, 0)
+	if stdout.String() != "hi\n" {
+		t.Fatalf("unexpected stdout %q", stdout.String())
+	}
+	want := "[10.0.0.1] echo hi\n[docker://web] false\n" +
+		"[docker://web] failed after 1s: exit status 1\n"
+	if stderr.String() != want {
+		t.Fatalf("expected stderr %q, got %q", want, stderr.String())
+	}
+
+	var nilRecorder *recorder
+	nilRecorder.record("10.0.0.1", "cmd", "echo", 0)
+	if err = nilRecorder.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadTranscriptsLimit(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec, err := newRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.record("10.0.0.1", "cmd", "count", 0)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(rec.output("10.0.0.1", "stdout"), "%02d\n", i)
+	}
+	rec.record("10.0.0.1", "exit", "exit status 1", time.Second)
+	rec.record("10.0.0.2", "cmd", "echo hi", 0)
+	fmt.Fprint(rec.output("10.0.0.2", "stdout"), "hi\n")
+	if err = rec.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := readTranscripts(dir, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	replay(&stdout, &stderr, events, 0)
+	if want := "97\n98\n99\nhi\n"; stdout.String() != want {
+		t.Fatalf("expected stdout %q, got %q", want, stdout.String())
+	}
+	want := "[10.0.0.1] count\n[291 bytes of output truncated, see " +
+		"the full transcript with -record]\n[10.0.0.1] failed " +
+		"after 1s: exit status 1\n[10.0.0.2] echo hi\n"
+	if stderr.String() != want {
+		t.Fatalf("expected stderr %q, got %q", want, stderr.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// hostResult is what a command printed on a single host.
+type hostResult struct {
+	Host string
+	Out  string
+	Err  error
+}
+
+// adhocCmd runs a single command on every selected host, printing each host's
+// output, or with -compare, grouping hosts by identical output so outliers
+// stand out. It's meant for read-only commands, e.g.
+//
+//	up run -compare -t web ssh $server openssl version
+func adhocCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile providing variables, if it exists")
+	inventory := fs.String("i", "inventory.json", "path to inventory")
+	tags := fs.String("t", "all", "tags from inventory to run on")
+	compare := fs.Bool("compare", false, "group hosts by identical output, failing if they differ (default false)")
+	pol := addPolicyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usage(errors.New("run requires a command"))
+	}
+	if *tags == "" {
+		return usage(errors.New("run requires -t"))
+	}
+	text := strings.Join(fs.Args(), " ")
+
+	// The Upfile is only used for variables, so it's optional
+	var cmds map[up.CmdName]*up.Cmd
+	fi, err := os.Open(*upfile)
+	switch {
+	case err == nil:
+		defer fi.Close()
+		conf, err := up.ParseUpfile(fi)
+		if err != nil {
+			return fmt.Errorf("parse upfile: %w", err)
+		}
+		cmds = conf.Commands
+	case !os.IsNotExist(err):
+		return fmt.Errorf("open upfile: %w", err)
+	}
+
+	transports, err := selectHosts(*inventory, "run", *tags, pol)
+	if err != nil {
+		return err
+	}
+	scp := newScope(environVars(), cmds)
+	results := runOnHosts(transports, scp, text)
+	if *compare {
+		if n := printCompare(os.Stdout, results); n > 1 {
+			return fmt.Errorf("output differs: %d groups", n)
+		}
+		return nil
+	}
+	var failed int
+	for _, res := range results {
+		fmt.Printf("==> %s <==\n", res.Host)
+		if res.Err != nil {
+			failed++
+			fmt.Printf("error: %s\n", res.Err)
+			continue
+		}
+		if res.Out != "" {
+			fmt.Println(res.Out)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d hosts", failed)
+	}
+	return nil
+}
+
+// runOnHosts runs the command on every host concurrently, reporting what
+// each printed sorted by host.
+func runOnHosts(
+	transports map[string]transport,
+	scp *scope,
+	text string,
+) []hostResult {
+	return runEachHost(transports, func(
+		t transport,
+		host string,
+	) ([]byte, error) {
+		return hostOutput(t, scp, host, text)
+	})
+}
+
+// runEachHost calls fn for every host concurrently, reporting what each
+// printed sorted by host.
+func runEachHost(
+	transports map[string]transport,
+	fn func(t transport, host string) ([]byte, error),
+) []hostResult {
+	results := make([]hostResult, 0, len(transports))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for host := range transports {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			out, err := fn(transports[host], host)
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, hostResult{
+				Host: host,
+				Out:  strings.TrimSpace(string(out)),
+				Err:  err,
+			})
+		}(host)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Host < results[j].Host
+	})
+	return results
+}
+
+// printCompare groups hosts by identical output, treating each error as
+// output of its own, and prints the largest group first. Every smaller group
+// is marked as an outlier. It reports the number of groups.
+func printCompare(w io.Writer, results []hostResult) int {
+	type group struct {
+		out   string
+		hosts []string
+	}
+	var groups []*group
+	byOut := map[string]*group{}
+	for _, res := range results {
+		out := res.Out
+		if res.Err != nil {
+			out = fmt.Sprintf("error: %s", res.Err)
+		}
+		g, ok := byOut[out]
+		if !ok {
+			g = &group{out: out}
+			byOut[out] = g
+			groups = append(groups, g)
+		}
+		g.hosts = append(g.hosts, res.Host)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].hosts) > len(groups[j].hosts)
+	})
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "hosts"
+		if len(g.hosts) == 1 {
+			label = "host"
+		}
+		var outlier string
+		if i > 0 {
+			outlier = " (outlier)"
+		}
+		fmt.Fprintf(w, "%d %s%s: %s\n", len(g.hosts), label, outlier,
+			strings.Join(g.hosts, ", "))
+		if g.out == "" {
+			fmt.Fprintln(w, "\t(no output)")
+			continue
+		}
+		for _, line := range strings.Split(g.out, "\n") {
+			fmt.Fprintf(w, "\t%s\n", line)
+		}
+	}
+	return len(groups)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPrintCompare(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	n := printCompare(&buf, []hostResult{
+		{Host: "10.0.0.1", Out: "OpenSSL 3.0.2"},
+		{Host: "10.0.0.2", Out: "OpenSSL 1.1.1"},
+		{Host: "10.0.0.3", Out: "OpenSSL 3.0.2"},
+		{Host: "10.0.0.4", Err: errors.New("exit status 255")},
+		{Host: "10.0.0.5", Out: "OpenSSL 3.0.2"},
+	})
+	if n != 3 {
+		t.Fatalf("expected 3 groups, got %d", n)
+	}
+	want := `3 hosts: 10.0.0.1, 10.0.0.3, 10.0.0.5
+	OpenSSL 3.0.2
+
+1 host (outlier): 10.0.0.2
+	OpenSSL 1.1.1
+
+1 host (outlier): 10.0.0.4
+	error: exit status 255
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
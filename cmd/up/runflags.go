@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// runFlags are the flags up and up apply share, which configure how a plan
+// runs and who learns about it, rather than how it's made.
+type runFlags struct {
+	// Verbose will log full commands, even when they're very log. By
+	// default `up` truncates commands to 80 characters when logging,
+	// except in the case of a failure where the full command is displayed.
+	Verbose bool
+
+	// Prompt instructs `up` to wait for input before moving onto the next
+	// batch.
+	Prompt bool
+
+	// PromptAuto answers prompts with "continue" or "abort" when stdin
+	// isn't a terminal. When empty, prompting without a terminal is an
+	// error.
+	PromptAuto string
+
+	// PromptTimeout answers prompts nobody answers in time with
+	// PromptAuto, or "continue" if it's empty. Zero waits forever.
+	PromptTimeout time.Duration
+
+	// Policy is an optional path to a file restricting who may run which
+	// commands against which tags, enforced as well as the system policy.
+	// Defaults to $UP_POLICY.
+	Policy string
+
+	// Identity checked against the Policy, which must let the current OS
+	// user act as it. Defaults to the current OS user.
+	Identity string
+
+	// CacheDir records prerequisites which ran locally for a checksum,
+	// so they're skipped on later runs. Empty disables the cache.
+	CacheDir string
+
+	// CheckCacheTTL is how long conditionals which passed on a server
+	// for a checksum are remembered in CacheDir, so they're skipped on
+	// repeated runs. Zero disables it.
+	CheckCacheTTL time.Duration
+
+	// Rate limits how quickly commands start on servers, e.g. "5/s",
+	// regardless of the batch size. Empty is unlimited.
+	Rate *rateLimiter
+
+	// MaxInflight caps the commands running at once across every tag
+	// and batch. Zero is unlimited.
+	MaxInflight int
+
+	// NoShortCircuit runs every ExecIf step, even after one fails and
+	// the Execs must run anyway.
+	NoShortCircuit bool
+
+	// RunOnce runs steps which are the same on every server in a batch,
+	// such as notifications, once for the batch, as long as they run
+	// locally.
+	RunOnce bool
+
+	// Workers caps the servers in a batch running a step at once,
+	// independently of the batch size. Zero runs every server in the
+	// batch at once.
+	Workers int
+
+	// SimulateFailures makes chosen servers fail instead of running
+	// their first step, to rehearse how a rollout handles failures.
+	SimulateFailures *failureInjector
+
+	// Record is a directory in which a transcript of every command run
+	// on each server is written, to be played back with `up replay`.
+	Record string
+
+	// Progress is a file to which an event is written as a line of JSON
+	// when each batch starts and finishes, and when the deploy ends,
+	// for the progress package to follow.
+	Progress string
+
+	// StatusLine is a file to which logs and the output of commands are
+	// appended, while stdout only receives a short line as each batch
+	// starts, each server finishes and the deploy ends, e.g. to post to
+	// a chat thread.
+	StatusLine string
+
+	// Timestamps is the time zone in which each log line is stamped, or
+	// nil to leave them unstamped.
+	Timestamps *time.Location
+
+	// Deployment is a repo on a source forge, e.g. "github:OWNER/REPO",
+	// in which to track the deploy. DeploymentEnv defaults to the
+	// command, DeploymentRef to the commit checked out, and
+	// DeploymentURL optionally links to the deploy's logs.
+	Deployment    string
+	DeploymentEnv string
+	DeploymentRef string
+	DeploymentURL string
+
+	// Annotate posts annotations to dashboards such as Grafana or
+	// Datadog when the deploy starts and ends.
+	Annotate annotators
+
+	// Email is sent a summary of the deploy with each server's log
+	// attached.
+	Email *mailer
+
+	// ReportHTML is a file to which a standalone HTML report of the
+	// deploy is written.
+	ReportHTML string
+
+	// ReportJUnit is a file to which a JUnit XML report of the deploy is
+	// written, with a test case for each command run on each server.
+	ReportJUnit string
+
+	// ReportMaxOutput is how many bytes of each server's output, the
+	// last written, are kept in reports. Zero keeps everything.
+	ReportMaxOutput int
+
+	// SkipUnreachable leaves out hosts which don't accept a connection
+	// before the deploy starts, reporting them as skipped rather than
+	// failing.
+	SkipUnreachable bool
+
+	// TransportRetries is how many times a command is retried after
+	// failing to reach its server before the server counts as failed.
+	TransportRetries int
+
+	// IgnoreMaintenance deploys even to hosts in a maintenance window, as
+	// reported by the Upfile's maintenance_status command.
+	IgnoreMaintenance bool
+
+	// Strict fails rather than guessing, for CI: -c must be given, tags
+	// and ${name} variables must be defined, unreachable hosts fail the
+	// deploy before it starts and only declared variables are taken from
+	// the environment, which local commands don't inherit. Plans are
+	// already substituted, so up apply only checks hosts and the
+	// environment.
+	Strict bool
+
+	// Env replaces the environment of local commands unless nil, so the
+	// operator's own can't change what a deploy does. It's set by
+	// -clean-env to only the variables up needs and those passed.
+	Env []string
+
+	// LocalUser runs steps on this machine with sudo as a dedicated
+	// deploy user, unless they name their own, so the operator's keys
+	// and agent aren't used to deploy.
+	LocalUser string
+
+	// HTTP configures the clients making HTTP requests, such as to
+	// dashboards and forges: their timeout, retries, proxy and TLS
+	// certificates.
+	HTTP httpFlags
+}
+
+// addRunFlags defines the runFlags on fs. The function it returns validates
+// them once fs is parsed.
+func addRunFlags(fs *flag.FlagSet) func() (runFlags, error) {
+	var (
+		prompt       = fs.Bool("p", false, "prompt before moving to the next batch (default false)")
+		promptAuto   = fs.String("p-auto", "", "answer prompts with continue or abort when stdin is not a terminal or -p-timeout expires")
+		promptTime   = fs.Duration("p-timeout", 0, "answer prompts nobody answers within this duration with -p-auto, default continue")
+		verbose      = fs.Bool("v", false, "verbose logs full commands (default false)")
+		policy       = fs.String("policy", "", "path to policy restricting who may run commands, enforced with "+systemPolicy+" (default $UP_POLICY)")
+		identity     = fs.String("as", "", "identity checked against the policy, if it lets the current user act as it (defaults to the current user)")
+		cacheDir     = fs.String("cache-dir", defaultCacheDir(), "directory recording prerequisites already run for a checksum (empty disables)")
+		checkTTL     = fs.Duration("check-cache-ttl", 0, "skip conditionals which passed on a server for the checksum this recently (default 0, disabled)")
+		deployment   = fs.String("deployment", "", "track the deploy on github:OWNER/REPO or gitlab:GROUP/PROJECT")
+		deployEnv    = fs.String("deployment-env", "", "environment of the deployment (defaults to the command)")
+		deployRef    = fs.String("deployment-ref", "", "commit deployed (defaults to git rev-parse HEAD)")
+		deployURL    = fs.String("deployment-url", "", "link to the deploy's logs shown on the deployment")
+		annotateSpec = fs.String("annotate", "", "comma-separated dashboards to annotate with the deploy, grafana:URL or datadog[:SITE]")
+		email        = fs.String("email", "", "comma-separated addresses emailed a summary of the deploy with each server's log attached")
+		reportHTML   = fs.String("report-html", "", "file to write a standalone HTML report of the deploy")
+		reportJUnit  = fs.String("report-junit", "", "file to write a JUnit XML report with a test case for each command on each server")
+		reportMax    = fs.Int("report-max-output", defaultReportMaxOutput, "bytes of each server's output kept in reports, the last written (0 keeps everything)")
+		record       = fs.String("record", "", "directory to write a transcript of each server's commands and output, played back by up replay")
+		progressFile = fs.String("progress", "", "file to write progress events as lines of JSON, e.g. /dev/fd/3")
+		statusLine   = fs.String("status-line", "", "file to append logs to, printing only a line per batch and server with the percentage complete")
+		timestamps   = fs.String("timestamps", "local", "time zone of the RFC3339 time starting each log line, local or utc, or none")
+		simulate     = fs.String("simulate-failures", "", "comma-separated hosts, TAG:HOST globs or a percentage, e.g. 10%, which fail instead of running")
+		maxInfl      = fs.Int("max-inflight", 0, "most commands running at once across every tag and batch (default unlimited)")
+		noShort      = fs.Bool("no-short-circuit", false, "run every conditional step even after one fails (default false)")
+		runOnce      = fs.Bool("run-once", false, "run steps which are the same on every server once per batch (default false)")
+		workers      = fs.Int("workers", 0, "most servers in a batch running a step at once (default the whole batch)")
+		rate         = fs.String("rate", "", "limit how quickly commands start on servers, e.g. 5/s, 30/m or 600/h (default unlimited)")
+		skipDead     = fs.Bool("skip-unreachable", false, "skip hosts which don't accept a connection instead of failing (default false)")
+		retries      = fs.Int("transport-retries", 0, "times to retry a command which fails to reach its server, e.g. ssh exiting 255 (default 0)")
+		ignoreMaint  = fs.Bool("ignore-maintenance", false, "deploy even to hosts in a maintenance window (default false)")
+		cleanEnvFlag = fs.Bool("clean-env", false, "run local commands with only HOME, PATH, SSH_AUTH_SOCK, USER and -pass-env (default false)")
+		passEnv      = fs.String("pass-env", "", "comma-separated NAME or NAME=VALUE environment variables kept by -clean-env")
+		localUser    = fs.String("local-user", "", "run local steps as this user with sudo unless they're written as USER: (default the current user)")
+		proxy        = fs.String("proxy", "", "proxy for HTTP requests, e.g. http://proxy:3128 or socks5://localhost:1080 (default $HTTPS_PROXY)")
+		httpTimeout  = fs.Duration("http-timeout", 0, "timeout for each HTTP request, including retries (default 10s for -annotate, 30s for -deployment)")
+		httpRetries  = fs.Int("http-retries", 0, "times to retry HTTP requests which fail to connect or get a 429, 502, 503 or 504 (default 0)")
+		httpCACert   = fs.String("http-cacert", "", "PEM file of CA certificates trusted by HTTP requests alongside the system's")
+		httpCert     = fs.String("http-cert", "", "PEM client certificate for HTTP requests to servers requiring mutual TLS")
+		httpKey      = fs.String("http-key", "", "PEM private key of -http-cert")
+		strict       = fs.Bool("strict", false, "fail on undefined tags and variables and unreachable hosts, and don't import the environment, for CI (default false)")
+	)
+	return func() (runFlags, error) {
+		if *strict && *skipDead {
+			return runFlags{}, errors.New(
+				"cannot use -skip-unreachable with -strict")
+		}
+		rateLimit, err := parseRate(*rate)
+		if err != nil {
+			return runFlags{}, err
+		}
+		stampLoc, err := parseTimestamps(*timestamps)
+		if err != nil {
+			return runFlags{}, err
+		}
+		if *maxInfl < 0 {
+			return runFlags{}, errors.New(
+				"-max-inflight must not be negative")
+		}
+		if *workers < 0 {
+			return runFlags{}, errors.New(
+				"-workers must not be negative")
+		}
+		if *retries < 0 {
+			return runFlags{}, errors.New(
+				"-transport-retries must not be negative")
+		}
+		if *reportMax < 0 {
+			return runFlags{}, errors.New(
+				"-report-max-output must not be negative")
+		}
+		failures, err := parseFailures(*simulate)
+		if err != nil {
+			return runFlags{}, fmt.Errorf("simulate failures: %w",
+				err)
+		}
+		env, err := parseEnv(*cleanEnvFlag || *strict, *passEnv)
+		if err != nil {
+			return runFlags{}, err
+		}
+		if !validUser(*localUser) {
+			return runFlags{}, fmt.Errorf("invalid -local-user %q",
+				*localUser)
+		}
+		httpFlgs := httpFlags{
+			timeout: *httpTimeout,
+			retries: *httpRetries,
+			proxy:   *proxy,
+			caCert:  *httpCACert,
+			cert:    *httpCert,
+			key:     *httpKey,
+		}
+		if _, err = httpclient.New(httpFlgs.options()...); err != nil {
+			return runFlags{}, fmt.Errorf("http: %w", err)
+		}
+		annotate, err := parseAnnotators(*annotateSpec,
+			httpFlgs.options()...)
+		if err != nil {
+			return runFlags{}, fmt.Errorf("annotate: %w", err)
+		}
+		mail, err := newMailer(*email)
+		if err != nil {
+			return runFlags{}, fmt.Errorf("email: %w", err)
+		}
+		return runFlags{
+			Verbose:           *verbose,
+			Prompt:            *prompt,
+			PromptAuto:        *promptAuto,
+			PromptTimeout:     *promptTime,
+			Policy:            *policy,
+			Identity:          *identity,
+			CacheDir:          *cacheDir,
+			CheckCacheTTL:     *checkTTL,
+			Rate:              rateLimit,
+			MaxInflight:       *maxInfl,
+			NoShortCircuit:    *noShort,
+			RunOnce:           *runOnce,
+			Workers:           *workers,
+			SimulateFailures:  failures,
+			Record:            *record,
+			Progress:          *progressFile,
+			StatusLine:        *statusLine,
+			Timestamps:        stampLoc,
+			Deployment:        *deployment,
+			DeploymentEnv:     *deployEnv,
+			DeploymentRef:     *deployRef,
+			DeploymentURL:     *deployURL,
+			Annotate:          annotate,
+			Email:             mail,
+			ReportHTML:        *reportHTML,
+			ReportJUnit:       *reportJUnit,
+			ReportMaxOutput:   *reportMax,
+			SkipUnreachable:   *skipDead,
+			TransportRetries:  *retries,
+			IgnoreMaintenance: *ignoreMaint,
+			Strict:            *strict,
+			Env:               env,
+			LocalUser:         *localUser,
+			HTTP:              httpFlgs,
+		}, nil
+	}
+}
+
+// runner to run a plan with the given checksum as configured by the flags.
+func (f runFlags) runner(
+	transports map[string]transport,
+	chk string,
+) *runner {
+	return &runner{
+		transports: transports,
+		verbose:    f.Verbose,
+		cache:      buildCache{dir: f.CacheDir},
+		rate:       f.Rate,
+		sched:      newScheduler(f.MaxInflight),
+		workers:    f.Workers,
+		runOnce:    f.RunOnce,
+		failures:   f.SimulateFailures,
+		allExecIfs: f.NoShortCircuit,
+
+		skipUnreachable:  f.SkipUnreachable,
+		failUnreachable:  f.Strict,
+		transportRetries: f.TransportRetries,
+		env:              f.Env,
+		localUser:        f.LocalUser,
+		checks: checkCache{
+			dir: f.CacheDir,
+			ttl: f.CheckCacheTTL,
+			chk: chk,
+		},
+	}
+}
+
+// reporting for a deploy of cmd, whose commit is checked out in dir, as
+// configured by the flags. Logs are appended to statusLine if it's set.
+func (f runFlags) reporting(
+	cmd up.CmdName,
+	dir string,
+	statusLine io.Writer,
+) (reporting, error) {
+	env := f.DeploymentEnv
+	if env == "" {
+		env = string(cmd)
+	}
+	dep, err := newDeployment(f.Deployment, env, f.DeploymentRef,
+		f.DeploymentURL, dir, f.HTTP.options()...)
+	if err != nil {
+		return reporting{}, fmt.Errorf("deployment: %w", err)
+	}
+	return reporting{
+		record:     f.Record,
+		deployment: dep,
+		annotate:   f.Annotate,
+		identity:   f.Identity,
+		mail:       f.Email,
+		html:       f.ReportHTML,
+		junit:      f.ReportJUnit,
+		maxOutput:  f.ReportMaxOutput,
+		progress:   f.Progress,
+		statusLine: statusLine,
+	}, nil
+}
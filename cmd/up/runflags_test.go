@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAddRunFlags(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"-strict", "-workers", "2"}},
+		{args: []string{"-strict", "-skip-unreachable"}, wantErr: true},
+		{args: []string{"-workers", "-1"}, wantErr: true},
+		{args: []string{"-timestamps", "mars"}, wantErr: true},
+		{args: []string{"-local-user", "-u"}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		parseRun := addRunFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		run, err := parseRun()
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("%v: expected error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if !run.Strict || run.Workers != 2 {
+			t.Fatalf("%v: unexpected %+v", tc.args, run)
+		}
+
+		// -strict implies -clean-env
+		if run.Env == nil {
+			t.Fatalf("%v: expected a clean environment", tc.args)
+		}
+	}
+}
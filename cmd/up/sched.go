@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// scheduler decides when a command may start on a server. Each server runs
+// one command at a time, even when several tags running concurrently select
+// it, and when maxInflight is positive, no more than that many commands run
+// at once across every group. A nil scheduler never waits.
+type scheduler struct {
+	slots chan struct{}
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newScheduler(maxInflight int) *scheduler {
+	s := &scheduler{hosts: map[string]chan struct{}{}}
+	if maxInflight > 0 {
+		s.slots = make(chan struct{}, maxInflight)
+	}
+	return s
+}
+
+// acquire blocks until a command may start on the server, then reports a
+// function releasing it once the command finishes. Commands take the server
+// before a slot and never wait for each other while holding both, so they
+// can't deadlock.
+func (s *scheduler) acquire(server string) func() {
+	if s == nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	host, ok := s.hosts[server]
+	if !ok {
+		host = make(chan struct{}, 1)
+		s.hosts[server] = host
+	}
+	s.mu.Unlock()
+
+	host <- struct{}{}
+	if s.slots != nil {
+		s.slots <- struct{}{}
+	}
+	return func() {
+		if s.slots != nil {
+			<-s.slots
+		}
+		<-host
+	}
+}
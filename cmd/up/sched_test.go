@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	t.Parallel()
+	s := newScheduler(3)
+	var (
+		wg       sync.WaitGroup
+		inflight int32
+		maxSeen  int32
+		mu       sync.Mutex
+		perHost  = map[string]int{}
+	)
+	hosts := []string{"a", "b", "c", "d", "a", "a", "b"}
+	for i := 0; i < 4; i++ {
+		for _, host := range hosts {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				release := s.acquire(host)
+				defer release()
+
+				n := atomic.AddInt32(&inflight, 1)
+				defer atomic.AddInt32(&inflight, -1)
+				mu.Lock()
+				if n > maxSeen {
+					maxSeen = n
+				}
+				perHost[host]++
+				if perHost[host] > 1 {
+					mu.Unlock()
+					t.Errorf("%s ran two commands at once", host)
+					return
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				perHost[host]--
+				mu.Unlock()
+			}(host)
+		}
+	}
+	wg.Wait()
+	if maxSeen > 3 {
+		t.Fatalf("expected at most 3 inflight, saw %d", maxSeen)
+	}
+
+	var nilSched *scheduler
+	nilSched.acquire("a")()
+}
+
+func TestRunStepWorkers(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each command counts the commands running alongside it
+	step := planStep{}
+	var servers []string
+	for i := 0; i < 8; i++ {
+		server := fmt.Sprintf("10.0.0.%d", i)
+		servers = append(servers, server)
+		step[server] = fmt.Sprintf("mkdir %[1]s/%[2]s && "+
+			"ls %[1]s | grep -vc max >> %[1]s/max; sleep 0.05; "+
+			"rmdir %[1]s/%[2]s", dir, server)
+	}
+	r := &runner{workers: 3}
+	if _, err = r.runStep(step, servers, false); err != nil {
+		t.Fatal(err)
+	}
+	byt, err := ioutil.ReadFile(filepath.Join(dir, "max"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := strings.Fields(string(byt))
+	if len(counts) != len(servers) {
+		t.Fatalf("expected %d counts, got %v", len(servers), counts)
+	}
+	for _, count := range counts {
+		if n, _ := strconv.Atoi(count); n > 3 {
+			t.Fatalf("expected at most 3 running, got %v", counts)
+		}
+	}
+}
+
+func TestRunStepOnce(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-once")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "ran")
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	same := planStep{}
+	for _, server := range servers {
+		same[server] = "echo x >> " + pth
+	}
+	r := &runner{runOnce: true}
+	if _, err = r.runStep(same, servers, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Steps differing by server still run on each
+	different := planStep{}
+	for _, server := range servers {
+		different[server] = "echo " + server + " >> " + pth
+	}
+	if _, err = r.runStep(different, servers, false); err != nil {
+		t.Fatal(err)
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(string(byt))); n != 4 {
+		t.Fatalf("expected 4 runs, got %d: %q", n, byt)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// scope holds the values available for substitution into commands. A scope
+// is never modified after it's created, so it's safe to share across
+// goroutines. Per-server values are added with with(), which returns a new
+// child scope rather than changing the parent.
+type scope struct {
+	parent *scope
+	vals   map[string]string
+
+	// inv, if set, is the inventory whose hosts steps may refer to by
+	// tag.
+	inv *up.InventoryFile
+
+	// strict, if set, makes ${name} an error unless name is defined.
+	strict bool
+}
+
+// newScope copies vars and the Execs of every command which may be used as a
+// variable, so later changes to either can't affect the scope.
+func newScope(vars map[string]string, cmds map[up.CmdName]*up.Cmd) *scope {
+	vals := make(map[string]string, len(vars)+len(cmds))
+	for name, val := range vars {
+		vals[name] = val
+	}
+
+	// Commands take precedence over vars of the same name
+	for cmdName, cmd := range cmds {
+		if !cmd.Variable() {
+			continue
+		}
+		vals[string(cmdName)] = strings.TrimSpace(
+			strings.Join(cmd.Execs, "\n"))
+	}
+	return &scope{vals: vals}
+}
+
+// with returns a child scope in which name is substituted with val.
+func (s *scope) with(name, val string) *scope {
+	return &scope{parent: s, vals: map[string]string{name: val}}
+}
+
+// withInventory returns a child scope whose steps may refer to the hosts in
+// inv by tag.
+func (s *scope) withInventory(inv *up.InventoryFile) *scope {
+	return &scope{parent: s, inv: inv}
+}
+
+// withStrict returns a child scope in which ${name} is an error unless name
+// is defined, rather than being left for the shell.
+func (s *scope) withStrict() *scope {
+	return &scope{parent: s, strict: true}
+}
+
+// isStrict reports whether the scope or any parent was made withStrict.
+func (s *scope) isStrict() bool {
+	for ; s != nil; s = s.parent {
+		if s.strict {
+			return true
+		}
+	}
+	return false
+}
+
+// inventory reports the scope's inventory, or nil if it has none.
+func (s *scope) inventory() *up.InventoryFile {
+	for ; s != nil; s = s.parent {
+		if s.inv != nil {
+			return s.inv
+		}
+	}
+	return nil
+}
+
+// hostsWithTag reports the hosts in the scope's inventory with a tag.
+func (s *scope) hostsWithTag(tag string) ([]string, error) {
+	inv := s.inventory()
+	if inv == nil {
+		return nil, errors.New("no inventory")
+	}
+	return inv.HostsWithTag(tag)
+}
+
+// withServer returns a child scope for running on a server. $server is the
+// host as written in the inventory. $server.host and $server.port are split
+// from it, and $server.addr is the host in brackets if it's an IPv6 address,
+// for URLs and rsync destinations. The port is empty unless the inventory
+// gives one. $server.user is the user set for the host in the inventory, if
+// any, e.g. for ssh $server.user@$server.host.
+func (s *scope) withServer(server string) *scope {
+	host, port, err := up.SplitAddress(server)
+	if err != nil {
+		// The inventory is validated when it's parsed, so this only
+		// happens for hosts given another way
+		host, port = server, ""
+	}
+	var user string
+	if inv := s.inventory(); inv != nil {
+		user = inv.Settings(server).User
+	}
+	return &scope{parent: s, vals: map[string]string{
+		"server":      server,
+		"server.host": host,
+		"server.port": port,
+		"server.addr": up.URLHost(host),
+		"server.user": user,
+	}}
+}
+
+// serverSentinel stands in for the server's values to learn whether a line
+// depends on them.
+const serverSentinel = "\x00up-server\x00"
+
+// serverIndependent substitutes a line which doesn't refer to the server,
+// even through other variables, reporting false if it does.
+func (s *scope) serverIndependent(line string) (string, bool, error) {
+	cmd, err := (&scope{parent: s, vals: map[string]string{
+		"server":      serverSentinel,
+		"server.host": serverSentinel,
+		"server.port": serverSentinel,
+		"server.addr": serverSentinel,
+		"server.user": serverSentinel,
+	}}).substitute(line)
+	if err != nil {
+		return "", false, err
+	}
+	if strings.Contains(cmd, serverSentinel) {
+		return "", false, nil
+	}
+	return cmd, true, nil
+}
+
+// lookup reports the value of a name, checking child scopes first.
+func (s *scope) lookup(name string) (string, bool) {
+	for ; s != nil; s = s.parent {
+		if val, ok := s.vals[name]; ok {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// names reports every name defined in the scope or its parents.
+func (s *scope) names() []string {
+	seen := map[string]struct{}{}
+	var names []string
+	for ; s != nil; s = s.parent {
+		for name := range s.vals {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// identRegexp matches names which may be variables, such as "region" or
+// "server.user", rather than shell expansions such as ${#args}.
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// filteredRegexp matches variables passed through filters, such as
+// "${msg:q}" or "${checksum:short8:upper}".
+var filteredRegexp = regexp.MustCompile(`\$\{([^{}:]+)((?::[a-z0-9]+)*)\}`)
+
+// substitute variables recursively up to 10 times. After 10 substitutions,
+// this function reports an error. When names share a prefix, the longest
+// match is substituted. ${name:FILTER} is substituted with the value passed
+// through each filter, e.g. ${name:q} shell-quotes it, so spaces and quotes
+// in it can't break the command. Helpers such as $systemd_restart(app) are
+// expanded last.
+func (s *scope) substitute(cmd string) (string, error) {
+	return s.substituteDepth(cmd, 0)
+}
+
+func (s *scope) substituteDepth(cmd string, depth int) (string, error) {
+	if depth >= 10 {
+		return "", errors.New("possible cycle detected")
+	}
+	names := s.names()
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	replacements := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		val, _ := s.lookup(name)
+		replacements = append(replacements, "$"+name, val)
+	}
+	r := strings.NewReplacer(replacements...)
+	for i := 0; i < 10; i++ {
+		tmp, err := s.filter(r.Replace(cmd), depth)
+		if err != nil {
+			return "", err
+		}
+		if cmd == tmp {
+			// We're done, so expand helpers now that their
+			// arguments are substituted
+			if cmd, err = s.expandHosts(cmd); err != nil {
+				return "", err
+			}
+			return expandHelpers(cmd)
+		}
+		cmd = tmp
+	}
+	return "", errors.New("possible cycle detected")
+}
+
+// filter replaces each ${name:FILTER...} with the value of name,
+// substituted, then passed through each filter in order. Undefined names are
+// left alone, as with $name, unless the scope is strict.
+func (s *scope) filter(cmd string, depth int) (string, error) {
+	var err error
+	cmd = filteredRegexp.ReplaceAllStringFunc(cmd, func(ref string) string {
+		m := filteredRegexp.FindStringSubmatch(ref)
+		val, ok := s.lookup(m[1])
+		if !ok {
+			if s.isStrict() && identRegexp.MatchString(m[1]) {
+				err = fmt.Errorf("undefined variable: %s", ref)
+			}
+			return ref
+		}
+		val, subErr := s.substituteDepth(val, depth+1)
+		if subErr == nil && m[2] != "" {
+			val, subErr = applyFilters(val,
+				strings.Split(m[2][1:], ":"))
+		}
+		if subErr != nil {
+			err = fmt.Errorf("%s: %w", ref, subErr)
+			return ref
+		}
+		return val
+	})
+	return cmd, err
+}
+
+// hostsRegexp matches lists of hosts such as "$hosts(redis)".
+var hostsRegexp = regexp.MustCompile(`\$hosts\(([^()]*)\)`)
+
+// expandHosts replaces each $hosts(TAG) with the hosts in the scope's
+// inventory with the tag, separated by spaces, or $hosts(TAG,SEP) with them
+// separated by SEP exactly as written, e.g. $hosts(redis,,) for commas.
+func (s *scope) expandHosts(cmd string) (string, error) {
+	var err error
+	cmd = hostsRegexp.ReplaceAllStringFunc(cmd, func(call string) string {
+		args := strings.SplitN(hostsRegexp.FindStringSubmatch(call)[1],
+			",", 2)
+		sep := " "
+		if len(args) == 2 {
+			sep = args[1]
+		}
+		tag := strings.TrimSpace(args[0])
+		hosts, hostsErr := s.hostsWithTag(tag)
+		if hostsErr != nil {
+			err = fmt.Errorf("hosts %s: %w", tag, hostsErr)
+			return call
+		}
+		return strings.Join(hosts, sep)
+	})
+	return cmd, err
+}
+
+// missingVars reports the variables required by the given commands which are
+// neither set in vars nor defined as variables in the Upfile, sorted by name.
+func missingVars(conf *up.Config, vars map[string]string,
+	names ...up.CmdName) []string {
+	seen := map[string]struct{}{}
+	var missing []string
+	for _, name := range names {
+		for _, req := range conf.Required(name) {
+			if _, ok := seen[req]; ok {
+				continue
+			}
+			seen[req] = struct{}{}
+			if _, ok := vars[req]; ok {
+				continue
+			}
+			cmd := conf.Commands[up.CmdName(req)]
+			if cmd != nil && cmd.Variable() {
+				continue
+			}
+			missing = append(missing, req)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// declaredVars reports the vars declared in the Upfile or required by the
+// given commands, leaving out the rest, e.g. everything else in the
+// environment.
+func declaredVars(conf *up.Config, vars map[string]string,
+	names ...up.CmdName) map[string]string {
+	declared := map[string]string{}
+	for name, val := range vars {
+		if _, ok := conf.Vars[name]; ok {
+			declared[name] = val
+		}
+	}
+	for _, name := range names {
+		for _, req := range conf.Required(name) {
+			if val, ok := vars[req]; ok {
+				declared[req] = val
+			}
+		}
+	}
+	return declared
+}
+
+// checkVars reports an error listing each variable set in vars whose value
+// doesn't match the type declared for it in the Upfile.
+func checkVars(conf *up.Config, vars map[string]string) error {
+	names := make([]string, 0, len(conf.Vars))
+	for name := range conf.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var invalid []string
+	for _, name := range names {
+		val, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if err := conf.Vars[name].Check(val); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", name,
+				err))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid variables: %s",
+			strings.Join(invalid, "; "))
+	}
+	return nil
+}
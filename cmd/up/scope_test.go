@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestScopeSubstitute(t *testing.T) {
+	t.Parallel()
+	cmds := map[up.CmdName]*up.Cmd{
+		"remote":      {Execs: []string{"$user@$server"}},
+		"remote_user": {Execs: []string{"admin"}},
+		"deploy": {
+			ExecIfs: []up.CmdName{"remote"},
+			Execs:   []string{"never substituted"},
+		},
+	}
+	base := newScope(map[string]string{"user": "env"}, cmds).
+		with("checksum", "abc")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server := fmt.Sprintf("10.0.0.%d", i)
+			scp := base.with("server", server)
+			got, err := scp.substitute(
+				"ssh $remote $remote_user $checksum $deploy")
+			if err != nil {
+				errs <- err
+				return
+			}
+			want := fmt.Sprintf("ssh env@%s admin abc $deploy",
+				server)
+			if got != want {
+				errs <- fmt.Errorf("expected %q, got %q", want,
+					got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if _, ok := base.lookup("server"); ok {
+		t.Fatal("server leaked into parent scope")
+	}
+
+	cycle := newScope(nil, map[up.CmdName]*up.Cmd{
+		"a": {Execs: []string{"$b"}},
+		"b": {Execs: []string{"$a"}},
+	})
+	if _, err := cycle.substitute("$a"); err == nil {
+		t.Fatal("expected cycle error")
+	}
+}
+
+func TestSystemdHelpers(t *testing.T) {
+	t.Parallel()
+	scp := newScope(map[string]string{"app": "web@1.service"}, nil)
+	got, err := scp.substitute("ssh host '$systemd_restart($app)'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ssh host 'sudo -n systemctl restart web@1.service && " +
+		"sleep 1 && systemctl is-active --quiet web@1.service || " +
+		"{ echo web@1.service failed to restart >&2; " +
+		"sudo -n systemctl status --no-pager --full --lines=50 " +
+		"web@1.service >&2; false; }'"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	got, err = scp.substitute("$systemd_stop(app)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "&& ! systemctl is-active --quiet app ||") {
+		t.Fatalf("expected stop to check inactive, got %q", got)
+	}
+	for _, bad := range []string{
+		"$systemd_restart(app; rm -rf /)",
+		"$systemd_restart()",
+		"$systemd_enable(app)",
+	} {
+		if _, err = scp.substitute(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestScriptHelper(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "deploy.sh")
+	script := "#!/bin/sh\necho \"$GREETING $1 from '$0'\" > " +
+		filepath.Join(dir, "out") + "\nexit 3\n"
+	if err = ioutil.WriteFile(pth, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scp := newScope(map[string]string{"name": "world"}, nil)
+	cmd, err := scp.substitute("$script(GREETING=hello " + pth +
+		" $name)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cmd, "'") {
+		t.Fatalf("expected no single quotes in %q", cmd)
+	}
+	err = exec.Command("sh", "-c", cmd).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+	byt, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Fields(string(byt))
+	if len(got) != 4 || got[0] != "hello" || got[1] != "world" {
+		t.Fatalf("unexpected output %q", byt)
+	}
+	tmp := strings.Trim(got[3], "'")
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", tmp, err)
+	}
+
+	for _, bad := range []string{
+		"$script()",
+		"$script(X=1)",
+		"$script(" + filepath.Join(dir, "missing") + ")",
+		"$script(" + pth + " it's)",
+	} {
+		if _, err = scp.substitute(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestScopeWithServer(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"10.0.0.1":       "10.0.0.1 10.0.0.1  10.0.0.1",
+		"10.0.0.1:2222":  "10.0.0.1:2222 10.0.0.1 2222 10.0.0.1",
+		"fd00::1":        "fd00::1 fd00::1  [fd00::1]",
+		"[fd00::1]:2222": "[fd00::1]:2222 fd00::1 2222 [fd00::1]",
+	}
+	scp := newScope(nil, nil)
+	for server, want := range tcs {
+		got, err := scp.withServer(server).substitute(
+			"$server $server.host $server.port $server.addr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %q, got %q", server, want, got)
+		}
+	}
+
+	// The user comes from the inventory's settings
+	inv, err := up.ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1": ["web"],
+		"10.0.0.2": {"tags": ["web"], "user": "admin"},
+		"tags": {"web": {"user": "deploy"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scp = scp.withInventory(inv)
+	for server, want := range map[string]string{
+		"10.0.0.1": "deploy@10.0.0.1",
+		"10.0.0.2": "admin@10.0.0.2",
+		"10.0.0.3": "@10.0.0.3",
+	} {
+		got, err := scp.withServer(server).substitute(
+			"$server.user@$server.host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %q, got %q", server, want, got)
+		}
+	}
+}
+
+func TestScopeFilters(t *testing.T) {
+	t.Parallel()
+	cmds := map[up.CmdName]*up.Cmd{
+		"msg":  {Execs: []string{"it's $who"}},
+		"self": {Execs: []string{"${self:q}"}},
+	}
+	scp := newScope(map[string]string{
+		"who":  "a b; rm -rf /",
+		"sum":  "0123abcdef",
+		"addr": "[fd00::1]:2222",
+	}, cmds)
+	tcs := map[string]string{
+		"echo ${who:q}":             `echo 'a b; rm -rf /'`,
+		"echo ${msg:q}":             `echo 'it'"'"'s a b; rm -rf /'`,
+		"echo ${unknown:q}":         "echo ${unknown:q}",
+		"echo $who":                 "echo a b; rm -rf /",
+		"echo ${sum:short8}":        "echo 0123abcd",
+		"echo ${sum:short8:upper}":  "echo 0123ABCD",
+		"${addr:host} ${addr:port}": "fd00::1 2222",
+		"echo ${who}.":              "echo a b; rm -rf /.",
+	}
+	for line, want := range tcs {
+		got, err := scp.substitute(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %q, got %q", line, want, got)
+		}
+	}
+	for _, line := range []string{"${self:q}", "${who:nope}",
+		"${who:short0}"} {
+		if _, err := scp.substitute(line); err == nil {
+			t.Fatalf("%s: expected error", line)
+		}
+	}
+}
+
+func TestScopeHosts(t *testing.T) {
+	t.Parallel()
+	inv, err := up.ParseInventoryFile(strings.NewReader(`{
+		"1.1.1.1": ["web"],
+		"2.2.2.2": ["redis"],
+		"3.3.3.3": ["redis"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := map[up.CmdName]*up.Cmd{"peers": {Execs: []string{"redis"}}}
+	scp := newScope(nil, cmds).withInventory(inv)
+	tcs := map[string]string{
+		"echo $hosts(redis)":      "echo 2.2.2.2 3.3.3.3",
+		"echo $hosts($peers,,)":   "echo 2.2.2.2,3.3.3.3",
+		"echo $hosts( redis ,; )": "echo 2.2.2.2; 3.3.3.3",
+		"echo $hosts(db)":         "echo ",
+	}
+	for line, want := range tcs {
+		got, err := scp.substitute(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %q, got %q", line, want, got)
+		}
+	}
+	_, err = newScope(nil, nil).substitute("$hosts(redis)")
+	if err == nil {
+		t.Fatal("expected error without an inventory")
+	}
+}
+
+func TestScopeServerIndependent(t *testing.T) {
+	t.Parallel()
+	cmds := map[up.CmdName]*up.Cmd{
+		"remote": {Execs: []string{"deploy@$server.host"}},
+		"app":    {Execs: []string{"api"}},
+	}
+	scp := newScope(nil, cmds).with("checksum", "abc")
+	tcs := map[string]string{
+		"echo $app $checksum":    "echo api abc",
+		"ssh $remote echo $app":  "",
+		"curl $server.addr:8080": "",
+		"echo $server":           "",
+	}
+	for line, want := range tcs {
+		got, ok, err := scp.serverIndependent(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (want != "") || got != want {
+			t.Fatalf("%s: expected %q, got %q %t", line, want, got,
+				ok)
+		}
+	}
+}
+
+func TestMissingVars(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`deploy requires A, B, C
+	echo $A $B $C
+
+state requires D
+	echo $D
+
+C
+	c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"A": "a"}
+	got := missingVars(conf, vars, "deploy")
+	if fmt.Sprint(got) != "[B]" {
+		t.Fatalf("expected [B], got %v", got)
+	}
+	got = missingVars(conf, vars, "deploy", "state")
+	if fmt.Sprint(got) != "[B D]" {
+		t.Fatalf("expected [B D], got %v", got)
+	}
+	vars["B"], vars["D"] = "", ""
+	if got = missingVars(conf, vars, "deploy", "state"); len(got) != 0 {
+		t.Fatalf("expected none missing, got %v", got)
+	}
+}
+
+func TestDeclaredVars(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`var ENV string
+
+deploy requires A
+	echo $A $ENV $HOME
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"A": "a", "ENV": "prod", "HOME": "/root"}
+	got := declaredVars(conf, vars, "deploy", "")
+	if fmt.Sprint(got) != "map[A:a ENV:prod]" {
+		t.Fatalf("expected map[A:a ENV:prod], got %v", got)
+	}
+}
+
+func TestScopeStrict(t *testing.T) {
+	t.Parallel()
+	scp := newScope(map[string]string{"app": "web"}, nil)
+	cmd := "echo ${app} ${HOME} ${#args}"
+	got, err := scp.substitute(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "echo web ${HOME} ${#args}" {
+		t.Fatalf("unexpected %q", got)
+	}
+	if _, err = scp.withStrict().substitute(cmd); err == nil {
+		t.Fatal("expected undefined variable error")
+	}
+	got, err = scp.withStrict().substitute("echo ${app} $HOME ${#args}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "echo web $HOME ${#args}" {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestCheckVars(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`var PORT int
+var ENV enum(staging,prod)
+var DEBUG bool
+
+deploy
+	echo $ENV $PORT $DEBUG
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"PORT": "8080", "ENV": "prod"}
+	if err = checkVars(conf, vars); err != nil {
+		t.Fatal(err)
+	}
+	vars["ENV"], vars["DEBUG"] = "prdo", "maybe"
+	err = checkVars(conf, vars)
+	want := `invalid variables: DEBUG: "maybe" is not a bool; ` +
+		`ENV: "prdo" is not one of staging, prod`
+	if fmt.Sprint(err) != want {
+		t.Fatalf("expected %s, got %v", want, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// scriptHelper expands "[NAME=VALUE...] PATH [ARGS...]" into commands which
+// recreate the local script at PATH in a temporary file, run it with the
+// environment and arguments, then remove it, preserving its exit status. The
+// script is read when planning, so plans don't depend on local files, and is
+// base64 encoded so it needs no quoting.
+func scriptHelper(arg string) (string, error) {
+	words := strings.Fields(arg)
+	var env []string
+	for len(words) > 0 && strings.Contains(words[0], "=") {
+		env, words = append(env, words[0]), words[1:]
+	}
+	if len(words) == 0 {
+		return "", errors.New("missing script path")
+	}
+	byt, err := ioutil.ReadFile(words[0])
+	if err != nil {
+		return "", fmt.Errorf("read file: %w", err)
+	}
+	for _, w := range append(env, words[1:]...) {
+		if strings.Contains(w, "'") {
+			return "", fmt.Errorf(
+				"%s: single quotes are not allowed", w)
+		}
+	}
+	run := strings.Join(append(append(env, "$f"), words[1:]...), " ")
+	return fmt.Sprintf("(f=$(mktemp) && echo %s | base64 -d > $f && "+
+		"chmod 700 $f && %s; s=$?; rm -f $f; exit $s)",
+		base64.StdEncoding.EncodeToString(byt), run), nil
+}
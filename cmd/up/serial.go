@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// serial is the size of each tag's batches, from -n. It's either a number of
+// servers, where 0 is every server at once, or a percentage of each tag's
+// hosts, so tags of very different sizes roll out in the same number of
+// batches.
+type serial struct {
+	n   int
+	pct float64
+}
+
+// parseSerial parses a number of servers, e.g. "5", or a percentage, e.g.
+// "25%".
+func parseSerial(s string) (serial, error) {
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return serial{}, fmt.Errorf("-n %s must be above 0%% "+
+				"and at most 100%%", s)
+		}
+		return serial{pct: pct}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return serial{}, fmt.Errorf("-n %s must be a number of "+
+			"servers or a percentage, e.g. 25%%", s)
+	}
+	return serial{n: n}, nil
+}
+
+// size of each batch for a tag with the given number of hosts, or 0 for all
+// of them at once. Percentages round up, so every batch has a server.
+func (s serial) size(hosts int) int {
+	if s.pct == 0 {
+		return s.n
+	}
+	return int(math.Ceil(float64(hosts) * s.pct / 100))
+}
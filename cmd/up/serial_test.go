@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseSerial(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		have  string
+		hosts int
+		want  int
+	}{
+		{have: "3", hosts: 10, want: 3},
+		{have: "0", hosts: 10, want: 0},
+		{have: "25%", hosts: 10, want: 3},
+		{have: "25%", hosts: 1, want: 1},
+		{have: "12.5%", hosts: 16, want: 2},
+		{have: "100%", hosts: 7, want: 7},
+	}
+	for _, tc := range tcs {
+		s, err := parseSerial(tc.have)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.have, err)
+		}
+		if got := s.size(tc.hosts); got != tc.want {
+			t.Fatalf("%s of %d: expected %d, got %d", tc.have,
+				tc.hosts, tc.want, got)
+		}
+	}
+	for _, bad := range []string{"", "-1", "0%", "101%", "a%", "2.5"} {
+		if _, err := parseSerial(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
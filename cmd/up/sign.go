@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// planNamespace scopes plan signatures, so a signature made for another
+// purpose with the same key can't be replayed as a signed plan.
+const planNamespace = "up-plan@egtann"
+
+// signPlan writes a detached signature for the plan to pth + ".sig" using
+// ssh-keygen. key is a private key, or a public key whose private half is
+// held by ssh-agent.
+func signPlan(pth, key string) error {
+	// ssh-keygen refuses to overwrite an existing signature
+	if err := os.Remove(pth + ".sig"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove old signature: %w", err)
+	}
+	c := exec.Command("ssh-keygen", "-Y", "sign", "-q", "-f", key,
+		"-n", planNamespace, pth)
+	c.Stdin = os.Stdin
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("ssh-keygen: %w", err)
+	}
+	return nil
+}
+
+// verifyPlan checks the signature of a plan's contents at pth + ".sig" against
+// an OpenSSH allowed signers file, reporting the principal who signed it.
+func verifyPlan(pth string, byt []byte, allowedSigners string) (string, error) {
+	sig := pth + ".sig"
+	if _, err := os.Stat(sig); err != nil {
+		return "", fmt.Errorf("missing signature: %w", err)
+	}
+	out, err := sshKeygen(byt, "-Y", "find-principals", "-s", sig,
+		"-f", allowedSigners)
+	if err != nil {
+		return "", errors.New("plan is not signed by an allowed signer")
+	}
+	principal := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	_, err = sshKeygen(byt, "-Y", "verify", "-f", allowedSigners,
+		"-I", principal, "-n", planNamespace, "-s", sig)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	return principal, nil
+}
+
+// sshKeygen runs ssh-keygen with stdin, reporting its output.
+func sshKeygen(stdin []byte, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	c := exec.Command("ssh-keygen", args...)
+	c.Stdin = bytes.NewReader(stdin)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("ssh-keygen: %s: %w",
+			strings.TrimSpace(stderr.String()), err)
+	}
+	return stdout.String(), nil
+}
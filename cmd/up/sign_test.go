@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignPlan(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	dir, err := ioutil.TempDir("", "up-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keygen := func(name string) string {
+		pth := filepath.Join(dir, name)
+		err := exec.Command("ssh-keygen", "-q", "-t", "ed25519",
+			"-N", "", "-f", pth).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+	alice, mallory := keygen("alice"), keygen("mallory")
+	pub, err := ioutil.ReadFile(alice + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := filepath.Join(dir, "allowed_signers")
+	err = ioutil.WriteFile(signers, append([]byte("alice "), pub...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pth := filepath.Join(dir, "plan.json")
+	byt := []byte(`{"Command": "deploy"}`)
+	if err = ioutil.WriteFile(pth, byt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = signPlan(pth, alice); err != nil {
+		t.Fatal(err)
+	}
+	principal, err := verifyPlan(pth, byt, signers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "alice" {
+		t.Fatalf("expected alice, got %s", principal)
+	}
+	if _, err = verifyPlan(pth, []byte("{}"), signers); err == nil {
+		t.Fatal("expected error for modified plan")
+	}
+
+	if err = signPlan(pth, mallory); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifyPlan(pth, byt, signers); err == nil {
+		t.Fatal("expected error for unknown signer")
+	}
+}
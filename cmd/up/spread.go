@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// hostZones reports the zone, or region if by is "region", of every host, so
+// batches can be spread across them.
+func hostZones(settings map[string]up.Settings, by string) map[string]string {
+	zones := make(map[string]string, len(settings))
+	for host, s := range settings {
+		zones[host] = s.Zone
+		if by == "region" {
+			zones[host] = s.Region
+		}
+	}
+	return zones
+}
+
+// spreadBatches splits hosts into as few batches of up to max as possible,
+// dealing each zone's hosts across the batches in turn, so hosts in the same
+// zone land in different batches wherever there are enough of them. Hosts
+// without a zone share one.
+func spreadBatches(
+	hosts []string,
+	zones map[string]string,
+	max int,
+) [][]string {
+	byZone := map[string][]string{}
+	for _, host := range hosts {
+		byZone[zones[host]] = append(byZone[zones[host]], host)
+	}
+	names := make([]string, 0, len(byZone))
+	for zone, zoneHosts := range byZone {
+		names = append(names, zone)
+		rand.Shuffle(len(zoneHosts), func(i, j int) {
+			zoneHosts[i], zoneHosts[j] = zoneHosts[j], zoneHosts[i]
+		})
+	}
+
+	// Deal the largest zones first, while every batch has room.
+	// Randomize ties, so the same zone doesn't always go first.
+	rand.Shuffle(len(names), func(i, j int) {
+		names[i], names[j] = names[j], names[i]
+	})
+	sort.SliceStable(names, func(i, j int) bool {
+		return len(byZone[names[i]]) > len(byZone[names[j]])
+	})
+	b := make([][]string, (len(hosts)+max-1)/max)
+	var next int
+	for _, zone := range names {
+		for _, host := range byZone[zone] {
+			for len(b[next]) >= max {
+				next = (next + 1) % len(b)
+			}
+			b[next] = append(b[next], host)
+			next = (next + 1) % len(b)
+		}
+	}
+	return b
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSpreadBatches(t *testing.T) {
+	t.Parallel()
+	zones := map[string]string{
+		"a1": "a", "a2": "a", "a3": "a", "a4": "a",
+		"b1": "b", "b2": "b",
+		"c1": "c", "c2": "c",
+		"x": "",
+	}
+	hosts := make([]string, 0, len(zones))
+	for host := range zones {
+		hosts = append(hosts, host)
+	}
+	b := spreadBatches(hosts, zones, 3)
+	if len(b) != 3 {
+		t.Fatalf("expected 3 batches, got %v", b)
+	}
+	for _, srvs := range b {
+		inBatch := map[string]int{}
+		for _, srv := range srvs {
+			inBatch[zones[srv]]++
+		}
+		for zone, n := range inBatch {
+			if n > 2 || n > 1 && zone != "a" {
+				t.Fatalf("batch %v has %d hosts in %q", srvs, n,
+					zone)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/httpclient"
+)
+
+// hostStatus is the state read from a single host.
+type hostStatus struct {
+	Host  string
+	State *up.State
+	Err   error
+}
+
+// maxStateSize limits how much of a version endpoint's response is read.
+const maxStateSize = 1 << 20
+
+// statusCmd reads what's deployed on every selected host, either from the
+// state written by -state or from each host's version endpoint, and reports
+// which hosts are in sync with the local checksum without deploying
+// anything.
+func statusCmd(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile")
+	inventory := fs.String("i", "inventory.json", "path to inventory")
+	command := fs.String("c", "", "command printing a host's state, written by -state")
+	url := fs.String("url", "", "command holding the URL of each host's version endpoint")
+	tags := fs.String("t", "all", "tags from inventory to read")
+	directory := fs.String("d", ".", "directory for checksum")
+	checksumAlg := fs.String("checksum-algorithm", defaultChecksumAlgorithm, "algorithm for the checksum: sha256 or blake3")
+	checksumMode := fs.Bool("checksum-modes", false, "include file permissions in the checksum (default false)")
+	checksumLink := fs.Bool("checksum-symlinks", false, "include symlink targets in the checksum (default false)")
+	checksumSkip := fs.String("checksum-exclude", "", "comma-separated globs of files or directories left out of the checksum")
+	checksumName := fs.String("checksum", "", "compare hosts to this checksum named in the Upfile rather than -d")
+	versionFrom := fs.String("version-from", "", "where the version of -d comes from: checksum, git or file:PATH (defaults to the first command's version)")
+	versionID := fs.String("version-id", "", "compare hosts to this version rather than calculating it")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout for each version endpoint")
+	proxy := fs.String("proxy", "", "proxy for version endpoints, e.g. http://proxy:3128 (default $HTTPS_PROXY)")
+	retries := fs.Int("retries", 0, "times to retry requests which fail to connect or get a 429, 502, 503 or 504 (default 0)")
+	caCert := fs.String("cacert", "", "PEM file of CA certificates trusted alongside the system's")
+	cert := fs.String("cert", "", "PEM client certificate for servers requiring mutual TLS")
+	key := fs.String("key", "", "PEM private key of -cert")
+	pol := addPolicyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*command == "") == (*url == "") {
+		return usage(errors.New("status requires one of -c or -url"))
+	}
+	if *versionFrom != "" && *versionID != "" {
+		return usage(errors.New("cannot use -version-id with " +
+			"-version-from"))
+	}
+
+	fi, err := os.Open(*upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	name := conf.Resolve(up.CmdName(*command + *url))
+	cmd, ok := conf.Commands[name]
+	if !ok {
+		return fmt.Errorf("undefined command: %s", name)
+	}
+
+	transports, err := selectHosts(*inventory, name, *tags, pol)
+	if err != nil {
+		return err
+	}
+	opts := checksumOpts{
+		Algorithm: *checksumAlg,
+		Modes:     *checksumMode,
+		Symlinks:  *checksumLink,
+	}
+	if *checksumSkip != "" {
+		opts.Exclude = strings.Split(*checksumSkip, ",")
+	}
+	from := *versionFrom
+	if first, ok := conf.Commands[conf.DefaultCommand]; ok && from == "" {
+		from = first.Version
+	}
+	src, err := newVersionSource(from, *versionID, *directory, opts)
+	if err != nil {
+		return err
+	}
+	chk, err := src.version()
+	if err != nil {
+		return fmt.Errorf("calc version: %w", err)
+	}
+	scp := newScope(environVars(), conf.Commands).with("checksum", chk)
+	sums, err := namedChecksums(conf.Checksums, filepath.Dir(*upfile),
+		opts)
+	if err != nil {
+		return fmt.Errorf("calc checksum: %w", err)
+	}
+	for name, sum := range sums {
+		scp = scp.with(name, sum)
+	}
+	if *checksumName != "" {
+		if chk, ok = sums["checksum."+*checksumName]; !ok {
+			return fmt.Errorf("undefined checksum: %s",
+				*checksumName)
+		}
+	}
+	text := strings.Join(cmd.Execs, "\n")
+	read := func(host string) (*up.State, error) {
+		return readState(transports[host], scp, host, text)
+	}
+	if *url != "" {
+		client, err := httpclient.New(httpFlags{
+			timeout: *timeout,
+			retries: *retries,
+			proxy:   *proxy,
+			caCert:  *caCert,
+			cert:    *cert,
+			key:     *key,
+		}.options()...)
+		if err != nil {
+			return err
+		}
+		read = func(host string) (*up.State, error) {
+			return fetchState(client, scp, host, text)
+		}
+	}
+
+	printStatus(os.Stdout, readStatuses(transports, read), chk)
+	windows, err := readMaintenance(conf, transports, scp)
+	if err != nil {
+		return fmt.Errorf("read maintenance: %w", err)
+	}
+	printMaintenance(os.Stdout, windows, len(transports))
+	return nil
+}
+
+// readStatuses reads every host's state concurrently, sorted by host.
+func readStatuses(
+	transports map[string]transport,
+	read func(host string) (*up.State, error),
+) []hostStatus {
+	statuses := make([]hostStatus, 0, len(transports))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for host := range transports {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			state, err := read(host)
+			mu.Lock()
+			defer mu.Unlock()
+			statuses = append(statuses, hostStatus{
+				Host:  host,
+				State: state,
+				Err:   err,
+			})
+		}(host)
+	}
+	wg.Wait()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+	return statuses
+}
+
+// readState runs the command on the host and parses its output.
+func readState(
+	t transport,
+	scp *scope,
+	server, text string,
+) (*up.State, error) {
+	out, err := hostOutput(t, scp, server, text)
+	if err != nil {
+		return nil, err
+	}
+	return parseState(out)
+}
+
+// hostOutput runs the command on the host and reports what it prints. If it
+// fails, the error includes anything it printed to stderr.
+func hostOutput(
+	t transport,
+	scp *scope,
+	server, text string,
+) ([]byte, error) {
+	line, err := scp.withServer(server).substitute(text)
+	if err != nil {
+		return nil, fmt.Errorf("substitute: %w", err)
+	}
+	return runOutput(t, server, line)
+}
+
+// runOutput runs an already substituted command on the host and reports what
+// it prints, as with hostOutput.
+func runOutput(t transport, server, line string) ([]byte, error) {
+	user, line := up.RunAs(line)
+	var stdout, stderr bytes.Buffer
+	err := execute(t, server, user, line, nil, nil, &stdout,
+		&stderr)
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// fetchState requests the host's version endpoint and parses the response.
+func fetchState(
+	client *http.Client,
+	scp *scope,
+	server, text string,
+) (*up.State, error) {
+	url, err := scp.withServer(server).substitute(text)
+	if err != nil {
+		return nil, fmt.Errorf("substitute: %w", err)
+	}
+	resp, err := client.Get(strings.TrimSpace(url))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStateSize))
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return parseState(byt)
+}
+
+// parseState accepts either an up.State as JSON or, like
+// GetCalculatedChecksum, a bare checksum. Empty input means no state was
+// written.
+func parseState(byt []byte) (*up.State, error) {
+	var state up.State
+	byt = bytes.TrimSpace(byt)
+	switch {
+	case len(byt) == 0:
+		return &state, nil
+	case byt[0] != '{':
+		state.Checksum = string(byt)
+		return &state, nil
+	}
+	if err := json.Unmarshal(byt, &state); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &state, nil
+}
+
+// printStatus writes a table of each host's state and whether it matches the
+// local checksum, followed by the number of hosts in each condition.
+func printStatus(w io.Writer, statuses []hostStatus, chk string) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSYNC\tCHECKSUM\tCOMMAND\tVERSION\tTIME")
+	counts := map[string]int{}
+	for _, s := range statuses {
+		var cond string
+		switch {
+		case s.Err != nil:
+			cond = "error"
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Host, cond, s.Err)
+		case s.State.Checksum == "":
+			cond = "unknown"
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\n", s.Host, cond)
+		default:
+			cond = "outdated"
+			switch {
+			case s.State.Checksum == chk:
+				cond = "in sync"
+			case up.ChecksumAlgorithm(s.State.Checksum) !=
+				up.ChecksumAlgorithm(chk):
+				// The checksums can't be compared, so the host
+				// may well be in sync
+				cond = "other algorithm"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Host, cond, s.State.Checksum,
+				dash(string(s.State.Command)),
+				dash(s.State.Version),
+				formatStateTime(s.State.Time))
+		}
+		counts[cond]++
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nlocal checksum %s\n", chk)
+	conds := []string{"in sync", "outdated", "other algorithm",
+		"unknown", "error"}
+	for _, cond := range conds {
+		if counts[cond] > 0 {
+			fmt.Fprintf(w, "%d/%d hosts %s\n", counts[cond],
+				len(statuses), cond)
+		}
+	}
+}
+
+// dash reports "-" in place of an empty string, so table columns line up.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatStateTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
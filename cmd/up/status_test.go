@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestReadState(t *testing.T) {
+	t.Parallel()
+	scp := newScope(nil, nil)
+	state, err := readState(localTransport{}, scp, "1.1.1.1",
+		`echo '{"checksum":"abc","command":"deploy"}'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Checksum != "abc" || state.Command != "deploy" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	state, err = readState(localTransport{}, scp, "1.1.1.1", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Checksum != "" {
+		t.Fatalf("expected empty state, got %+v", state)
+	}
+	_, err = readState(localTransport{}, scp, "1.1.1.1",
+		"echo oops >&2; false")
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected error with stderr, got %v", err)
+	}
+}
+
+func TestFetchState(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/checksum":
+				w.Write([]byte("abc\n"))
+			case "/state":
+				w.Write([]byte(`{"checksum":"def"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+	client := srv.Client()
+	scp := newScope(nil, nil)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for path, want := range map[string]string{
+		"checksum": "abc",
+		"state":    "def",
+	} {
+		state, err := fetchState(client, scp, host,
+			"http://$server/"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Checksum != want {
+			t.Fatalf("expected %s, got %+v", want, state)
+		}
+	}
+	_, err := fetchState(client, scp, host, "http://$server/x")
+	if err == nil {
+		t.Fatal("expected error for 404")
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	printStatus(&buf, []hostStatus{
+		{Host: "1.1.1.1", State: &up.State{
+			Checksum: "sha256:abc",
+			Command:  "deploy",
+			Time:     now,
+			Version:  "v1",
+		}},
+		{Host: "2.2.2.2", State: &up.State{Checksum: "sha256:old"}},
+		{Host: "3.3.3.3", State: &up.State{Checksum: "blake3:abc"}},
+		{Host: "4.4.4.4", State: &up.State{Checksum: "abc"}},
+		{Host: "5.5.5.5", State: &up.State{}},
+		{Host: "6.6.6.6", Err: errors.New("timeout")},
+	}, "sha256:abc")
+	want := `HOST     SYNC             CHECKSUM    COMMAND  VERSION  TIME
+1.1.1.1  in sync          sha256:abc  deploy   v1       2020-01-02T03:04:05Z
+2.2.2.2  outdated         sha256:old  -        -        -
+3.3.3.3  other algorithm  blake3:abc  -        -        -
+4.4.4.4  other algorithm  abc         -        -        -
+5.5.5.5  unknown          -           -        -        -
+6.6.6.6  error            timeout
+
+local checksum sha256:abc
+1/6 hosts in sync
+1/6 hosts outdated
+2/6 hosts other algorithm
+1/6 hosts unknown
+1/6 hosts error
+`
+	if buf.String() != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
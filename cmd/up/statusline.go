@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~egtann/up/progress"
+)
+
+// statusLog is the file to which logs are appended for -status-line.
+type statusLog struct {
+	*os.File
+
+	// loc in which log lines are stamped, or nil.
+	loc *time.Location
+}
+
+// startStatusLine appends logs to the file at pth rather than writing them to
+// stderr, until it's closed. Log lines are stamped with the time in loc
+// unless it's nil.
+func startStatusLine(pth string, loc *time.Location) (statusLog, error) {
+	fi, err := os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return statusLog{}, fmt.Errorf("open status line log: %w", err)
+	}
+	setLogOutput(fi, loc)
+	return statusLog{File: fi, loc: loc}, nil
+}
+
+// Close the file, writing logs to stderr again.
+func (l statusLog) Close() error {
+	setLogOutput(os.Stderr, l.loc)
+	return l.File.Close()
+}
+
+// statusLines writes a short line for each progress event, with the batch
+// and percentage complete, for -status-line.
+type statusLines struct {
+	out io.Writer
+
+	// plan being run. Its servers are counted at the first batch, after
+	// unreachable servers have been skipped.
+	plan *plan
+
+	mu       sync.Mutex
+	total    int
+	finished int
+	statuses map[progress.Status]int
+
+	// batches is each tag's current batch, e.g. "2/3".
+	batches map[string]string
+}
+
+func (s *statusLines) callbacks() progress.Callbacks {
+	return progress.Callbacks{
+		OnBatchStart:   s.batchStart,
+		OnServerResult: s.serverResult,
+		OnDeployEnd:    s.deployEnd,
+	}
+}
+
+func (s *statusLines) batchStart(b progress.Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batches == nil {
+		s.batches = map[string]string{}
+		s.statuses = map[progress.Status]int{}
+		for _, g := range s.plan.Groups {
+			for _, pb := range g.Batches {
+				s.total += len(pb.Servers)
+			}
+		}
+	}
+	s.batches[b.Tag] = fmt.Sprintf("%d/%d", b.Number, b.Total)
+	fmt.Fprintf(s.out, "%s %s: started %s (%s)\n", b.Tag,
+		s.batches[b.Tag], strings.Join(b.Servers, ", "), s.complete())
+}
+
+func (s *statusLines) serverResult(r progress.Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished++
+	s.statuses[r.Status]++
+	var msg string
+	switch r.Status {
+	case progress.Current:
+		msg = "already current"
+	case progress.Failed:
+		msg = "failed: " + firstLine(r.Err)
+	default:
+		msg = string(r.Status)
+	}
+	fmt.Fprintf(s.out, "%s %s: %s %s (%s)\n", r.Tag, s.batches[r.Tag],
+		r.Server, msg, s.complete())
+}
+
+func (s *statusLines) deployEnd(e progress.End) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts []string
+	for _, status := range []progress.Status{
+		progress.Deployed,
+		progress.Current,
+		progress.Failed,
+	} {
+		if n := s.statuses[status]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, status))
+		}
+	}
+	summary := fmt.Sprintf("%d/%d servers", s.finished, s.total)
+	if len(counts) > 0 {
+		summary += ", " + strings.Join(counts, ", ")
+	}
+	if len(s.plan.Unmatched) > 0 {
+		summary += "; tags matching no hosts: " +
+			strings.Join(s.plan.Unmatched, ", ")
+	}
+	took := roundDuration(e.Took)
+	if e.Err != "" {
+		fmt.Fprintf(s.out, "%s failed after %s: %s (%s)\n", e.Command,
+			took, firstLine(e.Err), summary)
+		return
+	}
+	fmt.Fprintf(s.out, "%s succeeded in %s (%s)\n", e.Command, took,
+		summary)
+}
+
+// complete reports how many servers finished of the total, e.g. "3/6, 50%".
+func (s *statusLines) complete() string {
+	pct := 100
+	if s.total > 0 {
+		pct = s.finished * 100 / s.total
+	}
+	return fmt.Sprintf("%d/%d, %d%%", s.finished, s.total, pct)
+}
+
+// firstLine of an error, so each event stays on a single line.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + "..."
+	}
+	return s
+}
+
+// joinProgress calls each event's callbacks in a and then b.
+func joinProgress(a, b progress.Callbacks) progress.Callbacks {
+	return progress.Callbacks{
+		OnBatchStart: func(e progress.Batch) {
+			a.BatchStart(e)
+			b.BatchStart(e)
+		},
+		OnServerResult: func(e progress.Result) {
+			a.ServerResult(e)
+			b.ServerResult(e)
+		},
+		OnDeployEnd: func(e progress.End) {
+			a.DeployEnd(e)
+			b.DeployEnd(e)
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.sr.ht/~egtann/up/progress"
+)
+
+func TestStatusLines(t *testing.T) {
+	t.Parallel()
+	p := &plan{Groups: []*planGroup{{Tag: "web", Batches: []*planBatch{
+		{Servers: []string{"10.0.0.1", "10.0.0.2"}},
+		{Servers: []string{"10.0.0.3"}},
+	}}}, Unmatched: []string{"wbe"}}
+	var buf bytes.Buffer
+	cb := (&statusLines{out: &buf, plan: p}).callbacks()
+	cb.BatchStart(progress.Batch{Tag: "web", Number: 1, Total: 2,
+		Servers: []string{"10.0.0.1", "10.0.0.2"}})
+	cb.ServerResult(progress.Result{Tag: "web", Server: "10.0.0.1",
+		Status: progress.Deployed})
+	cb.ServerResult(progress.Result{Tag: "web", Server: "10.0.0.2",
+		Status: progress.Current})
+	cb.BatchStart(progress.Batch{Tag: "web", Number: 2, Total: 2,
+		Servers: []string{"10.0.0.3"}})
+	cb.ServerResult(progress.Result{Tag: "web", Server: "10.0.0.3",
+		Status: progress.Failed, Err: "exit status 1\nmore"})
+	cb.DeployEnd(progress.End{Command: "deploy",
+		Took: 61 * time.Second, Err: "boom"})
+	want := `web 1/2: started 10.0.0.1, 10.0.0.2 (0/3, 0%)
+web 1/2: 10.0.0.1 deployed (1/3, 33%)
+web 1/2: 10.0.0.2 already current (2/3, 66%)
+web 2/2: started 10.0.0.3 (2/3, 66%)
+web 2/2: 10.0.0.3 failed: exit status 1... (3/3, 100%)
+deploy failed after 1m1s: boom (3/3 servers, 1 deployed, 1 current, ` +
+		`1 failed; tags matching no hosts: wbe)
+`
+	if buf.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// unitRegexp matches the systemd unit names accepted by helpers, which never
+// need quoting.
+var unitRegexp = regexp.MustCompile(`^[A-Za-z0-9@._:-]+$`)
+
+// systemdHelper expands into a systemctl action on a unit followed by a check
+// of the unit's resulting state. If either fails, the unit's status and
+// recent logs are printed to stderr and the step fails. sudo -n fails rather
+// than waiting for a password nobody will type.
+func systemdHelper(action string, active bool) func(string) (string, error) {
+	return func(unit string) (string, error) {
+		unit = strings.TrimSpace(unit)
+		if !unitRegexp.MatchString(unit) {
+			return "", fmt.Errorf("invalid unit %q", unit)
+		}
+		check := "systemctl is-active --quiet " + unit
+		if !active {
+			check = "! " + check
+		}
+		return fmt.Sprintf("sudo -n systemctl %s %s && sleep 1 && "+
+			"%s || { echo %s failed to %s >&2; "+
+			"sudo -n systemctl status --no-pager --full "+
+			"--lines=50 %s >&2; false; }", action, unit, check,
+			unit, action, unit), nil
+	}
+}
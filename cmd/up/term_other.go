@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// isTerminal reports whether the file is a character device, such as a TTY.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// withoutEcho calls fn. Echo can't be turned off on this platform, so
+// secrets typed are shown.
+func withoutEcho(f *os.File, fn func() error) error {
+	return fn()
+}
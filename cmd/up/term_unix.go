@@ -0,0 +1,41 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal reports whether the file is a terminal, which unlike checking
+// for a character device excludes /dev/null.
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		ioctlGetTermios, uintptr(unsafe.Pointer(&t)))
+	return errno == 0
+}
+
+// withoutEcho calls fn with echo turned off on the terminal, so secrets typed
+// aren't shown, then restores it.
+func withoutEcho(f *os.File, fn func() error) error {
+	var old syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		ioctlGetTermios, uintptr(unsafe.Pointer(&old)))
+	if errno != 0 {
+		return fmt.Errorf("get termios: %w", errno)
+	}
+	t := old
+	t.Lflag &^= syscall.ECHO
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		ioctlSetTermios, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return fmt.Errorf("set termios: %w", errno)
+	}
+	defer syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlSetTermios,
+		uintptr(unsafe.Pointer(&old)))
+	return fn()
+}
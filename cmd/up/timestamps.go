@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// parseTimestamps parses -timestamps, the time zone in which log lines are
+// stamped, "local" or "utc", or "none" to leave them unstamped, for which it
+// reports nil.
+func parseTimestamps(s string) (*time.Location, error) {
+	switch s {
+	case "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown timestamps %q: use local, utc "+
+			"or none", s)
+	}
+}
+
+// setLogOutput writes logs to w, stamping each line with the time in loc
+// unless it's nil.
+func setLogOutput(w io.Writer, loc *time.Location) {
+	if loc != nil {
+		w = stampWriter{w: w, loc: loc, now: time.Now}
+	}
+	log.SetOutput(w)
+}
+
+// stampWriter starts each line written with the time in RFC3339, so logs may
+// be lined up with incident timelines. Each write is expected to end a line,
+// as log's do.
+type stampWriter struct {
+	w   io.Writer
+	loc *time.Location
+	now func() time.Time
+}
+
+func (s stampWriter) Write(p []byte) (int, error) {
+	stamp := []byte(s.now().In(s.loc).Format(time.RFC3339) + " ")
+	lines := bytes.SplitAfter(p, []byte("\n"))
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		buf.Write(stamp)
+		buf.Write(line)
+	}
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// roundDuration rounds a duration for logs and summaries: to the second once
+// it's over a minute, otherwise to a tenth of a second, or a millisecond
+// when it's shorter than a second.
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Minute:
+		return d.Round(time.Second)
+	case d >= time.Second:
+		return d.Round(100 * time.Millisecond)
+	default:
+		return d.Round(time.Millisecond)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStampWriter(t *testing.T) {
+	t.Parallel()
+	loc, err := parseTimestamps("utc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := stampWriter{w: &buf, loc: loc, now: func() time.Time {
+		cet := time.FixedZone("CET", 3600)
+		return time.Date(2020, 1, 2, 3, 4, 5, 0, cet)
+	}}
+	if _, err = w.Write([]byte("one\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := "2020-01-02T02:04:05Z one\n2020-01-02T02:04:05Z two\n"
+	if buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+	if loc, err = parseTimestamps("none"); err != nil || loc != nil {
+		t.Fatalf("expected no stamps, got %v %v", loc, err)
+	}
+	if _, err = parseTimestamps("est"); err == nil {
+		t.Fatal("expected error for an unknown zone")
+	}
+}
+
+func TestRoundDuration(t *testing.T) {
+	t.Parallel()
+	tcs := map[time.Duration]string{
+		1234567 * time.Nanosecond:  "1ms",
+		1234567 * time.Microsecond: "1.2s",
+		61500 * time.Millisecond:   "1m2s",
+	}
+	for d, want := range tcs {
+		if got := roundDuration(d).String(); got != want {
+			t.Fatalf("%s: expected %s, got %s", d, want, got)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// transport prepares commands to run for a server. The default transport runs
+// commands locally using sh, leaving it to the Upfile to reach the server,
+// e.g. with ssh. Other transports run commands on the server directly. If
+// user is set, the command runs as that user. If the command's Env is set, it
+// holds only variables the transport needs, such as secrets which mustn't be
+// passed as arguments, and they're added to the environment.
+type transport interface {
+	command(server, user, cmd string) (*exec.Cmd, error)
+}
+
+// sessionTransport is a transport which runs commands over a connection it
+// keeps open to the server, rather than starting a process for each.
+type sessionTransport interface {
+	transport
+	run(server, user, cmd string, stdout, stderr io.Writer) error
+}
+
+// execute runs cmd for server with the transport, over its session if it
+// keeps one. Unless env is nil, it replaces the environment of the local
+// process, keeping any variables the transport added to it.
+func execute(
+	t transport,
+	server, user, cmd string,
+	env []string,
+	stdin io.Reader,
+	stdout, stderr io.Writer,
+) error {
+	if s, ok := t.(sessionTransport); ok {
+		return s.run(server, user, cmd, stdout, stderr)
+	}
+	c, err := t.command(server, user, cmd)
+	if err != nil {
+		return err
+	}
+	if env != nil {
+		c.Env = append(append([]string{}, env...),
+			addedEnv(c.Env, os.Environ())...)
+	}
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	return c.Run()
+}
+
+// addedEnv returns the variables a transport appended to base to build env.
+func addedEnv(env, base []string) []string {
+	if len(env) <= len(base) {
+		return nil
+	}
+	return env[len(base):]
+}
+
+// transportError is a failure to reach the server, rather than of the command
+// itself, so the command may be retried.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// sshExitCode is the status with which ssh exits when it can't connect or
+// loses its connection, rather than the remote command failing.
+const sshExitCode = 255
+
+// isTransportError reports whether err is a failure to reach the server.
+// Commands run locally usually reach the server with ssh, so exiting with
+// ssh's status for connection errors counts as one.
+func isTransportError(err error) bool {
+	var tErr *transportError
+	if errors.As(err, &tErr) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == sshExitCode
+}
+
+// newTransport for a host given its inventory settings. Hosts addressed as
+// docker://container or k8s://namespace/pod always use the matching container
+// transport.
+func newTransport(host string, s up.Settings) (transport, error) {
+	parts := strings.SplitN(host, "://", 2)
+	if len(parts) == 2 {
+		if s.Transport != "" {
+			return nil, fmt.Errorf("transport %s conflicts with %s://",
+				s.Transport, parts[0])
+		}
+		switch parts[0] {
+		case "docker":
+			if parts[1] == "" {
+				return nil, errors.New("missing container name")
+			}
+			return dockerTransport{container: parts[1]}, nil
+		case "k8s":
+			pod := strings.SplitN(parts[1], "/", 2)
+			if len(pod) != 2 || pod[0] == "" || pod[1] == "" {
+				return nil, errors.New(
+					"kubernetes hosts must be k8s://namespace/pod")
+			}
+			return kubectlTransport{
+				namespace: pod[0],
+				pod:       pod[1],
+			}, nil
+		default:
+			return nil, fmt.Errorf("unknown scheme: %s", parts[0])
+		}
+	}
+	switch s.Transport {
+	case "", "local":
+		return localTransport{}, nil
+	case "winrm":
+		return winrmTransport{
+			settings: s,
+			password: os.Getenv("UP_WINRM_PASSWORD"),
+		}, nil
+	case "agent":
+		switch s.HostKeys {
+		case "", "strict", "tofu":
+		default:
+			return nil, fmt.Errorf("unknown host_keys %q: use "+
+				"strict or tofu", s.HostKeys)
+		}
+		return &agentTransport{settings: s}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport: %s", s.Transport)
+	}
+}
+
+// localTransport runs commands on this machine with sh. Other users run the
+// command with sudo, so an ssh command connects with that user's name and
+// keys.
+type localTransport struct{}
+
+func (localTransport) command(server, user, cmd string) (*exec.Cmd, error) {
+	if user != "" {
+		return exec.Command("sudo", "-n", "-u", user, "sh", "-c",
+			cmd), nil
+	}
+	return exec.Command("sh", "-c", cmd), nil
+}
+
+// validUser reports whether a user may be passed to sudo -u: empty, for the
+// current user, or a name which can't be mistaken for an option.
+func validUser(user string) bool {
+	return !strings.ContainsAny(user, " \t") &&
+		!strings.HasPrefix(user, "-")
+}
+
+// winrmTransport runs commands on Windows servers over WinRM using the winrm
+// CLI (https://github.com/masterzen/winrm-cli), which must be in the PATH.
+// The password is read from the UP_WINRM_PASSWORD environment variable rather
+// than the inventory, which is often committed alongside the Upfile, and
+// passed to winrm as WINRM_PASSWORD rather than with -password, since any
+// local user can read a process's arguments.
+type winrmTransport struct {
+	settings up.Settings
+	password string
+}
+
+func (t winrmTransport) command(
+	server, user, cmd string,
+) (*exec.Cmd, error) {
+	if user != "" {
+		return nil, errors.New(
+			"winrm cannot run commands as another user")
+	}
+	port := t.settings.Port
+	if port == 0 {
+		port = 5985
+		if t.settings.HTTPS {
+			port = 5986
+		}
+	}
+	host, _, err := up.SplitAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-hostname", host,
+		"-port", strconv.Itoa(port),
+		"-username", t.settings.User,
+	}
+	if t.settings.HTTPS {
+		args = append(args, "-https")
+	}
+	if t.settings.Insecure {
+		args = append(args, "-insecure")
+	}
+	c := exec.Command("winrm", append(args, cmd)...)
+
+	// Without UP_WINRM_PASSWORD, winrm reads any WINRM_PASSWORD the
+	// operator exported
+	if t.password != "" {
+		c.Env = append(os.Environ(), "WINRM_PASSWORD="+t.password)
+	}
+	return c, nil
+}
+
+// dockerTransport runs commands inside a container with `docker exec`.
+type dockerTransport struct {
+	container string
+}
+
+func (t dockerTransport) command(
+	server, user, cmd string,
+) (*exec.Cmd, error) {
+	args := []string{"exec", "-i"}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	args = append(args, t.container, "sh", "-c", cmd)
+	return exec.Command("docker", args...), nil
+}
+
+// kubectlTransport runs commands inside a Kubernetes pod with `kubectl exec`.
+// kubectl can't choose the user, so other users run the command with sudo,
+// which must be installed in the pod.
+type kubectlTransport struct {
+	namespace string
+	pod       string
+}
+
+func (t kubectlTransport) command(
+	server, user, cmd string,
+) (*exec.Cmd, error) {
+	args := []string{"exec", "-i", "-n", t.namespace, t.pod, "--"}
+	if user != "" {
+		args = append(args, "sudo", "-n", "-u", user)
+	}
+	args = append(args, "sh", "-c", cmd)
+	return exec.Command("kubectl", args...), nil
+}
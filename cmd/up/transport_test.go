@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestNewTransport(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		host     string
+		settings up.Settings
+		user     string
+		want     string
+		wantErr  bool
+	}{
+		{host: "10.0.0.1", want: "sh -c true"},
+		{
+			host: "10.0.0.1",
+			user: "deploy",
+			want: "sudo -n -u deploy sh -c true",
+		},
+		{
+			host:     "win",
+			settings: up.Settings{Transport: "winrm", User: "a"},
+			want:     "winrm -hostname win -port 5985 -username a",
+		},
+		{host: "docker://web", want: "docker exec -i web sh -c true"},
+		{
+			host: "docker://web",
+			user: "deploy",
+			want: "docker exec -i -u deploy web sh -c true",
+		},
+		{
+			host: "k8s://prod/web-0",
+			want: "kubectl exec -i -n prod web-0 -- sh -c true",
+		},
+		{
+			host: "k8s://prod/web-0",
+			user: "deploy",
+			want: "kubectl exec -i -n prod web-0 -- " +
+				"sudo -n -u deploy",
+		},
+		{host: "k8s://web-0", wantErr: true},
+		{
+			host:     "win",
+			settings: up.Settings{Transport: "winrm"},
+			user:     "deploy",
+			wantErr:  true,
+		},
+		{host: "ftp://web", wantErr: true},
+		{
+			host:     "docker://web",
+			settings: up.Settings{Transport: "winrm"},
+			wantErr:  true,
+		},
+		{
+			host:     "10.0.0.1:2222",
+			settings: up.Settings{Transport: "agent", User: "a"},
+			want: "ssh -T -o BatchMode=yes -p 2222 -l a " +
+				"10.0.0.1 true",
+		},
+		{
+			host:     "10.0.0.1",
+			settings: up.Settings{Transport: "agent", Port: 22},
+			user:     "deploy",
+			want: "ssh -T -o BatchMode=yes -p 22 10.0.0.1 " +
+				"sudo -n -u deploy sh -c 'true'",
+		},
+		{host: "x", settings: up.Settings{Transport: "x"}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.host, func(t *testing.T) {
+			tr, err := newTransport(tc.host, tc.settings)
+			var c *exec.Cmd
+			if err == nil {
+				c, err = tr.command(tc.host, tc.user, "true")
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join(c.Args, " ")
+			if !strings.HasPrefix(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestStepUser(t *testing.T) {
+	t.Parallel()
+	r := &runner{localUser: "deploy"}
+	docker := dockerTransport{container: "web"}
+	tcs := []struct {
+		t    transport
+		user string
+		want string
+	}{
+		{t: localTransport{}, want: "deploy"},
+		{t: localTransport{}, user: "app", want: "app"},
+		{t: docker, want: ""},
+		{t: docker, user: "app", want: "app"},
+	}
+	for i, tc := range tcs {
+		if got := r.stepUser(tc.t, tc.user); got != tc.want {
+			t.Fatalf("%d: expected %q, got %q", i, tc.want, got)
+		}
+	}
+	for user, want := range map[string]bool{
+		"": true, "deploy": true, "-u": false, "a b": false,
+	} {
+		if got := validUser(user); got != want {
+			t.Fatalf("%q: expected %t, got %t", user, want, got)
+		}
+	}
+}
+
+func TestWinrmPassword(t *testing.T) {
+	t.Parallel()
+	tr := winrmTransport{
+		settings: up.Settings{Transport: "winrm", User: "a"},
+		password: "hunter2",
+	}
+	c, err := tr.command("win", "", "echo hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range c.Args {
+		if strings.Contains(arg, "hunter2") {
+			t.Fatalf("password in arguments: %q", c.Args)
+		}
+	}
+	env := c.Env
+	if len(env) != len(os.Environ())+1 ||
+		env[len(env)-1] != "WINRM_PASSWORD=hunter2" {
+		t.Fatalf("expected password added to environment, got %q", env)
+	}
+
+	// The password is added to a clean environment rather than
+	// replaced by it
+	stub := exec.Command("/bin/sh", "-c", `echo "$PATH $WINRM_PASSWORD"`)
+	stub.Env = c.Env
+	var out strings.Builder
+	err = execute(stubTransport{stub}, "win", "", "",
+		[]string{"PATH=/bin"}, nil, &out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "/bin hunter2\n" {
+		t.Fatalf("unexpected environment %q", out.String())
+	}
+
+	// Without a password, the environment is inherited, so winrm reads
+	// any WINRM_PASSWORD the operator exported
+	tr.password = ""
+	c, err = tr.command("win", "", "echo hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Env != nil {
+		t.Fatalf("expected inherited environment, got %q", c.Env)
+	}
+}
+
+// stubTransport returns a prepared command, so tests can run it without the
+// transport's CLI.
+type stubTransport struct {
+	c *exec.Cmd
+}
+
+func (s stubTransport) command(server, user, cmd string) (*exec.Cmd, error) {
+	return s.c, nil
+}
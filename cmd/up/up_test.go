@@ -1,23 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"git.sr.ht/~egtann/up"
+	"git.sr.ht/~egtann/up/progress"
 )
 
 func TestMakeBatches(t *testing.T) {
 	t.Parallel()
 	tcs := []struct {
-		serial int
-		have   map[up.InvName][]string
+		serial string
+		have   map[string][]string
 		want   batch
 	}{
 		{
-			serial: 1,
-			have: map[up.InvName][]string{
+			serial: "1",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 			},
 			want: batch{
@@ -25,8 +33,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 3,
-			have: map[up.InvName][]string{
+			serial: "3",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e"},
 			},
@@ -36,8 +44,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 0,
-			have: map[up.InvName][]string{
+			serial: "0",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e"},
 			},
@@ -47,8 +55,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 2,
-			have: map[up.InvName][]string{
+			serial: "2",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e", "f", "g"},
 			},
@@ -58,8 +66,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 3,
-			have: map[up.InvName][]string{
+			serial: "3",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e", "f", "g"},
 			},
@@ -69,8 +77,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 10,
-			have: map[up.InvName][]string{
+			serial: "10",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e", "f", "g"},
 			},
@@ -80,8 +88,8 @@ func TestMakeBatches(t *testing.T) {
 			},
 		},
 		{
-			serial: 2,
-			have: map[up.InvName][]string{
+			serial: "2",
+			have: map[string][]string{
 				"srv1": []string{"a", "b", "c"},
 				"srv2": []string{"d", "e", "f", "g"},
 				"srv3": []string{"d", "e"},
@@ -102,11 +110,44 @@ func TestMakeBatches(t *testing.T) {
 				"srv8": [][]string{{"p", "q"}, {"r", "s"}, {"t", "u"}, {"v"}},
 			},
 		},
+		{
+			// Percentages of each tag's hosts round up
+			serial: "50%",
+			have: map[string][]string{
+				"srv1": []string{"a", "b", "c"},
+				"srv2": []string{"d", "e", "f", "g"},
+				"srv3": []string{"h"},
+			},
+			want: batch{
+				"srv1": [][]string{{"a", "b"}, {"c"}},
+				"srv2": [][]string{{"d", "e"}, {"f", "g"}},
+				"srv3": [][]string{{"h"}},
+			},
+		},
+		{
+			serial: "100%",
+			have: map[string][]string{
+				"srv1": []string{"a", "b", "c"},
+			},
+			want: batch{
+				"srv1": [][]string{{"a", "b", "c"}},
+			},
+		},
 	}
 	for i, tc := range tcs {
 		t.Run(fmt.Sprint(i), func(t *testing.T) {
-			conf := &up.Config{Inventory: tc.have}
-			batches, err := makeBatches(conf, tc.serial)
+			inventory := up.Inventory{}
+			for tag, ips := range tc.have {
+				for _, ip := range ips {
+					inventory[ip] = append(inventory[ip], tag)
+				}
+			}
+			size, err := parseSerial(tc.serial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batches, err := makeBatches(&up.Config{}, inventory,
+				size, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -122,6 +163,228 @@ func TestMakeBatches(t *testing.T) {
 	}
 }
 
+func TestRunBatchShortCircuit(t *testing.T) {
+	t.Parallel()
+	for _, all := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "up-execif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		pth := filepath.Join(dir, "checked")
+		b := &planBatch{
+			Servers: []string{"10.0.0.1"},
+			ExecIfs: []planStep{
+				{"10.0.0.1": "false"},
+				{"10.0.0.1": "touch " + pth},
+			},
+			Execs: []planStep{{"10.0.0.1": "true"}},
+		}
+		r := &runner{allExecIfs: all}
+		if _, err = r.runBatch("web", b); err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(pth)
+		if ran := err == nil; ran != all {
+			t.Fatalf("all %t: expected second check to run %t",
+				all, all)
+		}
+	}
+}
+
+func TestRunBatchTransportRetries(t *testing.T) {
+	// Not parallel, since it shortens the delay between retries
+	defer func(d time.Duration) { transportRetryDelay = d }(
+		transportRetryDelay)
+	transportRetryDelay = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "up-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each step exits as ssh does when it can't connect until it has
+	// run twice
+	flaky := func(name string) planStep {
+		pth := filepath.Join(dir, name)
+		return planStep{"10.0.0.1": fmt.Sprintf("echo >> %s; "+
+			"[ $(wc -l < %s) -ge 2 ] || exit 255", pth, pth)}
+	}
+	tcs := []struct {
+		name    string
+		retries int
+		batch   *planBatch
+		wantErr bool
+	}{
+		{
+			name:    "retried",
+			retries: 1,
+			batch:   &planBatch{Execs: []planStep{flaky("a")}},
+		},
+		{
+			name:    "exhausted",
+			batch:   &planBatch{Execs: []planStep{flaky("b")}},
+			wantErr: true,
+		},
+		{
+			name:    "not transport",
+			retries: 3,
+			batch: &planBatch{Execs: []planStep{
+				{"10.0.0.1": "exit 1"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "condition",
+			batch: &planBatch{
+				ExecIfs: []planStep{flaky("c")},
+				Execs:   []planStep{{"10.0.0.1": "true"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		tc.batch.Servers = []string{"10.0.0.1"}
+		r := &runner{transportRetries: tc.retries}
+		_, err = r.runBatch("web", tc.batch)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: expected error %t, got %v", tc.name,
+				tc.wantErr, err)
+		}
+	}
+}
+
+func TestRunBatchCheckCache(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-check-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The conditional passes, counting how often it runs on each server
+	count := filepath.Join(dir, "count")
+	b := &planBatch{
+		Servers: []string{"10.0.0.1", "10.0.0.2"},
+		ExecIfs: []planStep{{
+			"10.0.0.1": "echo 1 >> " + count,
+			"10.0.0.2": "echo 2 >> " + count,
+		}},
+		Execs: []planStep{{"10.0.0.1": "false", "10.0.0.2": "false"}},
+	}
+	tcs := []struct {
+		chk     string
+		ttl     time.Duration
+		servers []string
+		want    string
+	}{
+		{"a", time.Hour, []string{"10.0.0.1"}, "1"},
+		{"a", time.Hour, []string{"10.0.0.1", "10.0.0.2"}, "1 2"},
+		{"a", time.Hour, []string{"10.0.0.1", "10.0.0.2"}, "1 2"},
+		{"b", time.Hour, []string{"10.0.0.2"}, "1 2 2"},
+		{"b", time.Nanosecond, []string{"10.0.0.2"}, "1 2 2 2"},
+	}
+	for i, tc := range tcs {
+		b.Servers = tc.servers
+		r := &runner{checks: checkCache{dir: dir, ttl: tc.ttl,
+			chk: tc.chk}}
+		if _, err = r.runBatch("web", b); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		byt, err := ioutil.ReadFile(count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(strings.Fields(string(byt)), " ")
+		if got != tc.want {
+			t.Fatalf("%d: expected %q, got %q", i, tc.want, got)
+		}
+	}
+}
+
+func TestRunTracked(t *testing.T) {
+	t.Parallel()
+	var (
+		mu      sync.Mutex
+		batches []progress.Batch
+		results = map[string]progress.Result{}
+	)
+	r := &runner{progress: progress.Callbacks{
+		OnBatchStart: func(b progress.Batch) {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, b)
+		},
+		OnServerResult: func(res progress.Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			results[res.Server] = res
+		},
+	}}
+	tcs := []struct {
+		batch *planBatch
+		want  map[string]progress.Status
+	}{
+		{
+			batch: &planBatch{
+				Servers: []string{"10.0.0.1"},
+				ExecIfs: []planStep{{"10.0.0.1": "true"}},
+				Execs:   []planStep{{"10.0.0.1": "false"}},
+			},
+			want: map[string]progress.Status{
+				"10.0.0.1": progress.Current,
+			},
+		},
+		{
+			batch: &planBatch{
+				Servers: []string{"10.0.0.1", "10.0.0.2"},
+				Execs: []planStep{{
+					"10.0.0.1": "true",
+					"10.0.0.2": "true",
+				}},
+			},
+			want: map[string]progress.Status{
+				"10.0.0.1": progress.Deployed,
+				"10.0.0.2": progress.Deployed,
+			},
+		},
+		{
+			batch: &planBatch{
+				Servers: []string{"10.0.0.1", "10.0.0.2"},
+				Execs: []planStep{{
+					"10.0.0.1": "true",
+					"10.0.0.2": "exit 3",
+				}},
+			},
+			want: map[string]progress.Status{
+				"10.0.0.1": progress.Failed,
+				"10.0.0.2": progress.Failed,
+			},
+		},
+	}
+	for i, tc := range tcs {
+		results = map[string]progress.Result{}
+		err := r.runTracked("web", i, len(tcs), tc.batch)
+		if (err != nil) != (i == 2) {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if b := batches[i]; b.Number != i+1 || b.Total != len(tcs) ||
+			len(b.Servers) != len(tc.batch.Servers) {
+			t.Fatalf("%d: unexpected batch %+v", i, b)
+		}
+		for server, status := range tc.want {
+			if results[server].Status != status {
+				t.Fatalf("%d: expected %s %s, got %+v", i,
+					server, status, results[server])
+			}
+		}
+	}
+	if got := results["10.0.0.2"].Err; got != "exit status 3" {
+		t.Fatalf("expected the server's own error, got %q", got)
+	}
+}
+
 // sliceDeepEq compares nested slice equality without caring about order.
 func sliceDeepEq(a, b [][]string) bool {
 	if len(a) != len(b) {
@@ -145,3 +408,44 @@ func sliceDeepEq(a, b [][]string) bool {
 	}
 	return len(seen) == count
 }
+
+func TestStrictStdinCommand(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`alias s = second
+
+first
+	echo first
+
+second
+	echo second
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if _, err = parseFlags(fs, []string{"-strict", "-f", "-"}); err == nil {
+		t.Fatal("expected error for -strict without -c")
+	}
+	for _, name := range []string{"second", "s"} {
+		fs = flag.NewFlagSet("up", flag.ContinueOnError)
+		flgs, err := parseFlags(fs, []string{"-strict", "-f", "-",
+			"-c", name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !flgs.Stdin {
+			t.Fatal("expected Upfile from stdin")
+		}
+		if err = useCommand(conf, flgs.Command); err != nil {
+			t.Fatal(err)
+		}
+		if conf.DefaultCommand != "second" {
+			t.Fatalf("%s: expected second, got %s", name,
+				conf.DefaultCommand)
+		}
+	}
+	if err = useCommand(conf, "third"); err == nil {
+		t.Fatal("expected error for undefined command")
+	}
+}
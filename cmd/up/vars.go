@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// varsCmd prints the variables a command would use, their values, and where
+// each comes from, to debug substitution.
+func varsCmd(args []string) error {
+	fs := flag.NewFlagSet("vars", flag.ExitOnError)
+	upfile := fs.String("f", "Upfile", "path to upfile")
+	command := fs.String("c", "", "command (defaults to the first in the upfile)")
+	plugins := fs.String("plugin", "", "comma-separated plugins providing variables")
+	all := fs.Bool("a", false, "print every variable, not only those the command uses (default false)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fi, err := os.Open(*upfile)
+	if err != nil {
+		return fmt.Errorf("open upfile: %w", err)
+	}
+	defer fi.Close()
+	conf, err := up.ParseUpfile(fi)
+	if err != nil {
+		return fmt.Errorf("parse upfile: %w", err)
+	}
+	name := conf.DefaultCommand
+	if *command != "" {
+		name = conf.Resolve(up.CmdName(*command))
+		if _, ok := conf.Commands[name]; !ok {
+			return fmt.Errorf("undefined command: %s", name)
+		}
+	}
+
+	// Copy the environment, so what plugins add can be told apart
+	env := environVars()
+	vars := make(map[string]string, len(env))
+	for k, v := range env {
+		vars[k] = v
+	}
+	if *plugins != "" {
+		invFile := &up.InventoryFile{Hosts: up.Inventory{}}
+		err = loadPlugins(strings.Split(*plugins, ","), invFile, vars,
+			name, "", nil)
+		if err != nil {
+			return fmt.Errorf("plugin: %w", err)
+		}
+	}
+	entries := varEntries(conf, env, vars)
+	if !*all {
+		entries = usedVars(conf, name, entries)
+	}
+	printVars(os.Stdout, entries)
+	return nil
+}
+
+// varEntry is a variable, its value, and where the value comes from: "env",
+// "plugin", "upfile" for commands used as variables, "builtin" for those set
+// by up while deploying, or "unset" for required variables without a value.
+type varEntry struct {
+	name   string
+	value  string
+	origin string
+}
+
+// varEntries reports every variable available to an Upfile's commands, sorted
+// by name, as they'd be substituted: builtins take precedence over commands,
+// which take precedence over env and plugins. Values of variables declared
+// secret are masked.
+func varEntries(conf *up.Config, env, vars map[string]string) []varEntry {
+	byName := map[string]varEntry{}
+	for name, val := range vars {
+		origin := "plugin"
+		if _, ok := env[name]; ok {
+			origin = "env"
+		}
+		byName[name] = varEntry{
+			name:   name,
+			value:  val,
+			origin: origin,
+		}
+	}
+	for name, cmd := range conf.Commands {
+		if !cmd.Variable() {
+			continue
+		}
+		val := strings.TrimSpace(strings.Join(cmd.Execs, "\n"))
+		byName[string(name)] = varEntry{
+			name:   string(name),
+			value:  val,
+			origin: "upfile",
+		}
+	}
+	builtins := []string{"checksum", "deploy_id", "each", "server",
+		"server.host", "server.port", "server.addr", "server.user",
+		"state"}
+	for name := range conf.Checksums {
+		builtins = append(builtins, "checksum."+name)
+	}
+	for _, name := range builtins {
+		byName[name] = varEntry{name: name, origin: "builtin"}
+	}
+	for _, cmd := range conf.Commands {
+		for _, name := range cmd.Requires {
+			if _, ok := byName[name]; !ok {
+				byName[name] = varEntry{name: name,
+					origin: "unset"}
+			}
+		}
+	}
+	entries := make([]varEntry, 0, len(byName))
+	for _, e := range byName {
+		secret := conf.Vars[e.name].Type == "secret"
+		if secret && e.origin != "unset" {
+			e.value = "********"
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// usedVars filters entries to those referenced by the named command or any
+// command it references, or required by them. When names share a prefix, the
+// longest is the one used, as when substituting.
+func usedVars(conf *up.Config, name up.CmdName,
+	entries []varEntry) []varEntry {
+	used := map[string]struct{}{}
+	for _, req := range conf.Required(name) {
+		used[req] = struct{}{}
+	}
+	graph := conf.Graph()
+	seen := map[up.CmdName]struct{}{}
+	var visit func(up.CmdName)
+	visit = func(name up.CmdName) {
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		cmd := conf.Commands[name]
+		if cmd == nil {
+			return
+		}
+		for _, line := range cmd.Execs {
+			if _, ok := up.Literal(line); ok {
+				continue
+			}
+			for _, ref := range varNameRefs(line, entries) {
+				used[ref] = struct{}{}
+			}
+		}
+		for _, ref := range graph[name] {
+			visit(ref)
+		}
+	}
+	visit(conf.Resolve(name))
+	var filtered []varEntry
+	for _, e := range entries {
+		if _, ok := used[e.name]; ok {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// varNameRefs reports the names of entries referenced as variables in a line.
+func varNameRefs(line string, entries []varEntry) []string {
+	var refs []string
+	for {
+		i := strings.IndexByte(line, '$')
+		if i < 0 {
+			return refs
+		}
+		line = strings.TrimPrefix(line[i+1:], "{")
+		var best string
+		for _, e := range entries {
+			if len(e.name) > len(best) &&
+				strings.HasPrefix(line, e.name) {
+				best = e.name
+			}
+		}
+		if best != "" {
+			refs = append(refs, best)
+			line = line[len(best):]
+		}
+	}
+}
+
+// printVars writes a table of variables. Values are quoted, so whitespace and
+// multi-line commands are visible. Builtins have no value until deploying.
+func printVars(out io.Writer, entries []varEntry) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "NAME\tVALUE\tORIGIN")
+	for _, e := range entries {
+		val := fmt.Sprintf("%q", e.value)
+		if e.origin == "builtin" || e.origin == "unset" {
+			val = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.name, val, e.origin)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+func TestVarEntries(t *testing.T) {
+	t.Parallel()
+	conf, err := up.ParseUpfile(strings.NewReader(`var TOKEN secret
+
+deploy requires TOKEN, IMAGE_TAG
+	ssh $remote 'run $HOME_DIR $TOKEN $checksum'
+
+remote
+	$USER@$server
+
+unused
+	echo $PATH
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"USER": "me", "HOME": "/home/me",
+		"PATH": "/bin"}
+	vars := map[string]string{"USER": "me", "HOME": "/home/me",
+		"PATH": "/bin", "HOME_DIR": "/srv", "TOKEN": "abc"}
+	entries := usedVars(conf, "deploy", varEntries(conf, env, vars))
+
+	out := &bytes.Buffer{}
+	printVars(out, entries)
+	want := `NAME       VALUE            ORIGIN
+HOME_DIR   "/srv"           plugin
+IMAGE_TAG  -                unset
+TOKEN      "********"       plugin
+USER       "me"             env
+checksum   -                builtin
+remote     "$USER@$server"  upfile
+server     -                builtin
+`
+	if got := out.String(); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// versionSource reports the version being deployed, which is substituted for
+// $checksum and compared to the version each host reports. Teams identify
+// builds differently, so the version may be a checksum, a commit, an id
+// passed on the command line or the contents of a file.
+type versionSource interface {
+	version() (string, error)
+}
+
+// newVersionSource for dir. An id, from -version-id, is used as is and takes
+// precedence. Otherwise from names the source as written after "version" in
+// the Upfile: "checksum", the default, "git" or "file:PATH", relative to dir.
+func newVersionSource(
+	from, id, dir string,
+	opts checksumOpts,
+) (versionSource, error) {
+	if id != "" {
+		return idSource(id), nil
+	}
+	if from != "" && !up.ValidVersion(from) {
+		return nil, fmt.Errorf("unknown version source %q: use "+
+			"checksum, git or file:PATH", from)
+	}
+	switch {
+	case from == "git":
+		return gitSource{dir: dir}, nil
+	case strings.HasPrefix(from, "file:"):
+		pth := from[len("file:"):]
+		if !filepath.IsAbs(pth) {
+			pth = filepath.Join(dir, pth)
+		}
+		return fileSource{path: pth}, nil
+	default:
+		return checksumSource{dir: dir, opts: opts}, nil
+	}
+}
+
+// checksumSource hashes every file in a directory.
+type checksumSource struct {
+	dir  string
+	opts checksumOpts
+}
+
+func (s checksumSource) version() (string, error) {
+	return calcChecksum(s.dir, s.opts)
+}
+
+// gitSource reads the commit checked out in a directory.
+type gitSource struct {
+	dir string
+}
+
+func (s gitSource) version() (string, error) {
+	return gitVersion(s.dir)
+}
+
+// fileSource reads the version from a file, such as VERSION, written by the
+// build. Surrounding whitespace is trimmed.
+type fileSource struct {
+	path string
+}
+
+func (s fileSource) version() (string, error) {
+	byt, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("read version: %w", err)
+	}
+	ver := strings.TrimSpace(string(byt))
+	if ver == "" {
+		return "", fmt.Errorf("empty version in %s", s.path)
+	}
+	return ver, nil
+}
+
+// idSource is a version given explicitly, e.g. a CI build number.
+type idSource string
+
+func (s idSource) version() (string, error) {
+	return string(s), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersionSource(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "up-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "VERSION"),
+		[]byte("1.4.2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "EMPTY"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := checksumOpts{Algorithm: defaultChecksumAlgorithm}
+
+	type testcase struct {
+		from, id string
+		want     string
+		err      bool
+	}
+	tcs := map[string]testcase{
+		"default":  {want: "sha256:"},
+		"checksum": {from: "checksum", want: "sha256:"},
+		"file":     {from: "file:VERSION", want: "1.4.2"},
+		"abs": {
+			from: "file:" + filepath.Join(dir, "VERSION"),
+			want: "1.4.2",
+		},
+		"id":      {id: "build-81", want: "build-81"},
+		"id wins": {from: "git", id: "build-81", want: "build-81"},
+		"missing": {from: "file:NOPE", err: true},
+		"empty":   {from: "file:EMPTY", err: true},
+		"unknown": {from: "svn", err: true},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			src, err := newVersionSource(tc.from, tc.id, dir, opts)
+			var got string
+			if err == nil {
+				got, err = src.version()
+			}
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got, tc.want) {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
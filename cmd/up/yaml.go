@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by Ansible playbooks into maps of
+// map[string]interface{}, slices of []interface{} and string scalars: block
+// mappings and sequences, plain and quoted scalars, flow sequences and
+// mappings on a single line, and literal (|) and folded (>) block scalars.
+// Anchors, tags and multiple documents aren't supported.
+func parseYAML(byt []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, text := range strings.Split(string(byt), "\n") {
+		text = strings.TrimRight(text, " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent yaml",
+				i+1)
+		}
+		lines = append(lines, yamlLine{
+			num:    i + 1,
+			indent: len(text) - len(trimmed),
+			text:   trimmed,
+		})
+	}
+	p := &yamlParser{lines: lines}
+	p.skip()
+	if p.i < len(p.lines) && p.lines[p.i].text == "---" {
+		p.i++
+		p.skip()
+	}
+	if p.i >= len(p.lines) {
+		return nil, nil
+	}
+	val, err := p.node(p.lines[p.i].indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.i < len(p.lines) {
+		l := p.lines[p.i]
+		return nil, fmt.Errorf("line %d: unexpected %q", l.num, l.text)
+	}
+	return val, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// skip blank lines and comments.
+func (p *yamlParser) skip() {
+	for ; p.i < len(p.lines); p.i++ {
+		text := p.lines[p.i].text
+		if text != "" && !strings.HasPrefix(text, "#") {
+			return
+		}
+	}
+}
+
+// node parses the sequence or mapping starting at the current line.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	var items []interface{}
+	for p.skip(); p.i < len(p.lines); p.skip() {
+		l := p.lines[p.i]
+		if l.indent != indent || !isYAMLItem(l.text) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			p.i++
+			p.skip()
+			if p.i >= len(p.lines) || p.lines[p.i].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			item, err := p.node(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+
+		// An item starting with a key begins a mapping indented to
+		// the key's column
+		if _, _, ok := splitYAMLKey(rest); ok && !isYAMLFlow(rest) {
+			col := l.indent + len(l.text) - len(rest)
+			p.lines[p.i] = yamlLine{
+				num:    l.num,
+				indent: col,
+				text:   rest,
+			}
+			item, err := p.mapping(col)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		p.i++
+		item, err := p.scalar(rest, l)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for p.skip(); p.i < len(p.lines); p.skip() {
+		l := p.lines[p.i]
+		if l.indent != indent || isYAMLItem(l.text) {
+			if l.indent > indent {
+				return nil, fmt.Errorf(
+					"line %d: bad indentation", l.num)
+			}
+			break
+		}
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value",
+				l.num)
+		}
+		p.i++
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			val, err := p.scalar(rest, l)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = val
+			continue
+		}
+
+		// Sequences may be indented the same as their key
+		p.skip()
+		if p.i >= len(p.lines) {
+			m[key] = nil
+			continue
+		}
+		next := p.lines[p.i]
+		if next.indent > indent ||
+			(next.indent == indent && isYAMLItem(next.text)) {
+			val, err := p.node(next.indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = val
+			continue
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+// scalar parses a value on a single line, or a block scalar starting on the
+// line.
+func (p *yamlParser) scalar(text string, l yamlLine) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "|"), strings.HasPrefix(text, ">"):
+		return p.block(text, l.indent), nil
+	case isYAMLFlow(text):
+		val, rest, err := parseYAMLFlow(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.num, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" &&
+			!strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected %q", l.num,
+				rest)
+		}
+		return val, nil
+	}
+	val, err := unquoteYAML(stripYAMLComment(text))
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", l.num, err)
+	}
+	return val, nil
+}
+
+// block collects a literal or folded block scalar from the lines indented
+// beyond the parent.
+func (p *yamlParser) block(header string, parent int) string {
+	literal := header[0] == '|'
+	chomp := strings.TrimSpace(stripYAMLComment(header[1:]))
+	var (
+		lines  []string
+		indent = -1
+	)
+	for ; p.i < len(p.lines); p.i++ {
+		l := p.lines[p.i]
+		if l.text == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if l.indent <= parent {
+			break
+		}
+		if indent < 0 {
+			indent = l.indent
+		}
+		pad := ""
+		if l.indent > indent {
+			pad = strings.Repeat(" ", l.indent-indent)
+		}
+		lines = append(lines, pad+l.text)
+	}
+
+	// Trailing blank lines belong to whatever follows
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		p.i--
+	}
+	var text string
+	if literal {
+		text = strings.Join(lines, "\n")
+	} else {
+		var b strings.Builder
+		for i, line := range lines {
+			switch {
+			case line == "":
+				b.WriteString("\n")
+			case i > 0 && lines[i-1] != "":
+				b.WriteString(" ")
+			}
+			b.WriteString(line)
+		}
+		text = b.String()
+	}
+	if chomp != "-" && text != "" {
+		text += "\n"
+	}
+	return text
+}
+
+// splitYAMLKey splits "key: value" outside of quotes.
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case i == 0 && (r == '"' || r == '\''):
+			quote = r
+		case r == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key, err := unquoteYAML(strings.TrimSpace(text[:i]))
+			if err != nil || key == "" {
+				return "", "", false
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		case r == '#' && i > 0 && text[i-1] == ' ':
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+func isYAMLFlow(text string) bool {
+	return strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{")
+}
+
+// parseYAMLFlow parses a flow sequence or mapping, reporting the unparsed
+// remainder.
+func parseYAMLFlow(text string) (interface{}, string, error) {
+	open := text[0]
+	closer := byte(']')
+	if open == '{' {
+		closer = '}'
+	}
+	text = strings.TrimLeft(text[1:], " ")
+	var (
+		items []interface{}
+		m     = map[string]interface{}{}
+	)
+	for {
+		if text == "" {
+			return nil, "", errors.New(
+				"unterminated flow collection")
+		}
+		if text[0] == closer {
+			break
+		}
+		var (
+			key string
+			val interface{}
+			err error
+		)
+		if open == '{' {
+			i := strings.Index(text, ":")
+			if i < 0 {
+				return nil, "", errors.New("expected key: value")
+			}
+			key, err = unquoteYAML(strings.TrimSpace(text[:i]))
+			if err != nil {
+				return nil, "", err
+			}
+			text = strings.TrimLeft(text[i+1:], " ")
+		}
+		if isYAMLFlow(text) {
+			val, text, err = parseYAMLFlow(text)
+		} else {
+			var raw string
+			raw, text = splitYAMLFlowItem(text)
+			val, err = unquoteYAML(strings.TrimSpace(raw))
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if open == '{' {
+			m[key] = val
+		} else {
+			items = append(items, val)
+		}
+		text = strings.TrimLeft(text, " ")
+		if strings.HasPrefix(text, ",") {
+			text = strings.TrimLeft(text[1:], " ")
+		}
+	}
+	if open == '{' {
+		return m, text[1:], nil
+	}
+	return items, text[1:], nil
+}
+
+// splitYAMLFlowItem splits text at the first comma or closing bracket
+// outside of quotes.
+func splitYAMLFlowItem(text string) (string, string) {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',' || r == ']' || r == '}':
+			return text[:i], text[i:]
+		}
+	}
+	return text, ""
+}
+
+// stripYAMLComment removes a trailing comment from an unquoted or quoted
+// scalar.
+func stripYAMLComment(text string) string {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case i == 0 && (r == '"' || r == '\''):
+			quote = r
+		case r == '#' && i > 0 && text[i-1] == ' ':
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return text
+}
+
+// unquoteYAML reports the value of a plain, single- or double-quoted scalar.
+// Null is reported as an empty string.
+func unquoteYAML(text string) (string, error) {
+	switch {
+	case text == "~" || text == "null":
+		return "", nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s: %w", text, err)
+		}
+		return s, nil
+	}
+	return text, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	t.Parallel()
+	tcs := []struct{ in, want string }{
+		{"key: value\nother: 'it''s' # note\n",
+			"map[key:value other:it's]"},
+		{"- a\n- \"b\\tc\"\n- [d, 'e, f']\n", "[a b\tc [d e, f]]"},
+		{"- hosts: web\n  tasks:\n  - shell: echo hi\n    become: yes\n",
+			"[map[hosts:web tasks:[map[become:yes shell:echo hi]]]]"},
+		{"---\nvars: {a: 1, b: [2, 3]}\n", "map[vars:map[a:1 b:[2 3]]]"},
+		{"script: |\n  one\n    two\n\n  three\nnext: x\n",
+			"map[next:x script:one\n  two\n\nthree\n]"},
+		{"folded: >-\n  one\n  two\n\n  three\n",
+			"map[folded:one two\nthree]"},
+		{"list:\n- a\n- b\nempty:\n", "map[empty:<nil> list:[a b]]"},
+		{"url: http://example.com:8080/x\n",
+			"map[url:http://example.com:8080/x]"},
+	}
+	for _, tc := range tcs {
+		got, err := parseYAML([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("%q: %s", tc.in, err)
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Fatalf("%q: expected %q, got %q", tc.in, tc.want,
+				fmt.Sprint(got))
+		}
+	}
+	for _, in := range []string{
+		"key: value\n    bad: indent\n",
+		"\tkey: value\n",
+		"key: [a, b\n",
+		"key: 'open\n",
+	} {
+		if _, err := parseYAML([]byte(in)); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build gofuzz
+// +build gofuzz
+
+package up
+
+import "bytes"
+
+// Fuzz the parser with go-fuzz. Upfiles which parse are given priority, since
+// they also exercise validation and the command graph.
+func Fuzz(data []byte) int {
+	conf, err := Parse(data)
+	if err != nil {
+		return 0
+	}
+	if _, err = ParseFile(bytes.NewReader(data)); err != nil {
+		panic("ParseFile rejected a valid Upfile: " + err.Error())
+	}
+	conf.Unreachable(conf.Roots()...)
+	conf.warnings()
+	return 1
+}
@@ -0,0 +1,176 @@
+package up
+
+import (
+	"sort"
+	"strings"
+)
+
+// Graph reports the commands referenced by each command, either as an ExecIf,
+// a Need, a Run, a drain, or as a variable within its Execs. References are
+// sorted by name.
+func (t *Config) Graph() map[CmdName][]CmdName {
+	graph := make(map[CmdName][]CmdName, len(t.Commands))
+	for name, cmd := range t.Commands {
+		seen := map[CmdName]struct{}{}
+		for _, execIf := range cmd.ExecIfs {
+			seen[execIf] = struct{}{}
+		}
+		for _, exec := range cmd.Execs {
+			if _, ok := Literal(exec); ok {
+				continue
+			}
+			for _, ref := range t.varRefs(exec) {
+				seen[ref] = struct{}{}
+			}
+		}
+		for _, need := range cmd.Needs {
+			seen[t.Resolve(need.Command)] = struct{}{}
+		}
+		for _, run := range cmd.Runs {
+			seen[t.Resolve(run.Command)] = struct{}{}
+		}
+		for _, drain := range cmd.Drain {
+			seen[t.Resolve(drain)] = struct{}{}
+		}
+		for _, undrain := range cmd.Undrain {
+			seen[t.Resolve(undrain)] = struct{}{}
+		}
+		refs := make([]CmdName, 0, len(seen))
+		for ref := range seen {
+			refs = append(refs, ref)
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+		graph[name] = refs
+	}
+	return graph
+}
+
+// Roots reports the commands which can be invoked with -c: the default
+// command, any command which isn't a Variable, since those are never
+// substituted, and the targets of aliases.
+func (t *Config) Roots() []CmdName {
+	seen := map[CmdName]struct{}{}
+	for name, cmd := range t.Commands {
+		if name == t.DefaultCommand || !cmd.Variable() {
+			seen[name] = struct{}{}
+		}
+	}
+	for _, target := range t.Aliases {
+		seen[target] = struct{}{}
+	}
+	roots := make([]CmdName, 0, len(seen))
+	for name := range seen {
+		roots = append(roots, name)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+	return roots
+}
+
+// Prerequisites reports every command which must run before the named one,
+// including the prerequisites of prerequisites, in the order they must run.
+// Each prerequisite appears once. Aliases are resolved.
+func (t *Config) Prerequisites(name CmdName) []Need {
+	var needs []Need
+	seen := map[Need]struct{}{}
+	var visit func(CmdName)
+	visit = func(name CmdName) {
+		for _, need := range t.Commands[name].Needs {
+			need.Command = t.Resolve(need.Command)
+			if _, ok := seen[need]; ok {
+				continue
+			}
+			seen[need] = struct{}{}
+			visit(need.Command)
+			needs = append(needs, need)
+		}
+	}
+	visit(t.Resolve(name))
+	return needs
+}
+
+// Unreachable reports commands and variables which can't be reached from any
+// of the given roots, sorted by name. If no roots are given, Roots() are used.
+func (t *Config) Unreachable(roots ...CmdName) []CmdName {
+	if len(roots) == 0 {
+		roots = t.Roots()
+	}
+	graph := t.Graph()
+	seen := map[CmdName]struct{}{}
+	var visit func(CmdName)
+	visit = func(name CmdName) {
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		for _, ref := range graph[name] {
+			visit(ref)
+		}
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	var dead []CmdName
+	for name := range t.Commands {
+		if _, ok := seen[name]; !ok {
+			dead = append(dead, name)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i] < dead[j] })
+	return dead
+}
+
+// Required reports the variables required by the named command and every
+// command it references, sorted by name. Each variable appears once. Aliases
+// are resolved.
+func (t *Config) Required(name CmdName) []string {
+	graph := t.Graph()
+	seen := map[CmdName]struct{}{}
+	vars := map[string]struct{}{}
+	var visit func(CmdName)
+	visit = func(name CmdName) {
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		if cmd := t.Commands[name]; cmd != nil {
+			for _, req := range cmd.Requires {
+				vars[req] = struct{}{}
+			}
+		}
+		for _, ref := range graph[name] {
+			visit(ref)
+		}
+	}
+	visit(t.Resolve(name))
+	required := make([]string, 0, len(vars))
+	for v := range vars {
+		required = append(required, v)
+	}
+	sort.Strings(required)
+	return required
+}
+
+// varRefs reports the commands referenced as variables in a line, either as
+// $name or ${name:q}. When several command names share a prefix, the longest
+// match wins.
+func (t *Config) varRefs(line string) []CmdName {
+	var refs []CmdName
+	for {
+		i := strings.IndexByte(line, '$')
+		if i < 0 {
+			return refs
+		}
+		line = strings.TrimPrefix(line[i+1:], "{")
+		var best CmdName
+		for name := range t.Commands {
+			if len(name) > len(best) &&
+				strings.HasPrefix(line, string(name)) {
+				best = name
+			}
+		}
+		if best != "" {
+			refs = append(refs, best)
+			line = line[len(best):]
+		}
+	}
+}
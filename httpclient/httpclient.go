@@ -0,0 +1,245 @@
+// Package httpclient makes the HTTP clients up uses for health checks,
+// version checks, dashboards and deployments, configured with functional
+// options. Applications embedding up's features can make clients which
+// behave the same as the up command's -http-* flags:
+//
+//	client, err := httpclient.New(
+//		httpclient.WithTimeout(10*time.Second),
+//		httpclient.WithCACert("/etc/ssl/internal-ca.pem"),
+//		httpclient.WithRetries(3, httpclient.DefaultRetryWait),
+//	)
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Option configures a client made by New.
+type Option func(*config) error
+
+// config is the configuration Options build up.
+type config struct {
+	timeout   time.Duration
+	proxy     *url.URL
+	tls       *tls.Config
+	retries   int
+	retryWait time.Duration
+}
+
+// DefaultRetryWait is how long a client waits before its first retry. It
+// doubles with each retry after.
+const DefaultRetryWait = 500 * time.Millisecond
+
+// WithTimeout limits how long each request may take, including its retries.
+// Zero keeps the client's default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout < 0 {
+			return errors.New("timeout must not be negative")
+		}
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithProxy sends requests through a proxy such as http://proxy:3128 or
+// socks5://localhost:1080 rather than the proxy set by $HTTPS_PROXY,
+// $HTTP_PROXY and $NO_PROXY. An empty proxy keeps the environment's.
+func WithProxy(proxy string) Option {
+	return func(c *config) error {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			c.proxy = u
+		}
+		return nil
+	}
+}
+
+// WithCACert trusts the PEM certificates in file, e.g. an internal CA, in
+// addition to the system's. An empty file changes nothing.
+func WithCACert(file string) Option {
+	return func(c *config) error {
+		if file == "" {
+			return nil
+		}
+		byt, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("read ca cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(byt) {
+			return fmt.Errorf("no certificates in %s", file)
+		}
+		c.tls.RootCAs = pool
+		return nil
+	}
+}
+
+// WithClientCert presents the PEM certificate and key in certFile and
+// keyFile to servers requiring mutual TLS. Empty files change nothing.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(c *config) error {
+		if certFile == "" && keyFile == "" {
+			return nil
+		}
+		if certFile == "" || keyFile == "" {
+			return errors.New("client cert and key must be set " +
+				"together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load client cert: %w", err)
+		}
+		c.tls.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithInsecure skips verifying servers' TLS certificates.
+func WithInsecure() Option {
+	return func(c *config) error {
+		c.tls.InsecureSkipVerify = true
+		return nil
+	}
+}
+
+// WithRetries retries requests which fail to reach their server or which
+// the server is too busy to handle, waiting first for wait, which doubles
+// with each retry. Zero retries disables them.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *config) error {
+		if retries < 0 {
+			return errors.New("retries must not be negative")
+		}
+		c.retries = retries
+		c.retryWait = wait
+		return nil
+	}
+}
+
+// New reports a client for up's HTTP requests, such as health checks,
+// dashboards and deployments. Options are applied in order, so later ones
+// win. Unless WithProxy is given, requests go through the proxy set by
+// $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY, as for curl.
+func New(opts ...Option) (*http.Client, error) {
+	c := &config{tls: &tls.Config{}, retryWait: DefaultRetryWait}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if c.proxy != nil {
+		t.Proxy = http.ProxyURL(c.proxy)
+	}
+	t.TLSClientConfig = c.tls
+	var rt http.RoundTripper = t
+	if c.retries > 0 {
+		rt = &retryTransport{
+			base:    t,
+			retries: c.retries,
+			wait:    c.retryWait,
+		}
+	}
+	return &http.Client{Timeout: c.timeout, Transport: rt}, nil
+}
+
+// retryTransport retries requests which fail to reach their server, or
+// which the server reports it's too busy to handle. Requests which may have
+// been handled, such as a POST whose response was lost, are only retried if
+// their method is idempotent, so an annotation or deployment isn't created
+// twice.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	wait    time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait := t.wait
+	for i := 0; ; i++ {
+		resp, err := t.base.RoundTrip(req)
+		if i == t.retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if req.GetBody != nil {
+			req = req.Clone(req.Context())
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("get body: %w", err)
+			}
+		}
+	}
+}
+
+// retryable reports whether a request should be retried after the response
+// or error it got.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+		default:
+			return false
+		}
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// parseProxy parses a proxy URL such as http://proxy:3128 or
+// socks5://localhost:1080. An empty proxy reports nil.
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unknown proxy scheme %q: use http, "+
+			"https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s has no host", proxy)
+	}
+	return u, nil
+}
@@ -0,0 +1,150 @@
+package httpclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, proxy := range []string{
+		"http://proxy:3128",
+		"socks5://localhost:1080",
+	} {
+		client, err := New(WithProxy(proxy))
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+		u, err := client.Transport.(*http.Transport).Proxy(req)
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+		if u.String() != proxy {
+			t.Fatalf("expected %s, got %s", proxy, u)
+		}
+	}
+	for _, proxy := range []string{
+		"ftp://proxy:21",
+		"http://",
+		"proxy:3128",
+	} {
+		if _, err := New(WithProxy(proxy)); err == nil {
+			t.Fatalf("%s: expected error", proxy)
+		}
+	}
+	if _, err := New(WithClientCert("cert.pem", "")); err == nil {
+		t.Fatal("expected error for a cert without a key")
+	}
+}
+
+func TestCACert(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	client, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(srv.URL); err == nil {
+		t.Fatal("expected untrusted certificate error")
+	}
+
+	dir, err := ioutil.TempDir("", "up-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	byt := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	})
+	if err = ioutil.WriteFile(ca, byt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err = New(WithCACert(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			byt, _ := ioutil.ReadAll(r.Body)
+			if string(byt) != r.Method {
+				t.Errorf("expected body %s, got %q", r.Method,
+					byt)
+			}
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case 2:
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}))
+	defer srv.Close()
+
+	client, err := New(WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		method string
+		status int
+		calls  int32
+	}{
+		// PUT is idempotent, so it's retried after a 502
+		{method: http.MethodPut, status: http.StatusOK, calls: 3},
+
+		// POST may have been handled before the 502, so it's only
+		// retried after the 503
+		{method: http.MethodPost, status: http.StatusBadGateway,
+			calls: 2},
+	}
+	for _, tc := range tcs {
+		atomic.StoreInt32(&calls, 0)
+		req, err := http.NewRequest(tc.method, srv.URL,
+			strings.NewReader(tc.method))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.method,
+				tc.status, resp.StatusCode)
+		}
+		if got := atomic.LoadInt32(&calls); got != tc.calls {
+			t.Fatalf("%s: expected %d calls, got %d", tc.method,
+				tc.calls, got)
+		}
+	}
+}
@@ -4,14 +4,364 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Inventory maps hosts to their tags.
 type Inventory map[string][]string
 
+// Settings describe how to reach a host. They may be declared per host or per
+// tag in the inventory. Per-host settings take precedence.
+type Settings struct {
+	// Transport used to run commands for the host, such as "winrm".
+	// Defaults to running commands locally with sh, in which case the
+	// Upfile is responsible for reaching the host, e.g. with ssh.
+	Transport string `json:"transport,omitempty"`
+
+	// User to connect as. Steps may refer to it as $server.user.
+	User string `json:"user,omitempty"`
+
+	// Key is the path of the private key with which transports
+	// connecting with ssh authenticate. Only it is offered, rather than
+	// every key the operator has.
+	Key string `json:"key,omitempty"`
+
+	// SSHAgent, if false, stops transports connecting with ssh from
+	// authenticating with keys in the operator's ssh agent.
+	SSHAgent *bool `json:"ssh_agent,omitempty"`
+
+	// Port to connect to.
+	Port int `json:"port,omitempty"`
+
+	// HTTPS connects over TLS for HTTP-based transports such as WinRM.
+	HTTPS bool `json:"https,omitempty"`
+
+	// Insecure skips TLS certificate verification for HTTP-based
+	// transports.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Zone and Region in which the host runs, such as a cloud
+	// provider's availability zone. Batches may be spread across them.
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+
+	// KnownHosts is a known_hosts file kept alongside the inventory,
+	// which transports connecting with ssh check rather than each
+	// operator's own.
+	KnownHosts string `json:"known_hosts,omitempty"`
+
+	// HostKeys is how transports connecting with ssh verify host keys:
+	// "strict" refuses hosts whose key isn't known, and "tofu" trusts a
+	// host's key the first time it connects, recording it. Either
+	// refuses a key which changed. Empty leaves it to the operator's ssh
+	// config, unless KnownHosts is set, which is strict.
+	HostKeys string `json:"host_keys,omitempty"`
+}
+
+// InventoryFile is a fully parsed inventory, including any optional settings.
+//
+// Inventory files map hosts to either a list of tags or an object with tags
+// and settings. The reserved key "tags" maps tag names to settings applied to
+// every host with that tag:
+//
+//	{
+//		"10.0.0.1": ["dashboard"],
+//		"10.0.0.2": {"tags": ["iis"], "port": 5986},
+//		"tags": {"iis": {"transport": "winrm", "https": true}}
+//	}
+type InventoryFile struct {
+	// Hosts and their tags.
+	Hosts Inventory
+
+	// HostSettings declared on individual hosts.
+	HostSettings map[string]Settings
+
+	// TagSettings declared in the reserved "tags" key.
+	TagSettings map[string]Settings
+
+	// Groups declared in the reserved "groups" key. Each maps a
+	// composite tag to the tags or other groups it contains.
+	Groups map[string][]string
+}
+
+// hostEntry is the object form of a host in the inventory.
+type hostEntry struct {
+	Settings
+	Tags []string `json:"tags"`
+}
+
 func ParseInventory(rdr io.Reader) (Inventory, error) {
-	inv := Inventory{}
-	if err := json.NewDecoder(rdr).Decode(&inv); err != nil {
+	inv, err := ParseInventoryFile(rdr)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Hosts, nil
+}
+
+// ParseInventoryFile parses an inventory along with any host and tag settings.
+func ParseInventoryFile(rdr io.Reader) (*InventoryFile, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.NewDecoder(rdr).Decode(&raw); err != nil {
 		return nil, fmt.Errorf("decode: %w", err)
 	}
+	inv := &InventoryFile{
+		Hosts:        Inventory{},
+		HostSettings: map[string]Settings{},
+		TagSettings:  map[string]Settings{},
+		Groups:       map[string][]string{},
+	}
+	for key, val := range raw {
+		switch key {
+		case "tags":
+			if err := json.Unmarshal(val, &inv.TagSettings); err != nil {
+				return nil, fmt.Errorf("decode tags: %w", err)
+			}
+			continue
+		case "groups":
+			if err := json.Unmarshal(val, &inv.Groups); err != nil {
+				return nil, fmt.Errorf("decode groups: %w", err)
+			}
+			continue
+		}
+		var tags []string
+		if err := json.Unmarshal(val, &tags); err == nil {
+			inv.Hosts[key] = tags
+			continue
+		}
+		var entry hostEntry
+		if err := json.Unmarshal(val, &entry); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", key, err)
+		}
+		inv.Hosts[key] = entry.Tags
+		inv.HostSettings[key] = entry.Settings
+	}
+	if err := inv.applyAddressPorts(); err != nil {
+		return nil, err
+	}
+	if err := inv.validateGroups(); err != nil {
+		return nil, fmt.Errorf("groups: %w", err)
+	}
 	return inv, nil
 }
+
+// applyAddressPorts validates every host's address and uses a port given in
+// it, e.g. "10.0.0.1:2222", as the host's port setting.
+func (f *InventoryFile) applyAddressPorts() error {
+	for host := range f.Hosts {
+		_, port, err := SplitAddress(host)
+		if err != nil {
+			return fmt.Errorf("host %w", err)
+		}
+		if port == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(port)
+		s := f.HostSettings[host]
+		if s.Port != 0 && s.Port != n {
+			return fmt.Errorf("%s: port %d conflicts with address",
+				host, s.Port)
+		}
+		s.Port = n
+		f.HostSettings[host] = s
+	}
+	return nil
+}
+
+// validateGroups ensures group names don't shadow host tags and every member
+// is a tag or group, so typos don't silently select nothing.
+func (f *InventoryFile) validateGroups() error {
+	tags := map[string]struct{}{}
+	for _, hostTags := range f.Hosts {
+		for _, tag := range hostTags {
+			tags[tag] = struct{}{}
+		}
+	}
+	for group, members := range f.Groups {
+		if _, exist := tags[group]; exist {
+			return fmt.Errorf("%s is both a group and a tag", group)
+		}
+		for _, member := range members {
+			_, isTag := tags[member]
+			_, isGroup := f.Groups[member]
+			if !isTag && !isGroup {
+				return fmt.Errorf("%s: %s is undefined", group,
+					member)
+			}
+		}
+	}
+	for group := range f.Groups {
+		if _, err := f.ExpandTags([]string{group}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveTags matches any glob patterns, as understood by path.Match, against
+// the inventory's tags and groups, then expands groups into their tags. It
+// reports an error if a pattern matches nothing.
+func (f *InventoryFile) ResolveTags(patterns []string) ([]string, error) {
+	var tags []string
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			tags = append(tags, pattern)
+			continue
+		}
+		var found bool
+		for _, name := range f.tagNames() {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, fmt.Errorf("match %s: %w", pattern, err)
+			}
+			if ok {
+				found = true
+				tags = append(tags, name)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s matches no tags", pattern)
+		}
+	}
+	return f.ExpandTags(tags)
+}
+
+// HostsWithTag reports the hosts with a tag, which may be a glob or group, as
+// with ResolveTags, sorted. "all" selects every host.
+func (f *InventoryFile) HostsWithTag(tag string) ([]string, error) {
+	var hosts []string
+	if tag == "all" {
+		for host := range f.Hosts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		return hosts, nil
+	}
+	tags, err := f.ResolveTags([]string{tag})
+	if err != nil {
+		return nil, err
+	}
+	want := map[string]struct{}{}
+	for _, tag := range tags {
+		want[tag] = struct{}{}
+	}
+	for host, hostTags := range f.Hosts {
+		for _, tag := range hostTags {
+			if _, ok := want[tag]; ok {
+				hosts = append(hosts, host)
+				break
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// tagNames reports every tag on a host and every group.
+func (f *InventoryFile) tagNames() []string {
+	seen := map[string]struct{}{}
+	for _, hostTags := range f.Hosts {
+		for _, tag := range hostTags {
+			seen[tag] = struct{}{}
+		}
+	}
+	for group := range f.Groups {
+		seen[group] = struct{}{}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExpandTags replaces any groups with the tags they contain, recursively.
+// Tags which aren't groups are returned unchanged. The result is sorted and
+// contains no duplicates.
+func (f *InventoryFile) ExpandTags(tags []string) ([]string, error) {
+	seen := map[string]struct{}{}
+	var expand func(tag string, path []string) error
+	expand = func(tag string, path []string) error {
+		members, isGroup := f.Groups[tag]
+		if !isGroup {
+			seen[tag] = struct{}{}
+			return nil
+		}
+		for _, p := range path {
+			if p == tag {
+				return fmt.Errorf("group %s contains itself", tag)
+			}
+		}
+		for _, member := range members {
+			if err := expand(member, append(path, tag)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, tag := range tags {
+		if err := expand(tag, nil); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for tag := range seen {
+		out = append(out, tag)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Settings reports the settings for a host. Settings from the host's tags are
+// applied in alphabetical order of tag name, then the host's own settings
+// override them.
+func (f *InventoryFile) Settings(host string) Settings {
+	tags := append([]string{}, f.Hosts[host]...)
+	sort.Strings(tags)
+	var s Settings
+	for _, tag := range tags {
+		s = s.merge(f.TagSettings[tag])
+	}
+	return s.merge(f.HostSettings[host])
+}
+
+// merge returns s with any non-zero fields in o applied on top.
+func (s Settings) merge(o Settings) Settings {
+	if o.Transport != "" {
+		s.Transport = o.Transport
+	}
+	if o.User != "" {
+		s.User = o.User
+	}
+	if o.Key != "" {
+		s.Key = o.Key
+	}
+	if o.SSHAgent != nil {
+		s.SSHAgent = o.SSHAgent
+	}
+	if o.Port != 0 {
+		s.Port = o.Port
+	}
+	if o.HTTPS {
+		s.HTTPS = true
+	}
+	if o.Insecure {
+		s.Insecure = true
+	}
+	if o.Zone != "" {
+		s.Zone = o.Zone
+	}
+	if o.Region != "" {
+		s.Region = o.Region
+	}
+	if o.KnownHosts != "" {
+		s.KnownHosts = o.KnownHosts
+	}
+	if o.HostKeys != "" {
+		s.HostKeys = o.HostKeys
+	}
+	return s
+}
@@ -0,0 +1,181 @@
+package up
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseInventoryFile(t *testing.T) {
+	t.Parallel()
+	inv, err := ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1": ["dashboard"],
+		"10.0.0.2": {"tags": ["iis", "windows"], "port": 5999, "zone": "b"},
+		"10.0.0.3": {"tags": ["iis"], "transport": "local"},
+		"tags": {
+			"iis": {"transport": "winrm", "user": "Admin"},
+			"windows": {"https": true, "region": "east"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Hosts) != 3 {
+		t.Fatalf("expected 3 hosts, got %d", len(inv.Hosts))
+	}
+	if got := inv.Hosts["10.0.0.2"]; len(got) != 2 {
+		t.Fatalf("expected 2 tags, got %v", got)
+	}
+	want := Settings{
+		Transport: "winrm",
+		User:      "Admin",
+		Port:      5999,
+		HTTPS:     true,
+		Zone:      "b",
+		Region:    "east",
+	}
+	if got := inv.Settings("10.0.0.2"); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if got := inv.Settings("10.0.0.3").Transport; got != "local" {
+		t.Fatalf("expected local transport, got %q", got)
+	}
+	if got := inv.Settings("10.0.0.1"); got != (Settings{}) {
+		t.Fatalf("expected no settings, got %+v", got)
+	}
+}
+
+func TestExpandTags(t *testing.T) {
+	t.Parallel()
+	inv, err := ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1": ["dashboard"],
+		"10.0.0.2": ["reverse_proxy"],
+		"10.0.0.3": ["postgres"],
+		"groups": {
+			"frontend": ["dashboard", "reverse_proxy"],
+			"everything": ["frontend", "postgres"]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := inv.ExpandTags([]string{"everything", "dashboard"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[dashboard postgres reverse_proxy]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("expected %s, got %v", want, got)
+	}
+
+	bad := []string{
+		`{"1": ["a"], "groups": {"a": ["a"]}}`,
+		`{"1": ["a"], "groups": {"g": ["typo"]}}`,
+		`{"1": ["a"], "groups": {"g": ["h"], "h": ["g"]}}`,
+	}
+	for _, text := range bad {
+		if _, err = ParseInventoryFile(strings.NewReader(text)); err == nil {
+			t.Fatalf("expected error for %s", text)
+		}
+	}
+}
+
+func TestResolveTags(t *testing.T) {
+	t.Parallel()
+	inv, err := ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1": ["web-us-staging"],
+		"10.0.0.2": ["web-eu-prod"],
+		"10.0.0.3": ["db-us-staging"],
+		"groups": {"web-all": ["web-us-staging", "web-eu-prod"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		have    []string
+		want    string
+		wantErr bool
+	}{
+		{have: []string{"*staging*"}, want: "[db-us-staging web-us-staging]"},
+		{have: []string{"web-*"}, want: "[web-eu-prod web-us-staging]"},
+		{have: []string{"db-*", "web-eu-prod"}, want: "[db-us-staging web-eu-prod]"},
+		{have: []string{"literal"}, want: "[literal]"},
+		{have: []string{"cache-*"}, wantErr: true},
+		{have: []string{"[bad"}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		got, err := inv.ResolveTags(tc.have)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("%v: expected error", tc.have)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Fatalf("%v: expected %s, got %v", tc.have, tc.want, got)
+		}
+	}
+}
+
+func TestHostsWithTag(t *testing.T) {
+	t.Parallel()
+	inv, err := ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.2": ["web-eu", "redis"],
+		"10.0.0.1": ["web-us"],
+		"10.0.0.3": ["redis"],
+		"groups": {"web": ["web-us", "web-eu"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[string]string{
+		"redis":  "[10.0.0.2 10.0.0.3]",
+		"web":    "[10.0.0.1 10.0.0.2]",
+		"web-*":  "[10.0.0.1 10.0.0.2]",
+		"all":    "[10.0.0.1 10.0.0.2 10.0.0.3]",
+		"absent": "[]",
+	}
+	for tag, want := range tcs {
+		got, err := inv.HostsWithTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != want {
+			t.Fatalf("%s: expected %s, got %v", tag, want, got)
+		}
+	}
+	if _, err = inv.HostsWithTag("cache-*"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseInventoryFileAddresses(t *testing.T) {
+	t.Parallel()
+	inv, err := ParseInventoryFile(strings.NewReader(`{
+		"10.0.0.1:2222": ["web"],
+		"[fd00::1]:2200": {"tags": ["web"], "port": 2200},
+		"fd00::2": ["web"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.Settings("10.0.0.1:2222").Port; got != 2222 {
+		t.Fatalf("expected port 2222, got %d", got)
+	}
+	if got := inv.Settings("fd00::2").Port; got != 0 {
+		t.Fatalf("expected no port, got %d", got)
+	}
+	for _, in := range []string{
+		`{"10.0.0.1:ssh": ["web"]}`,
+		`{"[fd00::1": ["web"]}`,
+		`{"10.0.0.1:22": {"tags": ["web"], "port": 2222}}`,
+	} {
+		_, err = ParseInventoryFile(strings.NewReader(in))
+		if err == nil {
+			t.Fatalf("%s: expected error", in)
+		}
+	}
+}
@@ -18,11 +18,7 @@ const (
 	tokenTab                      // Tab '\t'
 	tokenNewline                  // Line break
 	tokenText                     // Plaintext
-	tokenComment                  // Pound '#'
-
-	// Keywords follow
-	tokenKeyword   // Used only to delimit keywords
-	tokenInventory // "inventory"
+	tokenComment                  // Pound '#' starting a word
 )
 
 type token struct {
@@ -33,46 +29,41 @@ type token struct {
 
 type stateFn func(*lexer) stateFn
 
-// run lexes the input by executing state functions until the state is nil.
-func (l *lexer) run() {
-	for l.state = lexText; l.state != nil; {
-		l.state = l.state(l)
-	}
-	close(l.tokens) // No more tokens will be delivered
-}
-
-// lexer holds the state of the scanner.
+// lexer holds the state of the scanner. It runs in the parser's goroutine,
+// only as far as the parser has read, so a parser which stops early, even by
+// panicking, leaves nothing running.
 type lexer struct {
-	input   string     // The string being scanned
-	state   stateFn    // The next lexing function to enter
-	start   int        // Start position of this token
-	pos     int        // Current position in the input
-	width   int        // Width of the last rune read
-	lastPos int        // Position of last token returned by nextToken
-	tokens  chan token // Channel of scanned tokens
+	input   string  // The string being scanned
+	state   stateFn // The next lexing function to enter
+	start   int     // Start position of this token
+	pos     int     // Current position in the input
+	width   int     // Width of the last rune read
+	lastPos int     // Position of last token returned by nextToken
+	tokens  []token // Scanned tokens not yet returned by nextToken
 }
 
+// bom is the UTF-8 byte order mark, which some editors on Windows add to the
+// start of files.
+const bom = "\ufeff"
+
 func lex(input string) *lexer {
 	l := &lexer{
-		input:  input,
-		state:  lexText,
-		tokens: make(chan token),
+		input: input,
+		state: lexText,
 	}
-	go l.run()
-	return l
-}
 
-// drain the output so the lexing goroutine will exit. Called by the parser,
-// not in the lexing goroutine.
-func (l *lexer) drain() {
-	for range l.tokens {
+	// Skip the byte order mark, so it's not glued to the first command
+	if strings.HasPrefix(input, bom) {
+		l.pos = len(bom)
+		l.start = l.pos
 	}
+	return l
 }
 
 // emit passes an token back to the client.
 func (l *lexer) emit(t tokenType) {
-	tkn := token{typ: t, val: l.input[l.start:l.pos]}
-	l.tokens <- tkn
+	tkn := token{typ: t, pos: l.start, val: l.input[l.start:l.pos]}
+	l.tokens = append(l.tokens, tkn)
 	l.start = l.pos
 }
 
@@ -87,9 +78,17 @@ func (l *lexer) next() rune {
 	return r
 }
 
-// nextToken reports the next token from the input.
+// nextToken reports the next token from the input, running state functions
+// until one is emitted. Once the input is exhausted, it reports a zero token.
 func (l *lexer) nextToken() token {
-	token := <-l.tokens
+	for len(l.tokens) == 0 && l.state != nil {
+		l.state = l.state(l)
+	}
+	var token token
+	if len(l.tokens) > 0 {
+		token = l.tokens[0]
+		l.tokens = l.tokens[1:]
+	}
 	l.lastPos = token.pos
 	return token
 }
@@ -127,10 +126,14 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// errorf returns an error token and terminates the scan by passing back a nil
-// pointer as the next state, terminating l.run.
+// errorf emits an error token and terminates the scan by passing back a nil
+// pointer as the next state.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- token{typ: tokenError, val: fmt.Sprintf(format, args...)}
+	l.tokens = append(l.tokens, token{
+		typ: tokenError,
+		pos: l.start,
+		val: fmt.Sprintf(format, args...),
+	})
 	return nil
 }
 
@@ -142,17 +145,22 @@ Outer:
 		switch {
 		case r == eof:
 			break Outer
-		case r == '#':
+		case r == '#' && len(text) == 0:
+			// Only a "#" starting a line or following whitespace
+			// starts a comment, so "a#b" and "${#v}" are text
 			l.emit(tokenComment)
-		case text == "inventory":
-			l.backup()
-			l.emit(tokenInventory)
 		case isEndOfLine(r):
 			l.backup()
 			if len(text) > 0 {
 				l.emit(tokenText)
 			}
 			l.next()
+
+			// Files edited on Windows end lines with "\r\n",
+			// which is a single line break
+			if r == '\r' && l.peek() == '\n' {
+				l.next()
+			}
 			l.emit(tokenNewline)
 		case r == ' ':
 			l.backup()
@@ -161,6 +169,11 @@ Outer:
 			}
 			return lexSpace
 		case r == '\t':
+			l.backup()
+			if len(text) > 0 {
+				l.emit(tokenText)
+			}
+			l.next()
 			l.emit(tokenTab)
 		}
 	}
@@ -3,155 +3,845 @@ package up
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
+// parser builds a File from the tokens emitted by the lexer.
+type parser struct {
+	file *File
+	text string
+	lex  *lexer
+
+	// doc holds "##" comment lines describing the next command.
+	doc []string
+
+	// last is the most recent position converted by pos.
+	last Pos
+
+	// keywords used on command lines, which mustn't also name commands.
+	keywords []Ident
+}
+
+// keywords which may follow a command's name, and how they're written.
+var keywords = map[string]string{
+	"needs":      "needs COMMAND",
+	"needs-each": "needs-each COMMAND",
+	"drain":      "drain COMMAND",
+	"undrain":    "undrain COMMAND",
+	"version":    "version SOURCE",
+	"requires":   "requires NAME",
+}
+
+func newParser(text string) *parser {
+	return &parser{file: &File{}, text: text}
+}
+
+// parse the full text into p.file.
+func (p *parser) parse() error {
+	p.lex = lex(p.text)
+	defer func() { p.lex = nil }()
+	return p.nextControl(p.nextNonSpace())
+}
+
 // parseUpfile to build a Config tree.
 func parseUpfile(text string) (*Config, error) {
+	p := newParser(text)
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
 	t := &Config{
 		Commands: map[CmdName]*Cmd{},
 		text:     text,
-		lex:      lex(text),
+		file:     p.file,
 	}
-	if err := t.parse(); err != nil {
-		t.lex.drain()
-		t.stopParse()
-		return nil, err
+	for _, node := range p.file.Commands {
+		name := CmdName(node.Name.Name)
+		if len(t.Commands) == 0 {
+			t.DefaultCommand = name
+		}
+		if t.Commands[name] != nil {
+			return nil, p.errorf(node.Name.Pos,
+				"duplicate command %s", name)
+		}
+		cmd := &Cmd{
+			Description: node.Description,
+			Version:     node.Version.Name,
+		}
+		for _, execIf := range node.ExecIfs {
+			cmd.ExecIfs = append(cmd.ExecIfs, CmdName(execIf.Name))
+		}
+		for _, exec := range node.Execs {
+			cmd.Execs = append(cmd.Execs, exec.Text)
+		}
+		for _, tag := range node.Tags {
+			cmd.Tags = append(cmd.Tags, tag.Name)
+		}
+		for _, need := range node.Needs {
+			cmd.Needs = append(cmd.Needs, Need{
+				Command: CmdName(need.Command.Name),
+				Each:    need.Each,
+			})
+		}
+		for _, drain := range node.Drain {
+			cmd.Drain = append(cmd.Drain, CmdName(drain.Name))
+		}
+		for _, undrain := range node.Undrain {
+			cmd.Undrain = append(cmd.Undrain, CmdName(undrain.Name))
+		}
+		for _, req := range node.Requires {
+			cmd.Requires = append(cmd.Requires, req.Name)
+		}
+		for _, run := range node.Runs {
+			r := Run{Command: CmdName(run.Command.Name)}
+			for _, tag := range run.Tags {
+				r.Tags = append(r.Tags, tag.Name)
+			}
+			cmd.Runs = append(cmd.Runs, r)
+		}
+		t.Commands[name] = cmd
+	}
+	for _, node := range p.file.Aliases {
+		name := CmdName(node.Name.Name)
+		if t.Aliases == nil {
+			t.Aliases = map[CmdName]CmdName{}
+		}
+		if _, exist := t.Aliases[name]; exist {
+			return nil, p.errorf(node.Name.Pos,
+				"duplicate alias %s", name)
+		}
+		if _, exist := t.Commands[name]; exist {
+			return nil, p.errorf(node.Name.Pos,
+				"alias %s conflicts with command", name)
+		}
+		target := CmdName(node.Target.Name)
+		if _, exist := t.Commands[target]; !exist {
+			return nil, p.errorf(node.Target.Pos,
+				"%s is undefined", target)
+		}
+		t.Aliases[name] = target
+	}
+
+	// A command named like a keyword can't be a condition, which would
+	// change meaning silently
+	for _, kw := range p.keywords {
+		if _, exist := t.Commands[t.Resolve(CmdName(kw.Name))]; exist {
+			return nil, p.errorf(kw.Pos,
+				"%s is a keyword and cannot be a condition",
+				kw.Name)
+		}
+	}
+	for _, node := range p.file.Checksums {
+		if t.Checksums == nil {
+			t.Checksums = map[string]string{}
+		}
+		if _, exist := t.Checksums[node.Name.Name]; exist {
+			return nil, p.errorf(node.Name.Pos,
+				"duplicate checksum %s", node.Name.Name)
+		}
+		t.Checksums[node.Name.Name] = node.Dir.Name
+	}
+	for _, node := range p.file.Vars {
+		if t.Vars == nil {
+			t.Vars = map[string]Var{}
+		}
+		if _, exist := t.Vars[node.Name.Name]; exist {
+			return nil, p.errorf(node.Name.Pos,
+				"duplicate var %s", node.Name.Name)
+		}
+		if _, exist := t.Commands[CmdName(node.Name.Name)]; exist {
+			return nil, p.errorf(node.Name.Pos,
+				"var %s conflicts with command", node.Name.Name)
+		}
+		v, ok := parseVar(node.Type.Name)
+		if !ok {
+			return nil, p.errorf(node.Type.Pos,
+				"unknown var type %s", node.Type.Name)
+		}
+		t.Vars[node.Name.Name] = v
 	}
-	t.stopParse()
 
 	// Validate to ensure that ExecIfs are defined after fully loading
 	// them, since we don't require them to be defined in a specific order
-	for cmdName, cmd := range t.Commands {
-		for _, execIf := range cmd.ExecIfs {
-			if execIf == cmdName {
-				return nil, fmt.Errorf("%s depends on itself", execIf)
+	for _, node := range p.file.Commands {
+		for _, execIf := range node.ExecIfs {
+			if execIf.Name == node.Name.Name {
+				return nil, p.errorf(execIf.Pos,
+					"%s depends on itself", execIf.Name)
+			}
+			if _, exist := t.Commands[CmdName(execIf.Name)]; !exist {
+				return nil, p.errorf(execIf.Pos,
+					"%s is undefined", execIf.Name)
 			}
-			if _, exist := t.Commands[execIf]; !exist {
-				return nil, fmt.Errorf("%s is undefined", execIf)
+		}
+		for _, run := range node.Runs {
+			target, exist := t.Commands[t.Resolve(
+				CmdName(run.Command.Name))]
+			switch {
+			case !exist:
+				return nil, p.errorf(run.Command.Pos,
+					"%s is undefined", run.Command.Name)
+			case len(target.Runs) > 0:
+				return nil, p.errorf(run.Command.Pos,
+					"%s is composite and cannot be run",
+					run.Command.Name)
+			}
+		}
+		for _, need := range node.Needs {
+			if need.Command.Name == node.Name.Name {
+				return nil, p.errorf(need.Command.Pos,
+					"%s depends on itself",
+					need.Command.Name)
+			}
+			target, exist := t.Commands[t.Resolve(
+				CmdName(need.Command.Name))]
+			switch {
+			case !exist:
+				return nil, p.errorf(need.Command.Pos,
+					"%s is undefined", need.Command.Name)
+			case len(target.Runs) > 0:
+				return nil, p.errorf(need.Command.Pos,
+					"%s is composite and cannot be needed",
+					need.Command.Name)
 			}
 		}
 	}
+	for _, node := range p.file.Commands {
+		hooks := append(append([]Ident{}, node.Drain...),
+			node.Undrain...)
+		for _, hook := range hooks {
+			target, exist := t.Commands[t.Resolve(
+				CmdName(hook.Name))]
+			switch {
+			case hook.Name == node.Name.Name:
+				return nil, p.errorf(hook.Pos,
+					"%s depends on itself", hook.Name)
+			case !exist:
+				return nil, p.errorf(hook.Pos,
+					"%s is undefined", hook.Name)
+			case !target.Variable():
+				return nil, p.errorf(hook.Pos,
+					"%s must only have steps to drain",
+					hook.Name)
+			}
+		}
+	}
+	if err := p.checkNeeds(t); err != nil {
+		return nil, err
+	}
 	if len(t.Commands) == 0 {
 		return nil, errors.New("no commands")
 	}
+	t.Warnings = t.warnings()
 	return t, nil
 }
 
-func (t *Config) parse() error {
-	return t.nextControl(t.nextNonSpace())
+// checkNeeds reports an error if prerequisites form a cycle, or if a
+// prerequisite run once locally needs one run on each server, which can't
+// have run yet.
+func (p *parser) checkNeeds(t *Config) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[CmdName]int{}
+	var path []CmdName
+	var visit func(*CmdNode) error
+	visit = func(node *CmdNode) error {
+		name := CmdName(node.Name.Name)
+		state[name] = visiting
+		path = append(path, name)
+		for _, need := range node.Needs {
+			target := t.Resolve(CmdName(need.Command.Name))
+			switch state[target] {
+			case visiting:
+				cycle := []string{string(target)}
+				for i := len(path) - 1; i >= 0; i-- {
+					cycle = append(cycle, string(path[i]))
+					if path[i] == target {
+						break
+					}
+				}
+				reverse(cycle)
+				return p.errorf(need.Command.Pos,
+					"needs cycle: %s",
+					strings.Join(cycle, " -> "))
+			case unvisited:
+				err := visit(p.file.Command(target))
+				if err != nil {
+					return err
+				}
+			}
+			if need.Each {
+				continue
+			}
+			for _, sub := range t.Prerequisites(target) {
+				if sub.Each {
+					return p.errorf(need.Command.Pos,
+						"%s runs locally but needs-each %s",
+						target, sub.Command)
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, node := range p.file.Commands {
+		if state[CmdName(node.Name.Name)] != unvisited {
+			continue
+		}
+		if err := visit(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reverse(ss []string) {
+	for i, j := 0, len(ss)-1; i < j; i, j = i+1, j-1 {
+		ss[i], ss[j] = ss[j], ss[i]
+	}
+}
+
+func (p *parser) errorf(pos Pos, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
 }
 
-func (t *Config) stopParse() {
-	t.lex = nil
+func (p *parser) ident(tkn token) Ident {
+	return Ident{Name: tkn.val, Pos: p.pos(tkn.pos)}
 }
 
-func (t *Config) nextNonSpace() token {
+// pos converts a byte offset into a Pos. Tokens arrive in order, so lines are
+// counted from the last position converted.
+func (p *parser) pos(offset int) Pos {
+	p.last = positionFrom(p.text, p.last, offset)
+	return p.last
+}
+
+func (p *parser) nextNonSpace() token {
 	for {
-		tkn := t.lex.nextToken()
+		tkn := p.lex.nextToken()
 		if tkn.typ != tokenSpace {
 			return tkn
 		}
 	}
 }
 
-func (t *Config) nextControl(tkn token) error {
-	switch tkn.typ {
-	case tokenEOF:
+func (p *parser) nextControl(tkn token) error {
+	// Skip blank lines and comments in a loop rather than recursing, so
+	// a file of many can't exhaust the stack
+	for tkn.typ == tokenNewline || tkn.typ == tokenComment ||
+		tkn.typ == tokenTab {
+		switch tkn.typ {
+		case tokenNewline:
+			p.doc = nil
+			tkn = p.nextNonSpace()
+			continue
+		case tokenTab:
+			// Lines of only whitespace are blank
+			next, blank := p.blankLine()
+			if !blank && next.typ != tokenEOF {
+				return p.errorf(p.pos(tkn.pos),
+					"unexpected indent")
+			}
+			tkn = next
+			continue
+		}
+
+		// Comments may also precede the first command, e.g. to
+		// describe the file
+		p.comment(tkn, false)
+	Comment:
+		for {
+			switch tkn = p.lex.nextToken(); tkn.typ {
+			case tokenNewline:
+				tkn = p.nextNonSpace()
+				break Comment
+			case tokenEOF:
+				return nil
+			case tokenError:
+				return p.errorf(p.pos(tkn.pos), "%s",
+					tkn.val)
+			}
+		}
+	}
+	switch {
+	case tkn.typ == tokenEOF:
 		return nil
+	case tkn.typ == tokenText && tkn.val == "alias":
+		return p.aliasControl(tkn)
+	case tkn.typ == tokenText && tkn.val == "checksum":
+		return p.checksumControl(tkn)
+	case tkn.typ == tokenText && tkn.val == "var":
+		return p.varControl(tkn)
 	default:
-		return t.commandControl(CmdName(tkn.val))
+		return p.commandControl(p.ident(tkn))
 	}
 }
 
-func (t *Config) commandControl(name CmdName) error {
-	if len(t.Commands) == 0 {
-		t.DefaultCommand = name
+// aliasControl parses `alias NAME = COMMAND` through the end of the line.
+func (p *parser) aliasControl(alias token) error {
+	var words []token
+	for {
+		tkn := p.lex.nextToken()
+		switch tkn.typ {
+		case tokenText:
+			words = append(words, tkn)
+			continue
+		case tokenSpace:
+			continue
+		case tokenNewline, tokenEOF:
+		default:
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected alias token %s (%d)", tkn.val,
+				tkn.typ)
+		}
+		if len(words) != 3 || words[1].val != "=" {
+			return p.errorf(p.pos(alias.pos),
+				"alias must be: alias NAME = COMMAND")
+		}
+		p.file.Aliases = append(p.file.Aliases, &AliasNode{
+			Name:   p.ident(words[0]),
+			Target: p.ident(words[2]),
+		})
+		if tkn.typ == tokenEOF {
+			return nil
+		}
+		return p.nextControl(p.nextNonSpace())
+	}
+}
+
+// checksumControl parses `checksum NAME=DIR NAME=DIR` through the end of the
+// line.
+func (p *parser) checksumControl(checksum token) error {
+	var nodes []*ChecksumNode
+	for {
+		tkn := p.lex.nextToken()
+		switch tkn.typ {
+		case tokenText:
+			i := strings.IndexByte(tkn.val, '=')
+			if i <= 0 || i == len(tkn.val)-1 {
+				return p.errorf(p.pos(tkn.pos),
+					"checksum must be: checksum NAME=DIR")
+			}
+			nodes = append(nodes, &ChecksumNode{
+				Name: Ident{
+					Name: tkn.val[:i],
+					Pos:  p.pos(tkn.pos),
+				},
+				Dir: Ident{
+					Name: tkn.val[i+1:],
+					Pos:  p.pos(tkn.pos + i + 1),
+				},
+			})
+			continue
+		case tokenSpace:
+			continue
+		case tokenNewline, tokenEOF:
+		default:
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected checksum token %s (%d)", tkn.val,
+				tkn.typ)
+		}
+		if len(nodes) == 0 {
+			return p.errorf(p.pos(checksum.pos),
+				"checksum must be: checksum NAME=DIR")
+		}
+		p.file.Checksums = append(p.file.Checksums, nodes...)
+		if tkn.typ == tokenEOF {
+			return nil
+		}
+		return p.nextControl(p.nextNonSpace())
 	}
-	if t.Commands[name] != nil {
-		return fmt.Errorf("duplicate command %s", name)
+}
+
+// varControl parses `var NAME TYPE` through the end of the line. Enums may
+// have spaces after their commas, e.g. `var ENV enum(staging, prod)`.
+func (p *parser) varControl(v token) error {
+	var words []token
+	for {
+		tkn := p.lex.nextToken()
+		switch tkn.typ {
+		case tokenText:
+			words = append(words, tkn)
+			continue
+		case tokenSpace:
+			continue
+		case tokenNewline, tokenEOF:
+		default:
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected var token %s (%d)", tkn.val,
+				tkn.typ)
+		}
+		if len(words) < 2 {
+			return p.errorf(p.pos(v.pos),
+				"var must be: var NAME TYPE")
+		}
+		typ := p.ident(words[1])
+		for _, word := range words[2:] {
+			typ.Name += word.val
+		}
+		p.file.Vars = append(p.file.Vars, &VarNode{
+			Name: p.ident(words[0]),
+			Type: typ,
+		})
+		if tkn.typ == tokenEOF {
+			return nil
+		}
+		return p.nextControl(p.nextNonSpace())
 	}
-	cmd := Cmd{}
+}
 
-	// Get all tokenText until newline, ignoring non-newline spaces
+func (p *parser) commandControl(name Ident) error {
+	node := &CmdNode{Name: name, Description: strings.Join(p.doc, " ")}
+	p.doc = nil
+
+	// Get all tokenText until newline, ignoring non-newline spaces. Names
+	// after a keyword belong to it rather than ExecIfs, and there must be
+	// at least one.
+	var keyword Ident
+	var args int
+	checkArgs := func() error {
+		if keyword.Name != "" && args == 0 {
+			return p.errorf(keyword.Pos, "%s must be: %s",
+				keyword.Name, keywords[keyword.Name])
+		}
+		return nil
+	}
 Outer2:
 	for {
-		tkn := t.lex.nextToken()
+		tkn := p.lex.nextToken()
 		switch tkn.typ {
 		case tokenText:
-			cmd.ExecIfs = append(cmd.ExecIfs, CmdName(tkn.val))
+			if _, ok := keywords[tkn.val]; ok {
+				if err := checkArgs(); err != nil {
+					return err
+				}
+				keyword, args = p.ident(tkn), 0
+				p.keywords = append(p.keywords, keyword)
+				continue
+			}
+			if strings.HasPrefix(tkn.val, "@") {
+				tag := p.ident(tkn)
+				tag.Name = tag.Name[1:]
+				tag.Pos = p.pos(tkn.pos + 1)
+				if tag.Name == "" {
+					return p.errorf(tag.Pos, "empty tag")
+				}
+				node.Tags = append(node.Tags, tag)
+				continue
+			}
+			if keyword.Name == "requires" {
+				// Names may be separated by commas as well as
+				// spaces, e.g. "requires UP_USER, IMAGE_TAG".
+				pos := tkn.pos
+				for _, v := range strings.Split(tkn.val, ",") {
+					req := Ident{
+						Name: v,
+						Pos:  p.pos(pos),
+					}
+					if v != "" {
+						node.Requires = append(
+							node.Requires, req)
+						args++
+					}
+					pos += len(v) + 1
+				}
+				continue
+			}
+			ident := p.ident(tkn)
+			args++
+			switch keyword.Name {
+			case "needs", "needs-each":
+				node.Needs = append(node.Needs, &NeedNode{
+					Command: ident,
+					Each:    keyword.Name == "needs-each",
+				})
+			case "drain":
+				node.Drain = append(node.Drain, ident)
+			case "undrain":
+				node.Undrain = append(node.Undrain, ident)
+			case "version":
+				if node.Version.Name != "" {
+					return p.errorf(ident.Pos, "version "+
+						"must be: version SOURCE")
+				}
+				if !ValidVersion(ident.Name) {
+					return p.errorf(ident.Pos,
+						"unknown version source %s",
+						ident.Name)
+				}
+				node.Version = ident
+			default:
+				node.ExecIfs = append(node.ExecIfs, ident)
+			}
 		case tokenNewline:
+			if err := checkArgs(); err != nil {
+				return err
+			}
 			break Outer2
 		case tokenSpace:
 			// Do nothing
 		case tokenEOF:
-			return errors.New("unexpected eof in command line")
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected eof in command line")
 		default:
-			return fmt.Errorf("unexpected command token %s (%d)", tkn.val, tkn.typ)
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected command token %s (%d)", tkn.val,
+				tkn.typ)
 		}
 	}
 
-	// Get all tokenText until not indented
+	// Get all tokenText until a line which is neither indented nor blank.
+	// Lines of only whitespace are blank.
 	var indented bool
 	var line string
+	var linePos int
 	var tkn token
+	addLine := func() {
+		line = strings.TrimRight(line, " ")
+		if line == "" {
+			return
+		}
+		pos := p.pos(linePos)
+		node.Execs = append(node.Execs, &ExecNode{
+			Text: line,
+			Pos:  pos,
+			Vars: varIdents(p.text, line, pos),
+		})
+		line = ""
+	}
 Outer:
 	for {
-		tkn = t.lex.nextToken()
+		tkn = p.lex.nextToken()
 		switch tkn.typ {
 		case tokenComment:
-			skipLine(t.lex)
+			// A comment ends the line, even when it follows a
+			// command
+			p.comment(tkn, indented)
+			addLine()
 			indented = false
+			if tkn = skipLine(p.lex); tkn.typ == tokenEOF {
+				break Outer
+			}
 			continue
 		case tokenNewline:
-			indented = false
-			if line != "" {
-				cmd.Execs = append(cmd.Execs, line)
+			if !indented && line == "" {
+				p.doc = nil
+			}
+			if indented && strings.TrimRight(line, " ") == fence {
+				exec, err := p.literal(p.pos(linePos),
+					tkn.pos+len(tkn.val))
+				if err != nil {
+					return err
+				}
+				node.Execs = append(node.Execs, exec)
 				line = ""
 			}
+			indented = false
+			addLine()
 			continue
 		case tokenTab:
 			if indented {
-				if t.lex.nextToken().typ == tokenNewline {
-					t.lex.backup()
-					// Ignore extra whitespace at end of lines
+				// Ignore extra whitespace at end of lines
+				switch tkn = p.lex.nextToken(); tkn.typ {
+				case tokenNewline:
+					indented = false
+					addLine()
 					continue
+				case tokenEOF:
+					addLine()
+					break Outer
 				}
 				// But error if there are too many tabs
 				// otherwise
-				return errors.New("unexpected double indent")
+				return p.errorf(p.pos(tkn.pos),
+					"unexpected double indent")
 			}
 			indented = true
 			continue
 		case tokenText, tokenSpace:
+			if !indented && tkn.typ == tokenSpace {
+				var blank bool
+				if tkn, blank = p.blankLine(); blank {
+					p.doc = nil
+					continue
+				}
+				if tkn.typ == tokenTab {
+					return p.errorf(p.pos(tkn.pos), "unexpected "+
+						"spaces before indent")
+				}
+			}
 			if !indented {
 				break Outer
 			}
 			// Continue parsing til the end of the line
-			line += tkn.val
+			if line == "" {
+				linePos = tkn.pos
+				p.doc = nil
+			}
+			// Slice rather than append, since the line's tokens
+			// are contiguous and lines may be very long
+			line = p.text[linePos : tkn.pos+len(tkn.val)]
 		case tokenEOF:
+			// The last line needn't end in a newline
+			addLine()
 			break Outer
 		default:
-			return fmt.Errorf("unexpected %d %q", tkn.typ, tkn.val)
+			return p.errorf(p.pos(tkn.pos),
+				"unexpected %d %q", tkn.typ, tkn.val)
 		}
 	}
 
 	// Ensure we found at least one
-	if len(cmd.Execs) == 0 {
-		return fmt.Errorf("nothing to exec for %s", name)
+	if len(node.Execs) == 0 {
+		return p.errorf(name.Pos, "nothing to exec for %s", name.Name)
+	}
+
+	// Composite commands only run other commands
+	var shell bool
+	for _, exec := range node.Execs {
+		text := exec.Text
+		if _, ok := Literal(text); ok {
+			shell = true
+			continue
+		}
+		// Prefixes only count written exactly, e.g. "as USER:", so
+		// shell such as "as -o a.o a.s" runs as written
+		if _, cmd, ok := Each(text); ok {
+			if cmd == "" {
+				return p.errorf(exec.Pos,
+					"each must be: each TAG: COMMAND")
+			}
+			text = cmd
+		}
+		if user, cmd := RunAs(text); user != "" && cmd == "" {
+			return p.errorf(exec.Pos, "as must be: as USER: COMMAND")
+		}
+		runs, err := parseRuns(p.text, exec)
+		if err != nil {
+			return err
+		}
+		if runs == nil {
+			shell = true
+		}
+		node.Runs = append(node.Runs, runs...)
+	}
+	if len(node.Runs) > 0 {
+		switch {
+		case shell:
+			return p.errorf(name.Pos,
+				"%s mixes run with other commands", name.Name)
+		case len(node.ExecIfs) > 0:
+			return p.errorf(node.ExecIfs[0].Pos,
+				"composite command %s cannot have conditions",
+				name.Name)
+		case len(node.Tags) > 0:
+			return p.errorf(node.Tags[0].Pos,
+				"composite command %s cannot have tags",
+				name.Name)
+		case len(node.Needs) > 0:
+			return p.errorf(node.Needs[0].Command.Pos,
+				"composite command %s cannot have needs",
+				name.Name)
+		case len(node.Drain) > 0 || len(node.Undrain) > 0:
+			return p.errorf(name.Pos,
+				"composite command %s cannot drain", name.Name)
+		}
+		node.Execs = nil
+	}
+	p.file.Commands = append(p.file.Commands, node)
+	return p.nextControl(tkn)
+}
+
+// comment records the comment starting at tkn. Unindented lines starting
+// with "##" describe the command which follows them. Any other comment ends
+// the description.
+func (p *parser) comment(tkn token, indented bool) {
+	line := p.text[tkn.pos:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if indented || !strings.HasPrefix(line, "##") {
+		p.doc = nil
+		return
+	}
+	p.doc = append(p.doc, strings.TrimSpace(line[2:]))
+}
+
+// literal reads the lines of a literal block, which start at offset after
+// its opening fence, through its closing fence. Their tokens are discarded,
+// so the lines are kept exactly as written, less their indent, including
+// any "#" or "$".
+func (p *parser) literal(open Pos, offset int) (*ExecNode, error) {
+	var lines []string
+	end := offset
+	for {
+		if end >= len(p.text) {
+			return nil, p.errorf(open, "unterminated literal block")
+		}
+		line := p.text[end:]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		end += len(line)
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == fence {
+			break
+		}
+		if strings.TrimSpace(line) != "" && line[0] != '\t' {
+			return nil, p.errorf(open, "unterminated literal block")
+		}
+		lines = append(lines, strings.TrimPrefix(line, "\t"))
 	}
-	t.Commands[name] = &cmd
-	if t.DefaultCommand == "" {
-		t.DefaultCommand = name
+	for {
+		tkn := p.lex.nextToken()
+		if tkn.typ == tokenEOF || tkn.typ == tokenError ||
+			tkn.pos+len(tkn.val) >= end {
+			break
+		}
+	}
+	return &ExecNode{
+		Text: fence + "\n" + strings.Join(lines, "\n") + "\n" + fence,
+		Pos:  open,
+	}, nil
+}
+
+// blankLine reads the whitespace following spaces at the start of a line,
+// reporting the token after it and whether the line is blank. If the
+// whitespace includes a tab and the line isn't blank, the tab is reported.
+func (p *parser) blankLine() (token, bool) {
+	var tab *token
+	for {
+		tkn := p.lex.nextToken()
+		switch tkn.typ {
+		case tokenSpace:
+		case tokenTab:
+			if tab == nil {
+				tab = &tkn
+			}
+		case tokenNewline:
+			return tkn, true
+		case tokenEOF:
+			return tkn, false
+		default:
+			if tab != nil {
+				return *tab, false
+			}
+			return tkn, false
+		}
 	}
-	return t.nextControl(tkn)
 }
 
-func skipLine(l *lexer) {
+// skipLine discards tokens through the end of the line, reporting the newline
+// or EOF which ended it.
+func skipLine(l *lexer) token {
 	for {
 		tkn := l.nextToken()
 		switch tkn.typ {
-		case tokenNewline, tokenEOF:
-			return
+		case tokenNewline, tokenEOF, tokenError:
+			return tkn
 		default:
 			continue
 		}
@@ -3,9 +3,13 @@ package up
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
@@ -16,13 +20,9 @@ func TestParse(t *testing.T) {
 		wantErr  bool
 	}{
 		{haveFile: "empty", wantErr: true},
-		{haveFile: "dupe_inventory", wantErr: true},
-		{haveFile: "invalid_inventory", wantErr: true},
-		{haveFile: "two_inventory_groups", want: &Config{
-			Inventory: map[InvName][]string{
-				"production": []string{"1.1.1.1"},
-				"staging":    []string{"www.example.com", "1.1.1.2"},
-			},
+		{haveFile: "dupe_command", wantErr: true},
+		{haveFile: "undefined_exec_if", wantErr: true},
+		{haveFile: "two_commands", want: &Config{
 			Commands: map[CmdName]*Cmd{
 				"deploy": &Cmd{
 					ExecIfs: []CmdName{"if1"},
@@ -30,8 +30,7 @@ func TestParse(t *testing.T) {
 				},
 				"if1": &Cmd{Execs: []string{"echo 'if1'"}},
 			},
-			DefaultCommand:     "deploy",
-			DefaultEnvironment: "production",
+			DefaultCommand: "deploy",
 		}},
 	}
 	for _, tc := range tests {
@@ -42,13 +41,16 @@ func TestParse(t *testing.T) {
 				t.Fatal(err)
 			}
 			rdr := bytes.NewReader(byt)
-			conf, err := Parse(rdr)
+			conf, err := ParseUpfile(rdr)
 			if err != nil {
 				if tc.wantErr {
 					return
 				}
 				t.Fatal(err)
 			}
+			if tc.wantErr {
+				t.Fatal("expected error")
+			}
 			byt, err = json.Marshal(conf)
 			if err != nil {
 				t.Fatal(err)
@@ -65,3 +67,895 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestWarnings(t *testing.T) {
+	t.Parallel()
+	byt, err := ioutil.ReadFile(filepath.Join("testdata", "warnings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ParseUpfile(bytes.NewReader(byt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"line 7: unused is only used by unreachable commands",
+		"line 10: x is never used",
+		"line 11: line is 178 characters long",
+		"line 13: dead is never used",
+	}
+	if len(conf.Warnings) != len(want) {
+		t.Fatalf("expected %d warnings, got %v", len(want),
+			conf.Warnings)
+	}
+	for i, w := range conf.Warnings {
+		if w.String() != want[i] {
+			t.Fatalf("expected %q, got %q", want[i], w)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy check
+	echo $remote_user ${msg:q}
+
+check
+	echo ok
+
+msg
+	it's deployed
+
+remote
+	ssh $server
+
+remote_user
+	deploy
+
+dead
+	echo $deader
+
+deader
+	echo 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := conf.Unreachable()
+	want := []CmdName{"dead", "deader", "remote"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	got = conf.Unreachable("dead")
+	want = []CmdName{"check", "deploy", "msg", "remote", "remote_user"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	t.Parallel()
+	f, err := ParseFile(bytes.NewBufferString(`deploy check
+	rsync -a app $remote:
+	ssh $remote 'restart'
+
+check
+	true
+
+remote
+	$UP_USER@$server
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Commands) != 3 {
+		t.Fatalf("expected 3 commands, got %d", len(f.Commands))
+	}
+	deploy := f.Commands[0]
+	if got := deploy.ExecIfs[0].Pos.String(); got != "1:8" {
+		t.Fatalf("expected check at 1:8, got %s", got)
+	}
+	exec := deploy.Execs[1]
+	if got := exec.Pos.String(); got != "3:2" {
+		t.Fatalf("expected exec at 3:2, got %s", got)
+	}
+	if len(exec.Vars) != 1 || exec.Vars[0].Name != "remote" ||
+		exec.Vars[0].Pos.String() != "3:6" {
+		t.Fatalf("unexpected vars: %+v", exec.Vars)
+	}
+	remote := f.Command("remote")
+	if remote == nil || remote.Name.Pos.Line != 8 {
+		t.Fatalf("unexpected remote: %+v", remote)
+	}
+	if got := len(remote.Execs[0].Vars); got != 2 {
+		t.Fatalf("expected 2 vars, got %d", got)
+	}
+
+	_, err = ParseUpfile(bytes.NewBufferString("deploy\n\techo\n\n" +
+		"other missing\n\techo\n"))
+	var synErr *SyntaxError
+	if !errors.As(err, &synErr) {
+		t.Fatalf("expected syntax error, got %v", err)
+	}
+	if synErr.Pos.String() != "4:7" {
+		t.Fatalf("expected error at 4:7, got %s", synErr.Pos)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`alias d = deploy_dashboard
+
+alias r = reboot
+deploy_dashboard
+	echo deploy
+
+reboot
+	echo reboot
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultCommand != "deploy_dashboard" {
+		t.Fatalf("unexpected default command %s", conf.DefaultCommand)
+	}
+	if got := conf.Resolve("d"); got != "deploy_dashboard" {
+		t.Fatalf("expected deploy_dashboard, got %s", got)
+	}
+	if got := conf.Resolve("reboot"); got != "reboot" {
+		t.Fatalf("expected reboot, got %s", got)
+	}
+	if len(conf.Warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", conf.Warnings)
+	}
+
+	bad := []string{
+		"alias d deploy\ndeploy\n\techo\n",
+		"alias d = missing\ndeploy\n\techo\n",
+		"alias deploy = deploy\ndeploy\n\techo\n",
+		"alias d = deploy\nalias d = deploy\ndeploy\n\techo\n",
+	}
+	for _, text := range bad {
+		if _, err = ParseUpfile(bytes.NewBufferString(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`checksum app=cmd/app lib=pkg
+checksum web=./web
+
+deploy
+	echo $checksum.app $checksum.web
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "map[app:cmd/app lib:pkg web:./web]"
+	if got := fmt.Sprint(conf.Checksums); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if conf.DefaultCommand != "deploy" {
+		t.Fatalf("unexpected default command %s", conf.DefaultCommand)
+	}
+	if pos := conf.File().Checksums[1].Dir.Pos.String(); pos != "1:26" {
+		t.Fatalf("expected lib's directory at 1:26, got %s", pos)
+	}
+
+	bad := []string{
+		"checksum\ndeploy\n\techo\n",
+		"checksum app\ndeploy\n\techo\n",
+		"checksum =cmd/app\ndeploy\n\techo\n",
+		"checksum app=\ndeploy\n\techo\n",
+		"checksum app=a app=b\ndeploy\n\techo\n",
+	}
+	for _, text := range bad {
+		if _, err = ParseUpfile(bytes.NewBufferString(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestVars(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`var PORT int
+var ENV enum(staging, prod)
+
+deploy
+	echo $ENV:$PORT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "map[ENV:{enum [staging prod]} PORT:{int []}]"
+	if got := fmt.Sprint(conf.Vars); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if conf.DefaultCommand != "deploy" {
+		t.Fatalf("unexpected default command %s", conf.DefaultCommand)
+	}
+	checks := []struct {
+		name, val string
+		ok        bool
+	}{
+		{"PORT", "8080", true},
+		{"PORT", "80a", false},
+		{"ENV", "prod", true},
+		{"ENV", "prdo", false},
+	}
+	for _, c := range checks {
+		err := conf.Vars[c.name].Check(c.val)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s=%s: unexpected error %v", c.name, c.val,
+				err)
+		}
+	}
+
+	bad := []string{
+		"var\ndeploy\n\techo\n",
+		"var PORT\ndeploy\n\techo\n",
+		"var PORT float\ndeploy\n\techo\n",
+		"var ENV enum()\ndeploy\n\techo\n",
+		"var ENV enum(a,,b)\ndeploy\n\techo\n",
+		"var PORT int\nvar PORT bool\ndeploy\n\techo\n",
+		"var deploy string\ndeploy\n\techo\n",
+	}
+	for _, text := range bad {
+		if _, err = ParseUpfile(bytes.NewBufferString(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestCommandTags(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy_dashboard @dashboard check @openbsd
+	echo deploy
+
+check
+	true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["deploy_dashboard"]
+	if fmt.Sprint(cmd.Tags) != "[dashboard openbsd]" {
+		t.Fatalf("unexpected tags %v", cmd.Tags)
+	}
+	if fmt.Sprint(cmd.ExecIfs) != "[check]" {
+		t.Fatalf("unexpected exec ifs %v", cmd.ExecIfs)
+	}
+	tag := conf.File().Commands[0].Tags[0]
+	if tag.Pos.String() != "1:19" {
+		t.Fatalf("expected tag at 1:19, got %s", tag.Pos)
+	}
+}
+
+func TestRuns(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`release
+	run deploy_web on web; run deploy_api on api,worker
+
+deploy_web
+	echo web
+
+deploy_api
+	echo api
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["release"]
+	want := "[{deploy_web [web]} {deploy_api [api worker]}]"
+	if fmt.Sprint(cmd.Runs) != want {
+		t.Fatalf("unexpected runs %v", cmd.Runs)
+	}
+	if len(cmd.Execs) != 0 {
+		t.Fatalf("unexpected execs %v", cmd.Execs)
+	}
+	if len(conf.Unreachable()) != 0 {
+		t.Fatalf("unexpected unreachable %v", conf.Unreachable())
+	}
+	tag := conf.File().Commands[0].Runs[1].Tags[1]
+	if tag.Pos.String() != "2:47" {
+		t.Fatalf("expected tag at 2:47, got %s", tag.Pos)
+	}
+
+	tcs := map[string]string{
+		"mixed":     "release\n\trun a on web\n\techo\n\na\n\techo\n",
+		"undefined": "release\n\trun a on web\n",
+		"nested": "release\n\trun b on web\n\n" +
+			"b\n\trun a on web\n\na\n\techo\n",
+		"malformed": "release\n\trun a on web; run a\n\na\n\techo\n",
+		"tagged":    "release @web\n\trun a on web\n\na\n\techo\n",
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseUpfile(bytes.NewBufferString(tc))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	// Lines not starting with a whole run statement are shell
+	conf, err = ParseUpfile(bytes.NewBufferString(
+		"deploy\n\trun foo\n\trun a web\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = conf.Commands["deploy"]
+	if len(cmd.Runs) != 0 || len(cmd.Execs) != 2 {
+		t.Fatalf("unexpected runs %v, execs %v", cmd.Runs, cmd.Execs)
+	}
+}
+
+func TestNeeds(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy check needs build needs-each migrate
+	echo deploy
+
+check
+	true
+
+build needs gen
+	echo build
+
+gen
+	echo gen
+
+migrate needs-each gen
+	echo migrate
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["deploy"]
+	if fmt.Sprint(cmd.ExecIfs) != "[check]" {
+		t.Fatalf("unexpected exec ifs %v", cmd.ExecIfs)
+	}
+	got := conf.Prerequisites("deploy")
+	want := "[{gen false} {build false} {gen true} {migrate true}]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("expected %s, got %v", want, got)
+	}
+	if len(conf.Warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", conf.Warnings)
+	}
+
+	tcs := map[string]string{
+		"self":      "a needs a\n\techo\n",
+		"undefined": "a needs b\n\techo\n",
+		"cycle": "a needs b\n\techo\n\nb needs c\n\techo\n\n" +
+			"c needs a\n\techo\n",
+		"each": "a needs b\n\techo\n\nb needs-each c\n\techo\n\n" +
+			"c\n\techo\n",
+		"composite": "a needs b\n\techo\n\nb\n\trun c on x\n\n" +
+			"c\n\techo\n",
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseUpfile(bytes.NewBufferString(tc))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy check drain lb_drain undrain lb_undrain
+	echo deploy
+
+check
+	true
+
+lb_drain
+	echo drain $server
+
+lb_undrain
+	echo undrain $server
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["deploy"]
+	if fmt.Sprint(cmd.ExecIfs) != "[check]" {
+		t.Fatalf("unexpected exec ifs %v", cmd.ExecIfs)
+	}
+	if fmt.Sprint(cmd.Drain, cmd.Undrain) != "[lb_drain] [lb_undrain]" {
+		t.Fatalf("unexpected drain %v, undrain %v", cmd.Drain,
+			cmd.Undrain)
+	}
+	if len(conf.Unreachable()) != 0 {
+		t.Fatalf("unexpected unreachable %v", conf.Unreachable())
+	}
+
+	tcs := map[string]string{
+		"self":      "a drain a\n\techo\n",
+		"undefined": "a drain b\n\techo\n",
+		"nested": "a undrain b\n\techo\n\nb check\n\techo\n\n" +
+			"check\n\ttrue\n",
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseUpfile(bytes.NewBufferString(tc))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy check version git needs build
+	echo deploy
+
+check
+	true
+
+build
+	true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["deploy"]
+	if cmd.Version != "git" {
+		t.Fatalf("expected version git, got %q", cmd.Version)
+	}
+	if fmt.Sprint(cmd.ExecIfs, cmd.Needs) != "[check] [{build false}]" {
+		t.Fatalf("unexpected exec ifs %v, needs %v", cmd.ExecIfs,
+			cmd.Needs)
+	}
+	if conf.Commands["check"].Version != "" {
+		t.Fatal("expected no version for check")
+	}
+
+	tcs := map[string]string{
+		"unknown": "a version svn\n\techo\n",
+		"no file": "a version file:\n\techo\n",
+		"twice":   "a version git checksum\n\techo\n",
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseUpfile(bytes.NewBufferString(tc))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestRequires(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`deploy check requires UP_USER, IMAGE_TAG needs build
+	echo deploy
+
+check requires CHECK_URL
+	true
+
+build requires IMAGE_TAG,REGISTRY
+	true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := conf.Commands["deploy"]
+	if fmt.Sprint(cmd.Requires) != "[UP_USER IMAGE_TAG]" {
+		t.Fatalf("unexpected requires %v", cmd.Requires)
+	}
+	if fmt.Sprint(cmd.ExecIfs, cmd.Needs) != "[check] [{build false}]" {
+		t.Fatalf("unexpected exec ifs %v, needs %v", cmd.ExecIfs,
+			cmd.Needs)
+	}
+	got := conf.Required("deploy")
+	want := "[CHECK_URL IMAGE_TAG REGISTRY UP_USER]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("expected %s, got %v", want, got)
+	}
+	if got := conf.Required("check"); fmt.Sprint(got) != "[CHECK_URL]" {
+		t.Fatalf("unexpected required %v", got)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"needs without command":      "a needs\n\techo\n",
+		"needs-each without command": "a needs-each\n\techo\n",
+		"drain without command":      "a drain\n\techo\n",
+		"undrain without command":    "a undrain\n\techo\n",
+		"version without source":     "a version\n\techo\n",
+		"requires without name":      "a requires ,\n\techo\n",
+		"keyword before keyword":     "a needs version git\n\techo\n",
+		"needs command": "a needs b\n\techo\n\nb\n\techo\n\n" +
+			"needs\n\techo\n",
+		"needs-each command": "a needs-each b\n\techo\n\n" +
+			"b\n\techo\n\nneeds-each\n\techo\n",
+		"drain command": "a drain b\n\techo\n\nb\n\techo\n\n" +
+			"drain\n\techo\n",
+		"undrain command": "a undrain b\n\techo\n\nb\n\techo\n\n" +
+			"undrain\n\techo\n",
+		"version command": "a version\n\techo\n\nversion\n\techo\n",
+		"requires command": "a requires X\n\techo\n\n" +
+			"requires\n\techo\n",
+		"alias": "a version git\n\techo\n\nb\n\techo\n\n" +
+			"alias version = b\n",
+	}
+	for name, tc := range tcs {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseUpfile(bytes.NewBufferString(tc))
+			var synErr *SyntaxError
+			if !errors.As(err, &synErr) {
+				t.Fatalf("expected syntax error, got %v", err)
+			}
+		})
+	}
+
+	// Commands may still be named like keywords, as long as they aren't
+	// used as conditions
+	conf, err := ParseUpfile(bytes.NewBufferString(
+		"deploy check\n\techo\n\ncheck\n\ttrue\n\nversion\n\techo 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(conf.Commands["deploy"].ExecIfs) != "[check]" {
+		t.Fatalf("unexpected exec ifs %v",
+			conf.Commands["deploy"].ExecIfs)
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	t.Parallel()
+	tcs := map[string][2]string{
+		"as deploy: systemctl restart app": {"deploy",
+			"systemctl restart app"},
+		"as $user:echo":      {"$user", "echo"},
+		"as: echo":           {"", "as: echo"},
+		"as -u root: echo":   {"", "as -u root: echo"},
+		"assert ok":          {"", "assert ok"},
+		"echo as deploy: ok": {"", "echo as deploy: ok"},
+	}
+	for step, want := range tcs {
+		user, cmd := RunAs(step)
+		if user != want[0] || cmd != want[1] {
+			t.Fatalf("%q: expected %q, %q, got %q, %q", step,
+				want[0], want[1], user, cmd)
+		}
+	}
+	conf, err := ParseUpfile(bytes.NewBufferString(
+		"deploy\n\tas deploy: echo hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := conf.Commands["deploy"].Execs[0]
+	if got != "as deploy: echo hi" {
+		t.Fatalf("unexpected exec %q", got)
+	}
+	_, err = ParseUpfile(bytes.NewBufferString("deploy\n\tas deploy:\n"))
+	if err == nil {
+		t.Fatal("expected error for as without a command")
+	}
+
+	// Steps not written exactly "as USER:" are shell, e.g. the assembler
+	for _, step := range []string{"as -o a.o a.s", "as deploy echo hi"} {
+		conf, err = ParseUpfile(bytes.NewBufferString(
+			"deploy\n\t" + step + "\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", step, err)
+		}
+		if got := conf.Commands["deploy"].Execs[0]; got != step {
+			t.Fatalf("expected %q, got %q", step, got)
+		}
+	}
+}
+
+func TestEach(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"each redis: echo $each": "redis echo $each true",
+		"each db-*:as app: ok":   "db-* as app: ok true",
+		"each: echo":             " each: echo false",
+		"each a b: echo":         " each a b: echo false",
+		"eachable":               " eachable false",
+	}
+	for step, want := range tcs {
+		tag, cmd, ok := Each(step)
+		if got := fmt.Sprint(tag, " ", cmd, " ", ok); got != want {
+			t.Fatalf("%q: expected %q, got %q", step, want, got)
+		}
+	}
+	for _, text := range []string{
+		"deploy\n\teach redis:\n",
+		"deploy\n\teach redis: as app:\n",
+	} {
+		_, err := ParseUpfile(bytes.NewBufferString(text))
+		if err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+
+	// Steps not written exactly "each TAG:" are shell
+	for _, step := range []string{"each x in y", "each redis echo"} {
+		conf, err := ParseUpfile(bytes.NewBufferString(
+			"deploy\n\t" + step + "\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", step, err)
+		}
+		if got := conf.Commands["deploy"].Execs[0]; got != step {
+			t.Fatalf("expected %q, got %q", step, got)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"put bin/app /srv/app": "bin/app /srv/app true",
+		"put  bin/app\t/srv/":  "bin/app /srv/ true",
+		"put bin/app":          "  false",
+		"put a b c":            "  false",
+		"output a b":           "  false",
+	}
+	for step, want := range tcs {
+		local, remote, ok := Put(step)
+		if got := fmt.Sprint(local, " ", remote, " ", ok); got != want {
+			t.Fatalf("%q: expected %q, got %q", step, want, got)
+		}
+	}
+}
+
+func TestLeadingComment(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(
+		"# Deploys the api\n\n# to every server\ndeploy\n\techo hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultCommand != "deploy" {
+		t.Fatalf("expected deploy, got %s", conf.DefaultCommand)
+	}
+	_, err = ParseUpfile(bytes.NewBufferString("# nothing else"))
+	if err == nil {
+		t.Fatal("expected error for an upfile without commands")
+	}
+}
+
+func TestDescription(t *testing.T) {
+	t.Parallel()
+	conf, err := ParseUpfile(bytes.NewBufferString(`## Deploys the
+## dashboard
+deploy
+	echo hi
+	## not a description
+
+## Builds the binary
+build
+	go build
+## Orphaned by the blank line
+
+check
+	# Not a description either
+	true
+# Plain comments end descriptions
+## Prints the version
+version
+	echo 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[CmdName]string{
+		"deploy":  "Deploys the dashboard",
+		"build":   "Builds the binary",
+		"check":   "",
+		"version": "Prints the version",
+	}
+	for name, want := range tcs {
+		if got := conf.Commands[name].Description; got != want {
+			t.Fatalf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestParseCornerCases(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"deploy\n\techo hi":              "[echo hi]",
+		"deploy\n\techo hi\t":            "[echo hi]",
+		"deploy\n\techo hi\n# done":      "[echo hi]",
+		"deploy\n\techo hi\n\t# done":    "[echo hi]",
+		"deploy\n\techo a # b\n\techo c": "[echo a echo c]",
+		"deploy\n\techo a#b\n\techo c\n": "[echo a#b echo c]",
+		"deploy\n\techo a\t\n\techo c\n": "[echo a echo c]",
+
+		// Only a "#" starting a word is a comment
+		"deploy\n\techo 'a#b'\n":             "[echo 'a#b']",
+		"deploy\n\tcurl https://x/#frag\n":   "[curl https://x/#frag]",
+		"deploy\n\tsed 's#a#b#' f\n":         "[sed 's#a#b#' f]",
+		"deploy\n\techo ${#v}\n":             "[echo ${#v}]",
+		"deploy\n\tcp inventory.json /tmp\n": "[cp inventory.json /tmp]",
+		"deploy\n\tinventory\n":              "[inventory]",
+	}
+	for text, want := range tcs {
+		conf, err := Parse([]byte(text))
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		got := fmt.Sprint(conf.Commands["deploy"].Execs)
+		if got != want {
+			t.Fatalf("%q: expected %s, got %s", text, want, got)
+		}
+	}
+}
+
+func TestParseInventoryName(t *testing.T) {
+	t.Parallel()
+
+	// "inventory" isn't a keyword, so commands may start with it
+	conf, err := Parse([]byte("deploy inventory_sync\n\techo\n\n" +
+		"inventory_sync\n\tcat inventory.json\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(conf.Commands["deploy"].ExecIfs,
+		conf.Commands["inventory_sync"].Execs)
+	if want := "[inventory_sync] [cat inventory.json]"; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseLarge(t *testing.T) {
+	t.Parallel()
+
+	// Positions are counted incrementally, so large Upfiles parse in
+	// linear time
+	text := "deploy " + strings.Repeat("check ", 1<<16) + "\n" +
+		"\t" + strings.Repeat("x", 1<<20) + "\n" +
+		strings.Repeat("\n# comment\n", 1<<16) +
+		"check\n" + strings.Repeat("\techo $each\n", 1<<16)
+	done := make(chan error, 1)
+	go func() {
+		_, err := Parse([]byte(text))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out parsing a large upfile")
+	}
+}
+
+func TestLexerStopsEarly(t *testing.T) {
+	t.Parallel()
+
+	// The lexer runs only as far as the parser reads, so a parser which
+	// stops early, e.g. by panicking, leaves no lexing goroutine behind
+	text := "deploy\n" + strings.Repeat("\techo a\n", 1<<10)
+	l := lex(text)
+	if tkn := l.nextToken(); tkn.typ != tokenText || tkn.val != "deploy" {
+		t.Fatalf("expected deploy, got %+v", tkn)
+	}
+	if l.pos > len("deploy\n\techo a\n") {
+		t.Fatalf("lexed ahead to %d", l.pos)
+	}
+	for tkn := l.nextToken(); tkn.typ != tokenEOF; tkn = l.nextToken() {
+		if tkn.typ == tokenError {
+			t.Fatalf("unexpected error %q", tkn.val)
+		}
+	}
+	if tkn := l.nextToken(); tkn != (token{}) {
+		t.Fatalf("expected zero token after EOF, got %+v", tkn)
+	}
+}
+
+func TestParseCRLF(t *testing.T) {
+	t.Parallel()
+	text := `## Deploys the api
+deploy check @api
+	# Comments are skipped
+	echo $check
+
+check
+	true
+`
+	want, err := Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlf := "\ufeff" + strings.Replace(text, "\n", "\r\n", -1)
+	got, err := Parse([]byte(crlf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DefaultCommand != want.DefaultCommand {
+		t.Fatalf("expected default %s, got %s", want.DefaultCommand,
+			got.DefaultCommand)
+	}
+	for name, cmd := range want.Commands {
+		wantCmd := fmt.Sprint(*cmd)
+		gotCmd := fmt.Sprint(*got.Commands[name])
+		if gotCmd != wantCmd {
+			t.Fatalf("%s: expected %s, got %s", name, wantCmd,
+				gotCmd)
+		}
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	t.Parallel()
+
+	// Lines of only whitespace are blank wherever they appear, and blank
+	// lines don't end a command
+	conf, err := Parse([]byte("\t\ndeploy\n\n\techo a\n  \n\t  \n" +
+		" \t\n\techo b\n\t\n\ncheck\n\ttrue\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[CmdName]string{
+		"deploy": "[echo a echo b]",
+		"check":  "[true]",
+	}
+	for name, want := range tcs {
+		got := fmt.Sprint(conf.Commands[name].Execs)
+		if got != want {
+			t.Fatalf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+	for _, text := range []string{
+		"\techo\ndeploy\n\techo\n",
+		"deploy\n\techo\n  \techo\n",
+	} {
+		if _, err = Parse([]byte(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	t.Parallel()
+	conf, err := Parse([]byte("deploy\n\techo $a\n\t```\n" +
+		"\tawk '{ print $1 }' # first\n\n\t\techo ${x:-y}\n\t```\n" +
+		"\techo $b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execs := conf.Commands["deploy"].Execs
+	if len(execs) != 3 {
+		t.Fatalf("expected 3 execs, got %q", execs)
+	}
+	script, ok := Literal(execs[1])
+	want := "awk '{ print $1 }' # first\n\n\techo ${x:-y}"
+	if !ok || script != want {
+		t.Fatalf("expected %q, got %q", want, script)
+	}
+	if _, ok = Literal(execs[0]); ok {
+		t.Fatalf("%q isn't a literal block", execs[0])
+	}
+	for _, text := range []string{
+		"deploy\n\t```\n\techo $a\n",
+		"deploy\n\t```\n\techo $a\ncheck\n\t```\n",
+	} {
+		if _, err = Parse([]byte(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package plugin lets providers maintained outside of up, such as secrets
+// managers or cloud inventories, extend it while the core stays small.
+//
+// Plugins are executables which up starts with -plugin and speaks to over
+// JSON-RPC on the plugin's stdin and stdout, so they may be versioned and
+// distributed independently and written in any language. Anything a plugin
+// writes to stderr is passed through to up's. A plugin written in Go only
+// needs to implement Provider and whichever of VarsProvider and
+// InventoryProvider it supports, then call Serve:
+//
+//	type vault struct{}
+//
+//	func (vault) Info() plugin.Info {
+//		return plugin.Info{Name: "vault", Version: "v1.0.0"}
+//	}
+//
+//	func (vault) Vars(req plugin.VarsRequest) (map[string]string, error) {
+//		return map[string]string{"db_password": "..."}, nil
+//	}
+//
+//	func main() {
+//		if err := plugin.Serve(vault{}); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+
+	"git.sr.ht/~egtann/up"
+)
+
+// ProtocolVersion is incremented whenever the RPC methods change
+// incompatibly. up refuses to use plugins serving a different version.
+const ProtocolVersion = 1
+
+// Info describes a plugin.
+type Info struct {
+	Name    string
+	Version string
+
+	// Protocol is set to ProtocolVersion by Serve.
+	Protocol int
+
+	// Provides lists what the plugin implements, "vars" and
+	// "inventory". It's set by Serve.
+	Provides []string
+}
+
+// VarsRequest describes the deploy for which a VarsProvider supplies
+// variables, so it may only fetch the secrets needed.
+type VarsRequest struct {
+	Command string
+	Tags    []string
+
+	// DeployID identifies the deploy, the same across retries passing
+	// the same -deploy-id.
+	DeployID string
+}
+
+// Provider is implemented by every plugin.
+type Provider interface {
+	Info() Info
+}
+
+// VarsProvider supplies variables, such as secrets, substituted into
+// commands like environment variables.
+type VarsProvider interface {
+	Vars(req VarsRequest) (map[string]string, error)
+}
+
+// InventoryProvider supplies hosts and their tags, such as those discovered
+// from a cloud provider, which are merged into the inventory.
+type InventoryProvider interface {
+	Inventory() (up.Inventory, error)
+}
+
+// Serve the provider over stdin and stdout until up closes them.
+func Serve(p Provider) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Plugin", &server{p: p}); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	srv.ServeCodec(jsonrpc.NewServerCodec(stdio{}))
+	return nil
+}
+
+// server adapts a Provider to the method signatures net/rpc requires.
+type server struct {
+	p Provider
+}
+
+func (s *server) Info(_ struct{}, reply *Info) error {
+	*reply = s.p.Info()
+	reply.Protocol = ProtocolVersion
+	reply.Provides = nil
+	if _, ok := s.p.(VarsProvider); ok {
+		reply.Provides = append(reply.Provides, "vars")
+	}
+	if _, ok := s.p.(InventoryProvider); ok {
+		reply.Provides = append(reply.Provides, "inventory")
+	}
+	return nil
+}
+
+func (s *server) Vars(req VarsRequest, reply *map[string]string) error {
+	vp, ok := s.p.(VarsProvider)
+	if !ok {
+		return errors.New("vars not provided")
+	}
+	vars, err := vp.Vars(req)
+	if err != nil {
+		return err
+	}
+	*reply = vars
+	return nil
+}
+
+func (s *server) Inventory(_ struct{}, reply *up.Inventory) error {
+	ip, ok := s.p.(InventoryProvider)
+	if !ok {
+		return errors.New("inventory not provided")
+	}
+	inv, err := ip.Inventory()
+	if err != nil {
+		return err
+	}
+	*reply = inv
+	return nil
+}
+
+// stdio joins stdin and stdout into a single connection.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error {
+	err := os.Stdin.Close()
+	if err2 := os.Stdout.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Client runs a plugin and calls it.
+type Client struct {
+	Info Info
+
+	cmd *exec.Cmd
+	rpc *rpc.Client
+}
+
+// Start the plugin at path and check it speaks this ProtocolVersion.
+func Start(path string) (*Client, error) {
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+	c := &Client{
+		cmd: cmd,
+		rpc: jsonrpc.NewClient(pipe{ReadCloser: stdout, wc: stdin}),
+	}
+	if err = c.rpc.Call("Plugin.Info", struct{}{}, &c.Info); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("info: %w", err)
+	}
+	if c.Info.Protocol != ProtocolVersion {
+		c.Close()
+		return nil, fmt.Errorf("%s speaks protocol %d, expected %d",
+			c.Info.Name, c.Info.Protocol, ProtocolVersion)
+	}
+	return c, nil
+}
+
+// Provides reports whether the plugin implements a capability, "vars" or
+// "inventory".
+func (c *Client) Provides(capability string) bool {
+	for _, p := range c.Info.Provides {
+		if p == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Vars requests variables from the plugin.
+func (c *Client) Vars(req VarsRequest) (map[string]string, error) {
+	var vars map[string]string
+	if err := c.rpc.Call("Plugin.Vars", req, &vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// Inventory requests hosts and their tags from the plugin.
+func (c *Client) Inventory() (up.Inventory, error) {
+	var inv up.Inventory
+	if err := c.rpc.Call("Plugin.Inventory", struct{}{}, &inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Close the connection, which signals the plugin to exit, and wait for it.
+func (c *Client) Close() error {
+	c.rpc.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("wait: %w", err)
+	}
+	return nil
+}
+
+// pipe joins a plugin's stdout and stdin into a single connection.
+type pipe struct {
+	io.ReadCloser
+	wc io.WriteCloser
+}
+
+func (p pipe) Write(b []byte) (int, error) { return p.wc.Write(b) }
+func (p pipe) Close() error {
+	err := p.wc.Close()
+	if err2 := p.ReadCloser.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
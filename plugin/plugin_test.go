@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"git.sr.ht/~egtann/up"
+)
+
+type testProvider struct{}
+
+func (testProvider) Info() Info {
+	return Info{Name: "test", Version: "v1.2.3"}
+}
+
+func (testProvider) Vars(req VarsRequest) (map[string]string, error) {
+	if req.Command == "fail" {
+		return nil, errors.New("boom")
+	}
+	secret := req.Command + fmt.Sprint(req.Tags)
+	return map[string]string{"secret": secret}, nil
+}
+
+func (testProvider) Inventory() (up.Inventory, error) {
+	return up.Inventory{"10.0.0.1": {"web"}}, nil
+}
+
+// TestMain serves the test provider when the test binary is started as a
+// plugin.
+func TestMain(m *testing.M) {
+	if os.Getenv("UP_TEST_PLUGIN") == "1" {
+		if err := Serve(testProvider{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPlugin(t *testing.T) {
+	os.Setenv("UP_TEST_PLUGIN", "1")
+	defer os.Unsetenv("UP_TEST_PLUGIN")
+	c, err := Start(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	info := fmt.Sprint(c.Info)
+	if want := "{test v1.2.3 1 [vars inventory]}"; info != want {
+		t.Fatalf("expected info %s, got %s", want, info)
+	}
+	if !c.Provides("vars") || c.Provides("other") {
+		t.Fatalf("unexpected provides %v", c.Info.Provides)
+	}
+	req := VarsRequest{Command: "deploy", Tags: []string{"web"}}
+	vars, err := c.Vars(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(vars); got != "map[secret:deploy[web]]" {
+		t.Fatalf("unexpected vars %s", got)
+	}
+	if _, err = c.Vars(VarsRequest{Command: "fail"}); err == nil ||
+		err.Error() != "boom" {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	inv, err := c.Inventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(inv); got != "map[10.0.0.1:[web]]" {
+		t.Fatalf("unexpected inventory %s", got)
+	}
+}
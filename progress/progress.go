@@ -0,0 +1,197 @@
+// Package progress lets applications which run up, such as chatops bots,
+// follow a deploy in their own UI without parsing its logs.
+//
+// up run with -progress PATH writes an event to PATH as a line of JSON
+// whenever a batch starts, a server finishes its batch, and the deploy ends.
+// Follow decodes them into calls to Callbacks. Passing a pipe as file
+// descriptor 3 keeps the events apart from the output of commands:
+//
+//	r, w, err := os.Pipe()
+//	...
+//	cmd := exec.Command("up", "-c", "deploy", "-t", "web",
+//		"-progress", "/dev/fd/3")
+//	cmd.ExtraFiles = []*os.File{w}
+//	if err = cmd.Start(); err != nil {
+//		...
+//	}
+//	w.Close()
+//	err = progress.Follow(r, progress.Callbacks{
+//		OnServerResult: func(res progress.Result) {
+//			bot.Say(res.Server + " " + string(res.Status))
+//		},
+//	})
+//
+// up uses the same Callbacks while deploying, through an Encoder.
+package progress
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Batch describes a batch of servers about to run.
+type Batch struct {
+	Time time.Time `json:"time"`
+	Tag  string    `json:"tag"`
+
+	// Number of the batch within its tag, counting from 1, and Total
+	// batches in the tag.
+	Number int `json:"number"`
+	Total  int `json:"total"`
+
+	Servers []string `json:"servers"`
+}
+
+// Status of a server once its batch finished.
+type Status string
+
+const (
+	// Deployed servers ran the command.
+	Deployed Status = "deployed"
+
+	// Current servers passed the command's conditionals, so they didn't
+	// need to run it.
+	Current Status = "current"
+
+	// Failed servers failed the command, or were in a batch which did.
+	Failed Status = "failed"
+)
+
+// Result is a server's result once its batch finished.
+type Result struct {
+	Time   time.Time `json:"time"`
+	Tag    string    `json:"tag"`
+	Server string    `json:"server"`
+	Status Status    `json:"status"`
+
+	// Err describes why the server failed. It's the batch's error if
+	// another server in the batch failed.
+	Err string `json:"error,omitempty"`
+
+	// Took is how long the batch ran.
+	Took time.Duration `json:"took"`
+}
+
+// End describes the deploy once it finished.
+type End struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	Checksum string    `json:"checksum"`
+	DeployID string    `json:"deploy_id,omitempty"`
+
+	// Err describes why the deploy failed, if it did.
+	Err string `json:"error,omitempty"`
+
+	Took time.Duration `json:"took"`
+}
+
+// Callbacks are called as a deploy progresses. Any may be nil. Batches of
+// different tags run concurrently, so callbacks may be called concurrently.
+type Callbacks struct {
+	OnBatchStart   func(Batch)
+	OnServerResult func(Result)
+	OnDeployEnd    func(End)
+}
+
+// BatchStart calls OnBatchStart if it's set.
+func (c Callbacks) BatchStart(b Batch) {
+	if c.OnBatchStart != nil {
+		c.OnBatchStart(b)
+	}
+}
+
+// ServerResult calls OnServerResult if it's set.
+func (c Callbacks) ServerResult(r Result) {
+	if c.OnServerResult != nil {
+		c.OnServerResult(r)
+	}
+}
+
+// DeployEnd calls OnDeployEnd if it's set.
+func (c Callbacks) DeployEnd(e End) {
+	if c.OnDeployEnd != nil {
+		c.OnDeployEnd(e)
+	}
+}
+
+// event is written as a line of JSON for each callback, with exactly one of
+// its fields set.
+type event struct {
+	BatchStart   *Batch  `json:"batch_start,omitempty"`
+	ServerResult *Result `json:"server_result,omitempty"`
+	DeployEnd    *End    `json:"deploy_end,omitempty"`
+}
+
+// Encoder writes events as lines of JSON.
+type Encoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewEncoder writes events to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{enc: json.NewEncoder(w)}
+}
+
+// Callbacks which write each event. A deploy matters more than its progress,
+// so failing to write doesn't stop it. The first error is kept for Err.
+func (e *Encoder) Callbacks() Callbacks {
+	return Callbacks{
+		OnBatchStart: func(b Batch) {
+			e.encode(event{BatchStart: &b})
+		},
+		OnServerResult: func(r Result) {
+			e.encode(event{ServerResult: &r})
+		},
+		OnDeployEnd: func(end End) {
+			e.encode(event{DeployEnd: &end})
+		},
+	}
+}
+
+func (e *Encoder) encode(ev event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return
+	}
+	e.err = e.enc.Encode(ev)
+}
+
+// Err reports the first error writing an event, if any.
+func (e *Encoder) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// Follow reads events written by an Encoder until r is closed, calling the
+// callbacks for each in order. Events it doesn't know, written by later
+// versions of up, are skipped.
+func Follow(r io.Reader, c Callbacks) error {
+	scn := bufio.NewScanner(r)
+	scn.Buffer(nil, 1<<20)
+	for scn.Scan() {
+		var ev event
+		if err := json.Unmarshal(scn.Bytes(), &ev); err != nil {
+			return fmt.Errorf("unmarshal: %w", err)
+		}
+		switch {
+		case ev.BatchStart != nil:
+			c.BatchStart(*ev.BatchStart)
+		case ev.ServerResult != nil:
+			c.ServerResult(*ev.ServerResult)
+		case ev.DeployEnd != nil:
+			c.DeployEnd(*ev.DeployEnd)
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	return nil
+}
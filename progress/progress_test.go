@@ -0,0 +1,65 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFollow(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	cb := enc.Callbacks()
+	cb.BatchStart(Batch{Tag: "web", Number: 1, Total: 2,
+		Servers: []string{"10.0.0.1", "10.0.0.2"}})
+	cb.ServerResult(Result{Tag: "web", Server: "10.0.0.1",
+		Status: Deployed, Took: time.Second})
+	cb.ServerResult(Result{Tag: "web", Server: "10.0.0.2",
+		Status: Failed, Err: "exit status 1"})
+	cb.DeployEnd(End{Command: "deploy", Err: "exit status 1"})
+	if err := enc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown events from later versions are skipped
+	buf.WriteString(`{"later_event":{}}` + "\n")
+
+	var got []string
+	err := Follow(&buf, Callbacks{
+		OnBatchStart: func(b Batch) {
+			servers := strings.Join(b.Servers, ",")
+			got = append(got, b.Tag+" "+servers)
+		},
+		OnServerResult: func(r Result) {
+			got = append(got, r.Server+" "+string(r.Status)+" "+
+				r.Took.String()+" "+r.Err)
+		},
+		OnDeployEnd: func(e End) {
+			got = append(got, e.Command+" "+e.Err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"web 10.0.0.1,10.0.0.2",
+		"10.0.0.1 deployed 1s ",
+		"10.0.0.2 failed 0s exit status 1",
+		"deploy exit status 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// Nil callbacks are skipped
+	if err = Follow(strings.NewReader(`{"deploy_end":{}}`),
+		Callbacks{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Follow(strings.NewReader("{"), Callbacks{}); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+}
@@ -1,10 +1,14 @@
 package up
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type CmdName string
@@ -14,25 +18,233 @@ type Config struct {
 	// Commands available to run grouped by command name.
 	Commands map[CmdName]*Cmd
 
+	// Aliases map short names to the commands they stand for.
+	Aliases map[CmdName]CmdName
+
+	// Checksums map names to directories, each of whose checksum is
+	// substituted for $checksum.NAME.
+	Checksums map[string]string
+
+	// Vars map names to the types declared for them, against which their
+	// values are checked before anything runs.
+	Vars map[string]Var
+
 	// DefaultCommand is the first command in the Upfile.
 	DefaultCommand CmdName
 
 	// DefaultEnvironment is the first inventory in the Upfile.
 	DefaultEnvironment string
 
-	lex      *lexer
-	text     string
-	indented bool
+	// Warnings are non-fatal problems found while parsing the Upfile.
+	Warnings []Warning
+
+	text string
+	file *File
+}
+
+// Resolve reports the command for which name is an alias, or name itself if
+// it isn't an alias.
+func (t *Config) Resolve(name CmdName) CmdName {
+	if target, ok := t.Aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// File reports the syntax tree from which the Config was built.
+func (t *Config) File() *File {
+	return t.file
 }
 
 // Cmd to run conditionally if the conditions listed in ExecIf all exit with
 // zero.
 type Cmd struct {
+	// Description of the command, written on "##" comment lines
+	// immediately before it, e.g. "## Deploys the dashboard".
+	Description string
+
 	// ExecIfs any of the following commands exit with non-zero codes.
 	ExecIfs []CmdName
 
 	// Execs these commands in order using the default shell.
 	Execs []string
+
+	// Tags from the inventory on which to run the command when none are
+	// given. Without these, the command runs on hosts tagged with its
+	// name.
+	Tags []string
+
+	// Needs are prerequisites which run before the command.
+	Needs []Need
+
+	// Drain commands remove each server from its load balancer before
+	// the command's Execs run. Undrain commands restore it after the
+	// Execs succeed.
+	Drain   []CmdName
+	Undrain []CmdName
+
+	// Runs other commands simultaneously, each on its own tags. Commands
+	// with Runs are composite and have no Execs.
+	Runs []Run
+
+	// Version names where the version deployed comes from, written after
+	// "version". It's empty, meaning a checksum of the directory, unless
+	// it's "git", the commit checked out, or "file:PATH", the contents of
+	// a file such as VERSION.
+	Version string
+
+	// Requires lists variables which must be set for the command to run,
+	// written after "requires".
+	Requires []string
+}
+
+// Variable reports whether the command may be substituted as a variable.
+// Commands with conditions, prerequisites, runs or drains may only be run.
+func (c *Cmd) Variable() bool {
+	return len(c.ExecIfs) == 0 && len(c.Needs) == 0 && len(c.Runs) == 0 &&
+		len(c.Drain) == 0 && len(c.Undrain) == 0
+}
+
+// ValidVersion reports whether src may be written after "version":
+// "checksum", "git" or "file:PATH", naming a file which holds the version.
+func ValidVersion(src string) bool {
+	switch {
+	case src == "checksum", src == "git":
+		return true
+	case strings.HasPrefix(src, "file:"):
+		return len(src) > len("file:")
+	default:
+		return false
+	}
+}
+
+// Var is the type declared for a variable: "string", "secret", a string
+// which isn't shown when prompted for, "int", "bool", or "enum", in which
+// case Values lists those allowed.
+type Var struct {
+	Type   string
+	Values []string
+}
+
+// parseVar parses a type written after the name in a var declaration, e.g.
+// "int" or "enum(staging,prod)".
+func parseVar(typ string) (Var, bool) {
+	switch typ {
+	case "string", "secret", "int", "bool":
+		return Var{Type: typ}, true
+	}
+	if !strings.HasPrefix(typ, "enum(") || !strings.HasSuffix(typ, ")") {
+		return Var{}, false
+	}
+	vals := strings.Split(typ[len("enum("):len(typ)-1], ",")
+	for _, val := range vals {
+		if val == "" {
+			return Var{}, false
+		}
+	}
+	return Var{Type: "enum", Values: vals}, true
+}
+
+// Check reports an error if val isn't of the type.
+func (v Var) Check(val string) error {
+	switch v.Type {
+	case "int":
+		if _, err := strconv.Atoi(val); err != nil {
+			return fmt.Errorf("%q is not an int", val)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("%q is not a bool", val)
+		}
+	case "enum":
+		for _, allowed := range v.Values {
+			if val == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", val,
+			strings.Join(v.Values, ", "))
+	}
+	return nil
+}
+
+// Need is a prerequisite command. It runs once locally before any server,
+// unless Each is set, in which case it runs on each server before the
+// command's ExecIfs.
+type Need struct {
+	Command CmdName
+	Each    bool
+}
+
+// Run is a command within a composite command and the tags on which it runs.
+type Run struct {
+	Command CmdName
+	Tags    []string
+}
+
+// RunAs splits a step written "as USER: COMMAND" into the user as whom the
+// command runs on the server and the command itself. Steps without the prefix
+// report an empty user, running as the transport's default user.
+func RunAs(step string) (user, cmd string) {
+	if !strings.HasPrefix(step, "as ") {
+		return "", step
+	}
+	parts := strings.SplitN(step[len("as "):], ":", 2)
+	if len(parts) != 2 {
+		return "", step
+	}
+	user = strings.TrimSpace(parts[0])
+	if user == "" || strings.ContainsAny(user, " \t") ||
+		strings.HasPrefix(user, "-") {
+		return "", step
+	}
+	return user, strings.TrimSpace(parts[1])
+}
+
+// Each splits a step written "each TAG: COMMAND" into the tag, whose hosts
+// the step is repeated over with each substituted for $each, and the command.
+func Each(step string) (tag, cmd string, ok bool) {
+	if !strings.HasPrefix(step, "each ") {
+		return "", step, false
+	}
+	parts := strings.SplitN(step[len("each "):], ":", 2)
+	if len(parts) != 2 {
+		return "", step, false
+	}
+	tag = strings.TrimSpace(parts[0])
+	if tag == "" || strings.ContainsAny(tag, " \t") {
+		return "", step, false
+	}
+	return tag, strings.TrimSpace(parts[1]), true
+}
+
+// Put splits a step written "put LOCAL REMOTE" into the local file and the
+// path on the server to which it's copied. Only transports which keep a
+// connection to the server, such as the agent, copy files this way. Others
+// run the step with sh like any other.
+func Put(step string) (local, remote string, ok bool) {
+	fields := strings.Fields(step)
+	if len(fields) != 3 || fields[0] != "put" {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// fence opens and closes a literal block.
+const fence = "```"
+
+// Literal reports the script within a step written as a literal block, an
+// indented block fenced by lines of "```". Literal blocks run as a single
+// step exactly as written, without substituting variables, for scripts
+// which use "$" themselves, such as awk.
+func Literal(step string) (script string, ok bool) {
+	open, end := fence+"\n", "\n"+fence
+	if len(step) < len(open)+len(end) ||
+		!strings.HasPrefix(step, open) ||
+		!strings.HasSuffix(step, end) {
+		return "", false
+	}
+	return step[len(open) : len(step)-len(end)], true
 }
 
 func ParseUpfile(rdr io.Reader) (*Config, error) {
@@ -40,11 +252,23 @@ func ParseUpfile(rdr io.Reader) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read all: %w", err)
 	}
+	return Parse(byt)
+}
+
+// Parse an Upfile's contents. Upfiles may come from untrusted sources, such
+// as pull requests, so any panic while parsing is reported as an error
+// rather than crashing the caller.
+func Parse(byt []byte) (conf *Config, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			conf, err = nil, fmt.Errorf("parse: %v", r)
+		}
+	}()
 	return parseUpfile(string(byt))
 }
 
 // GetCalculatedChecksum from a file which was created on deploy and contains
-// only a sha256 checksum, calculated by up. This is an optional helper, but if
+// only a checksum, calculated by up. This is an optional helper, but if
 // used it can determine whether another deploy is needed or redundant
 // following a successful health check.
 func GetCalculatedChecksum(filepath string) ([]byte, error) {
@@ -62,3 +286,47 @@ func GetCalculatedChecksum(filepath string) ([]byte, error) {
 	}
 	return byt, nil
 }
+
+// ChecksumAlgorithm reports the algorithm which calculated a checksum, e.g.
+// "sha256" or "blake3", from its prefix, along with any options, e.g.
+// "sha256+modes". Checksums calculated before up
+// prefixed them report "". Version endpoints may use it to tell a checksum of
+// another algorithm apart from an outdated one.
+func ChecksumAlgorithm(chk string) string {
+	i := strings.IndexByte(chk, ':')
+	if i < 0 {
+		return ""
+	}
+	return chk[:i]
+}
+
+// State is written to a host after up successfully runs a command on it when
+// -state is passed, recording what's deployed where.
+type State struct {
+	Checksum string    `json:"checksum"`
+	Command  CmdName   `json:"command"`
+	Time     time.Time `json:"time"`
+	Version  string    `json:"version"`
+
+	// DeployID identifies the deploy which wrote the state, so a retry
+	// of the same deploy can tell it already succeeded on the host.
+	DeployID string `json:"deploy_id,omitempty"`
+}
+
+// GetState from a file which was written on deploy by the command given to
+// -state. Like GetCalculatedChecksum, a missing file is not an error and
+// reports an empty State.
+func GetState(filepath string) (*State, error) {
+	byt, err := GetCalculatedChecksum(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if len(byt) == 0 {
+		return &state, nil
+	}
+	if err = json.Unmarshal(byt, &state); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &state, nil
+}
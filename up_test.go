@@ -1,6 +1,7 @@
 package up
 
 import (
+	"fmt"
 	"net/http"
 )
 
@@ -15,3 +16,23 @@ func ExampleGetCalculatedChecksum() {
 		w.Write(check)
 	})
 }
+
+func ExampleGetState() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		state, err := GetState("state.json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(state.Checksum))
+	})
+}
+
+func ExampleChecksumAlgorithm() {
+	fmt.Println(ChecksumAlgorithm("blake3:r0pNuN2c"))
+	fmt.Printf("%q\n", ChecksumAlgorithm("r0pNuN2c"))
+	// Output:
+	// blake3
+	// ""
+}
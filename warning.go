@@ -0,0 +1,71 @@
+package up
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxLineLength after which a line in the Upfile is considered suspiciously
+// long.
+const maxLineLength = 160
+
+// Warning describes a non-fatal problem found in an Upfile. Warnings don't
+// prevent up from running, but they usually indicate a mistake.
+type Warning struct {
+	// Line on which the problem was found, starting at 1.
+	Line int
+
+	// Msg describes the problem.
+	Msg string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Msg)
+}
+
+// warnings reports unreachable commands and suspiciously long lines sorted
+// by line number.
+func (t *Config) warnings() []Warning {
+	var warns []Warning
+	graph := t.Graph()
+	for _, name := range t.Unreachable() {
+		msg := fmt.Sprintf("%s is never used", name)
+		if isReferenced(graph, name) {
+			msg = fmt.Sprintf("%s is only used by unreachable commands",
+				name)
+		}
+		line := t.file.Command(name).Name.Pos.Line
+		warns = append(warns, Warning{Line: line, Msg: msg})
+	}
+	for i, line := range strings.Split(t.text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) > maxLineLength {
+			warns = append(warns, Warning{
+				Line: i + 1,
+				Msg: fmt.Sprintf("line is %d characters long",
+					len(line)),
+			})
+		}
+	}
+	sort.SliceStable(warns, func(i, j int) bool {
+		return warns[i].Line < warns[j].Line
+	})
+	return warns
+}
+
+// isReferenced reports whether a command is used as an ExecIf or variable by
+// any other command.
+func isReferenced(graph map[CmdName][]CmdName, name CmdName) bool {
+	for other, refs := range graph {
+		if other == name {
+			continue
+		}
+		for _, ref := range refs {
+			if ref == name {
+				return true
+			}
+		}
+	}
+	return false
+}